@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// abort --all is the panic button for work that should never have started,
+// such as a background mget of the wrong directory. It sets the aborting
+// flag every connection of the session shares: data connections fail their
+// next read or write, each transfer cut off is ended with ABOR, and commands
+// other than QUIT are refused, so a batch stops instead of moving on to its
+// next file. Once the background job and the queue worker have stopped, the
+// flag is cleared and the session takes commands as before. Downloads cut
+// off keep their .part files and resume checkpoints, and the queue's
+// unfinished jobs are saved to a session file in the state directory, which
+// load-session puts back.
+
+// errAborted stops whatever a connection was doing when abort --all ran, or
+// a stop signal arrived.
+var errAborted = errors.New("aborted")
+
+// abortPoll is how often abort --all looks to see whether the queue worker
+// has stopped.
+const abortPoll = 50 * time.Millisecond
+
+// abortableConn fails reads and writes once the session is aborting, as
+// pausableConn does for a paused queue job.
+type abortableConn struct {
+	net.Conn
+	aborting *atomic.Bool
+}
+
+func (c abortableConn) Read(p []byte) (int, error) {
+	if c.aborting.Load() {
+		return 0, errAborted
+	}
+	return c.Conn.Read(p)
+}
+
+func (c abortableConn) Write(p []byte) (int, error) {
+	if c.aborting.Load() {
+		return 0, errAborted
+	}
+	return c.Conn.Write(p)
+}
+
+func (c abortableConn) CloseWrite() error {
+	if hc, ok := c.Conn.(halfCloser); ok {
+		return hc.CloseWrite()
+	}
+	return nil
+}
+
+func (c abortableConn) CloseRead() error {
+	if hc, ok := c.Conn.(halfCloser); ok {
+		return hc.CloseRead()
+	}
+	return nil
+}
+
+// parseAbort checks abort's arguments; --all is the only form there is.
+func parseAbort(args []string) error {
+	fs := newCommandFlags("abort")
+	all := fs.Bool("all", false, "stop every transfer")
+	positional, err := parseCommandFlags(fs, args)
+	if err != nil || !*all || len(positional) > 0 {
+		return fmt.Errorf("usage: abort --all")
+	}
+	return nil
+}
+
+// stopAll sets the session aborting and sets the queue's jobs aside. It
+// returns at once; transfers stop as their connections notice.
+func (f *FTPConnection) stopAll() {
+	f.aborting.Store(true)
+	if f.queue != nil {
+		f.queue.halt()
+	}
+}
+
+// abortAll stops every transfer of the session and waits for them. The
+// caller holds f.control, so a background job has already finished.
+func (f *FTPConnection) abortAll() error {
+	busy := f.aborting.Load() || f.queue.busy() || f.queue.unfinished() > 0
+	f.stopAll()
+	f.settle()
+	if !busy {
+		f.out().Info("Nothing to abort")
+		return nil
+	}
+	if err := f.saveUnfinished(); err != nil {
+		return err
+	}
+	f.out().Info("All transfers aborted")
+	return nil
+}
+
+// settle waits for the queue worker to stop after stopAll, and then lets the
+// session send commands again.
+func (f *FTPConnection) settle() {
+	for f.queue.busy() {
+		time.Sleep(abortPoll)
+	}
+	f.aborting.Store(false)
+}
+
+// saveUnfinished saves the queue's unfinished jobs to a session file in the
+// state directory and drops them from the queue.
+func (f *FTPConnection) saveUnfinished() error {
+	n := f.queue.unfinished()
+	if n == 0 {
+		return nil
+	}
+	dir, err := appDir(stateDir)
+	if err != nil {
+		return err
+	}
+	file := filepath.Join(dir, "aborted-"+time.Now().Format("20060102-150405")+".json")
+	if _, err := f.saveSession(file); err != nil {
+		return fmt.Errorf("failed to save the queue: %v", err)
+	}
+	f.queue.flush()
+	f.out().Info("Saved %d unfinished queue jobs to %s; load-session %s puts them back, paused", n, file, file)
+	return nil
+}
+
+// abortTransfer ends a transfer that stopped because the session is
+// aborting. ABOR tells the server to drop it, and its replies, usually 426
+// for the transfer and 226 for ABOR, are read so none is left for the next
+// command.
+func (f *FTPConnection) abortTransfer(pending *completion) {
+	s, ok := f.session.(pipelineSession)
+	sent := ok && s.writeCommands([]string{"ABOR"}) == nil
+	pending.abort(errAborted)
+	if !sent {
+		return
+	}
+	timeout := f.settings.replyTimeout
+	f.session.setReplyTimeout(abortDrain)
+	defer f.session.setReplyTimeout(timeout)
+	for {
+		if _, err := f.session.readResponse(); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lockedBuffer is a bytes.Buffer that a background job and the test can
+// share.
+type lockedBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.String()
+}
+
+// waitFor polls cond for up to five seconds, failing with what when it
+// doesn't come true.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// slowMock serves big.bin and small.txt, and returns a connection to it
+// that downloads at 64 KB/s into a directory of its own.
+func slowMock(t *testing.T) (*FTPConnection, *lockedBuffer) {
+	t.Helper()
+	useTempDirs(t)
+	served := t.TempDir()
+	os.WriteFile(filepath.Join(served, "big.bin"), bytes.Repeat([]byte("x"), 4<<20), 0644)
+	os.WriteFile(filepath.Join(served, "small.txt"), []byte("small\n"), 0644)
+	addr, err := startMockServer(served)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(t.TempDir())
+	f, _ := dialMock(t, addr)
+	var out lockedBuffer
+	f.stdout = &out
+	if err := f.execute("set bwlimit 64k"); err != nil {
+		t.Fatal(err)
+	}
+	return f, &out
+}
+
+// growing reports whether the download to local has started.
+func growing(local string) func() bool {
+	return func() bool {
+		info, err := os.Stat(local)
+		return err == nil && info.Size() > 0
+	}
+}
+
+func TestParseAbort(t *testing.T) {
+	for _, args := range [][]string{nil, {"now"}, {"--all", "now"}} {
+		if err := parseAbort(args); err == nil {
+			t.Errorf("abort %q was accepted", args)
+		}
+	}
+	if err := parseAbort([]string{"--all"}); err != nil {
+		t.Errorf("abort --all: %v", err)
+	}
+}
+
+func TestAbortNothing(t *testing.T) {
+	f, out := newFakeConnection(newFakeSession())
+	if err := handleAbort(f, []string{"--all"}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "Nothing to abort") {
+		t.Errorf("abort with nothing running said:\n%s", out)
+	}
+}
+
+// abort --all stops a background download at once, keeping its .part
+// file, and leaves the connection ready for the next command.
+func TestAbortAllBackground(t *testing.T) {
+	f, out := slowMock(t)
+	f.control.Lock()
+	if err := f.runLocked("get big.bin &"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the download to start", growing("big.bin.part"))
+
+	start := time.Now()
+	if err := f.runAlongside("abort --all"); err != nil {
+		t.Fatalf("abort --all: %v\n%s", err, out)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("abort took %v", elapsed)
+	}
+	waitFor(t, "the job to report", func() bool {
+		return strings.Contains(out.String(), "[background] get big.bin: aborted - partial data kept in big.bin.part")
+	})
+	if !strings.Contains(out.String(), "All transfers aborted") {
+		t.Errorf("abort didn't say it was done:\n%s", out)
+	}
+	if _, err := os.Stat("big.bin.part"); err != nil {
+		t.Errorf("the cut-off download lost its .part file: %v", err)
+	}
+	if _, err := os.Stat("big.bin"); !os.IsNotExist(err) {
+		t.Errorf("the cut-off download was finished: %v", err)
+	}
+
+	if f.aborting.Load() {
+		t.Error("the session is still aborting")
+	}
+	if err := f.execute("get small.txt"); err != nil {
+		t.Fatalf("the next download: %v\n%s", err, out)
+	}
+	if got, _ := os.ReadFile("small.txt"); string(got) != "small\n" {
+		t.Errorf("the next download got %q", got)
+	}
+}
+
+// abort --all stops the queue's worker and sets its unfinished jobs aside
+// in a session file for load-session.
+func TestAbortAllQueue(t *testing.T) {
+	f, out := slowMock(t)
+	for _, line := range []string{"queue get big.bin", "queue get small.txt"} {
+		if err := f.execute(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "the queue to start", growing("big.bin.part"))
+
+	if err := f.execute("abort --all"); err != nil {
+		t.Fatalf("abort --all: %v\n%s", err, out)
+	}
+	if f.queue.busy() || f.queue.unfinished() != 0 {
+		t.Errorf("the queue is still busy, or has unfinished jobs: %v", f.queue.snapshot())
+	}
+	saved, _ := filepath.Glob(filepath.Join(stateDirOverride, stateDir, "aborted-*.json"))
+	if len(saved) != 1 || !strings.Contains(out.String(), "Saved 2 unfinished queue jobs to "+saved[0]) {
+		t.Fatalf("the unfinished jobs weren't saved (%v):\n%s", saved, out)
+	}
+	data, _ := os.ReadFile(saved[0])
+	if !strings.Contains(string(data), "big.bin") || !strings.Contains(string(data), "small.txt") {
+		t.Errorf("the session file lacks the jobs:\n%s", data)
+	}
+	if _, err := os.Stat("small.txt"); !os.IsNotExist(err) {
+		t.Errorf("the queue went on to its next job: %v", err)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// downloadTar streams the remote tree at dir into a tar archive at local,
+// gzipped when the name ends in .gz or .tgz. Files go straight from the data
+// connection into the archive without touching disk. Entries are stored under
+// the directory's base name, like `tar -c dir`.
+func (f *FTPConnection) downloadTar(dir, local string) (files int, bytes int64, err error) {
+	out, err := os.Create(local)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to create file %s: %v", local, err)
+	}
+	defer func() {
+		if cerr := out.Close(); err == nil && cerr != nil {
+			err = cerr
+		}
+		if err != nil {
+			// don't leave a truncated archive behind
+			os.Remove(local)
+		}
+	}()
+
+	var w io.Writer = out
+	if strings.HasSuffix(local, ".gz") || strings.HasSuffix(local, ".tgz") {
+		gz := gzip.NewWriter(out)
+		defer func() {
+			if cerr := gz.Close(); err == nil && cerr != nil {
+				err = cerr
+			}
+		}()
+		w = gz
+	}
+	tw := tar.NewWriter(w)
+	defer func() {
+		if cerr := tw.Close(); err == nil && cerr != nil {
+			err = cerr
+		}
+	}()
+
+	prefix := path.Base(path.Clean(dir))
+	if prefix == "/" || prefix == "." {
+		prefix = ""
+	}
+	fsys := newRemoteFS(f, dir)
+	err = fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		link := ""
+		if entry, ok := info.Sys().(RemoteEntry); ok {
+			link = entry.target
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		hdr.Name = path.Join(prefix, name)
+		if hdr.ModTime.IsZero() {
+			// the top directory isn't in any listing we fetched
+			hdr.ModTime = time.Now()
+		}
+		if d.IsDir() {
+			if hdr.Name == "." {
+				return nil
+			}
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		file, err := fsys.Open(name)
+		if err != nil {
+			return err
+		}
+		n, err := io.CopyN(tw, file, hdr.Size)
+		bytes += n
+		if cerr := file.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			// the header already promised hdr.Size bytes
+			return fmt.Errorf("%s: %v (file changed size during download?)", name, err)
+		}
+		files++
+		return nil
+	})
+	return files, bytes, err
+}
+
+// archiveEntry is one member of a local archive being uploaded.
+type archiveEntry struct {
+	name string
+	dir  bool
+	open func() (io.ReadCloser, error)
+}
+
+// uploadArchive uploads the members of a local .tar, .tar.gz/.tgz, or .zip
+// archive below the remote directory dir, creating directories as needed.
+// Members that would land outside dir, and links, are skipped.
+func (f *FTPConnection) uploadArchive(archive, dir string) (files int, bytes int64, err error) {
+	made := make(map[string]bool)
+	failed := 0
+	upload := func(entry archiveEntry) error {
+		name := path.Clean(entry.name)
+		if name == "." {
+			return nil
+		}
+		if !fs.ValidPath(name) {
+			f.out().Warn("skipping %s: path leaves the target directory", entry.name)
+			return nil
+		}
+		target := joinRemote(dir, name)
+		parent := target
+		if !entry.dir {
+			parent = path.Dir(target)
+		}
+		if parent != "." && !made[parent] {
+			if err := f.makeRemoteDirs(parent); err != nil {
+				return err
+			}
+			made[parent] = true
+		}
+		if entry.dir {
+			return nil
+		}
+
+		r, err := entry.open()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		n, err := f.uploadReader(r, target)
+		if err != nil {
+			f.out().Error(fmt.Errorf("%s: %v", target, err))
+			failed++
+			return nil
+		}
+		f.out().Info("Uploaded %s (%d bytes)", target, n)
+		files++
+		bytes += n
+		return nil
+	}
+
+	if strings.HasSuffix(archive, ".zip") {
+		err = eachZipEntry(archive, f.out(), upload)
+	} else {
+		err = eachTarEntry(archive, f.out(), upload)
+	}
+	if err == nil && failed > 0 {
+		err = fmt.Errorf("%d of %d uploads failed", failed, failed+files)
+	}
+	return files, bytes, err
+}
+
+func eachZipEntry(archive string, out Renderer, fn func(archiveEntry) error) error {
+	zr, err := zip.OpenReader(archive)
+	if err != nil {
+		return fmt.Errorf("failed to open archive %s: %v", archive, err)
+	}
+	defer zr.Close()
+	for _, zf := range zr.File {
+		mode := zf.FileInfo().Mode()
+		if !mode.IsRegular() && !mode.IsDir() {
+			out.Info("Skipped %s: not a regular file", zf.Name)
+			continue
+		}
+		// zips made on Windows may separate names with backslashes
+		name := strings.ReplaceAll(zf.Name, `\`, "/")
+		if err := fn(archiveEntry{name: name, dir: mode.IsDir(), open: zf.Open}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func eachTarEntry(archive string, out Renderer, fn func(archiveEntry) error) error {
+	file, err := os.Open(archive)
+	if err != nil {
+		return fmt.Errorf("failed to open archive %s: %v", archive, err)
+	}
+	defer file.Close()
+
+	var r io.Reader = file
+	if strings.HasSuffix(archive, ".gz") || strings.HasSuffix(archive, ".tgz") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return fmt.Errorf("failed to read archive %s: %v", archive, err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read archive %s: %v", archive, err)
+		}
+		entry := archiveEntry{name: hdr.Name, open: func() (io.ReadCloser, error) { return io.NopCloser(tr), nil }}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			entry.dir = true
+		case tar.TypeReg:
+		default:
+			out.Info("Skipped %s: not a regular file", hdr.Name)
+			continue
+		}
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+}
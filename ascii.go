@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"runtime"
+	"strings"
+)
+
+// negotiateType sends TYPE when the type setting differs from what the
+// server was last told. "server" leaves the server's default alone.
+func (f *FTPConnection) negotiateType() error {
+	want := map[string]string{"ascii": "A", "binary": "I"}[f.settings.transferType]
+	if want == "" || want == f.serverType {
+		return nil
+	}
+	resp, err := f.sendCommand("TYPE " + want)
+	if err != nil {
+		return err
+	}
+	if !isSuccessResponse(resp) {
+		return fmt.Errorf("TYPE %s failed: %s", want, strings.TrimSpace(resp))
+	}
+	f.serverType = want
+	return nil
+}
+
+// looksBinary guesses whether sample, the start of a file, is binary data
+// that an ASCII transfer would corrupt: it contains NUL bytes, or more than
+// a tenth of it is control characters other than whitespace.
+func looksBinary(sample []byte) bool {
+	if bytes.IndexByte(sample, 0) >= 0 {
+		return true
+	}
+	control := 0
+	for _, b := range sample {
+		if b < 0x20 && b != '\n' && b != '\r' && b != '\t' && b != '\f' {
+			control++
+		}
+	}
+	return control*10 > len(sample)
+}
+
+// binarySampleSize is how much of an upload checkASCIIUpload inspects.
+const binarySampleSize = 8 << 10
+
+// checkASCIIUpload refuses to send name in ASCII mode when sample, its first
+// binarySampleSize bytes, looks binary, unless the check is turned off.
+func (f *FTPConnection) checkASCIIUpload(name string, sample []byte) error {
+	if f.serverType != "A" || !f.settings.binaryCheck || !looksBinary(sample) {
+		return nil
+	}
+	return fmt.Errorf("%s looks like a binary file and TYPE A would corrupt it - use 'set type binary', or 'set binary-check off' to send it anyway", name)
+}
+
+// asciiConn converts between the CRLF line endings TYPE A puts on the wire
+// and the local convention: LF everywhere but Windows, where both are CRLF
+// and data passes through unchanged. warn is called once if the data looks
+// binary, since the conversion would then corrupt it.
+type asciiConn struct {
+	net.Conn
+	warn func()
+
+	checked bool // the first chunk has been checked by looksBinary
+	cr      bool // a received CR is held back until the next byte shows whether it ends a line
+	lastCR  bool // the last byte sent was a CR
+	buf     []byte
+}
+
+func (c *asciiConn) check(sample []byte) {
+	if !c.checked && len(sample) > 0 {
+		c.checked = true
+		if looksBinary(sample) {
+			c.warn()
+		}
+	}
+}
+
+func (c *asciiConn) Read(p []byte) (int, error) {
+	if runtime.GOOS == "windows" {
+		n, err := c.Conn.Read(p)
+		c.check(p[:n])
+		return n, err
+	}
+	if len(p) < 2 {
+		// leave room to flush a held CR alongside the next byte
+		return 0, fmt.Errorf("ascii read buffer too small")
+	}
+
+	if cap(c.buf) < len(p)-1 {
+		c.buf = make([]byte, len(p)-1)
+	}
+	n, err := c.Conn.Read(c.buf[:len(p)-1])
+	data := c.buf[:n]
+	c.check(data)
+
+	out := p[:0]
+	if c.cr && (n > 0 || err != nil) {
+		c.cr = false
+		if n == 0 || data[0] != '\n' {
+			out = append(out, '\r')
+		}
+	}
+	for i, b := range data {
+		if b == '\r' {
+			if i+1 == n {
+				c.cr = true
+				continue
+			}
+			if data[i+1] == '\n' {
+				continue
+			}
+		}
+		out = append(out, b)
+	}
+	if err != nil && c.cr {
+		c.cr = false
+		out = append(out, '\r')
+	}
+	return len(out), err
+}
+
+func (c *asciiConn) Write(p []byte) (int, error) {
+	c.check(p)
+	if runtime.GOOS == "windows" {
+		return c.Conn.Write(p)
+	}
+
+	converted := make([]byte, 0, len(p)+len(p)/16)
+	for _, b := range p {
+		if b == '\n' && !c.lastCR {
+			converted = append(converted, '\r')
+		}
+		converted = append(converted, b)
+		c.lastCR = b == '\r'
+	}
+	if _, err := c.Conn.Write(converted); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *asciiConn) CloseWrite() error {
+	if hc, ok := c.Conn.(halfCloser); ok {
+		return hc.CloseWrite()
+	}
+	return nil
+}
+
+func (c *asciiConn) CloseRead() error {
+	if hc, ok := c.Conn.(halfCloser); ok {
+		return hc.CloseRead()
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// atomicTempName is where put --atomic stores remote until it is complete: a
+// hidden name in the same directory, so the rename stays on one filesystem
+// and most pollers skip the file meanwhile.
+func atomicTempName(remote string) string {
+	dir, base := path.Split(remote)
+	return dir + "." + base + ".goftp-tmp"
+}
+
+// uploadAtomic uploads local under a temporary name beside remote and renames
+// it into place only once the server has confirmed the whole file, so
+// consumers polling the directory never see a partial one. With verify, the
+// server's checksum of the file must match the local one as well. On failure
+// the temporary file is deleted and remote is left as it was.
+func (f *FTPConnection) uploadAtomic(local, remote string, verify bool) (int64, error) {
+	if verify && f.settings.transferType == "ascii" {
+		return 0, fmt.Errorf("checksums can't be compared in ascii mode")
+	}
+	if verify && !f.offersChecksum() {
+		return 0, errNoChecksum
+	}
+	file, err := os.Open(local)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open local file %s: %v", local, err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	tmp := atomicTempName(remote)
+	n, err := f.uploadStream(file, tmp, 0)
+	if err == nil {
+		err = f.confirmUpload(local, tmp, n, info.Size(), verify)
+	}
+	if err == nil {
+		err = f.renameRemote(tmp, remote)
+	}
+	if err != nil {
+		// best effort: a failed STOR may have left nothing behind
+		f.sendCommand(fmt.Sprintf("DELE %s", tmp))
+	}
+	f.recordTransfer("put", remote, local, n, err)
+	return n, err
+}
+
+// confirmUpload checks that tmp holds all size bytes of local: the server
+// replied 226 (or 250), its byte counts agree where it gives them, and with
+// verify its checksum matches.
+func (f *FTPConnection) confirmUpload(local, tmp string, sent, size int64, verify bool) error {
+	reply := strings.TrimSpace(f.completionReply)
+	if code, _ := parseReplyLine(reply); code != "226" && code != "250" {
+		return fmt.Errorf("upload not confirmed: %s", reply)
+	}
+	if sent != size {
+		return fmt.Errorf("sent %d of %d bytes - the local file changed during the upload", sent, size)
+	}
+	// line-ending conversion changes the size in ascii mode
+	if f.serverType != "A" {
+		if stats := parseTransferStats(reply); stats.bytes >= 0 && stats.bytes != sent {
+			return fmt.Errorf("server received %d of %d bytes", stats.bytes, sent)
+		}
+		if f.hasFeature("SIZE") {
+			if got, err := f.getFileSize(tmp); err == nil && got != sent {
+				return fmt.Errorf("server stored %d of %d bytes", got, sent)
+			}
+		}
+	}
+	if !verify {
+		return nil
+	}
+	algorithm, remoteSum, err := f.remoteChecksum(tmp)
+	if err != nil {
+		return err
+	}
+	localSum, err := fileChecksum(local, algorithm)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(remoteSum, localSum) {
+		return fmt.Errorf("%s mismatch: server has %s, local file is %s", algorithm, remoteSum, localSum)
+	}
+	return nil
+}
+
+// renameRemote renames from to to with RNFR and RNTO.
+func (f *FTPConnection) renameRemote(from, to string) error {
+	resp, err := f.sendCommand(fmt.Sprintf("RNFR %s", from))
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(resp, "350") {
+		return fmt.Errorf("RNFR failed: %s", strings.TrimSpace(resp))
+	}
+	resp, err = f.sendCommand(fmt.Sprintf("RNTO %s", to))
+	if err != nil {
+		return err
+	}
+	if !isSuccessResponse(resp) {
+		return fmt.Errorf("RNTO failed: %s", strings.TrimSpace(resp))
+	}
+	return nil
+}
+
+// checksumCommands are the pre-HASH commands servers offer, strongest first.
+var checksumCommands = []struct{ command, algorithm string }{
+	{"XSHA256", "SHA-256"},
+	{"XSHA1", "SHA-1"},
+	{"XMD5", "MD5"},
+}
+
+// remoteChecksum asks the server for a checksum of p and returns it with the
+// algorithm used. It prefers HASH, selecting the strongest algorithm both
+// sides know, and falls back to XSHA256, XSHA1, or XMD5.
+func (f *FTPConnection) remoteChecksum(p string) (string, string, error) {
+	if params, ok := f.featureParams("HASH"); ok && f.hasFeature("HASH") {
+		offered := strings.ToUpper(params)
+		for _, c := range checksumCommands {
+			if !strings.Contains(offered, c.algorithm) {
+				continue
+			}
+			if resp, err := f.sendCommand("OPTS HASH " + c.algorithm); err != nil || !isSuccessResponse(resp) {
+				continue
+			}
+			resp, err := f.sendCommand(fmt.Sprintf("HASH %s", p))
+			if err != nil {
+				return "", "", err
+			}
+			// 213 SHA-256 0-49 <hex> <path>
+			fields := strings.Fields(resp)
+			if !strings.HasPrefix(resp, "213") || len(fields) < 4 {
+				return "", "", fmt.Errorf("HASH failed: %s", strings.TrimSpace(resp))
+			}
+			return strings.ToUpper(fields[1]), fields[3], nil
+		}
+	}
+	for _, c := range checksumCommands {
+		if !f.hasFeature(c.command) {
+			continue
+		}
+		resp, err := f.sendCommand(fmt.Sprintf("%s %s", c.command, p))
+		if err != nil {
+			return "", "", err
+		}
+		fields := strings.Fields(resp)
+		if !strings.HasPrefix(resp, "2") || len(fields) < 2 {
+			return "", "", fmt.Errorf("%s failed: %s", c.command, strings.TrimSpace(resp))
+		}
+		return c.algorithm, fields[1], nil
+	}
+	return "", "", errNoChecksum
+}
+
+var errNoChecksum = errors.New("the server offers no checksum command (HASH, XSHA256, XSHA1, or XMD5)")
+
+func (f *FTPConnection) offersChecksum() bool {
+	if f.hasFeature("HASH") {
+		return true
+	}
+	for _, c := range checksumCommands {
+		if f.hasFeature(c.command) {
+			return true
+		}
+	}
+	return false
+}
+
+// fileChecksum returns the hex checksum of a local file with a HASH
+// algorithm name.
+func fileChecksum(name, algorithm string) (string, error) {
+	var h hash.Hash
+	switch algorithm {
+	case "SHA-256":
+		h = sha256.New()
+	case "SHA-512":
+		h = sha512.New()
+	case "SHA-1":
+		h = sha1.New()
+	case "MD5":
+		h = md5.New()
+	default:
+		return "", fmt.Errorf("unsupported checksum algorithm %s", algorithm)
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
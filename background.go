@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// backgroundJob is a download started with a trailing &. It holds the main
+// control connection until it finishes, and meanwhile metadata commands such
+// as pwd, ls, and size run on the probe connection, so a long RETR doesn't
+// keep the user waiting for them.
+type backgroundJob struct {
+	command string
+	running atomic.Bool
+}
+
+// backgroundCommand returns line without a trailing &, and whether it had one.
+func backgroundCommand(line string) (string, bool) {
+	command, ok := strings.CutSuffix(strings.TrimSpace(line), "&")
+	return strings.TrimSpace(command), ok
+}
+
+// inBackground reports whether a background job holds the control connection.
+func (f *FTPConnection) inBackground() bool {
+	return f.background != nil && f.background.running.Load()
+}
+
+// startBackground runs command on this connection in its own goroutine. The
+// caller holds f.control, which passes to the job and is released when it
+// finishes, or straight away if it can't start.
+func (f *FTPConnection) startBackground(command string) error {
+	args := cleanInput(command)
+	if len(args) == 0 {
+		f.control.Unlock()
+		return fmt.Errorf("usage: <command> &")
+	}
+	if cmd, ok := commandRegistry[args[0]]; !ok || !cmd.background {
+		f.control.Unlock()
+		return fmt.Errorf("%s can't run in the background - only get and mget can", args[0])
+	}
+	// the probe connection follows the working directory, which can't
+	// change until the job is done
+	if f.workDir == "" {
+		if dir, err := f.currentDir(); err == nil {
+			f.workDir = dir
+		}
+	}
+	if f.probes == nil {
+		f.probes = &probePool{}
+	}
+	job := &backgroundJob{command: command}
+	job.running.Store(true)
+	f.background = job
+	f.out().Info("[background] %s started; pwd, ls, size, and other lookups can run meanwhile", command)
+
+	go func() {
+		err := f.execute(command)
+		aborted := f.aborting.Load()
+		job.running.Store(false)
+		f.control.Unlock()
+		if err != nil && aborted {
+			f.out().Info("[background] %s: %v", command, err)
+			return
+		}
+		if err != nil {
+			f.out().Error(fmt.Errorf("[background] %s: %v", command, err))
+			f.events.error(err)
+			f.commands.fail()
+			return
+		}
+		f.out().Info("[background] %s done", command)
+	}()
+	return nil
+}
+
+// runAlongside runs a line entered while a background job holds the control
+// connection. Metadata commands run on the probe connection; abort --all
+// stops the job; anything else waits for the job to finish.
+func (f *FTPConnection) runAlongside(line string) error {
+	args := cleanInput(line)
+	if len(args) == 0 {
+		return nil
+	}
+	if cmd, ok := commandRegistry[args[0]]; ok && cmd.metadata {
+		return f.runOnProbe(line)
+	}
+	if args[0] == "abort" && parseAbort(args[1:]) == nil {
+		// the job has to stop before abort can have the connection
+		f.out().Info("Aborting the background %s...", f.background.command)
+		f.stopAll()
+		f.control.Lock()
+		return f.runLocked(line)
+	}
+	f.out().Info("Waiting for the background %s to finish...", f.background.command)
+	f.control.Lock()
+	return f.runLocked(line)
+}
+
+// runOnProbe runs line on the probe connection. Unlike probe, it never falls
+// back to this connection, which the background job is using.
+func (f *FTPConnection) runOnProbe(line string) error {
+	p := f.probes
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for attempt := 0; ; attempt++ {
+		conn, err := p.ready(f)
+		if err != nil {
+			return fmt.Errorf("no second connection to run this on while the background %s runs: %v", f.background.command, err)
+		}
+		conn.settings = f.settings
+		err = conn.execute(line)
+		if attempt == 0 && conn.isConnectionDead(err) {
+			p.close()
+			f.stats.retry()
+			continue
+		}
+		return err
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// serverInfo is what the server says about its own software, from the 220
+// greeting or, failing that, a STAT reply after login.
+type serverInfo struct {
+	software string // e.g. "ProFTPD"; empty when unidentified
+	version  string
+	source   string // "greeting" or "STAT"
+}
+
+func (s serverInfo) String() string {
+	if s.software == "" {
+		return "unidentified"
+	}
+	name := s.software
+	if s.version != "" {
+		name += " " + s.version
+	}
+	return name + " (from " + s.source + ")"
+}
+
+// serverBanners recognise common FTP server software and its version in
+// greeting and STAT text.
+var serverBanners = []struct {
+	software string
+	pattern  *regexp.Regexp
+}{
+	{"ProFTPD", regexp.MustCompile(`(?i)\bProFTPD\s+v?([0-9][0-9a-z.]*)?`)},
+	{"vsFTPd", regexp.MustCompile(`(?i)\bvsFTPd\s*\(?v?([0-9][0-9.]*)?`)},
+	{"Pure-FTPd", regexp.MustCompile(`(?i)\bPure-FTPd\b\s*([0-9][0-9.]*)?`)},
+	{"FileZilla Server", regexp.MustCompile(`(?i)\bFileZilla Server\s*v?(?:ersion\s*)?([0-9][0-9.a-z]*)?`)},
+	{"Serv-U", regexp.MustCompile(`(?i)\bServ-U FTP Server\s*v?([0-9][0-9.]*)?`)},
+	{"Microsoft FTP Service", regexp.MustCompile(`(?i)\bMicrosoft FTP Service\b()`)},
+	{"wu-ftpd", regexp.MustCompile(`(?i)\bwu-(?:ftpd-)?([0-9][0-9.()a-z-]*)`)},
+	{"glFTPd", regexp.MustCompile(`(?i)\bglFTPd\s*([0-9][0-9.a-z]*)?`)},
+}
+
+// identifyServer returns the software named in text, if any.
+func identifyServer(text, source string) serverInfo {
+	for _, banner := range serverBanners {
+		if m := banner.pattern.FindStringSubmatch(text); m != nil {
+			return serverInfo{software: banner.software, version: strings.TrimSuffix(m[1], "."), source: source}
+		}
+	}
+	return serverInfo{}
+}
+
+// brokenEPSV reports server builds known to answer EPSV with a port that
+// can't be reached; early ProFTPD releases did so behind a masqueraded
+// address.
+func (s serverInfo) brokenEPSV() bool {
+	if s.software != "ProFTPD" {
+		return false
+	}
+	return strings.HasPrefix(s.version, "1.2.") || strings.HasPrefix(s.version, "1.3.0")
+}
+
+// noteGreeting identifies the server, and its idle timeout if stated, from
+// its 220 greeting.
+func (f *FTPConnection) noteGreeting(welcome string) {
+	f.server = identifyServer(welcome, "greeting")
+	f.noteIdleTimeout(welcome)
+}
+
+// identifyFromStat asks STAT for the server's software when the greeting
+// didn't name it, and for its idle timeout when the greeting didn't state
+// it; sites that trim their greeting often leave STAT alone.
+func (f *FTPConnection) identifyFromStat() {
+	if (f.server.software != "" && f.serverIdle != 0) || f.statChecked {
+		return
+	}
+	f.statChecked = true
+	resp, err := f.sendCommand("STAT")
+	if err != nil || !strings.HasPrefix(resp, "21") {
+		return
+	}
+	if f.server.software == "" {
+		f.server = identifyServer(resp, "STAT")
+	}
+	f.noteIdleTimeout(resp)
+}
+
+// workarounds are fixes for servers that misbehave, such as embedded FTP
+// servers in cameras and PLCs. Most are selected by the user; the few the
+// client can detect it turns on itself, with learnWorkaround.
+type workarounds struct {
+	brokenEPSV bool
+	noMLSD     bool
+	pasvNAT    bool
+}
+
+// workaroundRegistry lists the workarounds by the name `set workaround`
+// takes, in display order.
+var workaroundRegistry = []struct {
+	name        string
+	description string
+	flag        func(*workarounds) *bool
+}{
+	{"broken-epsv", "epsv uses PASV instead", func(w *workarounds) *bool { return &w.brokenEPSV }},
+	{"no-mlsd", "ignore advertised MLSD/MLST and parse LIST output", func(w *workarounds) *bool { return &w.noMLSD }},
+	{"pasv-nat", "connect passive data to the control host, ignoring the address in PASV replies", func(w *workarounds) *bool { return &w.pasvNAT }},
+}
+
+// disables reports whether a workaround turns off the FEAT feature name.
+func (w workarounds) disables(name string) bool {
+	name = strings.ToUpper(name)
+	return w.noMLSD && (name == "MLSD" || name == "MLST")
+}
+
+func (w workarounds) String() string {
+	var on []string
+	for _, def := range workaroundRegistry {
+		if *def.flag(&w) {
+			on = append(on, def.name)
+		}
+	}
+	if len(on) == 0 {
+		return "none"
+	}
+	return strings.Join(on, ",")
+}
+
+// set applies "<name> on|off" to one workaround, or replaces them all with a
+// comma-separated list of names, or "none", as profiles give them.
+func (w *workarounds) set(value string) error {
+	if name, state, found := strings.Cut(value, " "); found {
+		on, err := parseBool(strings.TrimSpace(state))
+		if err != nil {
+			return err
+		}
+		flag, err := workaroundFlag(w, name)
+		if err != nil {
+			return err
+		}
+		*flag = on
+		return nil
+	}
+	next := workarounds{}
+	if value != "none" {
+		for _, name := range strings.Split(value, ",") {
+			flag, err := workaroundFlag(&next, strings.TrimSpace(name))
+			if err != nil {
+				return err
+			}
+			*flag = true
+		}
+	}
+	*w = next
+	return nil
+}
+
+func workaroundFlag(w *workarounds, name string) (*bool, error) {
+	var names []string
+	for _, def := range workaroundRegistry {
+		if def.name == name {
+			return def.flag(w), nil
+		}
+		names = append(names, def.name)
+	}
+	return nil, fmt.Errorf("unknown workaround %q - expected %s", name, strings.Join(names, ", "))
+}
+
+// learnWorkaround turns on a workaround the session has found it needs,
+// saying why, and saves it to the session's profile so that later sessions
+// start with it rather than finding out again. Only the main session
+// learns: sibling connections take its settings when they open, and
+// diagnose's must see the server as it is. It reports whether the
+// workaround was turned on.
+func (f *FTPConnection) learnWorkaround(name, reason string) bool {
+	if !f.learns {
+		return false
+	}
+	flag, err := workaroundFlag(&f.settings.workarounds, name)
+	if err != nil || *flag {
+		return false
+	}
+	*flag = true
+	out := f.out()
+	out.Warn("%s - turning on workaround %s", reason, name)
+	value := f.settings.workarounds.String()
+	if f.profileName == "" {
+		out.Info("Add workaround = %q to a profile for %s to start with it next time", value, f.addr)
+		return true
+	}
+	path, err := resolveConfigPath(f.configPath)
+	if err == nil {
+		err = saveLearnedSetting(path, f.profileName, "workaround", value, name+", as "+reason)
+	}
+	if err != nil {
+		out.Warn("can't save workaround %s to profile %s: %v", name, f.profileName, err)
+		return true
+	}
+	out.Info("Saved workaround = %q to profile %s in %s", value, f.profileName, path)
+	return true
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// batchLimit caps how much one bulk command transfers, so that a nightly job
+// can work through a large backlog a run at a time: the files left over are
+// still missing or out of date at the target, so the next run picks them up.
+type batchLimit struct {
+	files int   // --max-files; 0 means no limit
+	bytes int64 // --max-total-size; 0 means no limit
+
+	admitted int
+	reserved int64
+}
+
+var errBatchLimit = errors.New("batch limit reached")
+
+// batchLimitOptions document --max-files and --max-total-size for help.
+var batchLimitOptions = []commandOption{
+	{"--max-files N", "transfer at most this many files, leaving the rest for the next run"},
+	{"--max-total-size SIZE", "transfer at most this many bytes, e.g. 10G, leaving the rest for the next run"},
+}
+
+// addFlags registers --max-files and --max-total-size on fs.
+func (l *batchLimit) addFlags(fs *flag.FlagSet) {
+	fs.IntVar(&l.files, "max-files", 0, batchLimitOptions[0].description)
+	fs.Func("max-total-size", batchLimitOptions[1].description, func(value string) error {
+		n, err := parseByteSize(value)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid size %q - expected bytes such as 500M or 10G", value)
+		}
+		l.bytes = n
+		return nil
+	})
+}
+
+// admit reserves room for a file of size bytes (-1 when unknown), or returns
+// errBatchLimit once the batch is full. Files are admitted in order, and the
+// first is admitted whatever its size, so a file bigger than the cap can't
+// hold up the backlog forever.
+func (l *batchLimit) admit(size int64) error {
+	if l.files > 0 && l.admitted >= l.files {
+		return errBatchLimit
+	}
+	size = max(size, 0)
+	if l.bytes > 0 && l.admitted > 0 && l.reserved+size > l.bytes {
+		return errBatchLimit
+	}
+	l.admitted++
+	l.reserved += size
+	return nil
+}
+
+// capped reports whether --max-files or --max-total-size was given.
+func (l *batchLimit) capped() bool {
+	return l.files > 0 || l.bytes > 0
+}
+
+// downloaded reports whether a capped batch can pass over the download of
+// size bytes to local because local already holds that many. Otherwise,
+// under clobber overwrite, the same first files would be fetched again, and
+// use up the cap, on every run, and the rest never reached. Without a cap,
+// downloads behave as they always have.
+func (l *batchLimit) downloaded(local string, size int64) bool {
+	if !l.capped() || size < 0 {
+		return false
+	}
+	info, err := os.Stat(local)
+	return err == nil && info.Mode().IsRegular() && info.Size() == size
+}
+
+// parseByteSize parses a byte count with an optional binary suffix, e.g.
+// 500k, 2M, or 10G.
+func parseByteSize(value string) (int64, error) {
+	text := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(value)), "b")
+	scale := int64(1)
+	switch {
+	case strings.HasSuffix(text, "k"):
+		scale = 1 << 10
+	case strings.HasSuffix(text, "m"):
+		scale = 1 << 20
+	case strings.HasSuffix(text, "g"):
+		scale = 1 << 30
+	case strings.HasSuffix(text, "t"):
+		scale = 1 << 40
+	}
+	if scale > 1 {
+		text = text[:len(text)-1]
+	}
+	n, err := strconv.ParseInt(text, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return n * scale, nil
+}
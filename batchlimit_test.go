@@ -0,0 +1,124 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestBatchLimitAdmit(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit batchLimit
+		sizes []int64
+		want  int // files admitted
+	}{
+		{"no cap", batchLimit{}, []int64{10, 20, 30}, 3},
+		{"max files", batchLimit{files: 2}, []int64{10, 20, 30}, 2},
+		{"max size", batchLimit{bytes: 25}, []int64{10, 10, 10}, 2},
+		{"first file always", batchLimit{bytes: 5}, []int64{100, 1}, 1},
+		{"unknown sizes count as empty", batchLimit{bytes: 5}, []int64{-1, -1, 5}, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			admitted := 0
+			for _, size := range tt.sizes {
+				if tt.limit.admit(size) != nil {
+					break
+				}
+				admitted++
+			}
+			if admitted != tt.want {
+				t.Errorf("admitted %d files, want %d", admitted, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	tests := map[string]int64{"500": 500, "500k": 500 << 10, "2M": 2 << 20, "10G": 10 << 30, "1tb": 1 << 40, "3 KB": -1}
+	for value, want := range tests {
+		got, err := parseByteSize(value)
+		if want < 0 {
+			if err == nil {
+				t.Errorf("parseByteSize(%q) = %d, want an error", value, got)
+			}
+			continue
+		}
+		if err != nil || got != want {
+			t.Errorf("parseByteSize(%q) = %d, %v, want %d", value, got, err, want)
+		}
+	}
+}
+
+// A capped mget passes over files already downloaded in full, so that each
+// run gets further through the backlog even under clobber overwrite.
+func TestMgetCapResumesBacklog(t *testing.T) {
+	useTempDirs(t)
+	dir := t.TempDir()
+	t.Chdir(dir)
+
+	s := newFakeSession()
+	s.files["LIST"] = "-rw-r--r--   1 ftp      ftp             5 Jan 01  2024 a.bin\r\n" +
+		"-rw-r--r--   1 ftp      ftp             5 Jan 01  2024 b.bin\r\n" +
+		"-rw-r--r--   1 ftp      ftp             5 Jan 01  2024 c.bin\r\n"
+	for _, name := range []string{"a.bin", "b.bin", "c.bin"} {
+		s.files["RETR "+name] = strings.ToUpper(name[:1]) + "data"
+	}
+	f, out := newFakeConnection(s)
+
+	for run, want := range [][]string{{"a.bin"}, {"a.bin", "b.bin"}, {"a.bin", "b.bin", "c.bin"}} {
+		if err := handleMget(f, []string{"--max-files", "1", "*.bin"}); err != nil {
+			t.Fatalf("run %d: %v\n%s", run+1, err, out)
+		}
+		var got []string
+		entries, _ := os.ReadDir(dir)
+		for _, e := range entries {
+			got = append(got, e.Name())
+		}
+		if !slices.Equal(got, want) {
+			t.Fatalf("after run %d the directory holds %q, want %q\n%s", run+1, got, want, out)
+		}
+	}
+	var retrieved []string
+	for _, cmd := range s.sentCommands() {
+		if strings.HasPrefix(cmd, "RETR ") {
+			retrieved = append(retrieved, cmd)
+		}
+	}
+	if want := []string{"RETR a.bin", "RETR b.bin", "RETR c.bin"}; !slices.Equal(retrieved, want) {
+		t.Errorf("three capped runs sent %q, want each file fetched once: %q", retrieved, want)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "c.bin")); string(data) != "Cdata" {
+		t.Errorf("c.bin holds %q", data)
+	}
+}
+
+// get -F takes file sizes from SIZE, so --max-total-size limits it.
+func TestGetListMaxTotalSize(t *testing.T) {
+	useTempDirs(t)
+	dir := t.TempDir()
+	t.Chdir(dir)
+
+	list := filepath.Join(t.TempDir(), "list.txt")
+	if err := os.WriteFile(list, []byte("big1.bin\nbig2.bin\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := newFakeSession().withFeatures("SIZE")
+	for _, name := range []string{"big1.bin", "big2.bin"} {
+		s.files["RETR "+name] = strings.Repeat("x", 100)
+		s.replies["SIZE "+name] = "213 100"
+	}
+	f, out := newFakeConnection(s)
+	if err := handleGet(f, []string{"-F", list, "--max-total-size", "150"}); err != nil {
+		t.Fatalf("get -F: %v\n%s", err, out)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "big2.bin")); !os.IsNotExist(err) {
+		t.Errorf("big2.bin was downloaded past --max-total-size 150\n%s", out)
+	}
+	if !strings.Contains(out.String(), "1 files left for the next run") {
+		t.Errorf("get -F didn't report the file left over:\n%s", out)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+// MODE B (RFC 959 section 3.4.2) frames data as blocks, each with a one-byte
+// descriptor and a two-byte count. Record-oriented and mainframe servers use
+// it so the end of a file is explicit and restart markers can be embedded
+// in the stream.
+const (
+	blockEOR     = 0x80 // end of record
+	blockEOF     = 0x40 // end of file
+	blockErrors  = 0x20 // data may contain errors
+	blockRestart = 0x10 // the block's data is a restart marker
+)
+
+// negotiateMode sends MODE when the transfer-mode setting differs from what
+// the server was last told, so it is in effect for the coming transfer.
+func (f *FTPConnection) negotiateMode() error {
+	want := "S"
+	if f.settings.blockMode {
+		want = "B"
+	}
+	have := f.serverMode
+	if have == "" {
+		have = "S"
+	}
+	if want == have {
+		return nil
+	}
+	resp, err := f.sendCommand("MODE " + want)
+	if err != nil {
+		return err
+	}
+	if !isSuccessResponse(resp) {
+		return fmt.Errorf("MODE %s failed: %s", want, strings.TrimSpace(resp))
+	}
+	f.serverMode = want
+	return nil
+}
+
+// blockConn decodes MODE B blocks on Read and encodes them on Write. Restart
+// markers in incoming data are passed to onMarker rather than returned.
+type blockConn struct {
+	net.Conn
+	onMarker func(string)
+
+	remaining int  // data bytes left in the current incoming block
+	eof       bool // the EOF block has been read
+	reading   bool // any data was read, so this is a download
+}
+
+func (c *blockConn) Read(p []byte) (int, error) {
+	c.reading = true
+	for c.remaining == 0 {
+		if c.eof {
+			return 0, io.EOF
+		}
+		var header [3]byte
+		if _, err := io.ReadFull(c.Conn, header[:]); err != nil {
+			if err == io.EOF {
+				return 0, fmt.Errorf("block mode data ended without an EOF block")
+			}
+			return 0, err
+		}
+		count := int(binary.BigEndian.Uint16(header[1:]))
+		if header[0]&blockRestart != 0 {
+			marker := make([]byte, count)
+			if _, err := io.ReadFull(c.Conn, marker); err != nil {
+				return 0, err
+			}
+			if c.onMarker != nil {
+				c.onMarker(string(marker))
+			}
+			continue
+		}
+		c.remaining = count
+		c.eof = header[0]&blockEOF != 0
+	}
+
+	n, err := c.Conn.Read(p[:min(len(p), c.remaining)])
+	c.remaining -= n
+	if err == io.EOF && c.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (c *blockConn) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), 0xffff)]
+		if err := c.writeBlock(0, chunk); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+func (c *blockConn) writeBlock(descriptor byte, data []byte) error {
+	header := []byte{descriptor, 0, 0}
+	binary.BigEndian.PutUint16(header[1:], uint16(len(data)))
+	if _, err := c.Conn.Write(append(header, data...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// CloseWrite ends an upload with the EOF block before half-closing, since in
+// block mode the server relies on the descriptor rather than the connection
+// closing.
+func (c *blockConn) CloseWrite() error {
+	if !c.reading {
+		if err := c.writeBlock(blockEOF, nil); err != nil {
+			return err
+		}
+	}
+	if hc, ok := c.Conn.(halfCloser); ok {
+		return hc.CloseWrite()
+	}
+	return nil
+}
+
+func (c *blockConn) CloseRead() error {
+	if hc, ok := c.Conn.(halfCloser); ok {
+		return hc.CloseRead()
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"path"
+	"strings"
+)
+
+// With set case-insensitive on, glob patterns match remote names whatever
+// their case, and mirror pairs names that differ only in case rather than
+// treating them as different files. That keeps a mirror between a
+// case-insensitive server (e.g. IIS) and a case-sensitive local disk from
+// downloading README.TXT next to an existing readme.txt, or the reverse.
+
+// matchName is path.Match for one name, ignoring case if fold is set.
+func matchName(pattern, name string, fold bool) bool {
+	if fold {
+		pattern, name = strings.ToLower(pattern), strings.ToLower(name)
+	}
+	ok, _ := path.Match(shellPattern(pattern), name)
+	return ok
+}
+
+// nameKey is the form of name that names are compared by.
+func nameKey(name string, fold bool) string {
+	if fold {
+		return strings.ToLower(name)
+	}
+	return name
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// checksumEntry is what a local file looked like when it was last uploaded.
+type checksumEntry struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	SHA256  string    `json:"sha256"`
+}
+
+// checksumDB remembers the local files a reverse mirror uploaded, keyed by
+// path relative to the mirror root, so the next run can tell which ones
+// changed without hashing every file. Each local/remote root pair on a
+// server has its own file in the cache directory; losing it only costs one
+// run that compares by size and time alone.
+type checksumDB struct {
+	path string
+
+	mu      sync.Mutex
+	entries map[string]checksumEntry
+}
+
+// openChecksumDB loads the database for mirroring localRoot to remoteRoot on
+// host, or starts an empty one.
+func openChecksumDB(host, localRoot, remoteRoot string) (*checksumDB, error) {
+	dir, err := appDir(cacheDir)
+	if err != nil {
+		return nil, err
+	}
+	absLocal, err := filepath.Abs(localRoot)
+	if err != nil {
+		return nil, err
+	}
+	key := sha256.Sum256([]byte(host + "\x00" + absLocal + "\x00" + remoteRoot))
+	db := &checksumDB{
+		path:    filepath.Join(dir, "checksums", hex.EncodeToString(key[:8])+".json"),
+		entries: make(map[string]checksumEntry),
+	}
+	data, err := os.ReadFile(db.path)
+	if os.IsNotExist(err) {
+		return db, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &db.entries); err != nil {
+		// a damaged cache is only a cache
+		db.entries = make(map[string]checksumEntry)
+	}
+	return db, nil
+}
+
+// has reports whether rel was uploaded with the database in use. It is
+// false for a nil database.
+func (db *checksumDB) has(rel string) bool {
+	if db == nil {
+		return false
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	_, ok := db.entries[rel]
+	return ok
+}
+
+// unchanged reports whether the local file at localPath still holds what was
+// uploaded as rel. Only a file whose size matches but whose time moved is
+// hashed; its new time is remembered when the content turns out the same.
+func (db *checksumDB) unchanged(rel, localPath string, info os.FileInfo) bool {
+	db.mu.Lock()
+	entry, ok := db.entries[rel]
+	db.mu.Unlock()
+	if !ok || entry.Size != info.Size() {
+		return false
+	}
+	if entry.ModTime.Equal(info.ModTime()) {
+		return true
+	}
+	sum, err := fileSHA256(localPath)
+	if err != nil || sum != entry.SHA256 {
+		return false
+	}
+	entry.ModTime = info.ModTime()
+	db.mu.Lock()
+	db.entries[rel] = entry
+	db.mu.Unlock()
+	return true
+}
+
+// record remembers the local file at localPath as uploaded to rel.
+func (db *checksumDB) record(rel, localPath string) error {
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return err
+	}
+	sum, err := fileSHA256(localPath)
+	if err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.entries[rel] = checksumEntry{Size: info.Size(), ModTime: info.ModTime(), SHA256: sum}
+	return nil
+}
+
+// save writes the database, dropping files that are no longer in the tree.
+func (db *checksumDB) save(present map[string]bool) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for rel := range db.entries {
+		if !present[rel] {
+			delete(db.entries, rel)
+		}
+	}
+	data, err := json.Marshal(db.entries)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(db.path), 0700); err != nil {
+		return err
+	}
+	tmp := db.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, db.path)
+}
+
+func fileSHA256(name string) (string, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// clockSkew is how far the server's timestamps run ahead of the local clock,
+// as measured by calibrate. Mirror subtracts it before comparing times, so a
+// server with a wrong clock or zone doesn't make every file look changed.
+type clockSkew struct {
+	measured bool
+	// clock is the server clock's error, seen in the times it stamps on
+	// files it receives.
+	clock time.Duration
+	// zone is how far LIST times run ahead of UTC: LIST shows the server's
+	// wall clock, which is off by its time zone. Where the server has no
+	// MDTM to separate the two, it includes the clock error too.
+	zone time.Duration
+}
+
+func (s clockSkew) String() string {
+	if !s.measured {
+		return "not measured (run calibrate)"
+	}
+	return fmt.Sprintf("clock %s, LIST times %s", signedDuration(s.clock), signedDuration(s.zone))
+}
+
+// correct returns entry's time on the local clock. stamped says whether the
+// server set the time itself, rather than being told it with MFMT, so that
+// its clock error applies. The correction is rounded to the listing's
+// precision so that corrected times still compare at that precision.
+func (s clockSkew) correct(entry RemoteEntry, stamped bool) time.Time {
+	t := entry.modTime
+	if t.IsZero() || !s.measured {
+		return t
+	}
+	var offset time.Duration
+	if !entry.modUTC {
+		offset += s.zone
+	}
+	if stamped {
+		offset += s.clock
+	}
+	if entry.modPrecision > 0 {
+		offset = offset.Round(entry.modPrecision)
+	}
+	return t.Add(-offset)
+}
+
+// calibrationJitter is the clock difference put down to the time an upload
+// takes to be acknowledged rather than to the server's clock.
+const calibrationJitter = 2 * time.Second
+
+// calibrateClock measures the server's clock and zone skew by uploading a
+// small file to dir, comparing its MDTM to the local time of the upload and
+// its LIST time to its MDTM, and deleting it again.
+func (f *FTPConnection) calibrateClock(dir string) (clockSkew, error) {
+	name := joinRemote(dir, fmt.Sprintf("goftp-calibrate-%d.tmp", os.Getpid()))
+	if _, err := f.uploadStream(strings.NewReader("goftp clock calibration\n"), name, 0); err != nil {
+		return clockSkew{}, fmt.Errorf("failed to upload %s: %v", name, err)
+	}
+	uploaded := time.Now()
+	defer f.sendCommand(fmt.Sprintf("DELE %s", name))
+
+	skew := clockSkew{measured: true}
+	reference := uploaded
+	if stamped, err := f.remoteModTime(name); err == nil {
+		if skew.clock = stamped.Sub(uploaded).Round(time.Second); skew.clock.Abs() < calibrationJitter {
+			skew.clock = 0
+		}
+		reference = stamped
+	}
+	entries, err := f.fetchListing(dir)
+	if err != nil {
+		return clockSkew{}, err
+	}
+	for _, entry := range entries {
+		if entry.name != path.Base(name) {
+			continue
+		}
+		if entry.modTime.IsZero() {
+			return clockSkew{}, fmt.Errorf("the listing shows no time for %s", name)
+		}
+		if entry.modUTC {
+			// MLSD times are UTC, like MDTM, and stand in for it
+			if reference.Equal(uploaded) {
+				if skew.clock = entry.modTime.Sub(uploaded).Round(time.Second); skew.clock.Abs() < calibrationJitter {
+					skew.clock = 0
+				}
+			}
+			return skew, nil
+		}
+		// LIST drops the seconds
+		offset := entry.modTime.Sub(reference.Truncate(time.Minute))
+		if reference.Equal(uploaded) {
+			// no MDTM: the clock error can't be told from the zone
+			skew.zone = offset.Round(time.Minute)
+		} else {
+			// zones are whole quarter hours from UTC
+			skew.zone = offset.Round(15 * time.Minute)
+		}
+		return skew, nil
+	}
+	return clockSkew{}, fmt.Errorf("%s is missing from the listing of %s", name, dir)
+}
+
+// signedDuration renders d with an explicit sign, e.g. "+2h0m0s".
+func signedDuration(d time.Duration) string {
+	if d < 0 {
+		return d.String()
+	}
+	return "+" + d.String()
+}
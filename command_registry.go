@@ -1,9 +1,43 @@
 package main
 
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
+
 type cliCommand struct {
 	callback    func(*FTPConnection, []string) error
+	category    string // the help menu group, one of commandCategories
+	description string
+	usage       string // the command with its arguments, as help shows it
+	options     []commandOption
+	examples    []string
+	writes      bool // modifies the server; refused in read-only mode
+	background  bool // may run in the background with a trailing &
+	metadata    bool // runs on the probe connection while a background job holds this one
+	// destructive, when set, returns the confirmation question for an
+	// invocation that deletes or overwrites data, or "" when args make it safe.
+	destructive func(args []string) string
+}
+
+// commandOption documents one of a command's flags for help.
+type commandOption struct {
+	flag        string // as typed, with a placeholder for its value, e.g. "--count N"
 	description string
-	name        string
+}
+
+// recursiveOption is chmod, chown, and chgrp's -R.
+var recursiveOption = commandOption{"-R", "apply to directory contents recursively"}
+
+// commandCategories are the help menu's groups, in the order it lists them.
+var commandCategories = []struct{ name, title string }{
+	{"navigation", "Navigation"},
+	{"transfer", "Transfer"},
+	{"management", "File management"},
+	{"settings", "Settings"},
+	{"session", "Session"},
 }
 
 var commandRegistry map[string]cliCommand
@@ -11,79 +45,531 @@ var commandRegistry map[string]cliCommand
 func init() {
 	commandRegistry = map[string]cliCommand{
 		"auth": {
-			name:        "auth",
+			category:    "session",
+			usage:       "auth",
 			description: "Authenticate with saved username and password.",
 			callback:    handleAuthenticate,
 		},
+		"anonymous": {
+			category:    "session",
+			usage:       "anonymous [email]",
+			description: "Log in again as the anonymous user.",
+			callback:    handleAnonymous,
+		},
 		"pwd": {
-			name:        "pwd",
+			category:    "navigation",
+			usage:       "pwd",
 			description: "Print working directory.",
 			callback:    handlePWD,
+			metadata:    true,
 		},
 		"pasv": {
-			name:        "pasv",
+			category:    "settings",
+			usage:       "pasv",
 			description: "Request server-DTP to \"listen\" on a data port (which is not its default data port) and to wait for a connection",
 			callback:    handlePasv,
 		},
 		"epsv": {
-			name:        "epsv",
+			category:    "settings",
+			usage:       "epsv",
 			description: "Enter into EPSV mode",
 			callback:    handleEpsv,
 		},
+		"port": {
+			category:    "settings",
+			usage:       "port",
+			description: "Open a local data port and send PORT/EPRT for the next transfer (active mode).",
+			callback:    handlePort,
+		},
 		"list": {
-			name:        "list",
+			category:    "navigation",
+			usage:       "list",
 			description: "Fetch list from server to the passive DTP.",
 			callback:    handleList,
+			metadata:    true,
+		},
+		"ls": {
+			category: "navigation",
+			usage:    "ls [--format plain|csv|tsv] [--refresh] [--since 24h] [--match GLOB] [--stream] [--short|-1] [pathname]",
+			options: []commandOption{
+				{"--format FORMAT", "output format: plain, csv, or tsv"},
+				{"--refresh", "fetch the listing again instead of using the cached one"},
+				{"--since AGE", "only list entries modified within this long, e.g. 24h or 7d"},
+				{"--match GLOB", "only list names matching this glob, narrowed by the server where it can"},
+				{"--stream", "show entries as they arrive instead of caching the listing"},
+				{"--short", "list names only, in columns on a terminal"},
+				{"-1", "list names only, one per line"},
+				{"-l", "long listing (the default)"},
+			},
+			examples:    []string{"ls --since 24h incoming", "ls --format csv --match '*.log' > logs.csv"},
+			description: "List parsed directory entries, optionally as CSV/TSV (name, size, mtime, type, permissions). Listings are cached until a change; --refresh fetches again. --match narrows a huge directory on the server with LIST <glob>; --stream shows entries as they arrive. --short lists names in columns; -1 one per line.",
+			callback:    handleLs,
+			metadata:    true,
 		},
 		"cwd": {
-			name:        "cwd <pathname>",
+			category:    "navigation",
+			usage:       "cwd <pathname>",
 			description: "Change the working directory with desired directory as argument.",
 			callback:    handleCWD,
 		},
 		"cdup": {
-			name:        "cdup",
+			category:    "navigation",
+			usage:       "cdup",
 			description: "Change working directory to parent directory.",
 			callback:    handleCdup,
 		},
 		"retr": {
-			name:        "retr <pathname>",
+			category:    "transfer",
+			usage:       "retr <pathname>",
 			description: "Transfer a copy of the file specified in the pathname from server-DTP",
 			callback:    handleRetr,
 		},
+		"get": {
+			category:    "transfer",
+			usage:       "get [--offset N] [--length M] [--decompress] [--verify-sidecar] <remote> [local] | get -F <listfile> | get --retry-failed <report> | get -r --tar <archive> <remote-dir>",
+			description: "Download a file, or every remote path listed in a file, negotiating the data connection automatically. --offset/--length fetch only part of the file; --decompress writes a .gz, .bz2, .xz, or .zst file uncompressed; --verify-sidecar checks the download against a checksum file beside it (name.sha256, SHA256SUMS, ...); -r --tar streams a tree into a tar(.gz) archive; --report writes a batch's failures to JSON and --retry-failed re-attempts them; --precmd and --postcmd send FTP commands around each transfer, overriding the precmd and postcmd settings.",
+			options: slices.Concat([]commandOption{
+				{"-F FILE", "read remote paths from a file"},
+				{"--report FILE", "write the items of a batch that fail, with error classes, to this JSON file"},
+				{"--retry-failed FILE", "download only the items that failed in this report"},
+				{"--offset N", "start this many bytes into the file"},
+				{"--length N", "stop after this many bytes"},
+				{"-r", "download a directory tree (requires --tar)"},
+				{"--tar FILE", "write the tree into this tar archive, gzipped if it ends in .gz or .tgz"},
+				{"--decompress", "decompress a .gz, .bz2, .xz, or .zst file while downloading it"},
+				{"--verify-sidecar", "verify the download against a checksum file beside it, such as name.sha256 or SHA256SUMS"},
+			}, batchLimitOptions, []commandOption{bwlimitOption}, transferCommandOptions),
+			examples:   []string{"get release.iso", "get --decompress logs/app.log.gz", "get -F wanted.txt --report failed.json", "get -r --tar site.tar.gz public_html"},
+			callback:   handleGet,
+			background: true,
+		},
+		"put": {
+			category:    "transfer",
+			usage:       "put [--create-dirs] [--atomic [--verify]] [--compress] [--chmod MODE] [--rename PATTERN] [--notify URL] <local> [remote] | put -F <listfile> | put --retry-failed <report> | put --extract <archive> [remote-dir]",
+			description: "Upload a file, or every local path listed in a file, negotiating the data connection automatically. --create-dirs creates missing remote directories; --atomic uploads to a temporary name and renames it into place after the server confirms it (--verify also compares checksums); --compress gzips each file on the fly and stores it with a .gz suffix; --chmod, --rename, and --notify run post-upload steps, overriding the upload-* settings; --name-rule renames files whose remote name comes from the local one; --extract uploads the members of a tar(.gz) or zip archive; --report writes a batch's failures to JSON and --retry-failed re-attempts them; --precmd and --postcmd send FTP commands around each transfer, overriding the precmd and postcmd settings.",
+			options: slices.Concat([]commandOption{
+				{"-F FILE", "read local paths from a file"},
+				{"--report FILE", "write the items of a batch that fail, with error classes, to this JSON file"},
+				{"--retry-failed FILE", "upload only the items that failed in this report"},
+				{"--create-dirs", "create missing remote directories"},
+				{"--extract ARCHIVE", "upload the members of this .tar, .tar.gz, or .zip archive"},
+				{"--atomic", "upload to a temporary name and rename it into place once the server confirms it"},
+				{"--verify", "with --atomic, also compare the server's checksum before renaming"},
+				{"--compress", "gzip each file while uploading it, storing it with a .gz suffix"},
+				{"--chmod MODE", "after uploading, set this mode with SITE CHMOD"},
+				{"--rename PATTERN", "after uploading, rename with this pattern, e.g. {name}.done"},
+				{"--name-rule RULE", "upload under a name the rule makes from the local one, as mirror's --name-rule; repeatable"},
+				{"--notify URL", "after uploading, POST a JSON notice to this URL"},
+			}, batchLimitOptions, []commandOption{bwlimitOption}, transferCommandOptions),
+			examples: []string{"put report.pdf", "put --atomic --verify data.csv incoming/data.csv", "put --create-dirs --extract site.tar.gz public_html"},
+			callback: handlePut,
+			writes:   true,
+		},
+		"mget": {
+			category:    "transfer",
+			usage:       "mget [--max-files N] [--max-total-size SIZE] [--report FILE] <pattern>...",
+			description: "Download every remote file matching the glob patterns (*, ?, [...], [!...], and ** for any depth). --precmd and --postcmd send FTP commands around each transfer. A dropped connection is reopened and the batch carries on, resuming the file in progress.",
+			options: slices.Concat(batchLimitOptions, []commandOption{
+				{"--report FILE", "write the items that fail, with error classes, to this JSON file"},
+				bwlimitOption,
+			}, transferCommandOptions),
+			examples:   []string{"mget '*.csv'", "mget --max-total-size 10G 'archive/**/*.tar'"},
+			callback:   handleMget,
+			background: true,
+		},
+		"mdelete": {
+			category:    "management",
+			usage:       "mdelete <pattern>...",
+			description: "Delete every remote file matching the glob patterns.",
+			callback:    handleMdelete,
+			writes:      true,
+			destructive: func(args []string) string {
+				return fmt.Sprintf("Delete every file matching %s?", strings.Join(args, " "))
+			},
+		},
+		"rwatch": {
+			category:    "transfer",
+			usage:       "rwatch [--interval 60s] [--match GLOB] [--get DIR] [--count N] [remote-dir]",
+			description: "Poll a remote directory's listing and report new, removed, and changed files until Ctrl-C (or N polls); --get downloads new and changed files.",
+			options: []commandOption{
+				{"--interval DURATION", "time between polls"},
+				{"--match GLOB", "watch only names matching this glob"},
+				{"--get DIR", "download new and changed files into this directory"},
+				{"--count N", "stop after this many polls"},
+			},
+			examples: []string{"rwatch --interval 5m --match '*.xml' --get inbox outgoing"},
+			callback: handleRwatch,
+		},
+		"tailsync": {
+			category:    "transfer",
+			usage:       "tailsync [--interval 10s] [--count N] <remote-log> <local-log>",
+			description: "Follow a growing remote log until Ctrl-C (or N polls), appending only the new bytes to a local copy with REST; a rotated or rewritten log is detected and followed from its start.",
+			options: []commandOption{
+				{"--interval DURATION", "time between polls"},
+				{"--count N", "stop after this many polls"},
+			},
+			examples: []string{"tailsync logs/access.log access.log"},
+			callback: handleTailsync,
+		},
+		"umask": {
+			category:    "settings",
+			usage:       "umask [<mode>|off]",
+			description: "Show or set the octal mask sent with SITE UMASK before uploads (the umask setting); setting it tries it on the server at once.",
+			callback:    handleUmask,
+		},
+		"chmod": {
+			category:    "management",
+			usage:       "chmod [-R] <mode> <pattern>...",
+			description: "Change permissions of matching remote paths with SITE CHMOD; -R includes directory contents.",
+			options:     []commandOption{recursiveOption},
+			examples:    []string{"chmod -R 755 public_html/cgi-bin"},
+			callback:    handleChmod,
+			writes:      true,
+		},
+		"chown": {
+			category:    "management",
+			usage:       "chown [-R] <owner> <pattern>...",
+			description: "Change the owner of matching remote paths with SITE CHOWN; -R includes directory contents.",
+			options:     []commandOption{recursiveOption},
+			callback:    handleChown,
+			writes:      true,
+		},
+		"chgrp": {
+			category:    "management",
+			usage:       "chgrp [-R] <group> <pattern>...",
+			description: "Change the group of matching remote paths with SITE CHGRP; -R includes directory contents.",
+			options:     []commandOption{recursiveOption},
+			callback:    handleChgrp,
+			writes:      true,
+		},
+		"cp": {
+			category:    "management",
+			usage:       "cp <remote-src> <remote-dst>",
+			description: "Copy a remote file, server-side with SITE CPFR/CPTO when supported, otherwise through the client.",
+			callback:    handleCp,
+			writes:      true,
+		},
+		"queue": {
+			category:    "transfer",
+			usage:       "queue [list] | queue get|put [-p N] [--again] <source> [target] | queue bump|hold|release <id>",
+			description: "Run transfers in the background on a separate connection, highest priority first. bump moves a waiting job to the front; hold keeps it waiting until release. A transfer already queued or done is skipped unless --again is given.",
+			options: []commandOption{
+				{"-p N", "run before queued jobs of lower priority"},
+				{"--again", "queue the transfer even if it is already queued or done"},
+				bwlimitOption,
+			},
+			examples: []string{"queue get -p 5 big.iso", "queue hold 3"},
+			callback: handleQueue,
+		},
+		"abort": {
+			category:    "transfer",
+			usage:       "abort --all",
+			description: "Stop every transfer at once: the background job, the queue, and the data connections they have open, each ended with ABOR. Cut-off downloads keep their .part files and resume checkpoints, and unfinished queue jobs are saved to a session file in the state directory for load-session. Runs even while a background job holds the connection.",
+			options: []commandOption{
+				{"--all", "stop every transfer of the session"},
+			},
+			callback: handleAbort,
+		},
+		"history": {
+			category:    "transfer",
+			usage:       "history transfers [--all] [-n N]",
+			description: "List this session's downloads and uploads, or with --all those of earlier sessions too, numbered for retry.",
+			options: []commandOption{
+				{"--all", "include earlier sessions from the transfer log"},
+				{"-n N", "show at most this many of the latest transfers"},
+			},
+			callback: handleHistory,
+		},
+		"retry": {
+			category:    "transfer",
+			usage:       "retry <n>",
+			description: "Run failed transfer n from 'history transfers' again.",
+			callback:    handleRetry,
+		},
+		"time": {
+			category:    "transfer",
+			usage:       "time <command...>",
+			description: "Run a command and print its wall time, with bytes moved and throughput when it transferred data.",
+			callback:    handleTime,
+		},
+		"pause": {
+			category:    "transfer",
+			usage:       "pause <job-id>",
+			description: "Stop a queued transfer where it is, keeping the data already moved.",
+			callback:    handlePause,
+		},
+		"resume": {
+			category:    "transfer",
+			usage:       "resume <job-id>",
+			description: "Continue a paused queue job from where it stopped, using REST on a fresh data connection.",
+			callback:    handleResume,
+		},
+		"find": {
+			category:    "navigation",
+			usage:       "find [--type f|d|l] [--since 24h] [--mmin -N|+N|N] [pattern|dir]...",
+			description: "Print remote paths matching the glob patterns, or everything beneath a directory, optionally only those modified within a window.",
+			options: []commandOption{
+				{"--type TYPE", "only show entries of this type: f, d, or l"},
+				{"--since AGE", "only show entries modified within this long, e.g. 24h or 7d"},
+				{"--mmin N", "only show entries modified -N (under), +N (over), or N minutes ago"},
+			},
+			examples: []string{"find --type f --since 7d 'reports/**/*.pdf'"},
+			callback: handleFind,
+			metadata: true,
+		},
 		"dele": {
-			name:        "dele <pathname>",
+			category:    "management",
+			usage:       "dele <pathname>",
 			description: "Delete the file specified in the pathname from server-DTP",
 			callback:    handleDele,
+			writes:      true,
+			destructive: func(args []string) string {
+				return fmt.Sprintf("Delete %s?", strings.Join(args, " "))
+			},
 		},
 		"stor": {
-			name:        "stor <filename>",
+			category:    "transfer",
+			usage:       "stor <filename>",
 			description: "Upload a file to the server.",
 			callback:    handleStor,
+			writes:      true,
+		},
+		"mirror": {
+			category:    "transfer",
+			usage:       "mirror [options] <source> [target]",
+			description: "Mirror a remote directory tree locally, or upload a local tree with -R; help mirror lists the options.",
+			options: slices.Concat([]commandOption{
+				{"-R, --reverse", "upload local tree to the server"},
+				{"-n, --only-newer", "transfer only files newer than the target"},
+				{"--only-missing", "transfer only files the target doesn't have, replacing none"},
+				{"--only-existing", "update only files the target already has, adding none"},
+				{"-e, --delete", "delete target files missing from the source"},
+				{"-P, --parallel N", "number of files to transfer at once"},
+				{"-X, --exclude-glob GLOB", "skip names matching the glob"},
+				{"--name-rule RULE", "rename files on the way: lower, upper, s/regexp/replacement/, or a pattern such as {stem}.bak{ext}; repeatable"},
+				{"--links POLICY", "symlink policy: skip, follow, or recreate"},
+				{"--checksum-db", "with -R, remember uploaded files' checksums to skip unchanged ones"},
+				{"--calibrate", "measure the server's clock skew with a temporary upload and correct times by it"},
+				{"--compare METHOD", "how to tell a changed file: size-time, or hash for servers with unreliable timestamps"},
+				{"--hash-max-size SIZE", "with --compare hash, compare larger files by size and time (default 64M)"},
+				{"--report FILE", "write the files that fail, with error classes, to this JSON file"},
+				{"--dry-run", "show what would be transferred and deleted, and stop"},
+				{"-y, --yes", "carry out the plan without asking"},
+			}, batchLimitOptions, []commandOption{bwlimitOption}),
+			examples: []string{"mirror --only-newer pub/data data", "mirror -R --delete -P 4 site public_html", "mirror --dry-run --delete pub/data data", "mirror --name-rule lower --name-rule 's/^IMG_//' DCIM photos"},
+			callback: handleMirror,
 		},
 		"stat": {
-			name:        "stat <pathname> (optional)",
+			category:    "navigation",
+			usage:       "stat <pathname> (optional)",
 			description: "Receive status on action in progress",
 			callback:    handleStat,
+			metadata:    true,
+		},
+		"features": {
+			category:    "session",
+			usage:       "features",
+			description: "Compare what the server advertises (FEAT) with what the client will actually use under the current settings.",
+			callback:    handleFeatures,
+			metadata:    true,
+		},
+		"trust": {
+			category:    "session",
+			usage:       "trust [SHA256:fingerprint]",
+			description: "Pin a TLS certificate for this server: the one the connection presents, or the one with the given fingerprint. Later connections must present the pinned certificate.",
+			callback:    handleTrust,
+		},
+		"untrust": {
+			category:    "session",
+			usage:       "untrust [host[:port]]",
+			description: "Forget the TLS certificate pinned for this server, or for the given host, so the next connection pins the one it presents.",
+			callback:    handleUntrust,
+		},
+		"status": {
+			category:    "session",
+			usage:       "status",
+			description: "Show connection details: server, TLS/PROT state, transfer type, data connection mode, keepalive, and current directories.",
+			callback:    handleStatus,
+		},
+		"stats": {
+			category:    "session",
+			usage:       "stats [--connection] [--commands]",
+			description: "Show the session's command and data totals; --connection adds keepalives sent, commands retried, reconnects, reply timeouts, and control round-trip times, to tell a flaky link from a throttling server; --commands breaks them down by FTP command, with error counts and reply latency percentiles, and writes them to the event stream as a metrics event.",
+			options: []commandOption{
+				{"--connection", "also show keepalives, retries, reconnects, and reply round-trip times"},
+				{"--commands", "show each FTP command's count, errors, and reply latencies"},
+			},
+			callback: handleStats,
+		},
+		"diagnose": {
+			category:    "session",
+			usage:       "diagnose",
+			description: "Find out which data connections get through to the server: PASV, EPSV, and PORT over IPv4 and IPv6, with plain and TLS data, each on a fresh connection, with the likely cause of each failure (NAT, blocked ports, PASV address mismatch).",
+			callback:    handleDiagnose,
+		},
+		"ping": {
+			category:    "session",
+			usage:       "ping [--count N]",
+			description: "Time the control channel with NOOPs, then check that data connections get through in each mode: PASV and EPSV by connecting to the offered port, PORT by listing the working directory.",
+			options: []commandOption{
+				{"--count N", "send this many NOOPs"},
+			},
+			callback: handlePing,
+		},
+		"version": {
+			category:    "session",
+			usage:       "version",
+			description: "Show the client's version, Go version, platform, and the commit it was built from.",
+			callback:    handleVersion,
+			metadata:    true,
 		},
 		"size": {
-			name:        "size <pathname>",
+			category:    "navigation",
+			usage:       "size <pathname>",
 			description: "Display size of file on server.",
 			callback:    handleSize,
+			metadata:    true,
+		},
+		"calibrate": {
+			category:    "settings",
+			usage:       "calibrate [dir]",
+			description: "Measure the server's clock and time zone skew with a temporary upload; mirror corrects times by it.",
+			callback:    handleCalibrate,
+			writes:      true,
+		},
+		"quota": {
+			category:    "management",
+			usage:       "quota [dir]",
+			description: "Show storage limits, usage, and free space, from SITE QUOTA, AVBL, or STAT where the server offers them.",
+			callback:    handleQuota,
+			metadata:    true,
+		},
+		"mdtm": {
+			category:    "navigation",
+			usage:       "mdtm <pathname>",
+			description: "Display modification time of file on server, in the time-format style.",
+			callback:    handleMdtm,
+			metadata:    true,
+		},
+		"set": {
+			category:    "settings",
+			usage:       "set [name] [value]",
+			description: "Show or change session settings (passive, port-range, external-ip).",
+			callback:    handleSet,
+		},
+		"config": {
+			category:    "settings",
+			usage:       "config show|check|edit",
+			description: "Show the effective configuration, validate the config file, or open it in $EDITOR.",
+			callback:    handleConfig,
+		},
+		"source": {
+			category:    "session",
+			usage:       "source <script> [args...]",
+			description: "Run the commands in a script file, which may also use let, foreach, if, echo, and fail (see README).",
+			callback:    handleSource,
+		},
+		"save-session": {
+			category:    "session",
+			usage:       "save-session <file>",
+			description: "Save the working directory, settings, and unfinished queue jobs, to pick up later with load-session.",
+			callback:    handleSaveSession,
+		},
+		"load-session": {
+			category:    "session",
+			usage:       "load-session <file>",
+			description: "Restore a session saved with save-session: settings, working directory, and queue jobs.",
+			callback:    handleLoadSession,
 		},
 		"quit": {
-			name:        "quit",
+			category:    "session",
+			usage:       "quit",
 			description: "Exit the Go-FTP client.",
 			callback:    handleExit,
 		},
 		"help": {
-			name:        "help",
-			description: "Display a help message.",
-			callback:    handleHelpMenu,
+			category:    "session",
+			usage:       "help [--all] [--markdown] [command]",
+			description: "List the commands, or describe one in full with its options and examples. --all describes every command; --markdown writes the reference as Markdown, for docs generators.",
+			options: []commandOption{
+				{"--all", "describe every command in full"},
+				{"--markdown", "write Markdown instead of plain text"},
+			},
+			examples: []string{"help get", "help --all --markdown > COMMANDS.md"},
+			callback: handleHelpMenu,
 		},
 		"serverhelp": {
-			name:        "serverhelp",
+			category:    "session",
+			usage:       "serverhelp",
 			description: "Display a help message from the server.",
 			callback:    handleHelp,
 		},
 	}
+	for name, cmd := range commandRegistry {
+		if !slices.ContainsFunc(commandCategories, func(c struct{ name, title string }) bool { return c.name == cmd.category }) {
+			panic(fmt.Sprintf("command %s has unknown category %q", name, cmd.category))
+		}
+	}
+}
+
+// commandsIn returns the names of the commands in category, sorted.
+func commandsIn(category string) []string {
+	var names []string
+	for name, cmd := range commandRegistry {
+		if cmd.category == category {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// usageLines splits a usage that gives alternative forms, separated by " | ",
+// into one line per form.
+func (c cliCommand) usageLines() []string {
+	return strings.Split(c.usage, " | ")
+}
+
+// helpText describes the command in full: its usage, what it does, its
+// options, and examples.
+func (c cliCommand) helpText() []string {
+	lines := c.usageLines()
+	lines = append(lines, "    "+c.description)
+	if len(c.options) > 0 {
+		width := 0
+		for _, o := range c.options {
+			width = max(width, len(o.flag))
+		}
+		lines = append(lines, "  Options:")
+		for _, o := range c.options {
+			lines = append(lines, fmt.Sprintf("    %-*s  %s", width, o.flag, o.description))
+		}
+	}
+	if len(c.examples) > 0 {
+		lines = append(lines, "  Examples:")
+		for _, example := range c.examples {
+			lines = append(lines, "    "+example)
+		}
+	}
+	return lines
+}
+
+// helpMarkdown is helpText as a Markdown section headed by the command's
+// name, at heading level depth.
+func (c cliCommand) helpMarkdown(name string, depth int) []string {
+	lines := []string{strings.Repeat("#", depth) + " " + name, "", "```"}
+	lines = append(lines, c.usageLines()...)
+	lines = append(lines, "```", "", c.description)
+	if len(c.options) > 0 {
+		lines = append(lines, "", "Options:", "")
+		for _, o := range c.options {
+			lines = append(lines, fmt.Sprintf("- `%s` - %s", o.flag, o.description))
+		}
+	}
+	if len(c.examples) > 0 {
+		lines = append(lines, "", "Examples:", "", "```")
+		lines = append(lines, c.examples...)
+		lines = append(lines, "```")
+	}
+	return lines
 }
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestHelpMarkdown(t *testing.T) {
+	f, out := newFakeConnection(newFakeSession())
+	if err := handleHelpMenu(f, []string{"--all", "--markdown"}); err != nil {
+		t.Fatal(err)
+	}
+	text := out.String()
+	if !strings.HasPrefix(text, "# Command reference\n") {
+		t.Errorf("the reference doesn't start with its title:\n%.200s", text)
+	}
+	for name := range commandRegistry {
+		if !strings.Contains(text, "\n### "+name+"\n") {
+			t.Errorf("the reference has no section for %s", name)
+		}
+	}
+	for _, category := range commandCategories {
+		if !strings.Contains(text, "\n## "+category.title+"\n") {
+			t.Errorf("the reference has no heading for %s", category.title)
+		}
+	}
+	if fences := strings.Count(text, "```"); fences%2 != 0 {
+		t.Errorf("the reference has %d code fences, an odd number", fences)
+	}
+}
+
+func TestHelpCommand(t *testing.T) {
+	f, out := newFakeConnection(newFakeSession())
+	if err := handleHelpMenu(f, []string{"get"}); err != nil {
+		t.Fatal(err)
+	}
+	get := commandRegistry["get"]
+	for _, want := range slices.Concat(get.usageLines(), []string{get.description, "Options:", "Examples:"}) {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("help get lacks %q:\n%s", want, out)
+		}
+	}
+
+	if err := handleHelpMenu(f, []string{"no-such-command"}); err == nil {
+		t.Error("help of an unknown command succeeded")
+	}
+}
+
+// The plain list gives each command one line, sorted within its category.
+func TestHelpList(t *testing.T) {
+	f, out := newFakeConnection(newFakeSession())
+	if err := handleHelpMenu(f, nil); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, line := range strings.Split(out.String(), "\n") {
+		if strings.HasSuffix(line, ":") {
+			if !slices.IsSorted(names) {
+				t.Errorf("commands out of order: %q", names)
+			}
+			names = nil
+		} else if strings.HasPrefix(line, " ") {
+			names = append(names, strings.Fields(line)[0])
+		}
+	}
+	if !slices.IsSorted(names) {
+		t.Errorf("commands out of order: %q", names)
+	}
+}
+
+// help lists each command once, under its category's heading, with the
+// headings in commandCategories order.
+func TestHelpCategories(t *testing.T) {
+	f, out := newFakeConnection(newFakeSession())
+	if err := handleHelpMenu(f, nil); err != nil {
+		t.Fatal(err)
+	}
+	titles := make(map[string]string)
+	for _, category := range commandCategories {
+		titles[category.title] = category.name
+	}
+	var headings []string
+	listed := make(map[string]string) // category by command
+	category := ""
+	for _, line := range strings.Split(out.String(), "\n") {
+		if name, ok := titles[strings.TrimSuffix(line, ":")]; ok && strings.HasSuffix(line, ":") {
+			category = name
+			headings = append(headings, name)
+			continue
+		}
+		if !strings.HasPrefix(line, " ") || category == "" {
+			continue
+		}
+		usage := strings.Fields(line)[0]
+		if _, dup := listed[usage]; dup {
+			t.Errorf("%s is listed twice", usage)
+		}
+		listed[usage] = category
+	}
+	for i, c := range commandCategories {
+		if i >= len(headings) || headings[i] != c.name {
+			t.Fatalf("headings %q, want the order of commandCategories", headings)
+		}
+	}
+	for name, cmd := range commandRegistry {
+		if got := listed[name]; got != cmd.category {
+			t.Errorf("%s is listed under %q, want %q", name, got, cmd.category)
+		}
+	}
+}
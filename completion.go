@@ -0,0 +1,180 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// `goftp completion bash|zsh|fish` prints a completion script for the
+// command-line flags, built from the flag definitions themselves so the
+// scripts list every flag with its usage text and can't fall behind.
+
+// completionValues says how to complete the value of a flag that takes one:
+// "file", "dir", or a space-separated list of words. Other flags take free
+// text, which isn't completed.
+var completionValues = map[string]string{
+	"config":      "file",
+	"credentials": "file",
+	"record":      "file",
+	"replay":      "file",
+	"T":           "file",
+	"o":           "file",
+	"i":           "file",
+	"state-dir":   "dir",
+	"P":           "dir",
+	"events":      "stdout-jsonl",
+}
+
+// completionShells are the shells a script can be generated for.
+var completionShells = []string{"bash", "zsh", "fish"}
+
+// completionFlag is a command-line flag as the scripts describe it.
+type completionFlag struct {
+	name   string
+	usage  string
+	isBool bool
+	values string // from completionValues
+}
+
+func completionFlags() []completionFlag {
+	var flags []completionFlag
+	flag.VisitAll(func(f *flag.Flag) {
+		b, ok := f.Value.(interface{ IsBoolFlag() bool })
+		flags = append(flags, completionFlag{name: f.Name, usage: f.Usage, isBool: ok && b.IsBoolFlag(), values: completionValues[f.Name]})
+	})
+	sort.Slice(flags, func(i, j int) bool { return flags[i].name < flags[j].name })
+	return flags
+}
+
+// runCompletion writes the completion script for shell to w.
+func runCompletion(w io.Writer, shell string) error {
+	prog := filepath.Base(os.Args[0])
+	prog = strings.TrimSuffix(prog, filepath.Ext(prog))
+	flags := completionFlags()
+	switch shell {
+	case "bash":
+		writeBashCompletion(w, prog, flags)
+	case "zsh":
+		writeZshCompletion(w, prog, flags)
+	case "fish":
+		writeFishCompletion(w, prog, flags)
+	default:
+		return fmt.Errorf("usage: %s completion %s", prog, strings.Join(completionShells, "|"))
+	}
+	return nil
+}
+
+func writeBashCompletion(w io.Writer, prog string, flags []completionFlag) {
+	fn := "_" + strings.NewReplacer("-", "_", ".", "_").Replace(prog)
+	var names, files, dirs, free []string
+	words := make(map[string][]string)
+	for _, f := range flags {
+		names = append(names, "-"+f.name)
+		switch {
+		case f.isBool:
+		case f.values == "file":
+			files = append(files, "-"+f.name)
+		case f.values == "dir":
+			dirs = append(dirs, "-"+f.name)
+		case f.values != "":
+			words[f.values] = append(words[f.values], "-"+f.name)
+		default:
+			free = append(free, "-"+f.name)
+		}
+	}
+	fmt.Fprintf(w, "# bash completion for %s; load it with: source <(%s completion bash)\n", prog, prog)
+	fmt.Fprintf(w, "%s() {\n", fn)
+	fmt.Fprintln(w, `    local cur="${COMP_WORDS[COMP_CWORD]}" prev="${COMP_WORDS[COMP_CWORD-1]}"`)
+	fmt.Fprintln(w, `    COMPREPLY=()`)
+	fmt.Fprintln(w, `    case "${prev#-}" in`)
+	pattern := func(names []string) string {
+		var alts []string
+		for _, name := range names {
+			alts = append(alts, strings.TrimPrefix(name, "-"))
+		}
+		return strings.Join(alts, "|")
+	}
+	if len(files) > 0 {
+		fmt.Fprintf(w, "        %s) COMPREPLY=($(compgen -f -- \"$cur\")); return ;;\n", pattern(files))
+	}
+	if len(dirs) > 0 {
+		fmt.Fprintf(w, "        %s) COMPREPLY=($(compgen -d -- \"$cur\")); return ;;\n", pattern(dirs))
+	}
+	var valueSets []string
+	for values := range words {
+		valueSets = append(valueSets, values)
+	}
+	sort.Strings(valueSets) // the same script every time
+	for _, values := range valueSets {
+		fmt.Fprintf(w, "        %s) COMPREPLY=($(compgen -W %q -- \"$cur\")); return ;;\n", pattern(words[values]), values)
+	}
+	if len(free) > 0 {
+		fmt.Fprintf(w, "        %s) return ;;\n", pattern(free))
+	}
+	fmt.Fprintln(w, `    esac`)
+	fmt.Fprintln(w, `    if [[ $COMP_CWORD -eq 2 && ${COMP_WORDS[1]} == completion ]]; then`)
+	fmt.Fprintf(w, "        COMPREPLY=($(compgen -W %q -- \"$cur\"))\n", strings.Join(completionShells, " "))
+	fmt.Fprintln(w, `    elif [[ $cur == -* ]]; then`)
+	fmt.Fprintf(w, "        COMPREPLY=($(compgen -W %q -- \"$cur\"))\n", strings.Join(names, " "))
+	fmt.Fprintln(w, `    elif [[ $COMP_CWORD -eq 1 ]]; then`)
+	fmt.Fprintln(w, `        COMPREPLY=($(compgen -W "completion proxy version" -- "$cur"))`)
+	fmt.Fprintln(w, `    fi`)
+	fmt.Fprintln(w, `}`)
+	fmt.Fprintf(w, "complete -F %s %s\n", fn, prog)
+}
+
+func writeZshCompletion(w io.Writer, prog string, flags []completionFlag) {
+	escape := strings.NewReplacer(`'`, `'\''`, `[`, `\[`, `]`, `\]`, `:`, `\:`)
+	fmt.Fprintf(w, "#compdef %s\n", prog)
+	fmt.Fprintf(w, "# zsh completion for %s; load it with: source <(%s completion zsh)\n", prog, prog)
+	fmt.Fprintf(w, "_%s() {\n", prog)
+	fmt.Fprintln(w, `    _arguments -s \`)
+	for _, f := range flags {
+		spec := fmt.Sprintf("-%s[%s]", f.name, escape.Replace(f.usage))
+		switch {
+		case f.isBool:
+		case f.values == "file":
+			spec += ":file:_files"
+		case f.values == "dir":
+			spec += ":directory:_files -/"
+		case f.values != "":
+			spec += fmt.Sprintf(":%s:(%s)", f.name, f.values)
+		default:
+			spec += fmt.Sprintf(":%s:", f.name)
+		}
+		fmt.Fprintf(w, "        '%s' \\\n", spec)
+	}
+	fmt.Fprintln(w, `        '1:command:(completion proxy version)' \`)
+	fmt.Fprintf(w, "        '2:shell:(%s)'\n", strings.Join(completionShells, " "))
+	fmt.Fprintln(w, `}`)
+	fmt.Fprintf(w, "compdef _%s %s\n", prog, prog)
+}
+
+func writeFishCompletion(w io.Writer, prog string, flags []completionFlag) {
+	quote := func(s string) string { return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'" }
+	fmt.Fprintf(w, "# fish completion for %s; load it with: %s completion fish | source\n", prog, prog)
+	for _, f := range flags {
+		line := fmt.Sprintf("complete -c %s -o %s -d %s", prog, f.name, quote(f.usage))
+		switch {
+		case f.isBool:
+		case f.values == "file":
+			line += " -r -F"
+		case f.values == "dir":
+			line += " -x -a '(__fish_complete_directories)'"
+		case f.values != "":
+			line += " -x -a " + quote(f.values)
+		default:
+			line += " -x"
+		}
+		fmt.Fprintln(w, line)
+	}
+	fmt.Fprintf(w, "complete -c %s -n __fish_use_subcommand -a completion -d 'Print a shell completion script'\n", prog)
+	fmt.Fprintf(w, "complete -c %s -n __fish_use_subcommand -a proxy -d 'Run a caching FTP proxy'\n", prog)
+	fmt.Fprintf(w, "complete -c %s -n __fish_use_subcommand -a version -d 'Print the version and build details'\n", prog)
+	fmt.Fprintf(w, "complete -c %s -n '__fish_seen_subcommand_from completion' -x -a %s\n", prog, quote(strings.Join(completionShells, " ")))
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var testCompletionFlags = []completionFlag{
+	{name: "config", usage: "Config file path", values: "file"},
+	{name: "events", usage: "Write events: a file, or 'stdout-jsonl'", values: "stdout-jsonl"},
+	{name: "host", usage: "FTP server [host:port]"},
+	{name: "state-dir", usage: "State directory", values: "dir"},
+	{name: "tls", usage: "Use explicit FTPS", isBool: true},
+}
+
+// Each shell's script is checked by the shell itself, where it's installed.
+func TestCompletionScripts(t *testing.T) {
+	tests := []struct {
+		shell string
+		write func(*bytes.Buffer)
+		check []string // the command that parses the script, given its path
+		want  []string
+	}{
+		{"bash", func(b *bytes.Buffer) { writeBashCompletion(b, "goftp", testCompletionFlags) }, []string{"bash", "-n"},
+			[]string{`config) COMPREPLY=($(compgen -f`, `state-dir) COMPREPLY=($(compgen -d`, `events) COMPREPLY=($(compgen -W "stdout-jsonl"`, "host) return ;;", "complete -F _goftp goftp"}},
+		{"zsh", func(b *bytes.Buffer) { writeZshCompletion(b, "goftp", testCompletionFlags) }, []string{"zsh", "-n"},
+			[]string{`'-host[FTP server \[host\:port\]]:host:'`, `'-tls[Use explicit FTPS]'`, `'-events[Write events\: a file, or '\''stdout-jsonl'\'']:events:(stdout-jsonl)'`}},
+		{"fish", func(b *bytes.Buffer) { writeFishCompletion(b, "goftp", testCompletionFlags) }, []string{"fish", "--no-execute"},
+			[]string{`complete -c goftp -o config -d 'Config file path' -r -F`, `-d 'Write events: a file, or \'stdout-jsonl\'' -x -a 'stdout-jsonl'`, `-o tls -d 'Use explicit FTPS'` + "\n"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.shell, func(t *testing.T) {
+			var b bytes.Buffer
+			tt.write(&b)
+			for _, want := range tt.want {
+				if !strings.Contains(b.String(), want) {
+					t.Errorf("the script lacks %q:\n%s", want, b.String())
+				}
+			}
+			if _, err := exec.LookPath(tt.check[0]); err != nil {
+				return
+			}
+			script := filepath.Join(t.TempDir(), "goftp."+tt.shell)
+			if err := os.WriteFile(script, b.Bytes(), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if out, err := exec.Command(tt.check[0], append(tt.check[1:], script)...).CombinedOutput(); err != nil {
+				t.Errorf("%s rejects the script: %v\n%s", tt.shell, err, out)
+			}
+		})
+	}
+}
+
+func TestRunCompletionUnknownShell(t *testing.T) {
+	if err := runCompletion(&bytes.Buffer{}, "powershell"); err == nil || !strings.Contains(err.Error(), "bash|zsh|fish") {
+		t.Errorf("runCompletion(powershell) = %v", err)
+	}
+}
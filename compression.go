@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// get --decompress pipes a compressed download through a decompressor on
+// its way to disk, so a database dump arrives uncompressed in one pass. gzip
+// and bzip2 are decompressed in-process; xz and zstd have no decoder in the
+// standard library, so they go through the xz and zstd commands. put
+// --compress gzips an upload on the fly instead, saving bandwidth to servers
+// without MODE Z.
+
+// decompressors maps the suffixes get --decompress handles to the external
+// command that decompresses them, if one is needed.
+var decompressors = []struct {
+	suffix string
+	tool   []string // nil for formats decompressed in-process
+}{
+	{".gz", nil},
+	{".bz2", nil},
+	{".xz", []string{"xz", "-dc"}},
+	{".zst", []string{"zstd", "-dc"}},
+}
+
+// decompressedName returns name without its compression suffix, and the
+// suffix.
+func decompressedName(name string) (string, string, error) {
+	for _, d := range decompressors {
+		if base, ok := strings.CutSuffix(name, d.suffix); ok && base != "" {
+			return base, d.suffix, nil
+		}
+	}
+	return "", "", fmt.Errorf("--decompress handles .gz, .bz2, .xz, and .zst files, not %s", name)
+}
+
+// checkDecompressor fails if the suffix's format needs a command that isn't
+// installed, before anything is downloaded.
+func checkDecompressor(suffix string) error {
+	for _, d := range decompressors {
+		if d.suffix == suffix && d.tool != nil {
+			if _, err := exec.LookPath(d.tool[0]); err != nil {
+				return fmt.Errorf("--decompress of %s files needs the %s command: %v", suffix, d.tool[0], err)
+			}
+		}
+	}
+	return nil
+}
+
+// decompress copies src, compressed in the suffix's format, to dst and
+// returns the uncompressed size.
+func decompress(suffix string, src io.Reader, dst io.Writer) (int64, error) {
+	switch suffix {
+	case ".gz":
+		zr, err := gzip.NewReader(src)
+		if err != nil {
+			return 0, fmt.Errorf("not gzip data: %v", err)
+		}
+		defer zr.Close()
+		return io.Copy(dst, zr)
+	case ".bz2":
+		return io.Copy(dst, bzip2.NewReader(src))
+	}
+	for _, d := range decompressors {
+		if d.suffix == suffix && d.tool != nil {
+			return decompressWith(d.tool, src, dst)
+		}
+	}
+	return 0, fmt.Errorf("no decompressor for %s", suffix)
+}
+
+// decompressWith runs an external decompressor between src and dst.
+func decompressWith(tool []string, src io.Reader, dst io.Writer) (int64, error) {
+	counted := &countingWriter{w: dst}
+	var stderr bytes.Buffer
+	cmd := exec.Command(tool[0], tool[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = src, counted, &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return counted.n, fmt.Errorf("%s failed: %s", tool[0], msg)
+		}
+		return counted.n, fmt.Errorf("%s failed: %v", tool[0], err)
+	}
+	return counted.n, nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// downloadDecompressed retrieves remote, compressed in the suffix's format,
+// and writes it uncompressed to local, by way of local.part. It returns the
+// bytes transferred and the uncompressed size. Such downloads can't resume,
+// since offsets in the compressed stream don't match the file on disk, and
+// aren't recorded in the history, whose retry would fetch the file still
+// compressed.
+func (f *FTPConnection) downloadDecompressed(remote, local, suffix string) (transferred, written int64, err error) {
+	if f.settings.transferType == "ascii" {
+		return 0, 0, fmt.Errorf("compressed files need binary transfers - use 'set type binary'")
+	}
+	if err := checkDecompressor(suffix); err != nil {
+		return 0, 0, err
+	}
+	commands := f.transferCommands()
+	if err := f.sendTransferCommands(commands.pre, remote); err != nil {
+		return 0, 0, err
+	}
+	part := local + ".part"
+	file, err := os.Create(part)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to create file %s: %v", part, err)
+	}
+	defer file.Close()
+
+	if _, err = f.prepareData(); err == nil {
+		err = f.transfer(fmt.Sprintf("RETR %s", remote), func(dataConn net.Conn) error {
+			counted := &countingConn{Conn: dataConn}
+			var err error
+			written, err = decompress(suffix, counted, file)
+			transferred = counted.n
+			if err != nil {
+				return fmt.Errorf("failed to decompress %s: %v", remote, err)
+			}
+			return nil
+		})
+	}
+	if err == nil {
+		err = file.Close()
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(part)
+		return transferred, 0, err
+	}
+	if err := os.Rename(part, local); err != nil {
+		return transferred, written, fmt.Errorf("failed to move %s into place: %v", part, err)
+	}
+	return transferred, written, f.sendTransferCommands(commands.post, remote)
+}
+
+// uploadCompressed gzips the local file path while storing it as remote,
+// and returns the compressed bytes sent. The gzip header keeps the local
+// name and modification time, which gunzip -N restores. Like decompressed
+// downloads, these uploads aren't recorded in the history.
+func (f *FTPConnection) uploadCompressed(local, remote string) (int64, error) {
+	file, err := os.Open(local)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open local file %s: %v", local, err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	pr, pw := io.Pipe()
+	compressed := make(chan struct{})
+	go func() {
+		defer close(compressed)
+		zw := gzip.NewWriter(pw)
+		zw.Name, zw.ModTime = filepath.Base(local), info.ModTime()
+		_, err := io.Copy(zw, file)
+		if err == nil {
+			err = zw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	n, err := f.uploadStream(pr, remote, 0)
+	// stop the compressor if the upload ended without reading everything
+	pr.Close()
+	<-compressed
+	return n, err
+}
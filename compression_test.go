@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDecompressedName(t *testing.T) {
+	tests := []struct {
+		name, base, suffix string
+	}{
+		{"dump.sql.gz", "dump.sql", ".gz"},
+		{"logs/app.log.bz2", "logs/app.log", ".bz2"},
+		{"archive.tar.xz", "archive.tar", ".xz"},
+		{"data.zst", "data", ".zst"},
+		{"plain.txt", "", ""},
+		{".gz", "", ""},
+	}
+	for _, tt := range tests {
+		base, suffix, err := decompressedName(tt.name)
+		if base != tt.base || suffix != tt.suffix || (err == nil) != (tt.base != "") {
+			t.Errorf("decompressedName(%q) = %q, %q, %v, want %q, %q", tt.name, base, suffix, err, tt.base, tt.suffix)
+		}
+	}
+}
+
+func gzipped(t *testing.T, data string) string {
+	t.Helper()
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	zw.Write([]byte(data))
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+func TestGetDecompress(t *testing.T) {
+	dump := strings.Repeat("INSERT INTO t VALUES (1);\n", 100)
+	s := newFakeSession()
+	s.files["RETR backups/dump.sql.gz"] = gzipped(t, dump)
+	s.files["RETR backups/bad.sql.gz"] = "not gzip at all"
+	f, out := newFakeConnection(s)
+	dir := t.TempDir()
+	t.Chdir(dir)
+
+	if err := handleGet(f, []string{"--decompress", "backups/dump.sql.gz"}); err != nil {
+		t.Fatalf("get --decompress: %v\n%s", err, out)
+	}
+	if got, err := os.ReadFile("dump.sql"); err != nil || string(got) != dump {
+		t.Errorf("dump.sql holds %d bytes, %v, want the %d decompressed", len(got), err, len(dump))
+	}
+
+	if err := handleGet(f, []string{"--decompress", "backups/bad.sql.gz", "bad.sql"}); err == nil {
+		t.Error("corrupt gzip data was saved")
+	}
+	for _, name := range []string{"bad.sql", "bad.sql.part"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("a failed decompression left %s behind", name)
+		}
+	}
+
+	for _, args := range [][]string{
+		{"--decompress", "--offset", "10", "backups/dump.sql.gz"},
+		{"--decompress", "backups/dump.sql"},
+	} {
+		if err := handleGet(f, args); err == nil {
+			t.Errorf("get %q succeeded", args)
+		}
+	}
+}
+
+func TestPutCompress(t *testing.T) {
+	s := newFakeSession()
+	f, out := newFakeConnection(s)
+	t.Chdir(t.TempDir())
+	report := strings.Repeat("id,name,total\n", 200)
+	os.WriteFile("report.csv", []byte(report), 0644)
+
+	if err := handlePut(f, []string{"--compress", "report.csv"}); err != nil {
+		t.Fatalf("put --compress: %v\n%s", err, out)
+	}
+	uploaded, ok := s.uploads["STOR report.csv.gz"]
+	if !ok {
+		t.Fatalf("nothing stored as report.csv.gz: sent %q", s.sentCommands())
+	}
+	zr, err := gzip.NewReader(strings.NewReader(uploaded))
+	if err != nil {
+		t.Fatalf("the upload isn't gzip data: %v", err)
+	}
+	var got bytes.Buffer
+	if _, err := got.ReadFrom(zr); err != nil || got.String() != report {
+		t.Errorf("the upload decompresses to %d bytes, %v, want the %d of report.csv", got.Len(), err, len(report))
+	}
+	if zr.Name != "report.csv" {
+		t.Errorf("the gzip header names %q, want report.csv", zr.Name)
+	}
+	if !strings.Contains(out.String(), "compressed from") {
+		t.Errorf("put didn't report the compression:\n%s", out)
+	}
+
+	if err := handlePut(f, []string{"--compress", "--atomic", "report.csv"}); err == nil {
+		t.Error("put --compress --atomic succeeded")
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// profile is a named set of connection defaults from the config file.
+type profile struct {
+	name         string
+	host         string
+	user         string
+	pass         string
+	credential   string // entry in the encrypted credentials file
+	initCommands []string
+	settings     map[string]string // values for `set`, applied at startup
+}
+
+// config is the parsed contents of the config file, which uses a small
+// TOML subset:
+//
+//	[profile.mirror]
+//	host = "ftp.example.com:21"
+//	user = "anonymous"
+//	init = ["cwd /pub/releases", "set passive off"]
+//	passive = "off"
+//
+// Any `set` option may appear as a key.
+type config struct {
+	profiles map[string]*profile
+	warnings []string // unknown keys, ignored when loading
+}
+
+// defaultConfigPath returns the per-user config file location.
+func defaultConfigPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "goftp", "config.toml"), nil
+}
+
+// loadConfig reads the config file at path. A missing file yields an empty
+// config so that the file stays optional.
+func loadConfig(path string) (*config, error) {
+	cfg := &config{profiles: make(map[string]*profile)}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var current *profile
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			section := strings.TrimSpace(strings.Trim(line, "[]"))
+			name, found := strings.CutPrefix(section, "profile.")
+			if !found || name == "" {
+				return nil, fmt.Errorf("%s:%d: unknown section [%s]", path, lineNo, section)
+			}
+			current = &profile{name: name, settings: make(map[string]string)}
+			cfg.profiles[name] = current
+			continue
+		}
+
+		key, raw, found := strings.Cut(line, "=")
+		if !found {
+			return nil, fmt.Errorf("%s:%d: expected key = value", path, lineNo)
+		}
+		if current == nil {
+			return nil, fmt.Errorf("%s:%d: setting outside of a [profile.<name>] section", path, lineNo)
+		}
+		values, err := parseConfigValue(strings.TrimSpace(raw))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, lineNo, err)
+		}
+
+		switch key = strings.TrimSpace(key); key {
+		case "host":
+			current.host = values[0]
+		case "user":
+			current.user = values[0]
+		case "pass":
+			current.pass = values[0]
+		case "credential":
+			current.credential = values[0]
+		case "init":
+			current.initCommands = values
+			for _, line := range values {
+				if words := cleanInput(line); len(words) > 0 {
+					if _, ok := commandRegistry[words[0]]; !ok {
+						cfg.warnings = append(cfg.warnings, fmt.Sprintf("%s:%d: unknown init command %q", path, lineNo, words[0]))
+					}
+				}
+			}
+		default:
+			setting, ok := settingRegistry[key]
+			if !ok {
+				cfg.warnings = append(cfg.warnings, fmt.Sprintf("%s:%d: unknown key %q", path, lineNo, key))
+				continue
+			}
+			scratch := defaultSettings()
+			if err := setting.set(&scratch, values[0]); err != nil {
+				return nil, fmt.Errorf("%s:%d: %s: %v", path, lineNo, key, err)
+			}
+			current.settings[key] = values[0]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// parseConfigValue parses a quoted string, a bare word, or a single-line
+// array of quoted strings.
+func parseConfigValue(raw string) ([]string, error) {
+	if inner, found := strings.CutPrefix(raw, "["); found {
+		inner, found = strings.CutSuffix(inner, "]")
+		if !found {
+			return nil, fmt.Errorf("unterminated array")
+		}
+		var values []string
+		for _, item := range splitConfigArray(inner) {
+			value, err := parseConfigString(item)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+		}
+		return values, nil
+	}
+
+	value, err := parseConfigString(raw)
+	if err != nil {
+		return nil, err
+	}
+	return []string{value}, nil
+}
+
+func parseConfigString(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	if strings.HasPrefix(raw, `"`) {
+		value, err := strconv.Unquote(raw)
+		if err != nil {
+			return "", fmt.Errorf("invalid string %s", raw)
+		}
+		return value, nil
+	}
+	// bare words run up to a trailing comment
+	value, _, _ := strings.Cut(raw, "#")
+	return strings.TrimSpace(value), nil
+}
+
+// splitConfigArray splits the inside of an array on commas outside quotes.
+func splitConfigArray(inner string) []string {
+	var items []string
+	var item strings.Builder
+	inQuotes, escaped := false, false
+	for _, r := range inner {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\' && inQuotes:
+			escaped = true
+		case r == '"':
+			inQuotes = !inQuotes
+		case r == ',' && !inQuotes:
+			if s := strings.TrimSpace(item.String()); s != "" {
+				items = append(items, s)
+			}
+			item.Reset()
+			continue
+		}
+		item.WriteRune(r)
+	}
+	if s := strings.TrimSpace(item.String()); s != "" {
+		items = append(items, s)
+	}
+	return items
+}
+
+// saveLearnedSetting sets key to value in the named profile of the config
+// file at path, under a comment giving the date and reason. A value set
+// before is replaced, but comments above it stay, so the notes of earlier
+// saves accumulate. The rest of the file is left as it was.
+func saveLearnedSetting(path, name, key, value, reason string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	start := -1
+	for i, line := range lines {
+		if strings.TrimSpace(line) == "[profile."+name+"]" {
+			start = i
+			break
+		}
+	}
+	if start < 0 {
+		return fmt.Errorf("%s has no [profile.%s] section", path, name)
+	}
+	end := len(lines)
+	for i := start + 1; i < len(lines); i++ {
+		if strings.HasPrefix(strings.TrimSpace(lines[i]), "[") {
+			end = i
+			break
+		}
+	}
+
+	at, replaced := -1, 0
+	for i := start + 1; i < end; i++ {
+		line := strings.TrimSpace(lines[i])
+		if k, _, found := strings.Cut(line, "="); found && !strings.HasPrefix(line, "#") && strings.TrimSpace(k) == key {
+			at, replaced = i, 1
+		}
+	}
+	if at < 0 {
+		// after the section's last line, ahead of the blank lines before the next
+		at = end
+		for at > start+1 && strings.TrimSpace(lines[at-1]) == "" {
+			at--
+		}
+	}
+	entry := []string{
+		"# learned " + time.Now().Format("2006-01-02") + ": " + reason,
+		key + " = " + strconv.Quote(value),
+	}
+	lines = append(lines[:at], append(entry, lines[at+replaced:]...)...)
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strings.Join(lines, "\n")+"\n"), info.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// resolveConfigPath returns path, or the default location when it is empty.
+func resolveConfigPath(path string) (string, error) {
+	if path != "" {
+		return path, nil
+	}
+	return defaultConfigPath()
+}
+
+// applySettings sets each of the profile's `set` options.
+func (p *profile) applySettings(s *sessionSettings) error {
+	for key, value := range p.settings {
+		if err := settingRegistry[key].set(s, value); err != nil {
+			return fmt.Errorf("profile %s: %s: %v", p.name, key, err)
+		}
+	}
+	return nil
+}
+
+// loadProfile reads the config file (the default location when path is
+// empty) and returns the named profile.
+func loadProfile(path, name string) (*profile, error) {
+	path, err := resolveConfigPath(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := loadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, warning := range cfg.warnings {
+		fmt.Fprintf(os.Stderr, "Warning: %s\n", warning)
+	}
+	prof, ok := cfg.profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("no profile %q in %s", name, path)
+	}
+	return prof, nil
+}
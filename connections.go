@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errConnectionLimit is returned instead of dialing when every connection
+// the server allows is already open.
+var errConnectionLimit = errors.New("connection limit reached")
+
+// tooManyConnections matches 421 and 530 replies that refuse a login because
+// of a per-server or per-address connection limit.
+var tooManyConnections = regexp.MustCompile(`(?i)too many|limit|maximum|max(imum)? (number of )?(connections|clients|users)`)
+
+// connectionBudget counts the control connections a session holds to one
+// server, shared by the main connection and every sibling opened from it. It
+// never dials past the cap, which is the max-connections setting if set,
+// otherwise the limit learned from the server refusing a connection. It also
+// spaces out commands across all of those connections.
+type connectionBudget struct {
+	mu          sync.Mutex
+	changed     *sync.Cond
+	open        int // including the main connection
+	learned     int // 0 until the server refuses a connection
+	held        map[*FTPConnection]bool
+	lastCommand time.Time // when the latest command was let through
+}
+
+func newConnectionBudget() *connectionBudget {
+	b := &connectionBudget{open: 1, held: make(map[*FTPConnection]bool)}
+	b.changed = sync.NewCond(&b.mu)
+	return b
+}
+
+func (b *connectionBudget) limit(max int) int {
+	if max > 0 {
+		return max
+	}
+	return b.learned
+}
+
+// reserve claims a slot for a connection about to be dialed.
+func (b *connectionBudget) reserve(max int) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if limit := b.limit(max); limit > 0 && b.open >= limit {
+		return fmt.Errorf("%w: %d of %d connections open", errConnectionLimit, b.open, limit)
+	}
+	b.open++
+	return nil
+}
+
+// adopt records that the connection in a reserved slot is up.
+func (b *connectionBudget) adopt(conn *FTPConnection) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.held[conn] = true
+}
+
+// cancel gives back a reserved slot whose connection failed. If a line of
+// the server's replies says it has too many connections, the ones still
+// open become the limit.
+func (b *connectionBudget) cancel(reply string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.open--
+	b.changed.Broadcast()
+	for _, line := range strings.Split(reply, "\n") {
+		code, _ := parseReplyLine(line)
+		if (code == "421" || code == "530") && tooManyConnections.MatchString(line) {
+			b.learned = b.open
+			return fmt.Errorf("%w: the server allows %d (%s)", errConnectionLimit, b.open, strings.TrimSpace(line))
+		}
+	}
+	return nil
+}
+
+// release gives back conn's slot when it closes. Closing twice is harmless.
+func (b *connectionBudget) release(conn *FTPConnection) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.held[conn] {
+		delete(b.held, conn)
+		b.open--
+		b.changed.Broadcast()
+	}
+}
+
+// waitChange blocks until a connection is given back.
+func (b *connectionBudget) waitChange() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.changed.Wait()
+}
+
+// pace waits until delay has passed since the previous command on any of
+// the session's connections.
+func (b *connectionBudget) pace(delay time.Duration) {
+	if delay <= 0 {
+		return
+	}
+	b.mu.Lock()
+	at := b.lastCommand.Add(delay)
+	if now := time.Now(); at.Before(now) {
+		at = now
+	}
+	b.lastCommand = at
+	b.mu.Unlock()
+	time.Sleep(time.Until(at))
+}
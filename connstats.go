@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// connectionStats counts what the control connections did besides the
+// user's commands - keepalives, automatic retries, reconnects - and times
+// every reply, so stats --connection can tell a flaky link (failed
+// keepalives, reconnects, retries) from a throttling server (slow replies on
+// a steady connection). Sibling connections share their session's stats.
+// Each FTP verb also gets its own counts and a latency histogram, for
+// stats --commands and the metrics event, so a server growing slow or
+// refusing one kind of command shows up before jobs start failing.
+type connectionStats struct {
+	mu                sync.Mutex
+	started           time.Time
+	commands          int
+	keepalives        int
+	keepaliveFailures int
+	retries           int // commands run again on a fresh connection
+	reconnects        int
+	timeouts          int // replies that didn't arrive within reply-timeout
+	replies           int
+	rttTotal          time.Duration
+	rttMin            time.Duration
+	rttMax            time.Duration
+	rttLast           time.Duration
+	verbs             map[string]*verbStats
+}
+
+// latencyBuckets are the upper bounds of the reply latency histogram's
+// buckets; a last bucket holds anything slower.
+var latencyBuckets = []time.Duration{
+	10 * time.Millisecond, 50 * time.Millisecond, 100 * time.Millisecond,
+	250 * time.Millisecond, 500 * time.Millisecond, time.Second,
+	2500 * time.Millisecond, 5 * time.Second, 10 * time.Second,
+}
+
+// verbStats is what one FTP verb's commands met with.
+type verbStats struct {
+	count      int
+	errors     int // answered with a 4xx or 5xx reply
+	unanswered int
+	rttTotal   time.Duration
+	rttMax     time.Duration
+	buckets    []int // counts by latencyBuckets, then the overflow
+}
+
+func newConnectionStats() *connectionStats {
+	return &connectionStats{started: time.Now(), verbs: make(map[string]*verbStats)}
+}
+
+// verb returns the stats for verb, creating them. s.mu must be held.
+func (s *connectionStats) verb(verb string) *verbStats {
+	v, ok := s.verbs[verb]
+	if !ok {
+		v = &verbStats{buckets: make([]int, len(latencyBuckets)+1)}
+		s.verbs[verb] = v
+	}
+	v.count++
+	return v
+}
+
+// reply records verb answered with resp after rtt.
+func (s *connectionStats) reply(verb, resp string, rtt time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v := s.verb(verb)
+	if strings.HasPrefix(resp, "4") || strings.HasPrefix(resp, "5") {
+		v.errors++
+	}
+	v.rttTotal += rtt
+	v.rttMax = max(v.rttMax, rtt)
+	i, _ := slices.BinarySearch(latencyBuckets, rtt)
+	v.buckets[i]++
+	s.commands++
+	s.replies++
+	s.rttTotal += rtt
+	s.rttLast = rtt
+	if s.replies == 1 || rtt < s.rttMin {
+		s.rttMin = rtt
+	}
+	s.rttMax = max(s.rttMax, rtt)
+}
+
+// roundTrip estimates the control connection's round-trip time as its
+// fastest reply, one that waited on neither the server nor a queue of
+// pipelined commands. It is 0 before any reply.
+func (s *connectionStats) roundTrip() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rttMin
+}
+
+// unanswered records a command of verb that got no reply.
+func (s *connectionStats) unanswered(verb string, timedOut bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.verb(verb).unanswered++
+	s.commands++
+	if timedOut {
+		s.timeouts++
+	}
+}
+
+func (s *connectionStats) keepalive(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keepalives++
+	if err != nil {
+		s.keepaliveFailures++
+	}
+}
+
+func (s *connectionStats) retry() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.retries++
+}
+
+func (s *connectionStats) reconnect() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reconnects++
+}
+
+// show reports the totals, and with connection the control connection
+// diagnostics too.
+func (s *connectionStats) show(out Renderer, traffic int64, connection bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out.Field("Session time", formatElapsed(time.Since(s.started)))
+	out.Field("Commands sent", fmt.Sprint(s.commands))
+	out.Field("Data transferred", formatBytes(traffic))
+	if !connection {
+		return
+	}
+	keepalives := fmt.Sprint(s.keepalives)
+	if s.keepaliveFailures > 0 {
+		keepalives += fmt.Sprintf(" (%d failed)", s.keepaliveFailures)
+	}
+	out.Field("Keepalives sent", keepalives)
+	out.Field("Commands retried", fmt.Sprint(s.retries))
+	out.Field("Reconnects", fmt.Sprint(s.reconnects))
+	out.Field("Reply timeouts", fmt.Sprint(s.timeouts))
+	if s.replies == 0 {
+		out.Field("Round-trip time", "no replies yet")
+		return
+	}
+	out.Field("Round-trip time", fmt.Sprintf("last %v, min %v, avg %v, max %v over %d replies",
+		roundRTT(s.rttLast), roundRTT(s.rttMin), roundRTT(s.rttTotal/time.Duration(s.replies)), roundRTT(s.rttMax), s.replies))
+}
+
+// percentile returns the upper bound of the bucket holding the p-th
+// percentile of the answered commands, or -1 when it lies beyond the last.
+func (v *verbStats) percentile(p float64) time.Duration {
+	rank := int(math.Ceil(p / 100 * float64(v.count-v.unanswered)))
+	seen := 0
+	for i, bound := range latencyBuckets {
+		seen += v.buckets[i]
+		if seen >= rank {
+			return bound
+		}
+	}
+	return -1
+}
+
+// showVerbs writes a table of each verb's counts and reply latencies. The
+// percentiles are histogram bucket bounds: "<=250ms" means the p-th
+// percentile reply took at most 250ms.
+func (s *connectionStats) showVerbs(out Renderer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.verbs) == 0 {
+		out.Info("No commands sent yet")
+		return nil
+	}
+	names := make([]string, 0, len(s.verbs))
+	for name := range s.verbs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	bound := func(d time.Duration) string {
+		if d < 0 {
+			return ">" + latencyBuckets[len(latencyBuckets)-1].String()
+		}
+		return "<=" + d.String()
+	}
+	var table strings.Builder
+	w := tabwriter.NewWriter(&table, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, " VERB\tCOUNT\tERRORS\tNO REPLY\tAVG\tP50\tP95\tMAX")
+	for _, name := range names {
+		v := s.verbs[name]
+		avg, p50, p95, slowest := "-", "-", "-", "-"
+		if answered := v.count - v.unanswered; answered > 0 {
+			avg = roundRTT(v.rttTotal / time.Duration(answered)).String()
+			p50, p95 = bound(v.percentile(50)), bound(v.percentile(95))
+			slowest = roundRTT(v.rttMax).String()
+		}
+		fmt.Fprintf(w, " %s\t%d\t%d\t%d\t%s\t%s\t%s\t%s\n", name, v.count, v.errors, v.unanswered, avg, p50, p95, slowest)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(table.String(), "\n"), "\n") {
+		out.Line(line)
+	}
+	return nil
+}
+
+// verbMetrics is one verb's stats as the metrics event carries them.
+type verbMetrics struct {
+	Verb       string    `json:"verb"`
+	Count      int       `json:"count"`
+	Errors     int       `json:"errors"`
+	Unanswered int       `json:"unanswered"`
+	LatencySum float64   `json:"latency_ms_sum"`
+	LatencyMax float64   `json:"latency_ms_max"`
+	BoundsMS   []float64 `json:"bucket_bounds_ms"`
+	Buckets    []int     `json:"bucket_counts"` // one more than the bounds: the last is slower than them all
+}
+
+// metrics returns every verb's stats, sorted by verb.
+func (s *connectionStats) metrics() []verbMetrics {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bounds := make([]float64, len(latencyBuckets))
+	for i, b := range latencyBuckets {
+		bounds[i] = durationMS(b)
+	}
+	metrics := make([]verbMetrics, 0, len(s.verbs))
+	for name, v := range s.verbs {
+		metrics = append(metrics, verbMetrics{
+			Verb:       name,
+			Count:      v.count,
+			Errors:     v.errors,
+			Unanswered: v.unanswered,
+			LatencySum: durationMS(v.rttTotal),
+			LatencyMax: durationMS(v.rttMax),
+			BoundsMS:   bounds,
+			Buckets:    slices.Clone(v.buckets),
+		})
+	}
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].Verb < metrics[j].Verb })
+	return metrics
+}
+
+func durationMS(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// roundRTT rounds a round-trip time for display, to 10µs.
+func roundRTT(d time.Duration) time.Duration {
+	return d.Round(10 * time.Microsecond)
+}
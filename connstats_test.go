@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsConnection(t *testing.T) {
+	s := newFakeSession()
+	f, out := newFakeConnection(s)
+	f.sendCommand("NOOP")
+	f.sendCommand("PWD")
+	f.stats.keepalive(nil)
+	f.stats.keepalive(errors.New("broken pipe"))
+	f.stats.retry()
+	f.stats.reconnect()
+	f.stats.unanswered("LIST", true)
+
+	if err := handleStats(f, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "Commands sent: 3") || strings.Contains(out.String(), "Keepalives") {
+		t.Errorf("stats without --connection:\n%s", out)
+	}
+
+	out.Reset()
+	if err := handleStats(f, []string{"--connection"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"Keepalives sent: 2 (1 failed)",
+		"Commands retried: 1",
+		"Reconnects: 1",
+		"Reply timeouts: 1",
+		"over 2 replies",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("stats --connection lacks %q:\n%s", want, out)
+		}
+	}
+
+	if err := handleStats(f, []string{"extra"}); err == nil {
+		t.Error("stats took an argument")
+	}
+}
+
+func TestConnectionStatsRoundTrip(t *testing.T) {
+	s := newConnectionStats()
+	if s.roundTrip() != 0 {
+		t.Errorf("roundTrip before any reply = %v, want 0", s.roundTrip())
+	}
+	for _, rtt := range []time.Duration{30 * time.Millisecond, 10 * time.Millisecond, 20 * time.Millisecond} {
+		s.reply("NOOP", "200 OK", rtt)
+	}
+	if s.roundTrip() != 10*time.Millisecond || s.rttMax != 30*time.Millisecond || s.rttLast != 20*time.Millisecond {
+		t.Errorf("after 30ms, 10ms, 20ms: min %v, max %v, last %v", s.rttMin, s.rttMax, s.rttLast)
+	}
+}
+
+func TestVerbStats(t *testing.T) {
+	s := newConnectionStats()
+	for _, rtt := range []time.Duration{5, 20, 20, 40, 200} {
+		s.reply("RETR", "150 Opening", rtt*time.Millisecond)
+	}
+	s.reply("RETR", "550 No such file", 30*time.Second)
+	s.unanswered("RETR", true)
+	s.reply("CWD", "250 OK", time.Millisecond)
+
+	retr := s.verbs["RETR"]
+	if retr.count != 7 || retr.errors != 1 || retr.unanswered != 1 {
+		t.Errorf("RETR counted %d, %d errors, %d unanswered, want 7, 1, 1", retr.count, retr.errors, retr.unanswered)
+	}
+	for _, tt := range []struct {
+		p    float64
+		want time.Duration
+	}{{50, 50 * time.Millisecond}, {10, 10 * time.Millisecond}, {95, -1}} {
+		if got := retr.percentile(tt.p); got != tt.want {
+			t.Errorf("RETR p%v = %v, want %v", tt.p, got, tt.want)
+		}
+	}
+
+	metrics := s.metrics()
+	if len(metrics) != 2 || metrics[0].Verb != "CWD" || metrics[1].Verb != "RETR" {
+		t.Fatalf("metrics for %+v, want CWD then RETR", metrics)
+	}
+	if m := metrics[1]; len(m.Buckets) != len(m.BoundsMS)+1 || m.Buckets[len(m.Buckets)-1] != 1 || m.LatencyMax != 30000 {
+		t.Errorf("RETR metrics = %+v, want the 30s reply in the overflow bucket", m)
+	}
+}
+
+func TestStatsCommands(t *testing.T) {
+	f, out := newFakeConnection(newFakeSession())
+	if err := handleStats(f, []string{"--commands"}); err != nil || !strings.Contains(out.String(), "No commands sent yet") {
+		t.Errorf("stats --commands before any command = %v:\n%s", err, out)
+	}
+	f.sendCommand("NOOP")
+	f.sendCommand("DELE missing.txt")
+	out.Reset()
+	if err := handleStats(f, []string{"--commands"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"VERB", "P95", "DELE  1      1", "NOOP  1      0"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("stats --commands lacks %q:\n%s", want, out)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// credential is one named login kept in the encrypted credentials file.
+type credential struct {
+	User string `json:"user"`
+	Pass string `json:"pass"`
+}
+
+// The credentials file is the magic header, a PBKDF2 salt, and an AES-GCM
+// nonce followed by the sealed JSON map of credentials.
+const (
+	credentialMagic  = "GOFTPCRED1\n"
+	credentialSalt   = 16
+	pbkdf2Iterations = 600000
+)
+
+// passphrase is asked for at most once per run, unless GOFTP_PASSPHRASE
+// supplies it.
+var passphrase = os.Getenv("GOFTP_PASSPHRASE")
+
+func defaultCredentialsPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "goftp", "credentials.enc"), nil
+}
+
+func credentialCipher(pass string, salt []byte) (cipher.AEAD, error) {
+	key, err := pbkdf2.Key(sha256.New, pass, salt, pbkdf2Iterations, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// unlockCredentials prompts for the passphrase (once per run) and decrypts
+// the credentials file. A missing file yields an empty store.
+func unlockCredentials(path string) (map[string]credential, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return make(map[string]credential), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rest, ok := bytes.CutPrefix(data, []byte(credentialMagic))
+	if !ok || len(rest) < credentialSalt {
+		return nil, fmt.Errorf("%s is not a goftp credentials file", path)
+	}
+	salt, rest := rest[:credentialSalt], rest[credentialSalt:]
+
+	if passphrase == "" {
+		if passphrase, err = promptPassword(fmt.Sprintf("Passphrase for %s: ", path)); err != nil {
+			return nil, err
+		}
+	}
+	aead, err := credentialCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) < aead.NonceSize() {
+		return nil, fmt.Errorf("%s is truncated", path)
+	}
+	nonce, sealed := rest[:aead.NonceSize()], rest[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		passphrase = ""
+		return nil, fmt.Errorf("wrong passphrase or corrupted credentials file %s", path)
+	}
+
+	creds := make(map[string]credential)
+	if err := json.Unmarshal(plain, &creds); err != nil {
+		return nil, fmt.Errorf("invalid credentials file %s: %v", path, err)
+	}
+	return creds, nil
+}
+
+// saveCredentials encrypts creds with the session passphrase under a fresh
+// salt and nonce, readable only by the owner.
+func saveCredentials(path string, creds map[string]credential) error {
+	plain, err := json.Marshal(creds)
+	if err != nil {
+		return err
+	}
+	salt := make([]byte, credentialSalt)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	aead, err := credentialCipher(passphrase, salt)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	out := append([]byte(credentialMagic), salt...)
+	out = append(out, nonce...)
+	out = aead.Seal(out, nonce, plain, nil)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, out, 0600)
+}
+
+// lookupCredential returns the named entry from the credentials file.
+func lookupCredential(path, name string) (credential, error) {
+	creds, err := unlockCredentials(path)
+	if err != nil {
+		return credential{}, err
+	}
+	cred, ok := creds[name]
+	if !ok {
+		names := make([]string, 0, len(creds))
+		for n := range creds {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return credential{}, fmt.Errorf("no credential %q in %s (have: %s)", name, path, strings.Join(names, ", "))
+	}
+	return cred, nil
+}
+
+// addCredential interactively stores a user and password under name,
+// creating the credentials file (and choosing its passphrase) if needed.
+func addCredential(path, name string) error {
+	_, statErr := os.Stat(path)
+	creating := os.IsNotExist(statErr)
+	if creating {
+		var err error
+		if passphrase, err = promptPassword(fmt.Sprintf("New passphrase for %s: ", path)); err != nil {
+			return err
+		}
+		confirm, err := promptPassword("Repeat passphrase: ")
+		if err != nil {
+			return err
+		}
+		if passphrase == "" || confirm != passphrase {
+			return fmt.Errorf("passphrases are empty or do not match")
+		}
+	}
+	creds, err := unlockCredentials(path)
+	if err != nil {
+		return err
+	}
+
+	user, err := promptLine(fmt.Sprintf("User for %s: ", name))
+	if err != nil {
+		return err
+	}
+	pass, err := promptPassword(fmt.Sprintf("Password for %s: ", user))
+	if err != nil {
+		return err
+	}
+	creds[name] = credential{User: strings.TrimSpace(user), Pass: pass}
+	if err := saveCredentials(path, creds); err != nil {
+		return err
+	}
+	fmt.Printf("Stored credential %q in %s\n", name, path)
+	return nil
+}
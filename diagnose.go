@@ -0,0 +1,310 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// diagnose works out which ways of opening a data connection get through
+// between here and the server, and why the others don't. Every combination
+// of address family, data protection, and data connection mode is tried
+// with an NLST of the login directory, each on a connection of its own, so
+// a check that fails can't leave the next one out of step. When the session
+// uses TLS the control connection stays encrypted throughout, and plain data
+// means PROT C.
+
+// diagnoseTimeout bounds each check's wait for its data connection, so a
+// blocked port costs seconds rather than the whole reply timeout.
+const diagnoseTimeout = 10 * time.Second
+
+// diagnoseModes are the data connection modes tried, in report order.
+var diagnoseModes = []struct {
+	name  string
+	enter func(*FTPConnection) (string, error)
+}{
+	{"PASV", (*FTPConnection).enterPassive},
+	{"EPSV", (*FTPConnection).enterExtendedPassive},
+	{"PORT", (*FTPConnection).enterActive},
+}
+
+// diagnosePath is one route to the server: an address of its host, and
+// whether data connections use TLS.
+type diagnosePath struct {
+	family  string // "IPv4" or "IPv6"
+	dial    string
+	tls     bool
+	err     error // why the path couldn't be tried at all
+	results []pingResult
+}
+
+func (p *diagnosePath) String() string {
+	if p.tls {
+		return p.family + ", TLS data"
+	}
+	return p.family + ", plain data"
+}
+
+// works reports whether mode got through on the path.
+func (p *diagnosePath) works(mode string) bool {
+	for _, r := range p.results {
+		if r.mode == mode {
+			return r.err == nil
+		}
+	}
+	return false
+}
+
+func addrFamily(ip net.IP) string {
+	if ip.To4() != nil {
+		return "IPv4"
+	}
+	return "IPv6"
+}
+
+// diagnosePaths lists the routes to try: the control connection's own
+// address first, then one of the host's addresses in the other family, if
+// it has one, each with plain and with TLS data.
+func (f *FTPConnection) diagnosePaths() ([]*diagnosePath, error) {
+	remote, ok := f.session.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, fmt.Errorf("diagnose needs a TCP connection to the server")
+	}
+	host, port, err := net.SplitHostPort(f.addr)
+	if err != nil {
+		return nil, err
+	}
+	family := addrFamily(remote.IP)
+	dials := []string{remote.String()}
+	families := []string{family}
+	if ips, err := net.LookupIP(host); err == nil {
+		for _, ip := range ips {
+			if addrFamily(ip) != family {
+				dials = append(dials, net.JoinHostPort(ip.String(), port))
+				families = append(families, addrFamily(ip))
+				break
+			}
+		}
+	}
+	var paths []*diagnosePath
+	for i, dial := range dials {
+		for _, tls := range []bool{false, true} {
+			paths = append(paths, &diagnosePath{family: families[i], dial: dial, tls: tls})
+		}
+	}
+	return paths, nil
+}
+
+// diagnoseConn opens and logs in a connection to dial for one check.
+func (f *FTPConnection) diagnoseConn(dial string, tlsData bool) (*FTPConnection, error) {
+	settings := f.settings
+	settings.tls = settings.tls || tlsData
+	settings.replyTimeout = min(settings.replyTimeout, diagnoseTimeout)
+	if err := f.reserveSibling(); err != nil {
+		return nil, err
+	}
+	conn, err := NewFTPConnection(dial, f.user, f.pass)
+	if err != nil {
+		f.budget.cancel("")
+		return nil, fmt.Errorf("can't connect to %s: %v", dial, err)
+	}
+	sibling, err := f.adoptSibling(conn, settings)
+	if err != nil {
+		return nil, err
+	}
+	if sibling.protP && !tlsData {
+		resp, err := sibling.sendCommand("PROT C")
+		if err == nil && !isSuccessResponse(resp) {
+			err = fmt.Errorf("the server requires TLS data connections: PROT C answered %s", strings.TrimSpace(resp))
+		}
+		if err != nil {
+			sibling.sendCommand("QUIT")
+			sibling.Close()
+			return nil, err
+		}
+		sibling.protP = false
+	}
+	return sibling, nil
+}
+
+// diagnose runs each mode's check on the path.
+func (f *FTPConnection) diagnose(p *diagnosePath) {
+	for _, mode := range diagnoseModes {
+		conn, err := f.diagnoseConn(p.dial, p.tls)
+		if err != nil {
+			if len(p.results) == 0 {
+				p.err = err
+				return
+			}
+			p.results = append(p.results, pingResult{mode: mode.name, err: err})
+			continue
+		}
+		p.results = append(p.results, conn.pingTransfer(mode.name, func() (string, error) { return mode.enter(conn) }))
+		conn.sendCommand("QUIT")
+		conn.Close()
+	}
+}
+
+// diagnoseReason suggests why a check failed, from how it failed.
+func diagnoseReason(mode string, err error) string {
+	msg := err.Error()
+	switch {
+	case strings.HasPrefix(msg, "can't connect to"):
+		return "the server can't be reached at this address: it is filtered on the way, or this address family isn't routed"
+	case strings.Contains(msg, "differs from control host") || strings.Contains(msg, "reserved data address"):
+		return "PASV IP mismatch: the server's reply names an address other than the one connected to, typically its private address behind NAT; set workaround pasv-nat on, or have the server's external address configured"
+	case strings.Contains(msg, "TLS handshake"):
+		return "the TLS handshake on the data connection failed: the server may insist on resuming the control connection's TLS session, or something on the path interferes with TLS"
+	case strings.Contains(msg, "AUTH TLS"):
+		return "the server doesn't offer TLS"
+	case strings.Contains(msg, "requires TLS data"):
+		return "the server accepts only TLS data connections"
+	case strings.HasPrefix(msg, "PORT failed") || strings.HasPrefix(msg, "EPRT failed"):
+		return "the server refused PORT: active mode may be disabled, or it won't connect to the address given, a private one when this side is behind NAT (set external-ip)"
+	case strings.HasPrefix(msg, mode+" failed"):
+		return "the server refused " + mode
+	case mode == "PORT" && strings.Contains(msg, "connect to data port"):
+		return "the server couldn't connect back: this side is behind NAT or a firewall that blocks incoming connections; use passive mode, or set external-ip and forward a port-range"
+	case isTimeout(err) || strings.Contains(msg, "timeout"):
+		return "connections to the server's passive port time out: a firewall on the path drops them, or the server's passive port range isn't forwarded through its NAT"
+	case strings.Contains(msg, "connection refused"):
+		return "the passive port is closed: the server's passive port range isn't open on its firewall or forwarded through its NAT"
+	}
+	return ""
+}
+
+// diagnoseFindings compares the paths with each other, for causes no single
+// check shows.
+func diagnoseFindings(paths []*diagnosePath) []string {
+	var plainOnly, tlsOnly bool
+	worked := make(map[string]bool) // by family
+	for _, p := range paths {
+		for _, mode := range diagnoseModes {
+			if p.works(mode.name) {
+				worked[p.family] = true
+			}
+		}
+		if p.tls {
+			continue
+		}
+		for _, q := range paths {
+			if !q.tls || q.family != p.family || q.err != nil {
+				continue
+			}
+			for _, mode := range diagnoseModes {
+				plainOnly = plainOnly || (p.works(mode.name) && !q.works(mode.name))
+				tlsOnly = tlsOnly || (q.works(mode.name) && !p.works(mode.name) && p.err == nil)
+			}
+		}
+	}
+	var findings []string
+	if plainOnly {
+		findings = append(findings, "Some modes work only with plain data: a firewall's FTP helper opens data ports by reading PASV and PORT on the control connection, which TLS hides from it. The server's passive port range needs opening outright.")
+	}
+	if tlsOnly {
+		findings = append(findings, "Some modes work only with TLS data: a firewall's FTP helper rewrites the plaintext PASV and PORT exchange wrongly, and TLS hides it from the helper.")
+	}
+	for _, family := range []string{"IPv4", "IPv6"} {
+		other := "IPv6"
+		if family == other {
+			other = "IPv4"
+		}
+		tried := false
+		for _, p := range paths {
+			tried = tried || p.family == family
+		}
+		if tried && !worked[family] && worked[other] {
+			findings = append(findings, fmt.Sprintf("Nothing works over %s while %s does: %s is filtered or badly routed on the path; connect to the server's %s address.", family, other, family, other))
+		}
+	}
+	return findings
+}
+
+// reportDiagnosis prints a table of the checks, then each failure with its likely
+// cause, then what the failures say together.
+func (f *FTPConnection) reportDiagnosis(paths []*diagnosePath) error {
+	var table strings.Builder
+	w := tabwriter.NewWriter(&table, 0, 0, 2, ' ', 0)
+	fmt.Fprint(w, " PATH")
+	for _, mode := range diagnoseModes {
+		fmt.Fprint(w, "\t"+mode.name)
+	}
+	fmt.Fprintln(w)
+	for _, p := range paths {
+		fmt.Fprint(w, " "+p.String())
+		for _, mode := range diagnoseModes {
+			cell := "not tried"
+			for _, r := range p.results {
+				if r.mode != mode.name {
+					continue
+				}
+				cell = "failed"
+				if r.err == nil {
+					cell = "ok, " + roundRTT(r.elapsed).String()
+				}
+			}
+			fmt.Fprint(w, "\t"+cell)
+		}
+		fmt.Fprintln(w)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	out := f.out()
+	for _, line := range strings.Split(strings.TrimSuffix(table.String(), "\n"), "\n") {
+		out.Line(line)
+	}
+
+	explain := func(what, mode string, err error) {
+		out.Line(fmt.Sprintf(" %s: %v", what, err))
+		if reason := diagnoseReason(mode, err); reason != "" {
+			out.Line("   likely: " + reason)
+		}
+	}
+	for _, p := range paths {
+		if p.err != nil {
+			explain(p.String(), "", p.err)
+			continue
+		}
+		for _, r := range p.results {
+			if r.err != nil {
+				explain(p.String()+", "+r.mode, r.mode, r.err)
+			}
+		}
+	}
+	if len(paths) == 2 {
+		out.Info("The server's host has only %s addresses, so the other family wasn't tried", paths[0].family)
+	}
+	for _, finding := range diagnoseFindings(paths) {
+		out.Info("%s", finding)
+	}
+
+	// the path and mode transfers take now
+	current, mode := "PORT", "active"
+	if f.settings.passive {
+		current, mode = "PASV", "passive"
+	}
+	for _, p := range paths[:2] {
+		if p.tls != f.protP {
+			continue
+		}
+		if p.works(current) {
+			out.Info("Transfers as configured (%s, %s mode) work", p, mode)
+			return nil
+		}
+		var working []string
+		for _, m := range diagnoseModes {
+			if p.works(m.name) {
+				working = append(working, m.name)
+			}
+		}
+		if len(working) == 0 {
+			out.Warn("transfers as configured (%s, %s mode) fail, and so does every other mode on this path", p, mode)
+		} else {
+			out.Warn("transfers as configured (%s, %s mode) fail, but %s works", p, mode, strings.Join(working, " and "))
+		}
+	}
+	return nil
+}
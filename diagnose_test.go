@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// The mock server has passive mode but neither PORT nor TLS.
+func TestDiagnose(t *testing.T) {
+	useTempDirs(t)
+	addr, err := startMockServer(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, out := dialMock(t, addr)
+	out.Reset()
+	if err := handleDiagnose(f, nil); err != nil {
+		t.Fatalf("diagnose: %v\n%s", err, out)
+	}
+	for _, want := range []string{
+		"IPv4, plain data  ok",
+		"IPv4, plain data, PORT:",
+		"the server refused PORT",
+		"the server doesn't offer TLS",
+		"only IPv4 addresses",
+		"Transfers as configured (IPv4, plain data, passive mode) work",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("diagnose output lacks %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestDiagnoseFindings(t *testing.T) {
+	ok := func(mode string) pingResult { return pingResult{mode: mode} }
+	failed := func(mode string) pingResult { return pingResult{mode: mode, err: errors.New("timeout")} }
+	all := []pingResult{ok("PASV"), ok("EPSV"), ok("PORT")}
+	none := []pingResult{failed("PASV"), failed("EPSV"), failed("PORT")}
+	tests := []struct {
+		name  string
+		paths []*diagnosePath
+		want  string // in the findings; empty for none
+	}{
+		{"all work", []*diagnosePath{
+			{family: "IPv4", results: all}, {family: "IPv4", tls: true, results: all},
+		}, ""},
+		{"plain only", []*diagnosePath{
+			{family: "IPv4", results: all}, {family: "IPv4", tls: true, results: none},
+		}, "work only with plain data"},
+		{"TLS only", []*diagnosePath{
+			{family: "IPv4", results: none}, {family: "IPv4", tls: true, results: all},
+		}, "work only with TLS data"},
+		{"IPv6 filtered", []*diagnosePath{
+			{family: "IPv6", results: none}, {family: "IPv6", tls: true, results: none},
+			{family: "IPv4", results: all}, {family: "IPv4", tls: true, results: all},
+		}, "Nothing works over IPv6 while IPv4 does"},
+	}
+	for _, tt := range tests {
+		findings := strings.Join(diagnoseFindings(tt.paths), "\n")
+		if (tt.want == "") != (findings == "") || !strings.Contains(findings, tt.want) {
+			t.Errorf("%s: findings %q, want %q", tt.name, findings, tt.want)
+		}
+	}
+}
+
+func TestDiagnoseReason(t *testing.T) {
+	tests := []struct {
+		mode, err, want string
+	}{
+		{"PASV", "can't connect to 10.0.0.5:50000: i/o timeout", "can't be reached"},
+		{"PASV", "PASV address 10.0.0.5 differs from control host 203.0.113.7", "PASV IP mismatch"},
+		{"PORT", "PORT failed: 500 Illegal PORT command", "the server refused PORT"},
+		{"EPSV", "EPSV failed: 502 Not implemented", "the server refused EPSV"},
+		{"PASV", "read tcp: connection refused", "the passive port is closed"},
+		{"PASV", "something else entirely", ""},
+	}
+	for _, tt := range tests {
+		got := diagnoseReason(tt.mode, errors.New(tt.err))
+		if (tt.want == "") != (got == "") || !strings.Contains(got, tt.want) {
+			t.Errorf("diagnoseReason(%s, %q) = %q, want %q", tt.mode, tt.err, got, tt.want)
+		}
+	}
+}
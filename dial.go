@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// Control connections to a host name with both IPv6 and IPv4 addresses are
+// dialed the RFC 8305 way: the addresses are interleaved by family, and each
+// attempt starts when the one before it fails or after happyEyeballsDelay,
+// whichever is first. The first connection made wins and the others are
+// abandoned, so a broken IPv6 path costs a quarter of a second rather than
+// a full connect timeout. The family that won is remembered for the host and
+// tried first by later connections to it: reconnects and the extra
+// connections that queue, parallel, and background transfers open. Passive
+// data connections go to the address the server names, in the control
+// connection's family.
+//
+// A host name's addresses are cached for dnsCacheTTL, so a batch of URLs or
+// a burst of sibling connections asks the resolver once.
+
+// happyEyeballsDelay is how long an attempt runs before the next starts
+// alongside it, RFC 8305's recommended Connection Attempt Delay.
+const happyEyeballsDelay = 250 * time.Millisecond
+
+// dialTimeout bounds a whole control connection dial.
+const dialTimeout = 30 * time.Second
+
+// preferredFamily remembers, by host, the address family ("IPv4" or "IPv6")
+// of the last control connection made to it.
+var preferredFamily = struct {
+	sync.Mutex
+	byHost map[string]string
+}{byHost: make(map[string]string)}
+
+// dnsCacheTTL is how long a host name's addresses are reused without
+// resolving it again.
+const dnsCacheTTL = time.Minute
+
+// resolved caches host name lookups, by host.
+var resolved = struct {
+	sync.Mutex
+	byHost map[string]resolvedHost
+}{byHost: make(map[string]resolvedHost)}
+
+type resolvedHost struct {
+	ips []net.IPAddr
+	at  time.Time
+}
+
+// lookupHost returns host's addresses, from the cache when it has a recent
+// answer.
+func lookupHost(ctx context.Context, host string) ([]net.IPAddr, error) {
+	resolved.Lock()
+	cached, ok := resolved.byHost[host]
+	resolved.Unlock()
+	if ok && time.Since(cached.at) < dnsCacheTTL {
+		return cached.ips, nil
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	resolved.Lock()
+	resolved.byHost[host] = resolvedHost{ips: ips, at: time.Now()}
+	resolved.Unlock()
+	return ips, nil
+}
+
+// dialControl connects to addr, a host:port, racing its addresses when the
+// host has more than one.
+func dialControl(addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return net.DialTimeout("tcp", addr, dialTimeout)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	ips, err := lookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	preferredFamily.Lock()
+	family := preferredFamily.byHost[host]
+	preferredFamily.Unlock()
+	var targets []string
+	for _, ip := range interleaveFamilies(ips, family) {
+		targets = append(targets, net.JoinHostPort(ip.String(), port))
+	}
+	conn, err := raceDials(ctx, targets)
+	if err != nil {
+		return nil, err
+	}
+	if remote, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		preferredFamily.Lock()
+		preferredFamily.byHost[host] = addrFamily(remote.IP)
+		preferredFamily.Unlock()
+	}
+	return conn, nil
+}
+
+// interleaveFamilies orders ips alternately by family, starting with first,
+// or with the family of the resolver's first answer when first is "".
+func interleaveFamilies(ips []net.IPAddr, first string) []net.IP {
+	if len(ips) == 0 {
+		return nil
+	}
+	if first == "" {
+		first = addrFamily(ips[0].IP)
+	}
+	var primary, secondary []net.IP
+	for _, ip := range ips {
+		if addrFamily(ip.IP) == first {
+			primary = append(primary, ip.IP)
+		} else {
+			secondary = append(secondary, ip.IP)
+		}
+	}
+	var ordered []net.IP
+	for len(primary) > 0 || len(secondary) > 0 {
+		if len(primary) > 0 {
+			ordered = append(ordered, primary[0])
+			primary = primary[1:]
+		}
+		if len(secondary) > 0 {
+			ordered = append(ordered, secondary[0])
+			secondary = secondary[1:]
+		}
+	}
+	return ordered
+}
+
+// raceDials dials targets in order, staggered by happyEyeballsDelay, and
+// returns the first connection made. It fails with the first attempt's error
+// when none connects.
+func raceDials(ctx context.Context, targets []string) (net.Conn, error) {
+	if len(targets) == 0 {
+		return nil, errors.New("no addresses to dial")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type attempt struct {
+		i    int
+		conn net.Conn
+		err  error
+	}
+	results := make(chan attempt, len(targets))
+	var dialer net.Dialer
+	start := func(i int) {
+		go func() {
+			conn, err := dialer.DialContext(ctx, "tcp", targets[i])
+			results <- attempt{i, conn, err}
+		}()
+	}
+
+	errs := make([]error, len(targets))
+	next, running := 0, 0
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case r := <-results:
+			running--
+			if r.err == nil {
+				cancel()
+				// close connections that finish after the winner
+				go func(pending int) {
+					for range pending {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}
+				}(running)
+				return r.conn, nil
+			}
+			errs[r.i] = r.err
+			if next == len(targets) && running == 0 {
+				return nil, errs[0]
+			}
+		}
+		if next < len(targets) {
+			start(next)
+			next++
+			running++
+			timer.Reset(happyEyeballsDelay)
+		}
+	}
+}
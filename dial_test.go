@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestInterleaveFamilies(t *testing.T) {
+	addrs := func(ips ...string) []net.IPAddr {
+		var out []net.IPAddr
+		for _, ip := range ips {
+			out = append(out, net.IPAddr{IP: net.ParseIP(ip)})
+		}
+		return out
+	}
+	tests := []struct {
+		ips   []net.IPAddr
+		first string
+		want  []string
+	}{
+		{addrs("2001:db8::1", "2001:db8::2", "192.0.2.1", "192.0.2.2"), "", []string{"2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2"}},
+		{addrs("2001:db8::1", "2001:db8::2", "192.0.2.1"), "IPv4", []string{"192.0.2.1", "2001:db8::1", "2001:db8::2"}},
+		{addrs("192.0.2.1", "192.0.2.2"), "IPv6", []string{"192.0.2.1", "192.0.2.2"}},
+		{nil, "", nil},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, ip := range interleaveFamilies(tt.ips, tt.first) {
+			got = append(got, ip.String())
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("interleaveFamilies(%v, %q) = %q, want %q", tt.ips, tt.first, got, tt.want)
+		}
+	}
+}
+
+// closedAddr returns a loopback address nothing listens on.
+func closedAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+// A refused attempt starts the next one at once rather than after the delay.
+func TestRaceDials(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	closed := closedAddr(t)
+
+	start := time.Now()
+	conn, err := raceDials(context.Background(), []string{closed, ln.Addr().String()})
+	if err != nil {
+		t.Fatalf("raceDials: %v", err)
+	}
+	conn.Close()
+	if conn.RemoteAddr().String() != ln.Addr().String() {
+		t.Errorf("connected to %v, want the listening %v", conn.RemoteAddr(), ln.Addr())
+	}
+	if elapsed := time.Since(start); elapsed >= happyEyeballsDelay {
+		t.Errorf("the second attempt waited %v after the first was refused", elapsed)
+	}
+
+	if _, err := raceDials(context.Background(), []string{closed, closedAddr(t)}); err == nil {
+		t.Error("raceDials succeeded with nothing listening")
+	}
+	if _, err := raceDials(context.Background(), nil); err == nil {
+		t.Error("raceDials succeeded with no addresses")
+	}
+}
+
+// dialControl races a host's addresses and remembers the family that won.
+func TestDialControlRemembersFamily(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	const host = "dual-stack.test"
+	resolved.Lock()
+	resolved.byHost[host] = resolvedHost{ips: []net.IPAddr{{IP: net.IPv6loopback}, {IP: net.IPv4(127, 0, 0, 1)}}, at: time.Now()}
+	resolved.Unlock()
+	t.Cleanup(func() {
+		resolved.Lock()
+		delete(resolved.byHost, host)
+		resolved.Unlock()
+		preferredFamily.Lock()
+		delete(preferredFamily.byHost, host)
+		preferredFamily.Unlock()
+	})
+
+	conn, err := dialControl(net.JoinHostPort(host, port))
+	if err != nil {
+		t.Fatalf("dialControl: %v", err)
+	}
+	conn.Close()
+	preferredFamily.Lock()
+	family := preferredFamily.byHost[host]
+	preferredFamily.Unlock()
+	if family != "IPv4" {
+		t.Errorf("remembered %q for %s, want IPv4, the only family listening", family, host)
+	}
+}
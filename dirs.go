@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// Kinds of per-user directories: persistent data such as history, caches
+// that may be deleted at any time, and state such as resume journals and logs.
+const (
+	dataDir  = "data"
+	cacheDir = "cache"
+	stateDir = "state"
+)
+
+// stateDirOverride, set by -state-dir, keeps all three kinds under one
+// directory for portable use.
+var stateDirOverride string
+
+// appDir returns goftp's directory of the given kind, creating it on demand.
+// On Linux and other Unix systems it follows the XDG base directory spec;
+// macOS and Windows use their native locations.
+func appDir(kind string) (string, error) {
+	dir, err := appDirPath(kind)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create %s directory: %v", kind, err)
+	}
+	return dir, nil
+}
+
+// appDirPath resolves the directory for kind without creating it.
+func appDirPath(kind string) (string, error) {
+	if stateDirOverride != "" {
+		return filepath.Join(stateDirOverride, kind), nil
+	}
+	if runtime.GOOS == "windows" {
+		base := os.Getenv("LocalAppData")
+		if base == "" {
+			return "", fmt.Errorf("%%LocalAppData%% is not set")
+		}
+		return filepath.Join(base, "goftp", kind), nil
+	}
+	if kind == cacheDir {
+		base, err := os.UserCacheDir()
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(base, "goftp"), nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	if runtime.GOOS == "darwin" || runtime.GOOS == "ios" {
+		base := filepath.Join(home, "Library", "Application Support", "goftp")
+		if kind == stateDir {
+			return filepath.Join(base, "state"), nil
+		}
+		return base, nil
+	}
+
+	env, fallback := "XDG_DATA_HOME", filepath.Join(home, ".local", "share")
+	if kind == stateDir {
+		env, fallback = "XDG_STATE_HOME", filepath.Join(home, ".local", "state")
+	}
+	// the spec says relative paths are invalid and should be ignored
+	if base := os.Getenv(env); filepath.IsAbs(base) {
+		return filepath.Join(base, "goftp"), nil
+	}
+	return filepath.Join(fallback, "goftp"), nil
+}
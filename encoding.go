@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Servers without UTF8 support (see features) keep names in whatever code
+// page their system was set up with, so a Cyrillic name on an old Windows
+// server arrives as cp1251 bytes and shows as mojibake. With set encoding,
+// replies and listings are decoded from that code page as they are read, so
+// display, glob patterns, and local file names all see UTF-8, and names in
+// outgoing commands are encoded back.
+
+// charmap is a single-byte character set. Bytes below 0x80 are ASCII in all
+// of them; decode holds the characters of 0x80 to 0xFF.
+type charmap struct {
+	decode [128]rune
+	encode map[rune]byte
+}
+
+// newCharmap builds a charmap from the 128 characters of its upper half.
+func newCharmap(upper string) *charmap {
+	c := &charmap{encode: make(map[rune]byte, 128)}
+	i := 0
+	for _, r := range upper {
+		c.decode[i] = r
+		c.encode[r] = byte(0x80 + i)
+		i++
+	}
+	if i != 128 {
+		panic(fmt.Sprintf("charmap has %d characters, not 128", i))
+	}
+	return c
+}
+
+func (c *charmap) decodeString(s string) string {
+	var b strings.Builder
+	b.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x80 {
+			b.WriteByte(s[i])
+		} else {
+			b.WriteRune(c.decode[s[i]-0x80])
+		}
+	}
+	return b.String()
+}
+
+// encodeString converts s from UTF-8, failing on the first character the
+// code page has no byte for.
+func (c *charmap) encodeString(s string) (string, error) {
+	if !utf8.ValidString(s) {
+		return "", fmt.Errorf("text is not valid UTF-8")
+	}
+	var b strings.Builder
+	b.Grow(len(s))
+	for _, r := range s {
+		if r < 0x80 {
+			b.WriteByte(byte(r))
+			continue
+		}
+		enc, ok := c.encode[r]
+		if !ok {
+			return "", fmt.Errorf("%q has no equivalent", r)
+		}
+		b.WriteByte(enc)
+	}
+	return b.String(), nil
+}
+
+// charsetAliases are other common names for the code pages in charsets.
+var charsetAliases = map[string]string{
+	"utf8":         "utf-8",
+	"latin1":       "iso-8859-1",
+	"latin2":       "iso-8859-2",
+	"latin9":       "iso-8859-15",
+	"windows-1250": "cp1250",
+	"windows-1251": "cp1251",
+	"windows-1252": "cp1252",
+	"ibm437":       "cp437",
+	"ibm850":       "cp850",
+	"ibm866":       "cp866",
+}
+
+// charsetName returns the canonical name of an encoding setting, accepting
+// aliases and any case.
+func charsetName(value string) (string, bool) {
+	name := strings.ToLower(value)
+	if alias, ok := charsetAliases[name]; ok {
+		name = alias
+	}
+	if _, ok := charsets[name]; ok || name == "utf-8" {
+		return name, true
+	}
+	return "", false
+}
+
+func charsetNames() []string {
+	names := make([]string, 0, len(charsets))
+	for name := range charsets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// toServer encodes s, a command line or path, in the server's encoding.
+func (f *FTPConnection) toServer(s string) (string, error) {
+	c := charsets[f.settings.encoding]
+	if c == nil {
+		return s, nil
+	}
+	enc, err := c.encodeString(s)
+	if err != nil {
+		return "", fmt.Errorf("can't convert to %s, the server's encoding: %v", f.settings.encoding, err)
+	}
+	return enc, nil
+}
+
+// fromServer decodes s, a reply or listing line, from the server's encoding.
+func (f *FTPConnection) fromServer(s string) string {
+	c := charsets[f.settings.encoding]
+	if c == nil {
+		return s
+	}
+	return c.decodeString(s)
+}
+
+// charsets holds the upper halves of the code pages legacy FTP servers
+// commonly use, taken from the Unicode mapping tables. Bytes a code page
+// leaves undefined map to the C1 control of the same value.
+var charsets = map[string]*charmap{
+	"cp437": newCharmap(
+		"ÇüéâäàåçêëèïîìÄÅ" +
+			"ÉæÆôöòûùÿÖÜ¢£¥₧ƒ" +
+			"áíóúñÑªº¿⌐¬½¼¡«»" +
+			"░▒▓│┤╡╢╖╕╣║╗╝╜╛┐" +
+			"└┴┬├─┼╞╟╚╔╩╦╠═╬╧" +
+			"╨╤╥╙╘╒╓╫╪┘┌█▄▌▐▀" +
+			"αßΓπΣσµτΦΘΩδ∞φε∩" +
+			"≡±≥≤⌠⌡÷≈°∙·√ⁿ²■\u00A0"),
+	"cp850": newCharmap(
+		"ÇüéâäàåçêëèïîìÄÅ" +
+			"ÉæÆôöòûùÿÖÜø£Ø×ƒ" +
+			"áíóúñÑªº¿®¬½¼¡«»" +
+			"░▒▓│┤ÁÂÀ©╣║╗╝¢¥┐" +
+			"└┴┬├─┼ãÃ╚╔╩╦╠═╬¤" +
+			"ðÐÊËÈıÍÎÏ┘┌█▄¦Ì▀" +
+			"ÓßÔÒõÕµþÞÚÛÙýÝ¯´" +
+			"\u00AD±‗¾¶§÷¸°¨·¹³²■\u00A0"),
+	"cp866": newCharmap(
+		"АБВГДЕЖЗИЙКЛМНОП" +
+			"РСТУФХЦЧШЩЪЫЬЭЮЯ" +
+			"абвгдежзийклмноп" +
+			"░▒▓│┤╡╢╖╕╣║╗╝╜╛┐" +
+			"└┴┬├─┼╞╟╚╔╩╦╠═╬╧" +
+			"╨╤╥╙╘╒╓╫╪┘┌█▄▌▐▀" +
+			"рстуфхцчшщъыьэюя" +
+			"ЁёЄєЇїЎў°∙·√№¤■\u00A0"),
+	"cp1250": newCharmap(
+		"€\u0081‚\u0083„…†‡\u0088‰Š‹ŚŤŽŹ" +
+			"\u0090‘’“”•–—\u0098™š›śťžź" +
+			"\u00A0ˇ˘Ł¤Ą¦§¨©Ş«¬\u00AD®Ż" +
+			"°±˛ł´µ¶·¸ąş»Ľ˝ľż" +
+			"ŔÁÂĂÄĹĆÇČÉĘËĚÍÎĎ" +
+			"ĐŃŇÓÔŐÖ×ŘŮÚŰÜÝŢß" +
+			"ŕáâăäĺćçčéęëěíîď" +
+			"đńňóôőö÷řůúűüýţ˙"),
+	"cp1251": newCharmap(
+		"ЂЃ‚ѓ„…†‡€‰Љ‹ЊЌЋЏ" +
+			"ђ‘’“”•–—\u0098™љ›њќћџ" +
+			"\u00A0ЎўЈ¤Ґ¦§Ё©Є«¬\u00AD®Ї" +
+			"°±Ііґµ¶·ё№є»јЅѕї" +
+			"АБВГДЕЖЗИЙКЛМНОП" +
+			"РСТУФХЦЧШЩЪЫЬЭЮЯ" +
+			"абвгдежзийклмноп" +
+			"рстуфхцчшщъыьэюя"),
+	"cp1252": newCharmap(
+		"€\u0081‚ƒ„…†‡ˆ‰Š‹Œ\u008DŽ\u008F" +
+			"\u0090‘’“”•–—˜™š›œ\u009DžŸ" +
+			"\u00A0¡¢£¤¥¦§¨©ª«¬\u00AD®¯" +
+			"°±²³´µ¶·¸¹º»¼½¾¿" +
+			"ÀÁÂÃÄÅÆÇÈÉÊËÌÍÎÏ" +
+			"ÐÑÒÓÔÕÖ×ØÙÚÛÜÝÞß" +
+			"àáâãäåæçèéêëìíîï" +
+			"ðñòóôõö÷øùúûüýþÿ"),
+	"iso-8859-1": newCharmap(
+		"\u0080\u0081\u0082\u0083\u0084\u0085\u0086\u0087\u0088\u0089\u008A\u008B\u008C\u008D\u008E\u008F" +
+			"\u0090\u0091\u0092\u0093\u0094\u0095\u0096\u0097\u0098\u0099\u009A\u009B\u009C\u009D\u009E\u009F" +
+			"\u00A0¡¢£¤¥¦§¨©ª«¬\u00AD®¯" +
+			"°±²³´µ¶·¸¹º»¼½¾¿" +
+			"ÀÁÂÃÄÅÆÇÈÉÊËÌÍÎÏ" +
+			"ÐÑÒÓÔÕÖ×ØÙÚÛÜÝÞß" +
+			"àáâãäåæçèéêëìíîï" +
+			"ðñòóôõö÷øùúûüýþÿ"),
+	"iso-8859-2": newCharmap(
+		"\u0080\u0081\u0082\u0083\u0084\u0085\u0086\u0087\u0088\u0089\u008A\u008B\u008C\u008D\u008E\u008F" +
+			"\u0090\u0091\u0092\u0093\u0094\u0095\u0096\u0097\u0098\u0099\u009A\u009B\u009C\u009D\u009E\u009F" +
+			"\u00A0Ą˘Ł¤ĽŚ§¨ŠŞŤŹ\u00ADŽŻ" +
+			"°ą˛ł´ľśˇ¸šşťź˝žż" +
+			"ŔÁÂĂÄĹĆÇČÉĘËĚÍÎĎ" +
+			"ĐŃŇÓÔŐÖ×ŘŮÚŰÜÝŢß" +
+			"ŕáâăäĺćçčéęëěíîď" +
+			"đńňóôőö÷řůúűüýţ˙"),
+	"iso-8859-15": newCharmap(
+		"\u0080\u0081\u0082\u0083\u0084\u0085\u0086\u0087\u0088\u0089\u008A\u008B\u008C\u008D\u008E\u008F" +
+			"\u0090\u0091\u0092\u0093\u0094\u0095\u0096\u0097\u0098\u0099\u009A\u009B\u009C\u009D\u009E\u009F" +
+			"\u00A0¡¢£€¥Š§š©ª«¬\u00AD®¯" +
+			"°±²³Žµ¶·ž¹º»ŒœŸ¿" +
+			"ÀÁÂÃÄÅÆÇÈÉÊËÌÍÎÏ" +
+			"ÐÑÒÓÔÕÖ×ØÙÚÛÜÝÞß" +
+			"àáâãäåæçèéêëìíîï" +
+			"ðñòóôõö÷øùúûüýþÿ"),
+	"koi8-r": newCharmap(
+		"─│┌┐└┘├┤┬┴┼▀▄█▌▐" +
+			"░▒▓⌠■∙√≈≤≥\u00A0⌡°²·÷" +
+			"═║╒ё╓╔╕╖╗╘╙╚╛╜╝╞" +
+			"╟╠╡Ё╢╣╤╥╦╧╨╩╪╫╬©" +
+			"юабцдефгхийклмно" +
+			"пярстужвьызшэщчъ" +
+			"ЮАБЦДЕФГХИЙКЛМНО" +
+			"ПЯРСТУЖВЬЫЗШЭЩЧЪ"),
+	"koi8-u": newCharmap(
+		"─│┌┐└┘├┤┬┴┼▀▄█▌▐" +
+			"░▒▓⌠■∙√≈≤≥\u00A0⌡°²·÷" +
+			"═║╒ёє╔ії╗╘╙╚╛ґ╝╞" +
+			"╟╠╡ЁЄ╣ІЇ╦╧╨╩╪Ґ╬©" +
+			"юабцдефгхийклмно" +
+			"пярстужвьызшэщчъ" +
+			"ЮАБЦДЕФГХИЙКЛМНО" +
+			"ПЯРСТУЖВЬЫЗШЭЩЧЪ"),
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// Every code page maps its 128 upper bytes to distinct characters, so that
+// a name decoded from the server encodes back to the same bytes.
+func TestCharsetsRoundTrip(t *testing.T) {
+	upper := make([]byte, 128)
+	for i := range upper {
+		upper[i] = byte(0x80 + i)
+	}
+	for name, c := range charsets {
+		decoded := c.decodeString(string(upper))
+		encoded, err := c.encodeString(decoded)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if encoded != string(upper) {
+			t.Errorf("%s doesn't round-trip its upper half", name)
+		}
+	}
+}
+
+func TestCharsetDecode(t *testing.T) {
+	tests := []struct {
+		charset, raw, want string
+	}{
+		{"cp1251", "\xcf\xf0\xe8\xe2\xe5\xf2.txt", "Привет.txt"},
+		{"koi8-r", "\xf0\xd2\xc9\xd7\xc5\xd4.txt", "Привет.txt"},
+		{"cp866", "\x8f\xe0\xa8\xa2\xa5\xe2.txt", "Привет.txt"},
+		{"iso-8859-1", "caf\xe9", "café"},
+		{"cp1252", "\x80 price", "€ price"},
+		{"iso-8859-15", "\xa4 price", "€ price"},
+		{"cp437", "\x84", "ä"},
+		{"iso-8859-2", "\xb1", "ą"},
+	}
+	for _, tt := range tests {
+		if got := charsets[tt.charset].decodeString(tt.raw); got != tt.want {
+			t.Errorf("%s: decoded %q to %q, want %q", tt.charset, tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestCharsetEncodeUnmappable(t *testing.T) {
+	if _, err := charsets["cp1251"].encodeString("日本.txt"); err == nil {
+		t.Error("cp1251 encoded Japanese")
+	}
+	if _, err := charsets["cp1251"].encodeString("\xff"); err == nil {
+		t.Error("invalid UTF-8 was encoded")
+	}
+}
+
+func TestCharsetName(t *testing.T) {
+	tests := map[string]string{
+		"CP1251": "cp1251", "windows-1251": "cp1251", "Latin1": "iso-8859-1",
+		"UTF8": "utf-8", "utf-8": "utf-8", "koi8-r": "koi8-r", "ebcdic": "",
+	}
+	for value, want := range tests {
+		got, ok := charsetName(value)
+		if ok != (want != "") || got != want {
+			t.Errorf("charsetName(%q) = %q, %v, want %q", value, got, ok, want)
+		}
+	}
+}
+
+// A listing in the server's code page is shown, and its names sent back,
+// in that code page.
+func TestEncodingListing(t *testing.T) {
+	useTempDirs(t)
+	s := newFakeSession()
+	s.files["LIST"] = "-rw-r--r--   1 ftp      ftp            10 Jan 01  2024 \xcf\xf0\xe8\xe2\xe5\xf2.txt\r\n"
+	s.files["RETR \xcf\xf0\xe8\xe2\xe5\xf2.txt"] = "0123456789"
+	f, out := newFakeConnection(s)
+	f.settings.encoding = "cp1251"
+	t.Chdir(t.TempDir())
+
+	if err := handleLs(f, []string{"-1"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := out.String(); got != "Привет.txt\n" {
+		t.Errorf("ls -1 printed %q, want the name decoded from cp1251", got)
+	}
+	if err := handleMget(f, []string{"*.txt"}); err != nil {
+		t.Fatalf("mget: %v\n%s", err, out)
+	}
+	if data, err := os.ReadFile("Привет.txt"); err != nil || string(data) != "0123456789" {
+		t.Errorf("mget saved %q, %v under the UTF-8 name", data, err)
+	}
+}
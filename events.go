@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clientEvent is one line of the -events stream. The field names and event
+// types are a stable interface for programs that wrap the CLI, so existing
+// ones must not change meaning.
+type clientEvent struct {
+	Time      time.Time     `json:"time"`
+	Type      string        `json:"type"` // connected, login, transfer-start, progress, transfer-done, warning, error, or metrics
+	Host      string        `json:"host,omitempty"`
+	User      string        `json:"user,omitempty"`
+	Direction string        `json:"direction,omitempty"` // "download" or "upload"
+	Path      string        `json:"path,omitempty"`
+	Bytes     int64         `json:"bytes,omitempty"`
+	OK        *bool         `json:"ok,omitempty"`
+	Reply     string        `json:"reply,omitempty"`
+	Message   string        `json:"message,omitempty"`
+	Command   string        `json:"command,omitempty"`
+	Metrics   []verbMetrics `json:"metrics,omitempty"`
+}
+
+// eventStream writes clientEvents as JSONL. All methods are safe to call on
+// a nil stream, which emits nothing.
+type eventStream struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// openEventStream returns the stream selected by the -events and -events-fd
+// flags, or nil when neither is set.
+func openEventStream(spec string, fd int) (*eventStream, error) {
+	switch {
+	case fd > 0:
+		file := os.NewFile(uintptr(fd), fmt.Sprintf("events-fd-%d", fd))
+		if _, err := file.Stat(); err != nil {
+			return nil, fmt.Errorf("events fd %d is not open: %v", fd, err)
+		}
+		return &eventStream{enc: json.NewEncoder(file)}, nil
+	case spec == "stdout-jsonl":
+		return &eventStream{enc: json.NewEncoder(os.Stdout)}, nil
+	case spec != "":
+		return nil, fmt.Errorf("unknown events destination %q - expected stdout-jsonl", spec)
+	}
+	return nil, nil
+}
+
+func (s *eventStream) emit(event clientEvent) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	event.Time = time.Now()
+	s.enc.Encode(event)
+}
+
+func (s *eventStream) connected(host, welcome string) {
+	s.emit(clientEvent{Type: "connected", Host: host, Reply: strings.TrimSpace(welcome)})
+}
+
+func (s *eventStream) login(user string, err error) {
+	ok := err == nil
+	event := clientEvent{Type: "login", User: user, OK: &ok}
+	if err != nil {
+		event.Message = redact(err.Error())
+	}
+	s.emit(event)
+}
+
+// metrics reports each FTP verb's counts and reply latency histogram.
+func (s *eventStream) metrics(metrics []verbMetrics) {
+	s.emit(clientEvent{Type: "metrics", Metrics: metrics})
+}
+
+func (s *eventStream) warning(command, message string) {
+	s.emit(clientEvent{Type: "warning", Command: redact(command), Message: redact(message)})
+}
+
+func (s *eventStream) error(err error) {
+	s.emit(clientEvent{Type: "error", Message: redact(err.Error())})
+}
+
+// progressInterval is the least time between progress events for a transfer.
+const progressInterval = 500 * time.Millisecond
+
+// eventTransfer follows one file transfer from the server's preliminary
+// reply to its completion reply.
+type eventTransfer struct {
+	stream    *eventStream
+	direction string
+	path      string
+
+	mu           sync.Mutex
+	bytes        int64
+	lastProgress time.Time
+	failure      error // set when the client gave up on the transfer
+}
+
+// startTransfer emits transfer-start for a RETR, STOR, APPE, or STOU of path
+// that the server has accepted. Other commands return nil.
+func (s *eventStream) startTransfer(verb, path string) *eventTransfer {
+	if s == nil {
+		return nil
+	}
+	direction := ""
+	switch verb {
+	case "RETR":
+		direction = "download"
+	case "STOR", "APPE", "STOU":
+		direction = "upload"
+	default:
+		return nil
+	}
+	t := &eventTransfer{stream: s, direction: direction, path: path, lastProgress: time.Now()}
+	s.emit(clientEvent{Type: "transfer-start", Direction: direction, Path: path})
+	return t
+}
+
+func (t *eventTransfer) add(n int) {
+	if t == nil || n == 0 {
+		return
+	}
+	t.mu.Lock()
+	t.bytes += int64(n)
+	bytes := t.bytes
+	due := time.Since(t.lastProgress) >= progressInterval
+	if due {
+		t.lastProgress = time.Now()
+	}
+	t.mu.Unlock()
+	if due {
+		t.stream.emit(clientEvent{Type: "progress", Direction: t.direction, Path: t.path, Bytes: bytes})
+	}
+}
+
+// fail marks the transfer as failed on the client side, whatever the
+// server's completion reply says.
+func (t *eventTransfer) fail(err error) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.failure = err
+	t.mu.Unlock()
+}
+
+// done emits transfer-done once the completion reply resp has arrived, or
+// with an empty resp when the reply was never read.
+func (t *eventTransfer) done(resp string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	bytes, failure := t.bytes, t.failure
+	t.mu.Unlock()
+	ok := failure == nil && strings.HasPrefix(resp, "2")
+	event := clientEvent{Type: "transfer-done", Direction: t.direction, Path: t.path, Bytes: bytes, OK: &ok, Reply: strings.TrimSpace(resp)}
+	if failure != nil {
+		event.Message = redact(failure.Error())
+	}
+	t.stream.emit(event)
+}
+
+// eventConn reports the bytes moved over a data connection to a transfer.
+type eventConn struct {
+	net.Conn
+	transfer *eventTransfer
+}
+
+func (c eventConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.transfer.add(n)
+	return n, err
+}
+
+func (c eventConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.transfer.add(n)
+	return n, err
+}
+
+func (c eventConn) CloseWrite() error {
+	if hc, ok := c.Conn.(halfCloser); ok {
+		return hc.CloseWrite()
+	}
+	return nil
+}
+
+func (c eventConn) CloseRead() error {
+	if hc, ok := c.Conn.(halfCloser); ok {
+		return hc.CloseRead()
+	}
+	return nil
+}
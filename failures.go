@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// failureReport lists the items a bulk transfer couldn't move, written with
+// --report so that a script can see what failed and why, and read back by
+// get and put --retry-failed to try only those items again.
+type failureReport struct {
+	Command  string       `json:"command"`
+	Time     time.Time    `json:"time"`
+	Failures []failedItem `json:"failures"`
+
+	direction string // of the command's transfers, "get" or "put"
+	mu        sync.Mutex
+}
+
+// failedItem is one failed transfer. Target is empty where the command
+// derived it from Source, saving a download under its base name in the
+// current directory or an upload under its base name in the remote one.
+type failedItem struct {
+	Direction string `json:"direction"` // "get" or "put"
+	Source    string `json:"source"`
+	Target    string `json:"target,omitempty"`
+	Class     string `json:"class"`
+	Temporary bool   `json:"temporary"` // likely to succeed if retried later
+	Error     string `json:"error"`
+}
+
+func newFailureReport(command, direction string) *failureReport {
+	return &failureReport{Command: command, Time: time.Now(), Failures: []failedItem{}, direction: direction}
+}
+
+// add records a failure. It does nothing on a nil report, so callers needn't
+// check whether --report was given.
+func (r *failureReport) add(source, target string, err error) {
+	if r == nil {
+		return
+	}
+	class, temporary := classifyFailure(err)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Failures = append(r.Failures, failedItem{
+		Direction: r.direction,
+		Source:    source,
+		Target:    target,
+		Class:     class,
+		Temporary: temporary,
+		Error:     redact(err.Error()),
+	})
+}
+
+// write saves the report to name. A nil report writes nothing.
+func (r *failureReport) write(name string) error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(name, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write report %s: %v", name, err)
+	}
+	return nil
+}
+
+// readFailureReport loads a report and returns its items for direction.
+func readFailureReport(name, direction string) ([]failedItem, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read report %s: %v", name, err)
+	}
+	var report failureReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		return nil, fmt.Errorf("invalid report %s: %v", name, err)
+	}
+	var items []failedItem
+	others := 0
+	for _, item := range report.Failures {
+		if item.Direction == direction {
+			items = append(items, item)
+		} else {
+			others++
+		}
+	}
+	if len(items) == 0 && others > 0 {
+		other := "put"
+		if direction == "put" {
+			other = "get"
+		}
+		return nil, fmt.Errorf("%s lists failed %ss - retry them with %s --retry-failed", name, other, other)
+	}
+	return items, nil
+}
+
+// failureCodes classifies FTP reply codes. 4xx replies are transient by
+// definition; of the 5xx ones, only a full disk may clear up on its own.
+var failureCodes = map[string]struct {
+	class     string
+	temporary bool
+}{
+	"421": {"connection", true},
+	"425": {"connection", true},
+	"426": {"connection", true},
+	"450": {"busy", true},
+	"451": {"server", true},
+	"452": {"space", true},
+	"530": {"permission", false},
+	"532": {"permission", false},
+	"552": {"space", true},
+	"553": {"permission", false},
+}
+
+var replyCode = regexp.MustCompile(`\b([45]\d\d)[ -]`)
+
+// classifyFailure sorts a transfer error into permission, missing, timeout,
+// connection, busy, space, server, or other, and says whether it is likely
+// to be temporary. Most errors carry the server's reply as text, so the
+// reply code and message are what it goes by.
+func classifyFailure(err error) (string, bool) {
+	var netErr net.Error
+	switch {
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout", true
+	case errors.Is(err, os.ErrPermission):
+		return "permission", false
+	case errors.Is(err, os.ErrNotExist):
+		return "missing", false
+	}
+	text := strings.ToLower(err.Error())
+	switch {
+	case strings.Contains(text, "timeout") || strings.Contains(text, "timed out"):
+		return "timeout", true
+	case strings.Contains(text, "connection reset") || strings.Contains(text, "broken pipe") ||
+		strings.Contains(text, "connection refused") || strings.Contains(text, "eof"):
+		return "connection", true
+	}
+	code := ""
+	if m := replyCode.FindStringSubmatch(err.Error()); m != nil {
+		code = m[1]
+	}
+	if known, ok := failureCodes[code]; ok {
+		return known.class, known.temporary
+	}
+	switch {
+	case strings.Contains(text, "permission") || strings.Contains(text, "denied") || strings.Contains(text, "not allowed"):
+		return "permission", false
+	case strings.Contains(text, "no such") || strings.Contains(text, "not found") || strings.Contains(text, "does not exist"):
+		return "missing", false
+	case strings.HasPrefix(code, "4"):
+		return "server", true
+	}
+	return "other", false
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSession is a scripted FTPSession: it answers commands from canned
+// replies and serves data commands over in-memory connections, so command
+// handlers can be tested without a server.
+type fakeSession struct {
+	mu      sync.Mutex
+	replies map[string]string // by whole command, then by verb
+	files   map[string]string // what a download or listing sends, by whole command, e.g. "RETR a.txt"
+	uploads map[string]string // what an upload received, by whole command
+	ends    map[string]string // completion replies other than 226 Transfer complete, by whole command
+	sent    []string          // every command, in order
+	data    *fakeDataConn     // the client's end of the next data connection
+	done    chan struct{}     // closed when the server's end of a transfer has finished
+	closed  chan struct{}     // closed when the client's end of it has been shut down
+	end     string            // the completion reply of the transfer in progress
+	rest    int64             // where the next download starts, from an accepted REST
+	remote  *net.TCPAddr      // the server's address, if not 127.0.0.1:21
+}
+
+// fakeDefaults answer the commands a session sends on its own.
+var fakeDefaults = map[string]string{
+	"USER": "331 Password required",
+	"PASS": "230 Logged in",
+	"TYPE": "200 Type set",
+	"MODE": "200 Mode set",
+	"OPTS": "200 OK",
+	"NOOP": "200 OK",
+	"PASV": "227 Entering Passive Mode (127,0,0,1,4,1)",
+	"EPSV": "229 Entering Extended Passive Mode (|||1025|)",
+	"PWD":  `257 "/" is the current directory`,
+	"CWD":  "250 Directory changed",
+	"FEAT": "211 No features",
+	"QUIT": "221 Goodbye",
+}
+
+func newFakeSession() *fakeSession {
+	return &fakeSession{
+		replies: make(map[string]string),
+		files:   make(map[string]string),
+		uploads: make(map[string]string),
+		ends:    make(map[string]string),
+	}
+}
+
+// newFakeConnection returns a logged-in connection over s, and the buffer
+// its output goes to.
+func newFakeConnection(s *fakeSession) (*FTPConnection, *bytes.Buffer) {
+	f := newFTPConnection(s, "127.0.0.1:21", "user", "pass")
+	f.isAuthenticated = true
+	var out bytes.Buffer
+	f.stdout = &out
+	return &f, &out
+}
+
+// withFeatures makes the session's FEAT reply advertise features, given as
+// they appear in the reply, e.g. "MLSD" or "SIZE".
+func (s *fakeSession) withFeatures(features ...string) *fakeSession {
+	s.replies["FEAT"] = "211-Features:\r\n " + strings.Join(features, "\r\n ") + "\r\n211 End"
+	return s
+}
+
+func (s *fakeSession) sendCommand(cmd string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent = append(s.sent, cmd)
+	verb, _, _ := strings.Cut(cmd, " ")
+	verb = strings.ToUpper(verb)
+	if verb == "REST" {
+		return s.restart(cmd), nil
+	}
+	if resp, ok := s.replies[cmd]; ok {
+		return resp + "\r\n", nil
+	}
+	switch verb {
+	case "RETR", "LIST", "NLST", "MLSD", "STOR", "APPE", "STOU":
+		return s.startTransfer(cmd, verb), nil
+	}
+	if resp, ok := s.replies[verb]; ok {
+		return resp + "\r\n", nil
+	}
+	if resp, ok := fakeDefaults[verb]; ok {
+		return resp + "\r\n", nil
+	}
+	return "502 " + verb + " not implemented\r\n", nil
+}
+
+// restart answers REST from the replies, by whole command and then by verb,
+// and remembers the offset if the reply accepts it.
+func (s *fakeSession) restart(cmd string) string {
+	resp, ok := s.replies[cmd]
+	if !ok {
+		resp, ok = s.replies["REST"]
+	}
+	if !ok {
+		return "502 REST not implemented\r\n"
+	}
+	if strings.HasPrefix(resp, "350") {
+		s.rest, _ = strconv.ParseInt(strings.TrimSpace(strings.TrimPrefix(cmd, "REST")), 10, 64)
+	}
+	return resp + "\r\n"
+}
+
+// startTransfer sets up the data connection for a data command, replying
+// 550 to a download or listing it has no data for.
+func (s *fakeSession) startTransfer(cmd, verb string) string {
+	upload := verb == "STOR" || verb == "APPE" || verb == "STOU"
+	content, ok := s.files[cmd]
+	if !ok && !upload {
+		return "550 " + cmd + ": no such file or directory\r\n"
+	}
+	if !upload {
+		content = content[min(int(s.rest), len(content)):]
+	}
+	s.rest = 0
+	toClient, serverOut := io.Pipe()
+	serverIn, fromClient := io.Pipe()
+	s.data = &fakeDataConn{r: toClient, w: fromClient, closed: make(chan struct{})}
+	s.closed = s.data.closed
+	done := make(chan struct{})
+	s.done = done
+	s.end = "226 Transfer complete"
+	if end, ok := s.ends[cmd]; ok {
+		s.end = end
+	}
+	go func() {
+		defer close(done)
+		if upload {
+			serverOut.Close()
+			received, _ := io.ReadAll(serverIn)
+			s.mu.Lock()
+			s.uploads[cmd] = string(received)
+			s.mu.Unlock()
+			return
+		}
+		serverIn.Close()
+		io.WriteString(serverOut, content)
+		serverOut.Close()
+	}()
+	return "150 Opening data connection\r\n"
+}
+
+// readResponse gives the completion reply of the transfer in progress, once
+// both ends of it have finished, as a server sends it after the data.
+func (s *fakeSession) readResponse() (string, error) {
+	s.mu.Lock()
+	done, closed, end := s.done, s.closed, s.end
+	s.done = nil
+	s.mu.Unlock()
+	if done == nil {
+		return "", errors.New("fake session: no reply pending")
+	}
+	<-done
+	<-closed
+	return end + "\r\n", nil
+}
+
+func (s *fakeSession) setReplyTimeout(time.Duration) {}
+
+func (s *fakeSession) openDataConn(string, net.Listener) (net.Conn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	conn := s.data
+	s.data = nil
+	if conn == nil {
+		return nil, errors.New("fake session: no data connection set up")
+	}
+	return conn, nil
+}
+
+func (s *fakeSession) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50000}
+}
+
+func (s *fakeSession) RemoteAddr() net.Addr {
+	if s.remote != nil {
+		return s.remote
+	}
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 21}
+}
+
+func (s *fakeSession) Close() error { return nil }
+
+// sentCommands returns the commands sent so far.
+func (s *fakeSession) sentCommands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.sent...)
+}
+
+// fakeDataConn is the client's end of an in-memory data connection. It can
+// be shut down one direction at a time, as a TCP connection can.
+type fakeDataConn struct {
+	r      *io.PipeReader // from the server
+	w      *io.PipeWriter // to the server
+	closed chan struct{}  // closed once the reading side is shut down
+	once   sync.Once
+}
+
+func (c *fakeDataConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c *fakeDataConn) Write(p []byte) (int, error) { return c.w.Write(p) }
+func (c *fakeDataConn) CloseWrite() error           { return c.w.Close() }
+
+func (c *fakeDataConn) CloseRead() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.r.Close()
+}
+
+func (c *fakeDataConn) Close() error {
+	c.w.Close()
+	return c.CloseRead()
+}
+
+func (c *fakeDataConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50001}
+}
+
+func (c *fakeDataConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1025}
+}
+
+func (c *fakeDataConn) SetDeadline(time.Time) error      { return nil }
+func (c *fakeDataConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *fakeDataConn) SetWriteDeadline(time.Time) error { return nil }
+
+func TestFakeSessionUpload(t *testing.T) {
+	s := newFakeSession()
+	f, _ := newFakeConnection(s)
+	if _, err := f.prepareData(); err != nil {
+		t.Fatal(err)
+	}
+	err := f.transfer("STOR up.txt", func(conn net.Conn) error {
+		_, err := io.WriteString(conn, "uploaded")
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.uploads["STOR up.txt"]; got != "uploaded" {
+		t.Errorf("server received %q, want %q", got, "uploaded")
+	}
+}
@@ -2,17 +2,25 @@ package main
 
 import (
 	"bufio"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
-	"net"
 	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"text/tabwriter"
 	"time"
 )
 
 type ProgressReader struct {
 	io.Reader
+	out   Renderer
 	total int64
 	read  int64
 }
@@ -20,13 +28,20 @@ type ProgressReader struct {
 func (pr *ProgressReader) Read(p []byte) (int, error) {
 	n, err := pr.Reader.Read(p)
 	pr.read += int64(n)
-	percentage := (float64(pr.read) / float64(pr.total)) * 100
-	fmt.Printf("\rProgress: %d/%d bytes (%.1f%%)", pr.read, pr.total, percentage)
+	pr.out.Progress(pr.read, pr.total)
 	// added small delay to observe file update progres
 	time.Sleep(time.Millisecond)
 	return n, err
 }
 
+// errQuit is returned by a handler to end the session; the REPL then runs
+// the shutdown sequence.
+var errQuit = errors.New("quit requested")
+
+// errSkipped reports a transfer deliberately not performed, such as a
+// download whose target exists under the "skip" clobber policy.
+var errSkipped = errors.New("target exists")
+
 func isSuccessResponse(response string) bool {
 	return len(response) > 0 && strings.HasPrefix(response, "2")
 }
@@ -38,31 +53,62 @@ func requireAuth(conn *FTPConnection) error {
 	return nil
 }
 
-func handleAuthenticate(conn *FTPConnection, args []string) error {
-	cmd := fmt.Sprintf("USER %s", conn.user)
-	resp, err := conn.sendCommand(cmd)
-	if err != nil {
-		return err
-	}
-	fmt.Print(resp)
+// stringList is a flag value that may be repeated, collecting every value.
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
 
-	if !strings.HasPrefix(resp, "331") {
-		return fmt.Errorf("USER command failed: %s", strings.TrimSpace(resp))
+// newCommandFlags returns a flag set for parsing the options of a REPL command.
+func newCommandFlags(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	return fs
+}
+
+// parseCommandFlags parses options found anywhere among args and returns the
+// positional arguments in order.
+func parseCommandFlags(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
 	}
+}
 
-	cmd = fmt.Sprintf("PASS %s", conn.pass)
-	resp, err = conn.sendCommand(cmd)
+func handleAuthenticate(conn *FTPConnection, args []string) error {
+	resp, err := conn.login()
+	conn.events.login(conn.user, err)
 	if err != nil {
 		return err
 	}
+	conn.out().Reply(resp)
+	conn.identifyFromStat()
+	conn.identifyClient()
+	conn.startKeepAlive()
+	return conn.runInitCommands()
+}
 
-	if !isSuccessResponse(resp) {
-		return fmt.Errorf("PASS command failed: %s", strings.TrimSpace(resp))
+func handleAnonymous(conn *FTPConnection, args []string) error {
+	conn.user, conn.pass = "anonymous", ""
+	if len(args) > 0 {
+		conn.pass = args[0]
 	}
-	fmt.Print(resp)
-	conn.isAuthenticated = true
-	conn.startKeepAlive()
-	return nil
+	conn.isAuthenticated = false
+	return handleAuthenticate(conn, nil)
 }
 
 func handlePWD(conn *FTPConnection, args []string) error {
@@ -78,7 +124,7 @@ func handlePWD(conn *FTPConnection, args []string) error {
 		return fmt.Errorf("PWD failed: %s", strings.TrimSpace(resp))
 	}
 
-	fmt.Print(resp)
+	conn.out().Reply(resp)
 	return nil
 }
 
@@ -87,19 +133,11 @@ func handlePasv(conn *FTPConnection, args []string) error {
 		return err
 	}
 
-	resp, err := conn.sendCommand("PASV")
+	resp, err := conn.enterPassive()
 	if err != nil {
 		return err
 	}
-	if !isSuccessResponse(resp) {
-		return fmt.Errorf("PASV failed: %s", strings.TrimSpace(resp))
-	}
-	addr, err := parseAddr(resp)
-	if err != nil {
-		return err
-	}
-	conn.dataAddr = addr
-	fmt.Print(resp)
+	conn.out().Reply(resp)
 	return nil
 }
 
@@ -108,19 +146,38 @@ func handleEpsv(conn *FTPConnection, args []string) error {
 		return err
 	}
 
-	resp, err := conn.sendCommand("EPSV")
+	if conn.settings.workarounds.brokenEPSV || conn.server.brokenEPSV() {
+		if !conn.settings.workarounds.brokenEPSV {
+			reason := conn.server.software + " " + conn.server.version + " is known to advertise unreachable EPSV ports"
+			if !conn.learnWorkaround("broken-epsv", reason) {
+				conn.out().Warn("%s - using PASV instead", reason)
+			}
+		}
+		resp, err := conn.enterPassive()
+		if err != nil {
+			return err
+		}
+		conn.out().Reply(resp)
+		return nil
+	}
+	resp, err := conn.enterExtendedPassive()
 	if err != nil {
 		return err
 	}
-	if !isSuccessResponse(resp) {
-		return fmt.Errorf("EPSV failed: %s", strings.TrimSpace(resp))
+	conn.out().Reply(resp)
+	return nil
+}
+
+func handlePort(conn *FTPConnection, args []string) error {
+	if err := requireAuth(conn); err != nil {
+		return err
 	}
-	addr, err := conn.parseEPSVAddr(resp)
+
+	resp, err := conn.enterActive()
 	if err != nil {
 		return err
 	}
-	conn.dataAddr = addr
-	fmt.Print(resp)
+	conn.out().Reply(resp)
 	return nil
 }
 
@@ -129,8 +186,8 @@ func handleList(conn *FTPConnection, args []string) error {
 		return err
 	}
 
-	if conn.dataAddr == "" {
-		return fmt.Errorf("no data connection available - run 'pasv' command first")
+	if !conn.hasDataConn() {
+		return fmt.Errorf("no data connection available - run 'pasv' or 'port' command first")
 	}
 
 	listCmd := "LIST"
@@ -146,46 +203,171 @@ func handleList(conn *FTPConnection, args []string) error {
 	if !strings.HasPrefix(resp, "150") {
 		return fmt.Errorf("LIST failed: %s", strings.TrimSpace(resp))
 	}
-	fmt.Print(resp)
+	conn.out().Reply(resp)
 
-	dataConn, err := net.Dial("tcp", conn.dataAddr)
+	dataConn, err := conn.openDataConn()
 	if err != nil {
-		return fmt.Errorf("failed to connect to data port: %v", err)
+		return err
 	}
 	defer dataConn.Close()
+	pending := conn.awaitCompletion(dataConn)
 
-	scanner := bufio.NewScanner(dataConn)
+	counted := &countingConn{Conn: dataConn}
+	scanner := bufio.NewScanner(counted)
 	for scanner.Scan() {
-		fmt.Println(scanner.Text())
+		conn.out().Line(conn.fromServer(scanner.Text()))
 	}
 
 	if err := scanner.Err(); err != nil {
-		return fmt.Errorf("error reading directory listing: %v", err)
+		return pending.abort(fmt.Errorf("error reading directory listing: %v", err))
 	}
+	conn.recorder.transfer("LIST", counted.n)
 
-	if tcpConn, ok := dataConn.(*net.TCPConn); ok {
+	if tcpConn, ok := dataConn.(halfCloser); ok {
 		tcpConn.CloseWrite()
 		tcpConn.CloseRead()
 	}
 
-	resp, err = conn.readResponse()
+	resp, err = pending.wait()
 	if err != nil {
 		return err
 	}
 
 	if !strings.HasPrefix(resp, "226") {
 		if strings.HasPrefix(resp, "426") {
-			fmt.Printf("WARNING - transfer complete, but data connection didn't close gracefully\n")
+			conn.out().Warn("transfer complete, but data connection didn't close gracefully")
 			return nil
 		} else {
 			return fmt.Errorf("transfer did not complete successfully: %s", strings.TrimSpace(resp))
 		}
 	}
-	fmt.Print(resp)
+	conn.out().Reply(resp)
 
 	return nil
 }
 
+func handleLs(conn *FTPConnection, args []string) error {
+	if err := requireAuth(conn); err != nil {
+		return err
+	}
+
+	fs := newCommandFlags("ls")
+	format := fs.String("format", "plain", "output format: plain, csv, or tsv")
+	refresh := fs.Bool("refresh", false, "fetch the listing again instead of using the cached one")
+	since := fs.String("since", "", "only list entries modified within this long, e.g. 24h or 7d")
+	match := fs.String("match", "", "only list names matching this glob, narrowed by the server where it can")
+	stream := fs.Bool("stream", false, "show entries as they arrive instead of caching the listing")
+	short := fs.Bool("short", false, "list names only, in columns on a terminal")
+	onePerLine := fs.Bool("1", false, "list names only, one per line")
+	long := fs.Bool("l", false, "long listing (the default)")
+	positional, err := parseCommandFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if *long && (*short || *onePerLine) {
+		return fmt.Errorf("-l can't be combined with --short or -1")
+	}
+	if (*short || *onePerLine) && *format != "plain" {
+		return fmt.Errorf("--short and -1 list names only and can't be combined with --format %s", *format)
+	}
+	dir := ""
+	if len(positional) > 0 {
+		dir = positional[0]
+	}
+
+	if *match != "" || *stream {
+		// streamed names can't be laid out in columns, which need them all
+		return streamLs(conn, dir, *match, *since, *format, *short || *onePerLine)
+	}
+	if *refresh {
+		delete(conn.listings, dir)
+	}
+	entries, err := conn.listDir(dir)
+	if err != nil {
+		return err
+	}
+	if *since != "" {
+		age, err := parseAge(*since)
+		if err != nil {
+			return err
+		}
+		cutoff := time.Now().Add(-age)
+		paths := make([]string, len(entries))
+		for i, entry := range entries {
+			paths[i] = joinRemote(dir, entry.name)
+		}
+		var recent []RemoteEntry
+		for i, t := range conn.modTimesOf(paths, entries) {
+			if !t.IsZero() && !t.Before(cutoff) {
+				recent = append(recent, entries[i])
+			}
+		}
+		entries = recent
+	}
+	if *short || *onePerLine {
+		// like GNU ls, columns only when a person is reading
+		width := 0
+		if *short && !*onePerLine && conn.stdout == nil && stdoutIsTerminal() {
+			width = terminalWidth()
+		}
+		renderColumns(conn.output(), entries, width)
+		return nil
+	}
+	return renderListing(conn.output(), entries, *format, conn.settings.timeFormat)
+}
+
+// Streamed listings reach the terminal in chunks of listingChunk entries, or
+// whatever arrived in listingFlushInterval if that is fewer, so a huge
+// directory shows steady progress without a write per line.
+const (
+	listingChunk         = 500
+	listingFlushInterval = 200 * time.Millisecond
+)
+
+// streamLs implements ls --stream and --match: entries are rendered as the
+// server sends them rather than after the whole listing is in.
+func streamLs(conn *FTPConnection, dir, match, since, format string, namesOnly bool) error {
+	var cutoff time.Time
+	if since != "" {
+		age, err := parseAge(since)
+		if err != nil {
+			return err
+		}
+		cutoff = time.Now().Add(-age)
+	}
+	out := bufio.NewWriter(conn.output())
+	lw, err := newListingWriter(out, format, conn.settings.timeFormat)
+	if err != nil {
+		return err
+	}
+	lw.namesOnly = namesOnly
+	shown, flushed := 0, time.Now()
+	emit := func(entry RemoteEntry) {
+		if !cutoff.IsZero() {
+			if t, ok := conn.modTimeOf(joinRemote(dir, entry.name), entry); !ok || t.Before(cutoff) {
+				return
+			}
+		}
+		lw.write(entry)
+		shown++
+		if shown%listingChunk == 0 || time.Since(flushed) >= listingFlushInterval {
+			lw.flush()
+			out.Flush()
+			flushed = time.Now()
+		}
+	}
+	if match != "" {
+		err = conn.listMatching(dir, match, emit)
+	} else {
+		err = conn.streamListing(dir, emit)
+	}
+	if flushErr := lw.flush(); err == nil {
+		err = flushErr
+	}
+	out.Flush()
+	return err
+}
+
 func handleStor(conn *FTPConnection, args []string) error {
 	if len(args) < 1 {
 		return fmt.Errorf("must provide filename to upload")
@@ -193,8 +375,8 @@ func handleStor(conn *FTPConnection, args []string) error {
 	if err := requireAuth(conn); err != nil {
 		return err
 	}
-	if conn.dataAddr == "" {
-		return fmt.Errorf("no data connection avaialable - run 'pasv' command first")
+	if !conn.hasDataConn() {
+		return fmt.Errorf("no data connection available - run 'pasv' or 'port' command first")
 	}
 
 	filename := args[0]
@@ -205,6 +387,15 @@ func handleStor(conn *FTPConnection, args []string) error {
 	}
 	defer file.Close()
 
+	sample := make([]byte, binarySampleSize)
+	sampled, _ := io.ReadFull(file, sample)
+	if err := conn.checkASCIIUpload(filename, sample[:sampled]); err != nil {
+		return err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
 	resp, err := conn.sendCommand(fmt.Sprintf("STOR %s", filename))
 	if err != nil {
 		return err
@@ -213,48 +404,52 @@ func handleStor(conn *FTPConnection, args []string) error {
 	if !strings.HasPrefix(resp, "150") {
 		return fmt.Errorf("STOR failed: %s", strings.TrimSpace(resp))
 	}
-	fmt.Print(resp)
+	conn.out().Reply(resp)
 
-	dataConn, err := net.Dial("tcp", conn.dataAddr)
+	dataConn, err := conn.openDataConn()
 	if err != nil {
-		return fmt.Errorf("failed to connect to data port: %v", err)
+		return err
 	}
+	pending := conn.awaitCompletion(dataConn)
 	fileInfo, _ := file.Stat()
 	totalSize := fileInfo.Size()
 
 	progressReader := &ProgressReader{
 		Reader: file,
+		out:    conn.out(),
 		total:  totalSize,
 	}
 
+	start := time.Now()
 	n, err := io.Copy(dataConn, progressReader)
 	if err != nil {
-		return fmt.Errorf("failed to upload file: %v", err)
+		return pending.abort(fmt.Errorf("failed to upload file: %v", err))
 	}
 	if totalSize > 0 {
-		//print a new line if transfer was successful
-		fmt.Println()
+		progressReader.out.EndProgress()
 	}
-	fmt.Printf("Uploaded %s (%d bytes)\n", filename, n)
-	if tcpConn, ok := dataConn.(*net.TCPConn); ok {
+	conn.out().Info("Uploaded %s (%s)", filename, transferSummary(n, time.Since(start)))
+	conn.recorder.transfer("STOR", n)
+	if tcpConn, ok := dataConn.(halfCloser); ok {
 		tcpConn.CloseWrite()
 		tcpConn.CloseRead()
 	}
 
-	resp, err = conn.readResponse()
+	resp, err = pending.wait()
 	if err != nil {
 		return err
 	}
 
 	if !strings.HasPrefix(resp, "226") {
 		if strings.HasPrefix(resp, "426") {
-			fmt.Printf("WARNING - transfer complete, but data connection didn't close gracefully\n")
+			conn.out().Warn("transfer complete, but data connection didn't close gracefully")
 			return nil
 		} else {
 			return fmt.Errorf("transfer did not complete successfully: %s", strings.TrimSpace(resp))
 		}
 	}
-	fmt.Print(resp)
+	conn.checkTransferStats(resp, n)
+	conn.out().Reply(resp)
 	return nil
 }
 
@@ -263,17 +458,41 @@ func (conn *FTPConnection) getFileSize(filename string) (int64, error) {
 	if err != nil {
 		return 0, err
 	}
+	return parseSizeReply(resp)
+}
 
+// parseSizeReply reads the size from a reply to SIZE.
+func parseSizeReply(resp string) (int64, error) {
 	if strings.HasPrefix(resp, "213") {
 		parts := strings.Fields(resp)
 		if len(parts) >= 2 {
 			return strconv.ParseInt(parts[1], 10, 64)
 		}
 	}
-
 	return 0, fmt.Errorf("could not determine file size")
 }
 
+// getModTime returns the modification time of a remote file using MDTM
+// (RFC 3659), which reports UTC.
+func (conn *FTPConnection) getModTime(filename string) (time.Time, error) {
+	resp, err := conn.sendCommand(fmt.Sprintf("MDTM %s", filename))
+	if err != nil {
+		return time.Time{}, err
+	}
+	return parseMDTMReply(resp)
+}
+
+// parseMDTMReply reads the modification time from a reply to MDTM.
+func parseMDTMReply(resp string) (time.Time, error) {
+	if strings.HasPrefix(resp, "213") {
+		parts := strings.Fields(resp)
+		if len(parts) >= 2 {
+			return parseMLSDTime(parts[1])
+		}
+	}
+	return time.Time{}, fmt.Errorf("could not determine modification time")
+}
+
 func handleSize(conn *FTPConnection, args []string) error {
 	if len(args) < 1 {
 		return fmt.Errorf("must provide a filename")
@@ -281,9 +500,6 @@ func handleSize(conn *FTPConnection, args []string) error {
 	if err := requireAuth(conn); err != nil {
 		return err
 	}
-	if conn.dataAddr == "" {
-		return fmt.Errorf("no data connection avaialable - run 'pasv' command first")
-	}
 	cmd := fmt.Sprintf("SIZE %s", args[0])
 	resp, err := conn.sendCommand(cmd)
 	if err != nil {
@@ -293,9 +509,9 @@ func handleSize(conn *FTPConnection, args []string) error {
 	if strings.HasPrefix(resp, "213") {
 		parts := strings.Fields(resp)
 		if len(parts) >= 2 {
-			fmt.Printf("File size: %s bytes\n", parts[1])
+			conn.out().Info("File size: %s bytes", parts[1])
 		}
-		fmt.Print(resp)
+		conn.out().Reply(resp)
 	} else {
 		return fmt.Errorf("SIZE failed: %s", strings.TrimSpace(resp))
 	}
@@ -303,6 +519,21 @@ func handleSize(conn *FTPConnection, args []string) error {
 	return nil
 }
 
+func handleMdtm(conn *FTPConnection, args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("must provide a filename")
+	}
+	if err := requireAuth(conn); err != nil {
+		return err
+	}
+	t, err := conn.remoteModTime(args[0])
+	if err != nil {
+		return fmt.Errorf("MDTM failed: %v", err)
+	}
+	conn.out().Field("Modified", formatTime(t, conn.settings.timeFormat))
+	return nil
+}
+
 func handleDele(conn *FTPConnection, args []string) error {
 	if len(args) < 1 {
 		return fmt.Errorf("must provide the filepath of the file you want to delete")
@@ -321,7 +552,7 @@ func handleDele(conn *FTPConnection, args []string) error {
 	if !strings.HasPrefix(resp, "250") {
 		return fmt.Errorf("DELE failed: %s", strings.TrimSpace(resp))
 	}
-	fmt.Print(resp)
+	conn.out().Reply(resp)
 	return nil
 }
 
@@ -332,13 +563,20 @@ func handleRetr(conn *FTPConnection, args []string) error {
 	if err := requireAuth(conn); err != nil {
 		return err
 	}
-	if conn.dataAddr == "" {
-		return fmt.Errorf("no data connection avaialable - run 'pasv' command first")
+	if !conn.hasDataConn() {
+		return fmt.Errorf("no data connection available - run 'pasv' or 'port' command first")
 	}
 	filename := args[0]
-	totalSize, err := conn.getFileSize(filename)
+	local, err := conn.localTarget(filename)
+	if errors.Is(err, errSkipped) {
+		conn.out().Info("Skipped %s: %v", filename, err)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	totalSize, err := conn.remoteSize(filename)
 	if err != nil {
-		fmt.Printf("Warning: could not get file size - %v\n", err)
+		conn.out().Warn("could not get file size - %v", err)
 		totalSize = 0
 	}
 	cmd := fmt.Sprintf("RETR %s", args[0])
@@ -349,147 +587,2066 @@ func handleRetr(conn *FTPConnection, args []string) error {
 	if !strings.HasPrefix(resp, "150") {
 		return fmt.Errorf("RETR failed: %s", strings.TrimSpace(resp))
 	}
-	fmt.Print(resp)
+	conn.out().Reply(resp)
 
-	dataConn, err := net.Dial("tcp", conn.dataAddr)
+	dataConn, err := conn.openDataConn()
 	if err != nil {
-		return fmt.Errorf("failed to connect to data port: %v", err)
+		return err
 	}
 	defer dataConn.Close()
+	pending := conn.awaitCompletion(dataConn)
 
-	file, err := os.Create(filename)
+	// as with get, the data goes to local.part until the server confirms
+	// the transfer, and one that stops short keeps it for resuming
+	part := local + ".part"
+	file, err := os.Create(part)
 	if err != nil {
-		return fmt.Errorf("failed to create file %s: %v", filename, err)
+		return pending.abort(fmt.Errorf("failed to create file %s: %v", part, err))
 	}
 	defer file.Close()
 
 	progressReader := &ProgressReader{
 		Reader: dataConn,
+		out:    conn.out(),
 		total:  totalSize,
 	}
+	start := time.Now()
 	n, err := io.Copy(file, progressReader)
 	if err != nil {
-		return fmt.Errorf("failed to write file: %v", err)
+		return pending.abort(fmt.Errorf("failed to write file: %v - partial data kept in %s", err, part))
 	}
 	if totalSize > 0 {
-		//print a new line if transfer was successful
-		fmt.Println()
+		progressReader.out.EndProgress()
+	}
+	if totalSize > 0 && n < totalSize && conn.serverType != "A" {
+		return pending.abort(fmt.Errorf("download of %s is truncated: %d of %d bytes arrived - partial data kept in %s", filename, n, totalSize, part))
 	}
 
-	fmt.Printf("Downloaded %s (%d bytes)\n", filename, n)
-	if tcpConn, ok := dataConn.(*net.TCPConn); ok {
+	conn.recorder.transfer("RETR", n)
+	if tcpConn, ok := dataConn.(halfCloser); ok {
 		tcpConn.CloseWrite()
 		tcpConn.CloseRead()
 	}
 
-	resp, err = conn.readResponse()
+	resp, err = pending.wait()
 	if err != nil {
+		return fmt.Errorf("%w - partial data kept in %s", err, part)
+	}
+	if !strings.HasPrefix(resp, "226") && !strings.HasPrefix(resp, "426") {
+		return fmt.Errorf("transfer did not complete successfully: %s - partial data kept in %s", strings.TrimSpace(resp), part)
+	}
+	file.Close()
+	if err := os.Rename(part, local); err != nil {
+		return fmt.Errorf("failed to move %s into place: %v", part, err)
+	}
+	conn.out().Info("Downloaded %s (%s)", local, transferSummary(n, time.Since(start)))
+	if strings.HasPrefix(resp, "426") {
+		conn.out().Warn("transfer complete, but data connection didn't close gracefully")
+		return nil
+	}
+	conn.checkTransferStats(resp, n)
+	conn.out().Reply(resp)
+	return nil
+}
+
+func handleMirror(conn *FTPConnection, args []string) error {
+	if err := requireAuth(conn); err != nil {
 		return err
 	}
 
-	if !strings.HasPrefix(resp, "226") {
-		if strings.HasPrefix(resp, "426") {
-			fmt.Printf("WARNING - transfer complete, but data connection didn't close gracefully\n")
-			return nil
-		} else {
-			return fmt.Errorf("transfer did not complete successfully: %s", strings.TrimSpace(resp))
+	opts := mirrorOptions{caseFold: conn.settings.caseFold}
+	fs := newCommandFlags("mirror")
+	fs.BoolVar(&opts.reverse, "reverse", false, "upload local tree to the server")
+	fs.BoolVar(&opts.reverse, "R", false, "alias for --reverse")
+	fs.BoolVar(&opts.onlyNewer, "only-newer", false, "transfer only files newer than the target")
+	fs.BoolVar(&opts.onlyNewer, "n", false, "alias for --only-newer")
+	fs.BoolVar(&opts.onlyMissing, "only-missing", false, "transfer only files the target doesn't have, replacing none")
+	fs.BoolVar(&opts.onlyExisting, "only-existing", false, "update only files the target already has, adding none")
+	opts.limit.addFlags(fs)
+	reportFile := fs.String("report", "", "write the files that fail, with error classes, to this JSON file")
+	fs.BoolVar(&opts.delete, "delete", false, "delete target files missing from the source")
+	fs.BoolVar(&opts.delete, "e", false, "alias for --delete")
+	fs.IntVar(&opts.parallel, "parallel", 1, "number of files to transfer at once")
+	fs.IntVar(&opts.parallel, "P", 1, "alias for --parallel")
+	fs.Var(&opts.excludes, "exclude-glob", "skip names matching the glob")
+	fs.Var(&opts.excludes, "X", "alias for --exclude-glob")
+	fs.StringVar(&opts.links, "links", "skip", "symlink policy: skip, follow, or recreate")
+	fs.BoolVar(&opts.checksums, "checksum-db", false, "with -R, remember uploaded files' checksums to skip unchanged ones")
+	fs.BoolVar(&opts.calibrate, "calibrate", false, "measure the server's clock skew with a temporary upload and correct times by it")
+	fs.StringVar(&opts.compare, "compare", "size-time", "how to tell a changed file: size-time, or hash for servers with unreliable timestamps")
+	opts.hashMaxSize = 64 << 20
+	fs.Func("hash-max-size", "with --compare hash, compare larger files by size and time (default 64M)", func(value string) error {
+		n, err := parseByteSize(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid size %q - expected bytes such as 64M", value)
+		}
+		opts.hashMaxSize = n
+		return nil
+	})
+	fs.BoolVar(&opts.dryRun, "dry-run", false, "show what would be transferred and deleted, and stop")
+	fs.BoolVar(&opts.yes, "yes", false, "carry out the plan without asking")
+	fs.BoolVar(&opts.yes, "y", false, "alias for --yes")
+	fs.BoolVar(&opts.verbose, "verbose", false, "say how the plan was worked out")
+	fs.BoolVar(&opts.verbose, "v", false, "alias for --verbose")
+	var nameSpecs stringList
+	fs.Var(&nameSpecs, "name-rule", "rename files on the way; repeatable")
+	var jobLimit *rateLimit
+	addRateFlag(fs, &jobLimit)
+	positional, err := parseCommandFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if opts.renames, err = parseNameRules(nameSpecs); err != nil {
+		return err
+	}
+	conn.jobLimit = jobLimit
+	defer func() { conn.jobLimit = nil }()
+	switch opts.links {
+	case "skip", "follow", "recreate":
+	default:
+		return fmt.Errorf("invalid --links policy %q - expected skip, follow, or recreate", opts.links)
+	}
+	if opts.onlyMissing && opts.onlyExisting {
+		return fmt.Errorf("--only-missing and --only-existing can't be combined")
+	}
+	switch opts.compare {
+	case "size-time", "hash":
+	default:
+		return fmt.Errorf("invalid --compare mode %q - expected size-time or hash", opts.compare)
+	}
+	if opts.compare == "hash" && opts.onlyNewer {
+		return fmt.Errorf("--only-newer compares times, so it can't be combined with --compare hash")
+	}
+	if len(positional) < 1 {
+		return fmt.Errorf("must provide a source directory")
+	}
+	if opts.parallel < 1 {
+		opts.parallel = 1
+	}
+
+	source := positional[0]
+	target := path.Base(source)
+	if opts.reverse {
+		target = localBase(source)
+	}
+	if len(positional) > 1 {
+		target = positional[1]
+	} else if target == "/" || target == "" {
+		target = "."
+	}
+
+	if *reportFile != "" {
+		direction := "get"
+		if opts.reverse {
+			direction = "put"
 		}
+		opts.report = newFailureReport("mirror", direction)
 	}
-	fmt.Print(resp)
-	return nil
-}
 
-func handleStat(conn *FTPConnection, args []string) error {
-	// TODO: handle arguments (acts like list)
-	cmd := "STAT"
-	if len(args) > 0 {
-		cmd = fmt.Sprintf("STAT %s", strings.Join(args, " "))
+	var stats mirrorStats
+	if opts.reverse {
+		stats, err = conn.mirrorUp(source, target, opts)
+	} else {
+		stats, err = conn.mirrorDown(source, target, opts)
+	}
+	if errors.Is(err, errMirrorNotRun) {
+		return nil
+	}
+	conn.out().Info("Mirror: %d transferred (%d bytes), %d skipped, %d deleted, %d failed",
+		stats.transferred, stats.bytes, stats.skipped, stats.deleted, stats.failed)
+	if stats.deferred > 0 {
+		conn.out().Info("Batch limit reached: %d files left for the next run", stats.deferred)
+	}
+	if writeErr := opts.report.write(*reportFile); err == nil {
+		err = writeErr
 	}
-	resp, err := conn.sendCommand(cmd)
 	if err != nil {
 		return err
 	}
-	if !isSuccessResponse(resp) {
-		return fmt.Errorf("STAT failed: %s", strings.TrimSpace(resp))
+	if stats.failed > 0 {
+		return fmt.Errorf("%d of %d transfers failed", stats.failed, stats.failed+stats.transferred)
 	}
-	fmt.Print(resp)
 	return nil
 }
 
-func handleCdup(conn *FTPConnection, args []string) error {
+func handleCalibrate(conn *FTPConnection, args []string) error {
 	if err := requireAuth(conn); err != nil {
 		return err
 	}
+	dir := ""
+	if len(args) > 0 {
+		dir = args[0]
+	}
+	skew, err := conn.calibrateClock(dir)
+	if err != nil {
+		return fmt.Errorf("calibration failed: %v", err)
+	}
+	conn.skew = skew
+	conn.out().Field("Server clock", signedDuration(skew.clock))
+	conn.out().Field("LIST times", signedDuration(skew.zone))
+	return nil
+}
 
-	resp, err := conn.sendCommand("CDUP")
+func handleQuota(conn *FTPConnection, args []string) error {
+	if err := requireAuth(conn); err != nil {
+		return err
+	}
+	dir := ""
+	if len(args) > 0 {
+		dir = args[0]
+	}
+	figures, err := conn.remoteQuota(dir)
 	if err != nil {
 		return err
 	}
-	if !isSuccessResponse(resp) {
-		return fmt.Errorf("CDUP failed: %s", strings.TrimSpace(resp))
+	for _, figure := range figures {
+		conn.out().Field(figure.name, figure.value)
 	}
-	fmt.Print(resp)
-
 	return nil
 }
 
-func handleCWD(conn *FTPConnection, args []string) error {
-	if err := requireAuth(conn); err != nil {
-		return err
+// maxRenames caps the name.1, name.2, ... candidates the rename clobber
+// policies try before giving up.
+const maxRenames = 1000
+
+// localTarget applies the clobber policy to a download destination. Under
+// "rename" an existing file is kept and the next free name.1, name.2, ...
+// is returned instead; under "skip" errSkipped is returned.
+func (conn *FTPConnection) localTarget(local string) (string, error) {
+	local = longPath(local)
+	if _, err := os.Stat(local); os.IsNotExist(err) {
+		return local, nil
+	} else if err != nil {
+		return "", err
+	}
+
+	switch conn.settings.clobber {
+	case "skip":
+		return "", errSkipped
+	case "rename":
+		for i := 1; i <= maxRenames; i++ {
+			candidate := fmt.Sprintf("%s.%d", local, i)
+			_, err := os.Stat(candidate)
+			if os.IsNotExist(err) {
+				conn.out().Info("%s exists, saving as %s", local, candidate)
+				return candidate, nil
+			}
+			if err != nil {
+				return "", err
+			}
+		}
+		return "", fmt.Errorf("%s.1 to %s.%d all exist - set clobber overwrite or clear some out", local, local, maxRenames)
 	}
-	if len(args) < 1 {
-		return fmt.Errorf("must provide a destination directory")
+	return local, nil
+}
+
+// remoteTarget applies the upload-clobber policy before local is stored as
+// remote, checking with SIZE (and MDTM for skip-identical) whether the
+// remote file exists. It returns the name to upload to, or errSkipped.
+func (conn *FTPConnection) remoteTarget(local, remote string) (string, error) {
+	policy := conn.settings.uploadClobber
+	if policy == "overwrite" {
+		return remote, nil
+	}
+	var target string
+	err := conn.probe(func(probe *FTPConnection) (err error) {
+		target, err = probe.clobberTarget(policy, local, remote)
+		return err
+	})
+	if target != "" && target != remote {
+		conn.out().Info("%s exists, uploading as %s", remote, target)
 	}
+	return target, err
+}
 
-	cwdCmd := fmt.Sprintf("CWD %s", args[0])
-	resp, err := conn.sendCommand(cwdCmd)
+// clobberTarget does remoteTarget's checks on conn, the probe connection.
+func (conn *FTPConnection) clobberTarget(policy, local, remote string) (string, error) {
+	size, err := conn.remoteSize(remote)
 	if err != nil {
-		return err
+		// not there, or the server can't say
+		return remote, nil
 	}
-	if !isSuccessResponse(resp) {
-		return fmt.Errorf("CWD failed: %s", strings.TrimSpace(resp))
+
+	switch policy {
+	case "skip":
+		return "", errSkipped
+	case "skip-identical":
+		info, err := os.Stat(local)
+		if err != nil || info.Size() != size {
+			return remote, nil
+		}
+		modTime, err := conn.remoteModTime(remote)
+		if err == nil && !modTime.Before(info.ModTime().Truncate(time.Second)) {
+			return "", fmt.Errorf("%w with the same size and an equal or newer time", errSkipped)
+		}
+		return remote, nil
+	case "prompt":
+		if !stdinIsTerminal() {
+			return remote, nil
+		}
+		detail := fmt.Sprintf("%d bytes", size)
+		if modTime, err := conn.remoteModTime(remote); err == nil {
+			detail += ", modified " + formatTime(modTime, conn.settings.timeFormat)
+		}
+		answer, err := promptLine(fmt.Sprintf("%s exists on the server (%s). Overwrite? [y/N/r(ename)] ", remote, detail))
+		if err != nil {
+			return "", err
+		}
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "y", "yes":
+			return remote, nil
+		case "r", "rename":
+		default:
+			return "", errSkipped
+		}
 	}
-	fmt.Print(resp)
 
-	return nil
+	// rename
+	for i := 1; i <= maxRenames; i++ {
+		candidate := fmt.Sprintf("%s.%d", remote, i)
+		if _, err := conn.remoteSize(candidate); err != nil {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("%s.1 to %s.%d all exist on the server", remote, remote, maxRenames)
 }
 
-func handleHelp(conn *FTPConnection, args []string) error {
-	resp, err := conn.sendCommand("HELP")
+// readPathList reads newline-separated paths from a list file, skipping blank
+// lines and # comments and expanding {{date}} and {{env}} templates.
+func readPathList(filename string) ([]string, error) {
+	file, err := os.Open(filename)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("failed to open list file %s: %v", filename, err)
 	}
+	defer file.Close()
 
-	if !isSuccessResponse(resp) {
-		return fmt.Errorf("HELP failed: %s", strings.TrimSpace(resp))
+	var paths []string
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line, err := expandTemplate(fmt.Sprintf("%s:%d", filename, lineNo), line)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, line)
 	}
+	return paths, scanner.Err()
+}
 
-	fmt.Print(resp)
-	return nil
+// batchPaths returns the sources of a get or put batch, from a -F list file
+// or the direction's items in a --retry-failed report, with the targets the
+// report names.
+func batchPaths(listFile, retryFailed, direction string) ([]string, map[string]string, error) {
+	if listFile != "" {
+		paths, err := readPathList(listFile)
+		return paths, nil, err
+	}
+	items, err := readFailureReport(retryFailed, direction)
+	if err != nil {
+		return nil, nil, err
+	}
+	var paths []string
+	targets := make(map[string]string)
+	for _, item := range items {
+		paths = append(paths, item.Source)
+		targets[item.Source] = item.Target
+	}
+	return paths, targets, nil
 }
 
-func handleHelpMenu(conn *FTPConnection, args []string) error {
-	fmt.Println("Supported commands:")
-	for _, v := range commandRegistry {
-		fmt.Printf(" %s - %s\n", v.name, v.description)
+// transferEach runs transfer for every path, reporting each result and
+// returning an error summarizing any failures. Failures are also added to
+// report, if there is one.
+func transferEach(out Renderer, batch *batchProgress, paths []string, report *failureReport, transfer func(string) (int64, error)) error {
+	failed, left := 0, 0
+	var lost error
+	for i, p := range paths {
+		start := time.Now()
+		n, err := transfer(p)
+		elapsed := time.Since(start)
+		if errors.Is(err, errBatchLimit) {
+			left = len(paths) - i
+			break
+		}
+		if errors.Is(err, errConnectionLost) || errors.Is(err, errAborted) {
+			for _, rest := range paths[i:] {
+				report.add(rest, "", err)
+			}
+			lost, left = err, len(paths)-i
+			break
+		}
+		batch.fileDone(p, n, func() {
+			switch {
+			case errors.Is(err, errSkipped):
+				out.Info("Skipped %s: %v", p, err)
+			case err != nil:
+				out.Error(fmt.Errorf("%s: %v", p, err))
+				report.add(p, "", err)
+				failed++
+			default:
+				out.Info("Transferred %s (%s)", p, transferSummary(n, elapsed))
+			}
+		})
+	}
+	batch.finish()
+	if lost != nil {
+		return fmt.Errorf("%v - %d of %d files not transferred", lost, left, len(paths))
+	}
+	if left > 0 {
+		out.Info("Batch limit reached: %d files left for the next run", left)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d transfers failed", failed, len(paths))
 	}
-	fmt.Println()
 	return nil
 }
 
-func handleExit(conn *FTPConnection, args []string) error {
-	defer conn.stopKeepAlive()
-	fmt.Println("Goodbye!")
-	resp, err := conn.sendCommand("QUIT")
+func handleGet(conn *FTPConnection, args []string) error {
+	if err := requireAuth(conn); err != nil {
+		return err
+	}
+
+	fs := newCommandFlags("get")
+	listFile := fs.String("F", "", "read remote paths from a file")
+	reportFile := fs.String("report", "", "write the items of a batch that fail, with error classes, to this JSON file")
+	retryFailed := fs.String("retry-failed", "", "download only the items that failed in this report")
+	var limit batchLimit
+	limit.addFlags(fs)
+	offset := fs.Int64("offset", 0, "start this many bytes into the file")
+	length := fs.Int64("length", -1, "stop after this many bytes")
+	recursive := fs.Bool("r", false, "download a directory tree (requires --tar)")
+	tarFile := fs.String("tar", "", "write the tree into this tar archive, gzipped if it ends in .gz or .tgz")
+	decompressFlag := fs.Bool("decompress", false, "decompress a .gz, .bz2, .xz, or .zst file while downloading it")
+	verifySidecar := fs.Bool("verify-sidecar", conn.settings.verifySidecar, "verify the download against a checksum file beside it, such as name.sha256 or SHA256SUMS")
+	var jobLimit *rateLimit
+	addRateFlag(fs, &jobLimit)
+	var jobCommands *transferCommands
+	addTransferCommandFlags(fs, &jobCommands, conn.settings)
+	positional, err := parseCommandFlags(fs, args)
 	if err != nil {
 		return err
 	}
+	conn.jobLimit, conn.jobCommands = jobLimit, jobCommands
+	defer func() { conn.jobLimit, conn.jobCommands = nil, nil }()
+	// asked for on this command, a missing checksum file is worth a warning
+	sidecarRequired := false
+	fs.Visit(func(fl *flag.Flag) { sidecarRequired = sidecarRequired || fl.Name == "verify-sidecar" })
+	if sidecarRequired && *verifySidecar && (*recursive || *decompressFlag || *offset > 0 || *length >= 0) {
+		return fmt.Errorf("--verify-sidecar checks whole downloads, not -r, --decompress, --offset, or --length")
+	}
+	if *recursive {
+		if *tarFile == "" {
+			return fmt.Errorf("get -r needs --tar <archive>; use mirror to copy a tree into a directory")
+		}
+		if *decompressFlag {
+			return fmt.Errorf("--decompress applies to a single file, not -r")
+		}
+		if len(positional) != 1 {
+			return fmt.Errorf("usage: get -r --tar <archive> <remote-dir>")
+		}
+		local, err := conn.localTarget(*tarFile)
+		if errors.Is(err, errSkipped) {
+			conn.out().Info("Skipped %s: %v", positional[0], err)
+			return nil
+		} else if err != nil {
+			return err
+		}
+		files, n, err := conn.downloadTar(positional[0], local)
+		if err != nil {
+			return err
+		}
+		conn.out().Info("Archived %s into %s (%d files, %d bytes)", positional[0], local, files, n)
+		return nil
+	}
+	if *offset < 0 || *length < -1 {
+		return fmt.Errorf("--offset and --length must not be negative")
+	}
+	ranged := *offset > 0 || *length >= 0
+	batch := *listFile != "" || *retryFailed != ""
+	if ranged && batch {
+		return fmt.Errorf("--offset and --length apply to a single file, not -F or --retry-failed")
+	}
+	if *decompressFlag && batch {
+		return fmt.Errorf("--decompress applies to a single file, not -F or --retry-failed")
+	}
+	if *listFile != "" && *retryFailed != "" {
+		return fmt.Errorf("-F and --retry-failed can't be combined")
+	}
+
+	if batch {
+		paths, targets, err := batchPaths(*listFile, *retryFailed, "get")
+		if err != nil {
+			return err
+		}
+		var report *failureReport
+		if *reportFile != "" {
+			report = newFailureReport("get", "get")
+		}
+		conn.batch = newBatchProgress(conn.out(), paths, nil)
+		defer func() { conn.batch = nil }()
+		err = transferEach(conn.out(), conn.batch, paths, report, func(remote string) (int64, error) {
+			local := targets[remote]
+			if local == "" {
+				local = path.Base(remote)
+			}
+			size := int64(-1)
+			if limit.capped() {
+				// the list file gives no sizes, and the cap needs them
+				if n, err := conn.remoteSize(remote); err == nil {
+					size = n
+				}
+			}
+			if limit.downloaded(local, size) {
+				return 0, fmt.Errorf("%w with the same size", errSkipped)
+			}
+			local, err := conn.localTarget(local)
+			if err != nil {
+				return 0, err
+			}
+			if err := limit.admit(size); err != nil {
+				return 0, err
+			}
+			n, err := conn.downloadFile(remote, local, size)
+			if err == nil && *verifySidecar {
+				err = conn.verifySidecar(remote, local, sidecarRequired)
+			}
+			return n, err
+		})
+		if writeErr := report.write(*reportFile); err == nil {
+			err = writeErr
+		}
+		return err
+	}
 
-	if !isSuccessResponse(resp) {
-		return fmt.Errorf("PWD failed: %s", strings.TrimSpace(resp))
+	if len(positional) < 1 {
+		return fmt.Errorf("must provide a remote file or -F <listfile>")
+	}
+	remote, local := positional[0], path.Base(positional[0])
+	suffix := ""
+	if *decompressFlag {
+		if ranged {
+			return fmt.Errorf("--decompress needs the whole file, not --offset or --length")
+		}
+		var plain string
+		if plain, suffix, err = decompressedName(remote); err != nil {
+			return err
+		}
+		local = path.Base(plain)
+		if len(positional) > 1 {
+			local = downloadPath(positional[1], plain)
+		}
+	} else if len(positional) > 1 {
+		local = downloadPath(positional[1], remote)
+	}
+	if local, err = conn.localTarget(local); errors.Is(err, errSkipped) {
+		conn.out().Info("Skipped %s: %v", remote, err)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	start := time.Now()
+	if ranged {
+		n, err := conn.downloadRange(remote, local, *offset, *length)
+		if err != nil {
+			return err
+		}
+		conn.out().Info("Downloaded %s (%s, from offset %d)", local, transferSummary(n, time.Since(start)), *offset)
+		return nil
+	}
+	if *decompressFlag {
+		n, written, err := conn.downloadDecompressed(remote, local, suffix)
+		if err != nil {
+			return err
+		}
+		conn.out().Info("Downloaded %s (%s, decompressed to %d bytes)", local, transferSummary(n, time.Since(start)), written)
+		return nil
+	}
+	n, err := conn.downloadFile(remote, local, -1)
+	if err != nil {
+		return err
+	}
+	conn.out().Info("Downloaded %s (%s)", local, transferSummary(n, time.Since(start)))
+	if *verifySidecar {
+		return conn.verifySidecar(remote, local, sidecarRequired)
 	}
-	fmt.Println(resp)
-	conn.Close()
-	os.Exit(0)
 	return nil
 }
+
+func handlePut(conn *FTPConnection, args []string) error {
+	if err := requireAuth(conn); err != nil {
+		return err
+	}
+
+	fs := newCommandFlags("put")
+	listFile := fs.String("F", "", "read local paths from a file")
+	reportFile := fs.String("report", "", "write the items of a batch that fail, with error classes, to this JSON file")
+	retryFailed := fs.String("retry-failed", "", "upload only the items that failed in this report")
+	var limit batchLimit
+	limit.addFlags(fs)
+	createDirs := fs.Bool("create-dirs", false, "create missing remote directories")
+	extract := fs.String("extract", "", "upload the members of this .tar, .tar.gz, or .zip archive")
+	atomic := fs.Bool("atomic", false, "upload to a temporary name and rename it into place once the server confirms it")
+	verify := fs.Bool("verify", false, "with --atomic, also compare the server's checksum before renaming")
+	compress := fs.Bool("compress", false, "gzip each file while uploading it, storing it with a .gz suffix")
+	hooks := conn.settings.uploadHooks
+	fs.StringVar(&hooks.chmod, "chmod", hooks.chmod, "after uploading, set this mode with SITE CHMOD")
+	fs.StringVar(&hooks.rename, "rename", hooks.rename, "after uploading, rename with this pattern, e.g. {name}.done")
+	fs.StringVar(&hooks.notify, "notify", hooks.notify, "after uploading, POST a JSON notice to this URL")
+	var nameSpecs stringList
+	fs.Var(&nameSpecs, "name-rule", "upload under a name the rule makes from the local one; repeatable")
+	var jobLimit *rateLimit
+	addRateFlag(fs, &jobLimit)
+	var jobCommands *transferCommands
+	addTransferCommandFlags(fs, &jobCommands, conn.settings)
+	positional, err := parseCommandFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	renames, err := parseNameRules(nameSpecs)
+	if err != nil {
+		return err
+	}
+	conn.jobLimit, conn.jobCommands = jobLimit, jobCommands
+	defer func() { conn.jobLimit, conn.jobCommands = nil, nil }()
+	if *verify && !*atomic {
+		return fmt.Errorf("--verify needs --atomic")
+	}
+	if *compress && (*atomic || *extract != "") {
+		return fmt.Errorf("--compress can't be combined with --atomic or --extract")
+	}
+	// "off" drops a step the settings ask for
+	for _, step := range []struct {
+		value    *string
+		validate func(string) error
+	}{{&hooks.chmod, validateUploadMode}, {&hooks.rename, validateRenamePattern}, {&hooks.notify, validateNotifyURL}} {
+		if *step.value == "off" {
+			*step.value = ""
+		} else if *step.value != "" {
+			if err := step.validate(*step.value); err != nil {
+				return err
+			}
+		}
+	}
+
+	if *extract != "" {
+		dir := ""
+		if len(positional) > 0 {
+			dir = positional[0]
+		}
+		files, n, err := conn.uploadArchive(*extract, dir)
+		if err != nil {
+			return err
+		}
+		conn.out().Info("Extracted %s: %d files (%d bytes)", *extract, files, n)
+		return nil
+	}
+
+	// upload returns the remote name actually used, which the clobber
+	// policy may have changed
+	upload := func(local, remote string) (string, int64, error) {
+		if name := path.Base(remote); len(renames) > 0 && name == localBase(local) {
+			renamed, err := renames.apply(name)
+			if err != nil {
+				return "", 0, err
+			}
+			remote = path.Join(path.Dir(remote), renamed)
+		}
+		local = longPath(local)
+		if *compress && !strings.HasSuffix(remote, ".gz") {
+			remote += ".gz"
+		}
+		remote, err := conn.remoteTarget(local, remote)
+		if err != nil {
+			return "", 0, err
+		}
+		size := int64(-1)
+		if info, err := os.Stat(local); err == nil {
+			size = info.Size()
+		}
+		if err := limit.admit(size); err != nil {
+			return "", 0, err
+		}
+		if dir := path.Dir(remote); *createDirs && dir != "." {
+			if err := conn.makeRemoteDirs(dir); err != nil {
+				return "", 0, err
+			}
+		}
+		var n int64
+		if *atomic {
+			n, err = conn.uploadAtomic(local, remote, *verify)
+		} else if *compress {
+			n, err = conn.uploadCompressed(local, remote)
+		} else {
+			n, err = conn.uploadFile(local, remote)
+		}
+		if err != nil || hooks.empty() {
+			return remote, n, err
+		}
+		remote, err = conn.runUploadHooks(hooks, local, remote, n)
+		return remote, n, err
+	}
+
+	if *listFile != "" && *retryFailed != "" {
+		return fmt.Errorf("-F and --retry-failed can't be combined")
+	}
+	if *listFile != "" || *retryFailed != "" {
+		paths, targets, err := batchPaths(*listFile, *retryFailed, "put")
+		if err != nil {
+			return err
+		}
+		var report *failureReport
+		if *reportFile != "" {
+			report = newFailureReport("put", "put")
+		}
+		sizes := make(map[string]int64)
+		for _, p := range paths {
+			if info, err := os.Stat(p); err == nil {
+				sizes[p] = info.Size()
+			}
+		}
+		conn.batch = newBatchProgress(conn.out(), paths, sizes)
+		defer func() { conn.batch = nil }()
+		err = transferEach(conn.out(), conn.batch, paths, report, func(local string) (int64, error) {
+			remote := targets[local]
+			if remote == "" {
+				remote = localBase(local)
+			}
+			_, n, err := upload(local, remote)
+			return n, err
+		})
+		if writeErr := report.write(*reportFile); err == nil {
+			err = writeErr
+		}
+		return err
+	}
+
+	if len(positional) < 1 {
+		return fmt.Errorf("must provide a local file or -F <listfile>")
+	}
+	local, remote := positional[0], localBase(positional[0])
+	if len(positional) > 1 {
+		remote = uploadPath(positional[1], local)
+	}
+	if remote == "" || strings.HasSuffix(remote, "/") {
+		return fmt.Errorf("%s names no file to upload", local)
+	}
+	start := time.Now()
+	remote, n, err := upload(local, remote)
+	if errors.Is(err, errSkipped) {
+		conn.out().Info("Skipped %s: %v", local, err)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	summary := transferSummary(n, time.Since(start))
+	if info, err := os.Stat(local); err == nil && *compress {
+		summary += fmt.Sprintf(", compressed from %d bytes", info.Size())
+	}
+	conn.out().Info("Uploaded %s (%s)", remote, summary)
+	return nil
+}
+
+// runEach applies fn to every remote path, reporting failures and returning
+// an error summarizing them.
+func runEach(out Renderer, paths []string, fn func(string) error) error {
+	failed := 0
+	for _, p := range paths {
+		if err := fn(p); err != nil {
+			out.Error(fmt.Errorf("%s: %v", p, err))
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d operations failed", failed, len(paths))
+	}
+	return nil
+}
+
+// filePaths returns the paths of matches that are not directories.
+func filePaths(matches []remoteMatch) []string {
+	var paths []string
+	for _, m := range matches {
+		if !m.entry.isDir() {
+			paths = append(paths, m.path)
+		}
+	}
+	return paths
+}
+
+func handleMget(conn *FTPConnection, args []string) error {
+	if err := requireAuth(conn); err != nil {
+		return err
+	}
+	var limit batchLimit
+	fs := newCommandFlags("mget")
+	limit.addFlags(fs)
+	reportFile := fs.String("report", "", "write the items that fail, with error classes, to this JSON file")
+	var jobLimit *rateLimit
+	addRateFlag(fs, &jobLimit)
+	var jobCommands *transferCommands
+	addTransferCommandFlags(fs, &jobCommands, conn.settings)
+	patterns, err := parseCommandFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	conn.jobLimit, conn.jobCommands = jobLimit, jobCommands
+	defer func() { conn.jobLimit, conn.jobCommands = nil, nil }()
+	if len(patterns) < 1 {
+		return fmt.Errorf("must provide at least one remote pattern")
+	}
+
+	matches, err := conn.expandGlobs(patterns)
+	if err != nil {
+		return err
+	}
+	// the listings behind the matches give the batch its byte total
+	paths := filePaths(matches)
+	sizes := make(map[string]int64)
+	for _, m := range matches {
+		if entry := conn.resolveEntry(m); entry.kind == "file" {
+			sizes[m.path] = entry.size
+		}
+	}
+	var report *failureReport
+	if *reportFile != "" {
+		report = newFailureReport("mget", "get")
+	}
+	// a reconnect mid-batch returns to the working directory, if it is known
+	if conn.workDir == "" {
+		if dir, err := conn.currentDir(); err == nil {
+			conn.workDir = dir
+		}
+	}
+	conn.batch = newBatchProgress(conn.out(), paths, sizes)
+	defer func() { conn.batch = nil }()
+	err = transferEach(conn.out(), conn.batch, paths, report, func(remote string) (int64, error) {
+		size, ok := sizes[remote]
+		if !ok {
+			size = -1
+		}
+		if limit.downloaded(path.Base(remote), size) {
+			return 0, fmt.Errorf("%w with the same size", errSkipped)
+		}
+		local, err := conn.localTarget(path.Base(remote))
+		if err != nil {
+			return 0, err
+		}
+		// files the clobber policy skips don't count against the limit
+		if err := limit.admit(size); err != nil {
+			return 0, err
+		}
+		n, err := conn.downloadFile(remote, local, size)
+		if err == nil {
+			return n, nil
+		}
+		// a dropped connection costs only a reconnect: the file resumes from
+		// what arrived, and the rest of the batch carries on
+		lost, rerr := conn.recoverLost()
+		if !lost {
+			return n, err
+		}
+		if rerr != nil {
+			return n, rerr
+		}
+		conn.stats.retry()
+		more, err := conn.downloadFile(remote, local, size)
+		return n + more, err
+	})
+	if writeErr := report.write(*reportFile); err == nil {
+		err = writeErr
+	}
+	return err
+}
+
+func handleMdelete(conn *FTPConnection, args []string) error {
+	if err := requireAuth(conn); err != nil {
+		return err
+	}
+	if len(args) < 1 {
+		return fmt.Errorf("must provide at least one remote pattern")
+	}
+
+	matches, err := conn.expandGlobs(args)
+	if err != nil {
+		return err
+	}
+	return runEach(conn.out(), filePaths(matches), func(remote string) error {
+		resp, err := conn.sendCommand(fmt.Sprintf("DELE %s", remote))
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(resp, "250") {
+			return fmt.Errorf("DELE failed: %s", strings.TrimSpace(resp))
+		}
+		conn.out().Info("Deleted %s", remote)
+		return nil
+	})
+}
+
+func handleUmask(conn *FTPConnection, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("usage: umask [<mode>|off]")
+	}
+	if len(args) == 0 {
+		conn.out().Field("umask", settingRegistry["umask"].get(&conn.settings))
+		return nil
+	}
+	// try it now, so a server without SITE UMASK is found out at once
+	if args[0] != "off" && conn.isAuthenticated {
+		if err := validateUploadMode(args[0]); err != nil {
+			return err
+		}
+		if err := conn.siteUmask(args[0]); err != nil {
+			return err
+		}
+		conn.umaskSent = args[0]
+	}
+	return settingRegistry["umask"].set(&conn.settings, args[0])
+}
+
+func handleRwatch(conn *FTPConnection, args []string) error {
+	if err := requireAuth(conn); err != nil {
+		return err
+	}
+	opts := watchOptions{}
+	fs := newCommandFlags("rwatch")
+	fs.DurationVar(&opts.interval, "interval", time.Minute, "time between polls")
+	fs.StringVar(&opts.match, "match", "", "watch only names matching this glob")
+	fs.StringVar(&opts.getDir, "get", "", "download new and changed files into this directory")
+	fs.IntVar(&opts.count, "count", 0, "stop after this many polls")
+	positional, err := parseCommandFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) > 1 {
+		return fmt.Errorf("usage: rwatch [--interval 60s] [--match GLOB] [--get DIR] [--count N] [remote-dir]")
+	}
+	if len(positional) == 1 {
+		opts.dir = positional[0]
+	}
+	if opts.interval < time.Second {
+		return fmt.Errorf("--interval must be at least 1s")
+	}
+	if opts.count < 0 {
+		return fmt.Errorf("--count must not be negative")
+	}
+	if opts.match != "" {
+		if _, err := path.Match(opts.match, ""); err != nil {
+			return fmt.Errorf("invalid --match pattern %q: %v", opts.match, err)
+		}
+	}
+	if opts.getDir != "" {
+		if info, err := os.Stat(opts.getDir); err != nil || !info.IsDir() {
+			return fmt.Errorf("--get needs an existing local directory, not %s", opts.getDir)
+		}
+	}
+	return conn.watchRemote(opts)
+}
+
+func handleTailsync(conn *FTPConnection, args []string) error {
+	if err := requireAuth(conn); err != nil {
+		return err
+	}
+	fs := newCommandFlags("tailsync")
+	interval := fs.Duration("interval", 10*time.Second, "time between polls")
+	count := fs.Int("count", 0, "stop after this many polls")
+	positional, err := parseCommandFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 2 {
+		return fmt.Errorf("usage: tailsync [--interval 10s] [--count N] <remote-log> <local-log>")
+	}
+	if *interval < time.Second {
+		return fmt.Errorf("--interval must be at least 1s")
+	}
+	if *count < 0 {
+		return fmt.Errorf("--count must not be negative")
+	}
+	return conn.tailRemote(positional[0], positional[1], *interval, *count)
+}
+
+func handleChmod(conn *FTPConnection, args []string) error {
+	return runSiteChange(conn, "chmod", "mode", args, func(mode string) error {
+		if _, err := strconv.ParseUint(mode, 8, 32); err != nil {
+			return fmt.Errorf("invalid mode %q - expected octal, e.g. 644", mode)
+		}
+		return nil
+	})
+}
+
+func handleChown(conn *FTPConnection, args []string) error {
+	return runSiteChange(conn, "chown", "owner", args, nil)
+}
+
+func handleChgrp(conn *FTPConnection, args []string) error {
+	return runSiteChange(conn, "chgrp", "group", args, nil)
+}
+
+// runSiteChange implements chmod, chown, and chgrp: "<name> [-R] <value>
+// <pattern>...", sending "SITE <NAME> <value> <path>" for every match and,
+// with -R, everything beneath matching directories.
+func runSiteChange(conn *FTPConnection, name, what string, args []string, validate func(string) error) error {
+	if err := requireAuth(conn); err != nil {
+		return err
+	}
+
+	fs := newCommandFlags(name)
+	recursive := fs.Bool("R", false, "apply to directory contents recursively")
+	positional, err := parseCommandFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) < 2 {
+		return fmt.Errorf("must provide a %s and at least one remote pattern", what)
+	}
+	verb := strings.ToUpper(name)
+	value := positional[0]
+	if validate != nil {
+		if err := validate(value); err != nil {
+			return err
+		}
+	}
+
+	matches, err := conn.expandGlobs(positional[1:])
+	if err != nil {
+		return err
+	}
+	var paths []string
+	for _, m := range matches {
+		paths = append(paths, m.path)
+		if !*recursive || !conn.resolveEntry(m).isDir() {
+			continue
+		}
+		// parents come first so a restored execute bit lets children be reached
+		children, err := conn.expandGlob(path.Join(m.path, "**"))
+		if err != nil {
+			conn.out().Error(fmt.Errorf("%s: %v", m.path, err))
+			continue
+		}
+		for _, child := range children {
+			paths = append(paths, child.path)
+		}
+	}
+
+	done := 0
+	return runEach(conn.out(), paths, func(remote string) error {
+		resp, err := conn.sendCommand(fmt.Sprintf("SITE %s %s %s", verb, value, remote))
+		if err != nil {
+			return err
+		}
+		if !isSuccessResponse(resp) {
+			return fmt.Errorf("SITE %s failed: %s", verb, strings.TrimSpace(resp))
+		}
+		done++
+		conn.out().Info("[%d/%d] %s %s %s", done, len(paths), name, value, remote)
+		return nil
+	})
+}
+
+func handleCp(conn *FTPConnection, args []string) error {
+	if err := requireAuth(conn); err != nil {
+		return err
+	}
+	if len(args) != 2 {
+		return fmt.Errorf("usage: cp <remote-src> <remote-dst>")
+	}
+
+	n, serverSide, err := conn.copyRemote(args[0], args[1])
+	if err != nil {
+		return err
+	}
+	if serverSide {
+		conn.out().Info("Copied %s to %s on the server", args[0], args[1])
+	} else {
+		conn.out().Info("Copied %s to %s via the client (%d bytes)", args[0], args[1], n)
+	}
+	return nil
+}
+
+func handleAbort(conn *FTPConnection, args []string) error {
+	if err := parseAbort(args); err != nil {
+		return err
+	}
+	return conn.abortAll()
+}
+
+func handleQueue(conn *FTPConnection, args []string) error {
+	if err := requireAuth(conn); err != nil {
+		return err
+	}
+	if conn.queue == nil {
+		conn.queue = &transferQueue{owner: conn}
+	}
+	if err := conn.queue.retry(); err != nil {
+		return err
+	}
+	if len(args) == 0 || args[0] == "list" {
+		jobs := conn.queue.snapshot()
+		if len(jobs) == 0 {
+			conn.out().Info("The queue is empty.")
+			return nil
+		}
+		for _, job := range jobs {
+			state := job.state
+			if job.held {
+				state = "held"
+			}
+			detail := fmt.Sprintf("priority %d", job.priority)
+			switch {
+			case job.err != nil:
+				detail = job.err.Error()
+			case job.state == "done":
+				detail = fmt.Sprintf("%d bytes", job.bytes)
+			case job.state == "paused":
+				detail = fmt.Sprintf("resumes at %d bytes", job.offset)
+			}
+			conn.out().Line(fmt.Sprintf("%4d  %-8s %s %s -> %s (%s)", job.id, state, job.direction(), job.remote, job.local, detail))
+		}
+		return nil
+	}
+
+	switch sub := args[0]; sub {
+	case "get", "put":
+		fs := newCommandFlags("queue " + sub)
+		priority := fs.Int("p", 0, "run before queued jobs of lower priority")
+		again := fs.Bool("again", false, "queue the transfer even if it is already queued or done")
+		var jobLimit *rateLimit
+		addRateFlag(fs, &jobLimit)
+		positional, err := parseCommandFlags(fs, args[1:])
+		if err != nil {
+			return err
+		}
+		if len(positional) < 1 || len(positional) > 2 {
+			return fmt.Errorf("usage: queue %s [-p N] [--again] [--bwlimit rate] <source> [target]", sub)
+		}
+		job := &queueJob{upload: sub == "put", priority: *priority, limit: jobLimit}
+		var remote, local string
+		if job.upload {
+			local, remote = positional[0], localBase(positional[0])
+		} else {
+			remote, local = positional[0], path.Base(positional[0])
+		}
+		if len(positional) > 1 {
+			if job.upload {
+				remote = uploadPath(positional[1], local)
+			} else {
+				local = downloadPath(positional[1], remote)
+			}
+		}
+		// the queue runs on its own connection, in its own directory
+		if !strings.HasPrefix(remote, "/") {
+			dir, err := conn.currentDir()
+			if err != nil {
+				return err
+			}
+			remote = path.Join(dir, remote)
+		}
+		if job.local, err = filepath.Abs(local); err != nil {
+			return err
+		}
+		job.remote = remote
+		if dup := conn.queue.duplicate(job); dup != nil && !*again {
+			conn.out().Warn("%s %s is already %s as job %d - skipping (use --again to queue it anyway)", sub, remote, dup.state, dup.id)
+			return nil
+		}
+		if err := conn.queue.add(job); err != nil {
+			return err
+		}
+		conn.out().Info("Queued job %d: %s %s", job.id, sub, remote)
+		return nil
+	case "bump", "hold", "release":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: queue %s <id>", sub)
+		}
+		id, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("invalid job id %q", args[1])
+		}
+		switch sub {
+		case "bump":
+			err = conn.queue.bump(id)
+		case "hold":
+			err = conn.queue.hold(id, true)
+		default:
+			err = conn.queue.hold(id, false)
+		}
+		if err != nil {
+			return err
+		}
+		conn.out().Info("Job %d %s", id, map[string]string{"bump": "moved to the front of the queue", "hold": "held", "release": "released"}[sub])
+		return nil
+	}
+	return fmt.Errorf("unknown queue command %q - expected list, get, put, bump, hold, or release", args[0])
+}
+
+func handlePause(conn *FTPConnection, args []string) error {
+	return jobControl(conn, "pause", args)
+}
+
+func handleResume(conn *FTPConnection, args []string) error {
+	return jobControl(conn, "resume", args)
+}
+
+// jobControl pauses or resumes the queue job named by args.
+func jobControl(conn *FTPConnection, verb string, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s <job-id>", verb)
+	}
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		return fmt.Errorf("invalid job id %q", args[0])
+	}
+	if conn.queue == nil {
+		return fmt.Errorf("no queued job %d", id)
+	}
+	if verb == "pause" {
+		err = conn.queue.pause(id)
+	} else {
+		err = conn.queue.resume(id)
+	}
+	if err != nil {
+		return err
+	}
+	conn.out().Info("Job %d %s", id, map[string]string{"pause": "paused", "resume": "resumed"}[verb])
+	return nil
+}
+
+func handleHistory(conn *FTPConnection, args []string) error {
+	if len(args) == 0 || args[0] != "transfers" {
+		return fmt.Errorf("usage: history transfers [--all] [-n N]")
+	}
+	fs := newCommandFlags("history transfers")
+	all := fs.Bool("all", false, "include earlier sessions from the transfer log")
+	limit := fs.Int("n", 20, "show at most this many of the latest transfers")
+	positional, err := parseCommandFlags(fs, args[1:])
+	if err != nil {
+		return err
+	}
+	if len(positional) > 0 {
+		return fmt.Errorf("usage: history transfers [--all] [-n N]")
+	}
+	if conn.history == nil {
+		return fmt.Errorf("this session keeps no transfer history")
+	}
+
+	records := conn.history.current()
+	if *all {
+		if records, err = conn.history.all(); err != nil {
+			return fmt.Errorf("failed to read the transfer log: %v", err)
+		}
+	}
+	if *limit > 0 && len(records) > *limit {
+		records = records[len(records)-*limit:]
+	}
+	if len(records) == 0 {
+		conn.out().Info("No transfers yet.")
+		return nil
+	}
+	for _, rec := range records {
+		conn.out().Line(rec.format(conn.settings.timeFormat))
+	}
+	return nil
+}
+
+func handleRetry(conn *FTPConnection, args []string) error {
+	if err := requireAuth(conn); err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return fmt.Errorf("usage: retry <n>")
+	}
+	number, err := strconv.Atoi(args[0])
+	if err != nil {
+		return fmt.Errorf("invalid transfer number %q", args[0])
+	}
+	if conn.history == nil {
+		return fmt.Errorf("this session keeps no transfer history")
+	}
+	rec, err := conn.history.find(number)
+	if err != nil {
+		return err
+	}
+	if rec.Error == "" {
+		return fmt.Errorf("transfer %d succeeded - nothing to retry", number)
+	}
+	if rec.Host != conn.addr {
+		return fmt.Errorf("transfer %d was with %s, not %s", number, rec.Host, conn.addr)
+	}
+
+	start := time.Now()
+	if rec.Direction == "put" {
+		n, err := conn.uploadFile(rec.Local, rec.Remote)
+		if err != nil {
+			return err
+		}
+		conn.out().Info("Uploaded %s (%s)", rec.Remote, transferSummary(n, time.Since(start)))
+		return nil
+	}
+	n, err := conn.downloadFile(rec.Remote, rec.Local, -1)
+	if err != nil {
+		return err
+	}
+	conn.out().Info("Downloaded %s (%s)", rec.Local, transferSummary(n, time.Since(start)))
+	return nil
+}
+
+func handleFind(conn *FTPConnection, args []string) error {
+	if err := requireAuth(conn); err != nil {
+		return err
+	}
+
+	fs := newCommandFlags("find")
+	kind := fs.String("type", "", "only show entries of this type: f, d, or l")
+	since := fs.String("since", "", "only show entries modified within this long, e.g. 24h or 7d")
+	mmin := fs.String("mmin", "", "only show entries modified -N (under), +N (over), or N minutes ago")
+	positional, err := parseCommandFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	var ageOK []func(time.Duration) bool
+	if *since != "" {
+		limit, err := parseAge(*since)
+		if err != nil {
+			return err
+		}
+		ageOK = append(ageOK, func(age time.Duration) bool { return age <= limit })
+	}
+	if *mmin != "" {
+		match, err := parseMmin(*mmin)
+		if err != nil {
+			return err
+		}
+		ageOK = append(ageOK, match)
+	}
+	kinds := map[string]string{"": "", "f": "file", "d": "dir", "l": "link"}
+	want, ok := kinds[*kind]
+	if !ok {
+		return fmt.Errorf("invalid --type %q - expected f, d, or l", *kind)
+	}
+
+	if len(positional) == 0 {
+		positional = []string{"**"}
+	}
+	for i, p := range positional {
+		// a plain directory lists everything beneath it
+		if !hasGlobMeta(p) {
+			positional[i] = path.Join(p, "**")
+		}
+	}
+
+	matches, err := conn.expandGlobs(positional)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, m := range matches {
+		if want != "" && m.entry.kind != want {
+			continue
+		}
+		if len(ageOK) > 0 && !conn.ageMatches(m, now, ageOK) {
+			continue
+		}
+		conn.out().Line(m.path)
+	}
+	return nil
+}
+
+// ageMatches reports whether m's modification time passes every age test.
+// Entries whose time can't be determined never match.
+func (conn *FTPConnection) ageMatches(m remoteMatch, now time.Time, tests []func(time.Duration) bool) bool {
+	t, ok := conn.modTimeOf(m.path, m.entry)
+	if !ok {
+		return false
+	}
+	for _, test := range tests {
+		if !test(now.Sub(t)) {
+			return false
+		}
+	}
+	return true
+}
+
+func handleStat(conn *FTPConnection, args []string) error {
+	// TODO: handle arguments (acts like list)
+	cmd := "STAT"
+	if len(args) > 0 {
+		cmd = fmt.Sprintf("STAT %s", strings.Join(args, " "))
+	}
+	resp, err := conn.sendCommand(cmd)
+	if err != nil {
+		return err
+	}
+	if !isSuccessResponse(resp) {
+		return fmt.Errorf("STAT failed: %s", strings.TrimSpace(resp))
+	}
+	conn.out().Reply(resp)
+	return nil
+}
+
+// keepaliveRunning reports whether the keepalive goroutine is still active.
+func (conn *FTPConnection) keepaliveRunning() bool {
+	if conn.keepaliveStop == nil {
+		return false
+	}
+	select {
+	case <-conn.keepaliveDone:
+		return false
+	default:
+		return true
+	}
+}
+
+func handleTrust(conn *FTPConnection, args []string) error {
+	var fingerprint string
+	if len(args) > 0 {
+		var err error
+		if fingerprint, err = parseFingerprint(args[0]); err != nil {
+			return err
+		}
+	} else {
+		state := conn.controlTLS()
+		if state == nil {
+			return fmt.Errorf("not connected with TLS - give the fingerprint to pin, e.g. trust SHA256:<hex>")
+		}
+		fingerprint = certFingerprint(state.PeerCertificates[0])
+	}
+	if err := pinCert(conn.addr, fingerprint); err != nil {
+		return err
+	}
+	conn.out().Info("Pinned %s for %s", fingerprint, conn.addr)
+	return nil
+}
+
+func handleUntrust(conn *FTPConnection, args []string) error {
+	host := conn.addr
+	if len(args) > 0 {
+		host = args[0]
+	}
+	removed, err := unpinCert(host)
+	if err != nil {
+		return err
+	}
+	if len(removed) == 0 {
+		return fmt.Errorf("no certificate is pinned for %s", host)
+	}
+	for _, addr := range removed {
+		conn.out().Info("Forgot the certificate pinned for %s", addr)
+	}
+	return nil
+}
+
+func handleStatus(conn *FTPConnection, args []string) error {
+	out := conn.out()
+	out.Field("Server", conn.addr)
+	user := conn.user
+	if !conn.isAuthenticated {
+		user += " (not logged in)"
+	}
+	out.Field("User", user)
+	out.Field("Server software", conn.server.String())
+	if state := conn.controlTLS(); state != nil {
+		out.Field("TLS", "on ("+describeTLS(state)+")")
+		cert := certFingerprint(state.PeerCertificates[0])
+		if verifyChain(*state) != nil {
+			cert += " (pinned, not verified by a CA)"
+		}
+		out.Field("Certificate", cert)
+	} else if conn.settings.tls {
+		out.Field("TLS", "off (the next auth sends AUTH TLS)")
+	} else {
+		out.Field("TLS", "off (plain FTP control connection)")
+	}
+	if conn.protP {
+		out.Field("PROT", "P (data connections are encrypted)")
+	} else {
+		out.Field("PROT", "none (data connections are unprotected)")
+	}
+	mode := "stream"
+	if conn.settings.blockMode {
+		mode = "block (MODE B)"
+	}
+	transferType := map[string]string{
+		"server": "server default (TYPE not sent)",
+		"ascii":  "ASCII (TYPE A, line endings converted)",
+		"binary": "binary (TYPE I)",
+	}[conn.settings.transferType]
+	out.Field("Transfer TYPE", transferType+", MODE: "+mode)
+	if conn.restartMarker != "" {
+		out.Field("Last restart marker", conn.restartMarker)
+	}
+	if stats := conn.lastTransfer; stats != nil {
+		reported := "no byte count"
+		if stats.bytes >= 0 {
+			reported = fmt.Sprintf("%d bytes (%d counted here)", stats.bytes, stats.local)
+		}
+		if stats.rate != "" {
+			reported += " at " + stats.rate
+		}
+		out.Field("Last transfer (server)", reported)
+	}
+
+	dataMode := "active (PORT/EPRT)"
+	if conn.settings.passive {
+		dataMode = "passive (PASV/EPSV)"
+	}
+	out.Field("Data connections", dataMode)
+	keepalive := "off"
+	if conn.keepaliveRunning() {
+		keepalive = "on (" + conn.keepaliveSchedule() + ")"
+	}
+	out.Field("Keepalive", keepalive)
+	out.Field("Read-only", formatBool(conn.settings.readOnly))
+	out.Field("Server time skew", conn.skew.String())
+
+	remote := "unknown"
+	if conn.isAuthenticated {
+		if dir, err := conn.currentDir(); err == nil {
+			remote = dir
+		}
+	}
+	out.Field("Remote directory", remote)
+	if local, err := os.Getwd(); err == nil {
+		out.Field("Local directory", local)
+	}
+	jobs := "none"
+	if n := conn.queue.pending(); n > 0 {
+		jobs = fmt.Sprintf("%d queued transfers", n)
+	}
+	out.Field("Pending jobs", jobs)
+	return nil
+}
+
+func handleStats(conn *FTPConnection, args []string) error {
+	fs := newCommandFlags("stats")
+	connection := fs.Bool("connection", false, "also show keepalives, retries, reconnects, and reply round-trip times")
+	commands := fs.Bool("commands", false, "show each FTP command's count, errors, and reply latencies")
+	positional, err := parseCommandFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) > 0 {
+		return fmt.Errorf("usage: stats [--connection] [--commands]")
+	}
+	conn.stats.show(conn.out(), conn.traffic.Load(), *connection)
+	if !*commands {
+		return nil
+	}
+	conn.events.metrics(conn.stats.metrics())
+	return conn.stats.showVerbs(conn.out())
+}
+
+func handleVersion(conn *FTPConnection, args []string) error {
+	out := conn.out()
+	for _, d := range buildDetails() {
+		out.Field(d[0], d[1])
+	}
+	return nil
+}
+
+func handlePing(conn *FTPConnection, args []string) error {
+	if err := requireAuth(conn); err != nil {
+		return err
+	}
+	fs := newCommandFlags("ping")
+	count := fs.Int("count", 3, "send this many NOOPs")
+	positional, err := parseCommandFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) > 0 || *count < 1 {
+		return fmt.Errorf("usage: ping [--count N]")
+	}
+
+	out := conn.out()
+	rtts, err := conn.pingControl(*count)
+	if err != nil {
+		return fmt.Errorf("control channel: %v", err)
+	}
+	fastest, slowest, total := rtts[0], rtts[0], time.Duration(0)
+	for _, rtt := range rtts {
+		fastest, slowest, total = min(fastest, rtt), max(slowest, rtt), total+rtt
+	}
+	out.Field("Control round trip", fmt.Sprintf("min %v, avg %v, max %v over %d NOOPs",
+		roundRTT(fastest), roundRTT(total/time.Duration(len(rtts))), roundRTT(slowest), len(rtts)))
+
+	// transfers use PASV in passive mode and PORT in active mode
+	current, mode, other, toggle := "PORT", "active", "PASV", "on"
+	if conn.settings.passive {
+		current, mode, other, toggle = "PASV", "passive", "PORT", "off"
+	}
+	var working []string
+	var currentErr, otherErr, epsvErr error
+	for _, result := range conn.pingData() {
+		out.Field(result.mode, result.String())
+		if result.err == nil {
+			working = append(working, result.mode)
+		}
+		switch result.mode {
+		case current:
+			currentErr = result.err
+		case other:
+			otherErr = result.err
+		case "EPSV":
+			epsvErr = result.err
+		}
+	}
+	// an EPSV port that can't be reached when the PASV one can is the server's fault
+	if epsvErr != nil && strings.HasPrefix(epsvErr.Error(), "can't connect to") && slices.Contains(working, "PASV") {
+		conn.learnWorkaround("broken-epsv", "the server's EPSV port can't be reached, though its PASV port can")
+	}
+	switch {
+	case currentErr == nil:
+		out.Field("Data channel", fmt.Sprintf("works in %s mode (%s)", mode, current))
+		return nil
+	case len(working) == 0:
+		return fmt.Errorf("no data connection mode works - the control connection gets through, but something on the path blocks data connections")
+	case otherErr == nil:
+		return fmt.Errorf("data connections fail in %s mode (%s), but %s works - try set passive %s", mode, current, strings.Join(working, " and "), toggle)
+	default:
+		return fmt.Errorf("data connections fail in %s mode (%s); only %s works", mode, current, strings.Join(working, " and "))
+	}
+}
+
+func handleDiagnose(conn *FTPConnection, args []string) error {
+	if err := requireAuth(conn); err != nil {
+		return err
+	}
+	if len(args) > 0 {
+		return fmt.Errorf("usage: diagnose")
+	}
+	paths, err := conn.diagnosePaths()
+	if err != nil {
+		return err
+	}
+	conn.out().Info("Trying %d data connection modes on %d paths, waiting at most %v for each...", len(diagnoseModes), len(paths), diagnoseTimeout)
+	// an address that can't be reached isn't tried again with TLS
+	unreachable := make(map[string]error)
+	for _, p := range paths {
+		if err, ok := unreachable[p.dial]; ok {
+			p.err = err
+			continue
+		}
+		conn.diagnose(p)
+		if p.err != nil && strings.HasPrefix(p.err.Error(), "can't connect to") {
+			unreachable[p.dial] = p.err
+		}
+	}
+	return conn.reportDiagnosis(paths)
+}
+
+// capability is one row of the `features` report.
+type capability struct {
+	name   string
+	server string
+	client string
+}
+
+// capabilities compares what the server advertises in FEAT with what this
+// client actually does with it under the current settings.
+func (conn *FTPConnection) capabilities() []capability {
+	advertised := func(name string) string {
+		params, ok := conn.featureParams(name)
+		switch {
+		case !ok:
+			return "no"
+		case params != "":
+			return "yes (" + params + ")"
+		}
+		return "yes"
+	}
+	uses := func(supported bool, yes, no string) string {
+		if supported {
+			return "yes - " + yes
+		}
+		return "no - " + no
+	}
+
+	hashes := "no"
+	if params, ok := conn.featureParams("HASH"); ok {
+		hashes = "yes (HASH " + params + ")"
+	} else {
+		var legacy []string
+		for _, name := range []string{"XCRC", "XMD5", "XSHA1", "XSHA256", "XSHA512"} {
+			if conn.hasFeature(name) {
+				legacy = append(legacy, name)
+			}
+		}
+		if len(legacy) > 0 {
+			hashes = "yes (" + strings.Join(legacy, ", ") + ")"
+		}
+	}
+	modeZ, tls := "no", "no"
+	if params, _ := conn.featureParams("MODE"); strings.Contains(strings.ToUpper(params), "Z") {
+		modeZ = "yes"
+	}
+	if params, _ := conn.featureParams("AUTH"); strings.Contains(strings.ToUpper(params), "TLS") {
+		tls = "yes (AUTH " + params + ")"
+	}
+
+	tlsUse := "no - control and data connections are plaintext (set tls on)"
+	if conn.controlTLS() != nil {
+		tlsUse = "control connection encrypted with AUTH TLS"
+		if conn.protP {
+			tlsUse += ", data connections with PROT P"
+		}
+	}
+
+	dataUse := "PORT (EPRT for IPv6), active mode"
+	if conn.settings.passive {
+		dataUse = "PASV, passive mode"
+	}
+	epsvUse := "data connections use " + dataUse
+	if conn.server.brokenEPSV() {
+		epsvUse = "no - this server build's EPSV is broken; epsv falls back to PASV"
+	} else if conn.settings.workarounds.brokenEPSV {
+		epsvUse = "no - workaround broken-epsv; epsv falls back to PASV"
+	}
+
+	encodingUse := "no - OPTS UTF8 is not sent, names pass through as-is"
+	if conn.settings.encoding != "utf-8" {
+		encodingUse = fmt.Sprintf("no - names are converted from %s (set encoding)", conn.settings.encoding)
+	}
+
+	return []capability{
+		{"MLSD", advertised("MLSD"), uses(conn.useMLSD(), "ls, find, and mirror parse MLSD facts", "ls, find, and mirror parse LIST output")},
+		{"SIZE", advertised("SIZE"), uses(conn.hasFeature("SIZE"), "download progress percentages and truncation checks", "sizes come from MLST or the parent listing")},
+		{"MDTM", advertised("MDTM"), uses(conn.hasFeature("MDTM"), "timestamps of followed links in mirror", "times come from MLST or the parent listing")},
+		{"MFMT", advertised("MFMT"), uses(conn.hasFeature("MFMT"), "mirror -R preserves modification times", "uploads get the server's time")},
+		{"REST", advertised("REST"), uses(conn.restStream(), "get --offset starts mid-file; interrupted transfers still restart", "get --offset is unavailable")},
+		{"UTF8", advertised("UTF8"), encodingUse},
+		{"MODE Z", modeZ, "no - transfers are uncompressed"},
+		{"Hashes", hashes, "no - transfers are not checksum-verified"},
+		{"TLS", tls, tlsUse},
+		{"EPSV", advertised("EPSV"), epsvUse},
+	}
+}
+
+func handleFeatures(conn *FTPConnection, args []string) error {
+	if err := requireAuth(conn); err != nil {
+		return err
+	}
+
+	var table strings.Builder
+	w := tabwriter.NewWriter(&table, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, " FEATURE\tSERVER\tCLIENT USES")
+	for _, c := range conn.capabilities() {
+		fmt.Fprintf(w, " %s\t%s\t%s\n", c.name, c.server, c.client)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	out := conn.out()
+	for _, line := range strings.Split(strings.TrimSuffix(table.String(), "\n"), "\n") {
+		out.Line(line)
+	}
+	return nil
+}
+
+func handleCdup(conn *FTPConnection, args []string) error {
+	if err := requireAuth(conn); err != nil {
+		return err
+	}
+
+	resp, err := conn.sendCommand("CDUP")
+	if err != nil {
+		return err
+	}
+	if !isSuccessResponse(resp) {
+		return fmt.Errorf("CDUP failed: %s", strings.TrimSpace(resp))
+	}
+	conn.out().Reply(resp)
+
+	return nil
+}
+
+func handleCWD(conn *FTPConnection, args []string) error {
+	if err := requireAuth(conn); err != nil {
+		return err
+	}
+	if len(args) < 1 {
+		return fmt.Errorf("must provide a destination directory")
+	}
+
+	cwdCmd := fmt.Sprintf("CWD %s", args[0])
+	resp, err := conn.sendCommand(cwdCmd)
+	if err != nil {
+		return err
+	}
+	if !isSuccessResponse(resp) {
+		return fmt.Errorf("CWD failed: %s", strings.TrimSpace(resp))
+	}
+	conn.out().Reply(resp)
+
+	return nil
+}
+
+func handleHelp(conn *FTPConnection, args []string) error {
+	resp, err := conn.sendCommand("HELP")
+	if err != nil {
+		return err
+	}
+
+	if !isSuccessResponse(resp) {
+		return fmt.Errorf("HELP failed: %s", strings.TrimSpace(resp))
+	}
+
+	conn.out().Reply(resp)
+	return nil
+}
+
+func handleTime(conn *FTPConnection, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: time <command...>")
+	}
+	if _, ok := commandRegistry[strings.ToLower(args[0])]; !ok {
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+	before := conn.traffic.Load()
+	start := time.Now()
+	err := conn.execute(strings.Join(args, " "))
+	elapsed := time.Since(start)
+
+	summary := formatElapsed(elapsed)
+	if moved := conn.traffic.Load() - before; moved > 0 {
+		summary = transferSummary(moved, elapsed)
+	}
+	conn.out().Info("%s: %s", args[0], summary)
+	return err
+}
+
+func handleSet(conn *FTPConnection, args []string) error {
+	if len(args) == 0 {
+		for _, v := range settingRegistry {
+			conn.out().Field(strings.Fields(v.name)[0], v.get(&conn.settings))
+		}
+		return nil
+	}
+
+	setting, ok := settingRegistry[strings.ToLower(args[0])]
+	if !ok {
+		return fmt.Errorf("unknown setting %q", args[0])
+	}
+	if len(args) < 2 {
+		conn.out().Field(args[0], setting.get(&conn.settings)+" - "+setting.description)
+		return nil
+	}
+	return setting.set(&conn.settings, strings.Join(args[1:], " "))
+}
+
+func handleSource(conn *FTPConnection, args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("usage: source <script> [args...]")
+	}
+	return conn.sourceScript(args[0], args[1:])
+}
+
+func handleSaveSession(conn *FTPConnection, args []string) error {
+	if err := requireAuth(conn); err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return fmt.Errorf("usage: save-session <file>")
+	}
+	state, err := conn.saveSession(args[0])
+	if err != nil {
+		return err
+	}
+	conn.out().Info("Saved session in %s: %s in %s, %d settings, %d queued jobs", args[0], state.Host, state.Dir, len(state.Settings), len(state.Queue))
+	return nil
+}
+
+func handleLoadSession(conn *FTPConnection, args []string) error {
+	if err := requireAuth(conn); err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return fmt.Errorf("usage: load-session <file>")
+	}
+	state, err := conn.loadSession(args[0])
+	if err != nil {
+		return err
+	}
+	conn.out().Info("Loaded session saved %s: %s, %d queued jobs", state.Saved.Format("2006-01-02 15:04"), state.Dir, len(state.Queue))
+	return nil
+}
+
+func handleConfig(conn *FTPConnection, args []string) error {
+	sub := "show"
+	if len(args) > 0 {
+		sub = args[0]
+	}
+	path, err := resolveConfigPath(conn.configPath)
+	if err != nil {
+		return err
+	}
+
+	switch sub {
+	case "show":
+		conn.showConfig(path)
+		return nil
+	case "check":
+		return checkConfig(conn.out(), path)
+	case "edit":
+		editor := os.Getenv("VISUAL")
+		if editor == "" {
+			editor = os.Getenv("EDITOR")
+		}
+		if editor == "" {
+			editor = "vi"
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		cmd := exec.Command(editor, path)
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("editor %s failed: %v", editor, err)
+		}
+		return checkConfig(conn.out(), path)
+	}
+	return fmt.Errorf("unknown config subcommand %q - expected show, check, or edit", sub)
+}
+
+// showConfig prints the effective configuration: defaults merged with the
+// profile, environment, flags, and any `set` since.
+func (conn *FTPConnection) showConfig(path string) {
+	if _, err := os.Stat(path); err != nil {
+		path += " (not found)"
+	}
+	profile := conn.profileName
+	if profile == "" {
+		profile = "(none)"
+	}
+	password := "(none)"
+	if conn.pass != "" {
+		password = "(set)"
+	}
+	conn.out().Field("config file", path)
+	conn.out().Field("profile", profile)
+	conn.out().Field("host", conn.addr)
+	conn.out().Field("user", conn.user)
+	conn.out().Field("pass", password)
+	for _, line := range conn.initCommands {
+		conn.out().Field("init", line)
+	}
+	for _, kind := range []string{dataDir, cacheDir, stateDir} {
+		if dir, err := appDirPath(kind); err == nil {
+			conn.out().Field(kind+" dir", dir)
+		}
+	}
+
+	keys := make([]string, 0, len(settingRegistry))
+	for key := range settingRegistry {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		conn.out().Field(key, settingRegistry[key].get(&conn.settings))
+	}
+}
+
+// checkConfig loads the config file at path and reports every problem found.
+func checkConfig(out Renderer, path string) error {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		out.Info("No config file at %s", path)
+		return nil
+	}
+	cfg, err := loadConfig(path)
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(cfg.profiles))
+	for name := range cfg.profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		p := cfg.profiles[name]
+		out.Field(fmt.Sprintf("[profile.%s]", name), fmt.Sprintf("host %q, %d settings, %d init commands", p.host, len(p.settings), len(p.initCommands)))
+	}
+	for _, warning := range cfg.warnings {
+		out.Warn("%s", warning)
+	}
+	if len(cfg.warnings) > 0 {
+		return fmt.Errorf("%d problems in %s", len(cfg.warnings), path)
+	}
+	out.Info("%s is valid", path)
+	return nil
+}
+
+func handleHelpMenu(conn *FTPConnection, args []string) error {
+	fs := newCommandFlags("help")
+	all := fs.Bool("all", false, "describe every command in full")
+	markdown := fs.Bool("markdown", false, "write Markdown instead of plain text")
+	names, err := parseCommandFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if _, ok := commandRegistry[name]; !ok {
+			return fmt.Errorf("unknown command %q", name)
+		}
+	}
+	out := conn.out()
+	if len(names) > 0 {
+		for i, name := range names {
+			if i > 0 {
+				out.Line("")
+			}
+			lines := commandRegistry[name].helpText()
+			if *markdown {
+				lines = commandRegistry[name].helpMarkdown(name, 2)
+			}
+			for _, line := range lines {
+				out.Line(line)
+			}
+		}
+		return nil
+	}
+
+	// every command, grouped by category
+	if *markdown {
+		out.Line("# Command reference")
+	}
+	for i, category := range commandCategories {
+		if i > 0 || *markdown {
+			out.Line("")
+		}
+		switch {
+		case *markdown:
+			out.Line("## " + category.title)
+		default:
+			out.Line(category.title + ":")
+		}
+		for _, name := range commandsIn(category.name) {
+			cmd := commandRegistry[name]
+			switch {
+			case *markdown:
+				out.Line("")
+				for _, line := range cmd.helpMarkdown(name, 3) {
+					out.Line(line)
+				}
+			case *all:
+				for _, line := range cmd.helpText() {
+					out.Line(" " + line)
+				}
+			default:
+				out.Line(fmt.Sprintf(" %s - %s", cmd.usage, cmd.description))
+			}
+		}
+	}
+	if !*markdown {
+		out.Line("")
+		out.Line("help <command> describes a command in full.")
+	}
+	return nil
+}
+
+func handleExit(conn *FTPConnection, args []string) error {
+	return errQuit
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// useTempDirs keeps the test's journals, caches, and logs out of the user's
+// directories.
+func useTempDirs(t *testing.T) {
+	t.Helper()
+	saved := stateDirOverride
+	stateDirOverride = t.TempDir()
+	t.Cleanup(func() { stateDirOverride = saved })
+}
+
+func TestHandleGet(t *testing.T) {
+	useTempDirs(t)
+	s := newFakeSession().withFeatures("SIZE", "MDTM", "REST STREAM")
+	s.files["RETR pub/hello.txt"] = "hello, world\n"
+	s.replies["SIZE pub/hello.txt"] = "213 13"
+	s.replies["MDTM pub/hello.txt"] = "213 20240102030405"
+	f, out := newFakeConnection(s)
+
+	local := filepath.Join(t.TempDir(), "hello.txt")
+	if err := handleGet(f, []string{"pub/hello.txt", local}); err != nil {
+		t.Fatalf("get: %v\n%s", err, out)
+	}
+	data, err := os.ReadFile(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello, world\n" {
+		t.Errorf("downloaded %q, want %q", data, "hello, world\n")
+	}
+	if _, err := os.Stat(local + ".part"); !os.IsNotExist(err) {
+		t.Errorf("%s.part left behind", local)
+	}
+}
+
+func TestHandleGetMissingFile(t *testing.T) {
+	useTempDirs(t)
+	s := newFakeSession()
+	f, _ := newFakeConnection(s)
+
+	local := filepath.Join(t.TempDir(), "missing.txt")
+	err := handleGet(f, []string{"missing.txt", local})
+	if err == nil || !strings.Contains(err.Error(), "550") {
+		t.Fatalf("get of a missing file returned %v, want the server's 550", err)
+	}
+	if _, err := os.Stat(local); !os.IsNotExist(err) {
+		t.Errorf("%s created for a failed download", local)
+	}
+}
+
+// retr writes to a .part file, moved into place only once the server
+// confirms the transfer; a short one keeps it for resuming.
+func TestHandleRetr(t *testing.T) {
+	useTempDirs(t)
+	t.Chdir(t.TempDir())
+	s := newFakeSession().withFeatures("SIZE")
+	s.files["RETR whole.txt"] = "hello, world\n"
+	s.replies["SIZE whole.txt"] = "213 13"
+	s.files["RETR short.txt"] = "hello"
+	s.replies["SIZE short.txt"] = "213 13"
+	s.files["RETR refused.txt"] = "hello, world\n"
+	s.ends["RETR refused.txt"] = "451 Local error"
+	f, out := newFakeConnection(s)
+	f.dataAddr = "127.0.0.1:1025"
+
+	if err := handleRetr(f, []string{"whole.txt"}); err != nil {
+		t.Fatalf("retr: %v\n%s", err, out)
+	}
+	if data, err := os.ReadFile("whole.txt"); err != nil || string(data) != "hello, world\n" {
+		t.Errorf("whole.txt holds %q, %v", data, err)
+	}
+	if _, err := os.Stat("whole.txt.part"); !os.IsNotExist(err) {
+		t.Error("whole.txt.part left behind")
+	}
+
+	for _, name := range []string{"short.txt", "refused.txt"} {
+		err := handleRetr(f, []string{name})
+		if err == nil || !strings.Contains(err.Error(), "partial data kept in "+name+".part") {
+			t.Errorf("retr %s returned %v, want the .part file kept", name, err)
+		}
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("the failed download was moved into place as %s", name)
+		}
+		if _, err := os.Stat(name + ".part"); err != nil {
+			t.Errorf("the failed download lost its .part file: %v", err)
+		}
+	}
+}
+
+func TestHandleLs(t *testing.T) {
+	tests := []struct {
+		name     string
+		features []string
+		files    map[string]string
+	}{
+		{
+			name:     "MLSD",
+			features: []string{"MLSD", "MLST type*;size*;modify*;"},
+			files: map[string]string{
+				"MLSD /pub": "type=cdir;modify=20240101000000; .\r\n" +
+					"type=file;size=1024;modify=20240102030405; report.pdf\r\n" +
+					"type=dir;modify=20240103000000; archive\r\n",
+			},
+		},
+		{
+			name: "LIST",
+			files: map[string]string{
+				"LIST /pub": "-rw-r--r--   1 ftp      ftp          1024 Jan 02  2024 report.pdf\r\n" +
+					"drwxr-xr-x   2 ftp      ftp          4096 Jan 03  2024 archive\r\n",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newFakeSession().withFeatures(tt.features...)
+			s.files = tt.files
+			f, out := newFakeConnection(s)
+			if err := handleLs(f, []string{"-1", "/pub"}); err != nil {
+				t.Fatalf("ls: %v\n%s", err, out)
+			}
+			// directories are marked with a slash, and "." is left out
+			if got, want := out.String(), "report.pdf\narchive/\n"; got != want {
+				t.Errorf("ls -1 printed %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestLocalTargetRename(t *testing.T) {
+	dir := t.TempDir()
+	local := filepath.Join(dir, "file.bin")
+	f, _ := newFakeConnection(newFakeSession())
+	f.settings.clobber = "rename"
+
+	if got, err := f.localTarget(local); err != nil || got != local {
+		t.Errorf("localTarget of a new file = %q, %v, want it unchanged", got, err)
+	}
+	for _, name := range []string{"file.bin", "file.bin.1"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, err := f.localTarget(local); err != nil || got != local+".2" {
+		t.Errorf("localTarget = %q, %v, want %q", got, err, local+".2")
+	}
+
+	// a stat error other than not-existing is returned, not looped on
+	if runtime.GOOS != "windows" {
+		if _, err := f.localTarget(filepath.Join(local, "below-a-file")); err == nil {
+			t.Error("localTarget below a regular file succeeded")
+		}
+	}
+
+	for i := 2; i <= maxRenames; i++ {
+		if err := os.WriteFile(fmt.Sprintf("%s.%d", local, i), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, err := f.localTarget(local); err == nil {
+		t.Errorf("localTarget with every rename taken = %q, want an error", got)
+	}
+}
+
+func TestHandleStatus(t *testing.T) {
+	f, out := newFakeConnection(newFakeSession())
+	if err := handleStatus(f, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{" Server: 127.0.0.1:21\n", " User: user\n", " TLS: off", " Read-only: off\n", " Remote directory: "} {
+		if !strings.Contains(out.String(), field) {
+			t.Errorf("status is missing %q:\n%s", field, out)
+		}
+	}
+}
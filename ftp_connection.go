@@ -2,154 +2,1367 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
 )
 
 type FTPConnection struct {
-	conn            net.Conn
+	session         FTPSession
+	addr            string
 	user            string
 	pass            string
-	reader          *bufio.Reader
 	isAuthenticated bool
 	dataAddr        string
+	dataListener    net.Listener
+	settings        sessionSettings
+	relaxPasv       bool
+	features        map[string]string
+	server          serverInfo               // software identified from the greeting or STAT
+	statChecked     bool                     // STAT has been asked for the server's software
+	serverIdle      time.Duration            // the server's idle timeout, when it said or showed it; 0 if unknown
+	lastCommand     time.Time                // when the last command was sent
+	listings        map[string][]RemoteEntry // cached by listDir, keyed by directory
+	serverMode      string                   // last MODE sent; empty means the default, stream
+	serverType      string                   // last TYPE sent; empty means the server default
+	restartMarker   string                   // last MODE B restart marker received
+	lastTransfer    *transferStats           // from the last completion reply that had any
+	completionReply string                   // final reply of the last transfer
+	batch           *batchProgress           // the bulk transfer in progress, if any
+	queue           *transferQueue           // created by the first queue command
+	pausing         *atomic.Bool             // when set, stops the transfer in progress; queue connections only
+	aborting        *atomic.Bool             // set by abort --all; shared with every sibling connection
+	workDir         string                   // cached PWD; empty until probe needs it
+	skew            clockSkew                // server clock and zone skew, once calibrated
+	probes          *probePool
+	budget          *connectionBudget // shared with every sibling connection
+	traffic         *atomic.Int64     // data bytes moved by this session and its siblings
+	pacer           *pacer            // paces bwlimit; shared with every sibling connection
+	jobLimit        *rateLimit        // the running command's --bwlimit, if any
+	jobCommands     *transferCommands // the running command's --precmd and --postcmd, if any
+	umaskSent       string            // the umask this login has had; cleared by USER
+	mlstSelected    bool              // OPTS MLST has been considered this login; cleared by USER
+	restProbed      bool              // REST 0 has been tried, for a server that doesn't advertise REST STREAM
+	restProbeOK     bool              // and the server accepted it
+	pipelineOff     bool              // the server lost pipelined commands, so they go one at a time
+	protP           bool              // PROT P is in effect, so data connections use TLS
+	history         *transferHistory  // nil in one-shot modes, which keep no log
+	idle            bool              // disconnected by idle-timeout; the next command reconnects
+	quitSent        bool              // QUIT was sent, so the server closing the connection is expected
+	control         *sync.Mutex       // held while a REPL command owns the control connection
+	background      *backgroundJob    // the last command run with a trailing &
+	sourceDepth     int               // scripts being run by source, one inside another
+	initCommands    []string
+	configPath      string // as given with -config; empty means the default
+	profileName     string
+	learns          bool          // workarounds found to be needed are turned on and saved; the main session only
+	terminating     chan struct{} // closed when a stop signal arrives; the main session only
+	stopSignal      os.Signal     // the stop signal, once terminating is closed
+	stdout          io.Writer     // command output; nil means os.Stdout
+	recorder        *sessionRecorder
+	events          *eventStream
+	machine         *machineOutput   // set in --machine mode
+	commands        *commandLog      // warnings and failures; shared with every sibling connection
+	stats           *connectionStats // shared with every sibling connection
+	activeTransfer  *eventTransfer   // the file transfer awaiting its completion reply
 	keepaliveStop   chan struct{}
 	keepaliveDone   chan struct{}
 	connectionLost  chan struct{}
 }
 
 func NewFTPConnection(host, user, pass string) (FTPConnection, error) {
-	addr := host + ":2121"
-	conn, err := net.DialTimeout("tcp", addr, 30*time.Second)
+	addr := host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		addr = net.JoinHostPort(host, "2121")
+	}
+	conn, err := dialControl(addr)
 	if err != nil {
 		return FTPConnection{}, err
 	}
+	return newFTPConnection(newNetSession(conn), addr, user, pass), nil
+}
 
+// newFTPConnection wraps an established session, such as a scripted fake.
+func newFTPConnection(session FTPSession, addr, user, pass string) FTPConnection {
 	return FTPConnection{
-		conn:            conn,
+		session:         session,
+		addr:            addr,
 		user:            user,
 		pass:            pass,
-		reader:          bufio.NewReader(conn),
 		isAuthenticated: false,
+		settings:        defaultSettings(),
+		control:         &sync.Mutex{},
+		budget:          newConnectionBudget(),
+		traffic:         &atomic.Int64{},
+		aborting:        &atomic.Bool{},
+		pacer:           &pacer{},
+		commands:        &commandLog{},
+		stats:           newConnectionStats(),
 		connectionLost:  make(chan struct{}),
-	}, nil
+	}
 }
 
+// parseEPSVAddr returns the data address from an EPSV reply: the control
+// connection's host with the advertised port.
 func (f *FTPConnection) parseEPSVAddr(epsvResp string) (string, error) {
-	start := strings.Index(epsvResp, "(")
-	end := strings.Index(epsvResp, ")")
+	port, err := parseEPSVPort(epsvResp)
+	if err != nil {
+		return "", err
+	}
+	controlAddr := f.session.RemoteAddr().String()
+	host, _, err := net.SplitHostPort(controlAddr)
+	if err != nil {
+		return "", fmt.Errorf("invalid control address %s: %v", controlAddr, err)
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port)), nil
+}
 
-	if start == -1 || end == -1 {
-		return "", fmt.Errorf("invalid EPSV response format")
+// parseEPSVPort extracts the port from "229 Entering Extended Passive Mode
+// (|||6446|)". RFC 2428 lets the server pick any printable delimiter in
+// place of '|'.
+func parseEPSVPort(epsvResp string) (int, error) {
+	_, after, found := strings.Cut(epsvResp, "(")
+	if !found {
+		return 0, fmt.Errorf("invalid EPSV response format")
+	}
+	inner, _, found := strings.Cut(after, ")")
+	if !found || len(inner) < 5 {
+		return 0, fmt.Errorf("invalid EPSV response format")
+	}
+
+	delim := inner[0]
+	if delim < 33 || delim > 126 {
+		return 0, fmt.Errorf("invalid EPSV delimiter %q", delim)
+	}
+	parts := strings.Split(inner, string(delim))
+	// "|||port|" splits into "", "", "", port, ""
+	if len(parts) != 5 || parts[1] != "" || parts[2] != "" || parts[4] != "" {
+		return 0, fmt.Errorf("invalid EPSV port format")
 	}
+	port, ok := parseDecimal(parts[3])
+	if !ok || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid EPSV port: %q", parts[3])
+	}
+	return port, nil
+}
 
-	portPart := epsvResp[start+1 : end]
-	parts := strings.Split(portPart, "|")
+// pasvNumbers matches the h1,h2,h3,h4,p1,p2 tuple of a PASV reply. Servers
+// differ on parentheses and spacing, so only the numbers are relied upon.
+var pasvNumbers = regexp.MustCompile(`(\d{1,3}) *, *(\d{1,3}) *, *(\d{1,3}) *, *(\d{1,3}) *, *(\d{1,3}) *, *(\d{1,3})`)
 
-	if len(parts) < 4 {
-		return "", fmt.Errorf("invalid EPSV port format")
+func parseAddr(pasvResp string) (string, error) {
+	// skip the reply code so it can't be mistaken for part of the address
+	text := pasvResp
+	if code, _ := parseReplyLine(text); code != "" {
+		text = text[3:]
+	}
+	m := pasvNumbers.FindStringSubmatch(text)
+	if m == nil {
+		return "", fmt.Errorf("no h1,h2,h3,h4,p1,p2 address found in PASV reply")
 	}
 
-	port := parts[3]
-	controlAddr := f.conn.RemoteAddr().String()
-	host, _, _ := net.SplitHostPort(controlAddr)
-	return fmt.Sprintf("%s:%s", host, port), nil
+	var nums [6]int
+	for i := range nums {
+		nums[i], _ = parseDecimal(m[i+1])
+		if nums[i] > 255 {
+			return "", fmt.Errorf("invalid PASV number %s at position %d", m[i+1], i)
+		}
+	}
+	port := nums[4]*256 + nums[5]
+	if port == 0 {
+		return "", fmt.Errorf("invalid data port 0")
+	}
+	return fmt.Sprintf("%d.%d.%d.%d:%d", nums[0], nums[1], nums[2], nums[3], port), nil
 }
 
-func parseAddr(pasvResp string) (string, error) {
-	// Find first '(' and split
-	_, after, found := strings.Cut(pasvResp, "(")
-	if !found {
-		return "", fmt.Errorf("no opening parenthesis found")
+// parseDecimal parses a short unsigned decimal number. Unlike strconv.Atoi it
+// rejects signs and surrounding space.
+func parseDecimal(s string) (int, bool) {
+	if s == "" || len(s) > 9 {
+		return 0, false
+	}
+	n := 0
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return 0, false
+		}
+		n = n*10 + int(s[i]-'0')
 	}
+	return n, true
+}
 
-	// Find first ')' and split
-	numbersStr, _, found := strings.Cut(after, ")")
-	if !found {
-		return "", fmt.Errorf("no closing parenthesis found")
+// isAnonymousUser reports whether user is one of the conventional anonymous
+// login names, which take an email address in place of a password.
+func isAnonymousUser(user string) bool {
+	return strings.EqualFold(user, "anonymous") || strings.EqualFold(user, "ftp")
+}
+
+// login performs the USER/PASS exchange and returns the server's replies.
+// With the tls setting on it sends AUTH TLS first, and PBSZ and PROT after.
+func (f *FTPConnection) login() (string, error) {
+	if f.settings.tls {
+		if err := f.startTLS(); err != nil {
+			return "", err
+		}
+	}
+	resp, err := f.sendLogin()
+	if err == nil && f.controlTLS() != nil && !f.protP {
+		err = f.protectData()
+	}
+	return resp, err
+}
+
+// sendLogin sends USER, and PASS if the server asks for one.
+func (f *FTPConnection) sendLogin() (string, error) {
+	resp, err := f.sendCommand(fmt.Sprintf("USER %s", f.user))
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(resp, "331") && !strings.HasPrefix(resp, "230") {
+		return resp, fmt.Errorf("USER command failed: %s", strings.TrimSpace(resp))
+	}
+
+	if strings.HasPrefix(resp, "230") {
+		// some servers admit anonymous users without a password
+		f.isAuthenticated = true
+		return resp, nil
+	}
+
+	pass := f.pass
+	if pass == "" && isAnonymousUser(f.user) {
+		pass = f.settings.anonPassword
+	}
+	passResp, err := f.sendCommand(fmt.Sprintf("PASS %s", pass))
+	if err != nil {
+		return resp, err
+	}
+	resp += passResp
+	if !isSuccessResponse(passResp) {
+		return resp, fmt.Errorf("PASS command failed: %s", strings.TrimSpace(passResp))
+	}
+
+	f.isAuthenticated = true
+	return resp, nil
+}
+
+// openSibling dials and authenticates another control connection to the same
+// server, for work that runs alongside this session. It fails with
+// errConnectionLimit rather than dialing when the server's limit is reached,
+// closing the idle probe connection first to make room if it can.
+func (f *FTPConnection) openSibling() (*FTPConnection, error) {
+	if err := f.reserveSibling(); err != nil {
+		return nil, err
+	}
+	sibling, err := NewFTPConnection(f.addr, f.user, f.pass)
+	if err != nil {
+		f.budget.cancel("")
+		return nil, err
 	}
+	return f.adoptSibling(sibling, f.settings)
+}
 
-	parts := strings.Split(numbersStr, ",")
-	if len(parts) != 6 {
-		return "", fmt.Errorf("expected 6 numbers, got %d", len(parts))
+// reserveSibling takes a place in the connection budget for a sibling.
+func (f *FTPConnection) reserveSibling() error {
+	err := f.budget.reserve(f.settings.maxConnections)
+	if errors.Is(err, errConnectionLimit) && f.probes != nil && f.probes.mu.TryLock() {
+		f.probes.close()
+		f.probes.mu.Unlock()
+		err = f.budget.reserve(f.settings.maxConnections)
 	}
-	for i, part := range parts[0:4] {
-		if num, err := strconv.Atoi(part); err != nil || num < 0 || num > 255 {
-			return "", fmt.Errorf("invalid IP octet at position %d: %s", i, part)
+	return err
+}
+
+// adoptSibling logs in a connection just opened to this session's server,
+// with settings, sharing the session's state as openSibling does. The
+// caller has reserved its place in the connection budget.
+func (f *FTPConnection) adoptSibling(sibling FTPConnection, settings sessionSettings) (*FTPConnection, error) {
+	sibling.addr = f.addr // a dialed IP address still presents the host name to TLS
+	sibling.relaxPasv = f.relaxPasv
+	sibling.serverIdle = f.serverIdle
+	sibling.settings = settings
+	sibling.events = f.events
+	sibling.machine = f.machine
+	sibling.commands = f.commands
+	sibling.stats = f.stats
+	sibling.budget = f.budget
+	sibling.traffic = f.traffic
+	sibling.aborting = f.aborting
+	sibling.pacer = f.pacer
+	sibling.history = f.history
+	welcome, err := sibling.readResponse()
+	if err == nil && !strings.HasPrefix(welcome, "2") {
+		err = fmt.Errorf("server refused the connection: %s", strings.TrimSpace(welcome))
+	}
+	if err != nil {
+		sibling.session.Close()
+		if limitErr := f.budget.cancel(welcome); limitErr != nil {
+			return nil, limitErr
 		}
+		return nil, fmt.Errorf("error reading welcome message: %v", err)
 	}
-	addr := strings.Join(parts[0:4], ".")
+	if resp, err := sibling.login(); err != nil {
+		sibling.session.Close()
+		if limitErr := f.budget.cancel(resp); limitErr != nil {
+			return nil, limitErr
+		}
+		return nil, err
+	}
+	f.budget.adopt(&sibling)
+	return &sibling, nil
+}
+
+// hasFeature reports whether the client should use a feature: the server
+// advertised it and no workaround turns it off.
+func (f *FTPConnection) hasFeature(name string) bool {
+	return f.advertises(name) && !f.settings.workarounds.disables(name)
+}
+
+// advertises reports whether the server listed name in its FEAT reply. FEAT
+// is only queried once per connection.
+func (f *FTPConnection) advertises(name string) bool {
+	if f.features == nil {
+		f.features = make(map[string]string)
+		resp, err := f.sendCommand("FEAT")
+		if err == nil && strings.HasPrefix(resp, "211") {
+			for _, line := range strings.Split(resp, "\n") {
+				// feature lines are indented by a single space
+				if !strings.HasPrefix(line, " ") {
+					continue
+				}
+				feat, params, _ := strings.Cut(strings.TrimSpace(line), " ")
+				f.features[strings.ToUpper(feat)] = params
+			}
+		}
+	}
+	_, ok := f.features[strings.ToUpper(name)]
+	return ok
+}
+
+// featureParams returns the parameters the server listed with a FEAT entry,
+// e.g. "TLS" for "AUTH TLS".
+func (f *FTPConnection) featureParams(name string) (string, bool) {
+	if !f.advertises(name) {
+		return "", false
+	}
+	return f.features[strings.ToUpper(name)], true
+}
+
+// negotiateTransfer brings the server's TYPE and MODE in line with the
+// settings before a data connection is set up.
+func (f *FTPConnection) negotiateTransfer() error {
+	if err := f.negotiateType(); err != nil {
+		return err
+	}
+	return f.negotiateMode()
+}
 
-	portH, err := strconv.Atoi(parts[4])
+// enterPassive issues PASV and records the data address for the next transfer.
+func (f *FTPConnection) enterPassive() (string, error) {
+	if err := f.negotiateTransfer(); err != nil {
+		return "", err
+	}
+	resp, err := f.sendCommand("PASV")
 	if err != nil {
-		return "", fmt.Errorf("error parsing port number high digit")
+		return "", err
+	}
+	if !isSuccessResponse(resp) {
+		return "", fmt.Errorf("PASV failed: %s", strings.TrimSpace(resp))
 	}
-	portL, err := strconv.Atoi(parts[5])
+	addr, err := parseAddr(resp)
 	if err != nil {
-		return "", fmt.Errorf("error parsing port number low digit")
+		return "", err
 	}
-	portVal := portH*256 + portL
+	if !f.settings.workarounds.pasvNAT && f.pasvBehindNAT(addr) {
+		host, _, _ := net.SplitHostPort(addr)
+		f.learnWorkaround("pasv-nat", fmt.Sprintf("the server's PASV replies name %s, an address it can't be reached at from here", host))
+	}
+	if f.settings.workarounds.pasvNAT {
+		addr, err = f.controlHostAddr(addr)
+		if err != nil {
+			return "", err
+		}
+	}
+	if err := f.checkDataAddr(addr); err != nil {
+		return "", err
+	}
+	f.closeDataListener()
+	f.dataAddr = addr
+	return resp, nil
+}
 
-	return fmt.Sprintf("%s:%d", addr, portVal), nil
+// enterExtendedPassive issues EPSV and records the data address for the next
+// transfer.
+func (f *FTPConnection) enterExtendedPassive() (string, error) {
+	resp, err := f.sendCommand("EPSV")
+	if err != nil {
+		return "", err
+	}
+	if !isSuccessResponse(resp) {
+		return "", fmt.Errorf("EPSV failed: %s", strings.TrimSpace(resp))
+	}
+	addr, err := f.parseEPSVAddr(resp)
+	if err != nil {
+		return "", err
+	}
+	if err := f.checkDataAddr(addr); err != nil {
+		return "", err
+	}
+	f.closeDataListener()
+	f.dataAddr = addr
+	return resp, nil
 }
 
-func (f *FTPConnection) readResponse() (string, error) {
-	// Refresh read deadline for this operation
-	f.conn.SetReadDeadline(time.Now().Add(45 * time.Second))
+// enterActive listens on a local port (within the configured port range) and
+// tells the server to connect to it with PORT, or EPRT for IPv6.
+func (f *FTPConnection) enterActive() (string, error) {
+	if err := f.negotiateTransfer(); err != nil {
+		return "", err
+	}
+	localIP := f.session.LocalAddr().(*net.TCPAddr).IP
+	ln, err := listenInRange(localIP, f.settings.portMin, f.settings.portMax)
+	if err != nil {
+		return "", err
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
 
-	var fullResponse strings.Builder
+	advertised := localIP
+	if f.settings.externalIP != "" {
+		advertised = net.ParseIP(f.settings.externalIP)
+	}
+	cmd := fmt.Sprintf("EPRT |2|%s|%d|", advertised, port)
+	if ip4 := advertised.To4(); ip4 != nil {
+		cmd = fmt.Sprintf("PORT %d,%d,%d,%d,%d,%d", ip4[0], ip4[1], ip4[2], ip4[3], port/256, port%256)
+	}
 
-	line, err := f.reader.ReadString('\n')
+	resp, err := f.sendCommand(cmd)
 	if err != nil {
+		ln.Close()
 		return "", err
 	}
-	fullResponse.WriteString(line)
+	if !isSuccessResponse(resp) {
+		ln.Close()
+		verb, _, _ := strings.Cut(cmd, " ")
+		return "", fmt.Errorf("%s failed: %s", verb, strings.TrimSpace(resp))
+	}
+
+	f.closeDataListener()
+	f.dataListener = &peerListener{Listener: ln, server: f.serverIP(), anyPeer: f.relaxPasv}
+	f.dataAddr = ""
+	return resp, nil
+}
+
+func (f *FTPConnection) serverIP() net.IP {
+	if addr, ok := f.session.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	return nil
+}
+
+// peerListener is an active-mode data listener that accepts only the server,
+// from any port: classically 20, though many servers use an ephemeral one.
+// Anyone else who connects first, such as a port scanner, is turned away
+// rather than handed the transfer.
+type peerListener struct {
+	net.Listener
+	server   net.IP
+	anyPeer  bool     // -relax-pasv: accept any address
+	rejected []string // addresses turned away
+}
+
+func (l *peerListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if len(l.rejected) > 0 && !errors.Is(err, net.ErrClosed) {
+				return nil, fmt.Errorf("only %s connected to the data port, not the server at %s - use -relax-pasv to accept them", strings.Join(l.rejected, ", "), l.server)
+			}
+			return nil, err
+		}
+		peer, ok := conn.RemoteAddr().(*net.TCPAddr)
+		if l.anyPeer || l.server == nil || (ok && peer.IP.Equal(l.server)) {
+			return conn, nil
+		}
+		l.rejected = append(l.rejected, conn.RemoteAddr().String())
+		conn.Close()
+	}
+}
+
+// SetDeadline bounds the wait for Accept.
+func (l *peerListener) SetDeadline(t time.Time) error {
+	if d, ok := l.Listener.(interface{ SetDeadline(time.Time) error }); ok {
+		return d.SetDeadline(t)
+	}
+	return nil
+}
+
+// listenInRange opens a listener on ip using the first free port between
+// min and max, or any port when no range is configured.
+func listenInRange(ip net.IP, min, max int) (net.Listener, error) {
+	if min == 0 {
+		return net.Listen("tcp", net.JoinHostPort(ip.String(), "0"))
+	}
+	for port := min; port <= max; port++ {
+		ln, err := net.Listen("tcp", net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+		if err == nil {
+			return ln, nil
+		}
+	}
+	return nil, fmt.Errorf("no free local port in range %d-%d", min, max)
+}
+
+func (f *FTPConnection) closeDataListener() {
+	if f.dataListener != nil {
+		f.dataListener.Close()
+		f.dataListener = nil
+	}
+}
+
+// prepareData negotiates a data connection for the next transfer, using
+// passive or active mode according to the session settings.
+func (f *FTPConnection) prepareData() (string, error) {
+	if f.settings.passive {
+		return f.enterPassive()
+	}
+	return f.enterActive()
+}
+
+// hasDataConn reports whether a data connection has been negotiated.
+func (f *FTPConnection) hasDataConn() bool {
+	return f.dataAddr != "" || f.dataListener != nil
+}
+
+// openDataConn establishes the data connection negotiated by the last
+// PASV/EPSV or PORT/EPRT exchange. Active-mode listeners are single use.
+func (f *FTPConnection) openDataConn() (net.Conn, error) {
+	ln := f.dataListener
+	f.dataListener = nil
+	dataConn, err := f.session.openDataConn(f.dataAddr, ln)
+	if err != nil {
+		return nil, err
+	}
+	if f.protP {
+		if dataConn, err = f.wrapDataTLS(dataConn); err != nil {
+			return nil, err
+		}
+	}
+	if f.serverMode == "B" {
+		f.restartMarker = ""
+		dataConn = &blockConn{Conn: dataConn, onMarker: func(marker string) { f.restartMarker = marker }}
+	}
+	if f.serverType == "A" {
+		dataConn = &asciiConn{Conn: dataConn, warn: func() {
+			f.out().Warn("this looks like binary data; TYPE A line-ending conversion will corrupt it (set type binary)")
+		}}
+	}
+	var limits []rateLimit
+	if f.settings.bandwidth != nil {
+		limits = append(limits, rateLimit{schedule: f.settings.bandwidth, pacer: f.pacer})
+	}
+	if f.jobLimit != nil {
+		limits = append(limits, *f.jobLimit)
+	}
+	if len(limits) > 0 {
+		dataConn = throttledConn{Conn: dataConn, limits: limits}
+	}
+	if f.activeTransfer != nil {
+		dataConn = eventConn{Conn: dataConn, transfer: f.activeTransfer}
+	}
+	dataConn = trafficConn{Conn: dataConn, total: f.traffic}
+	if f.pausing != nil {
+		dataConn = pausableConn{Conn: dataConn, pausing: f.pausing}
+	}
+	dataConn = abortableConn{Conn: dataConn, aborting: f.aborting}
+	return dataConn, nil
+}
+
+// halfCloser is a data connection that can be shut down one direction at a
+// time, such as *net.TCPConn.
+type halfCloser interface {
+	CloseWrite() error
+	CloseRead() error
+}
+
+// errStoppedEarly is returned by a transfer's fn when it deliberately stops
+// reading before the end of the data, as get --length does. The transfer
+// still succeeds, but the server's byte count isn't compared with the bytes
+// read.
+var errStoppedEarly = errors.New("stopped reading early")
+
+// transfer sends a data-bearing command, hands the opened data connection to
+// fn, and then waits for the server's completion reply.
+func (f *FTPConnection) transfer(cmd string, fn func(net.Conn) error) error {
+	verb, _, _ := strings.Cut(cmd, " ")
+
+	resp, err := f.sendCommand(cmd)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(resp, "150") && !strings.HasPrefix(resp, "125") {
+		return fmt.Errorf("%s failed: %s", verb, strings.TrimSpace(resp))
+	}
+
+	dataConn, err := f.openDataConn()
+	if err != nil {
+		return err
+	}
+	defer dataConn.Close()
 
-	// check if multiline
-	if len(line) >= 4 && line[3] == '-' {
-		code := line[:3]
+	pending := f.awaitCompletion(dataConn)
+	counted := &countingConn{Conn: dataConn}
+	var data net.Conn = counted
+	switch strings.ToUpper(verb) {
+	case "RETR", "STOR", "APPE", "STOU":
+		if f.batch != nil {
+			data = batchConn{Conn: counted, batch: f.batch}
+		}
+	}
+	err = fn(data)
+	stoppedEarly := errors.Is(err, errStoppedEarly)
+	if stoppedEarly {
+		err = nil
+	}
+	if err != nil {
+		if f.aborting.Load() {
+			f.activeTransfer.fail(errAborted)
+			f.abortTransfer(pending)
+			return errAborted
+		}
+		// the server still sends its completion reply, which must not be
+		// left for the next command to read
+		f.activeTransfer.fail(err)
+		err = pending.abort(err)
+		if f.restartMarker != "" {
+			return fmt.Errorf("%v (last restart marker %q)", err, f.restartMarker)
+		}
+		return err
+	}
+	f.recorder.transfer(verb, counted.n)
+	if tcpConn, ok := dataConn.(halfCloser); ok {
+		tcpConn.CloseWrite()
+		tcpConn.CloseRead()
+	}
 
+	resp, err = pending.wait()
+	if err != nil {
+		return err
+	}
+	f.completionReply = resp
+	if !strings.HasPrefix(resp, "226") && !strings.HasPrefix(resp, "426") {
+		return fmt.Errorf("transfer did not complete successfully: %s", strings.TrimSpace(resp))
+	}
+	// only a transfer that ran to its end and that the server reports
+	// complete can be compared; after a 426 or an early close the counts
+	// differ for good reason
+	if !strings.HasPrefix(resp, "226") || stoppedEarly {
+		return nil
+	}
+	switch strings.ToUpper(verb) {
+	case "RETR", "STOR", "APPE", "STOU":
+		f.checkTransferStats(resp, counted.n)
+	}
+	return nil
+}
+
+// transferStats is what a server said about a finished transfer, as in
+// "226 Transfer complete. 1,234 bytes transferred. 5.6 KB/sec.".
+type transferStats struct {
+	bytes int64 // -1 when the reply gave no byte count
+	rate  string
+	local int64 // bytes counted by the client
+}
+
+var (
+	replyRate  = regexp.MustCompile(`(?i)\d+(?:\.\d+)?\s*[kmg]?(?:b|bytes?)(?:/s(?:ec)?|\s+per\s+second)`)
+	replyBytes = regexp.MustCompile(`(?i)\b(\d[\d,]*)\s+bytes\b`)
+)
+
+// parseTransferStats extracts the byte count and rate, when present, from a
+// possibly multi-line completion reply.
+func parseTransferStats(resp string) transferStats {
+	stats := transferStats{bytes: -1, rate: replyRate.FindString(resp)}
+	// drop the rate first so "12 bytes/sec" isn't taken for a byte count
+	if m := replyBytes.FindStringSubmatch(replyRate.ReplaceAllString(resp, "")); m != nil {
+		if n, err := strconv.ParseInt(strings.ReplaceAll(m[1], ",", ""), 10, 64); err == nil {
+			stats.bytes = n
+		}
+	}
+	return stats
+}
+
+// checkTransferStats keeps the statistics from a completion reply for
+// status, and warns when the server's byte count differs from the local
+// one, which usually means the transfer was cut short. ASCII transfers are
+// not compared, since line-ending conversion changes the size.
+func (f *FTPConnection) checkTransferStats(resp string, local int64) {
+	stats := parseTransferStats(resp)
+	if stats.bytes < 0 && stats.rate == "" {
+		return
+	}
+	stats.local = local
+	f.lastTransfer = &stats
+	if stats.bytes >= 0 && stats.bytes != local && f.serverType != "A" {
+		f.batch.finish()
+		f.out().Warn("server reports %d bytes transferred but %d were counted here - the transfer is likely truncated", stats.bytes, local)
+	}
+}
+
+// earlyReplyGrace is how long the data connection may stay open after the
+// server has already reported the transfer complete.
+const earlyReplyGrace = 30 * time.Second
+
+// completion reads a transfer's final control reply while its data is still
+// moving, since some servers send 226 before the data connection reaches EOF
+// and reading strictly afterwards can deadlock. The reply is only handed back,
+// and recorded, once the data side is finished.
+type completion struct {
+	f        *FTPConnection
+	dataConn net.Conn
+	dataDone chan struct{} // closed when the caller is done with the data
+	replied  chan struct{} // closed when resp and err are set
+	once     sync.Once
+	resp     string
+	err      error
+	early    bool // the reply arrived while data was still moving
+}
+
+// awaitCompletion starts reading the completion reply for the transfer on
+// dataConn. Every call must be matched by wait or abort.
+func (f *FTPConnection) awaitCompletion(dataConn net.Conn) *completion {
+	c := &completion{
+		f:        f,
+		dataConn: dataConn,
+		dataDone: make(chan struct{}),
+		replied:  make(chan struct{}),
+	}
+	go func() {
+		defer close(c.replied)
 		for {
-			line, err = f.reader.ReadString('\n')
-			if err != nil {
-				return "", err
+			c.resp, c.err = f.session.readResponse()
+			if netErr, ok := c.err.(net.Error); ok && netErr.Timeout() {
+				select {
+				case <-c.dataDone:
+				default:
+					// a long transfer outlasts the control read deadline
+					continue
+				}
 			}
-			fullResponse.WriteString(line)
+			break
+		}
+		select {
+		case <-c.dataDone:
+			return
+		default:
+		}
+		c.early = true
+		if c.err == nil && isSuccessResponse(c.resp) {
+			// the server has sent everything; don't wait forever for a
+			// data connection it never closes
+			dataConn.SetDeadline(time.Now().Add(earlyReplyGrace))
+		} else {
+			// the transfer failed; unblock the data side
+			dataConn.Close()
+		}
+	}()
+	return c
+}
+
+// wait returns the completion reply once the data side is finished.
+func (c *completion) wait() (string, error) {
+	c.once.Do(func() {
+		close(c.dataDone)
+		<-c.replied
+		if c.err == nil {
+			c.f.noteReply(c.resp)
+		}
+	})
+	return c.resp, c.err
+}
+
+// abort closes the data connection of a transfer that failed with err, and
+// collects the completion reply. If the server gave up first, its reply is
+// the more useful error and is returned instead.
+func (c *completion) abort(err error) error {
+	c.dataConn.Close()
+	resp, replyErr := c.wait()
+	if replyErr == nil && c.early && !isSuccessResponse(resp) {
+		return fmt.Errorf("server ended the transfer: %s", strings.TrimSpace(resp))
+	}
+	return err
+}
 
-			if len(line) >= 4 && line[:3] == code && line[3] == ' ' {
-				break
+// downloadFile retrieves remote into the local file path over a fresh
+// data connection and returns the number of bytes written. size is the
+// remote size if the caller already knows it, or -1 to ask with SIZE. Data
+// goes to local.part until the download is complete; one that stops short
+// keeps its .part file for resuming, and one cut off after a checkpoint (see
+// resume.go) continues from it.
+func (f *FTPConnection) downloadFile(remote, local string, size int64) (int64, error) {
+	if size < 0 {
+		if known, err := f.remoteSize(remote); err == nil {
+			size = known
+		}
+	}
+	offset := f.resumeJournal(remote, local, size).offset()
+	if offset > 0 {
+		f.out().Info("Resuming %s at %d bytes, its last checkpoint", remote, offset)
+	}
+	return f.downloadFrom(remote, local, size, offset)
+}
+
+// downloadFrom is downloadFile resuming at offset, keeping the first offset
+// bytes of local.part and fetching the rest with REST. It returns the bytes
+// fetched by this call.
+func (f *FTPConnection) downloadFrom(remote, local string, size, offset int64) (int64, error) {
+	offset = f.resumeCheck(remote, offset)
+	commands := f.transferCommands()
+	if err := f.sendTransferCommands(commands.pre, remote); err != nil {
+		return 0, err
+	}
+	n, err := f.fetchFile(remote, local, size, offset)
+	if err == nil {
+		err = f.sendTransferCommands(commands.post, remote)
+	}
+	f.recordTransfer("get", remote, local, offset+n, err)
+	return n, err
+}
+
+func (f *FTPConnection) fetchFile(remote, local string, size, offset int64) (int64, error) {
+	if size < 0 {
+		if known, err := f.remoteSize(remote); err == nil {
+			size = known
+		}
+	}
+
+	part := local + ".part"
+	file, err := os.OpenFile(part, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create file %s: %v", part, err)
+	}
+	defer file.Close()
+	if err := file.Truncate(offset); err != nil {
+		return 0, fmt.Errorf("failed to prepare %s: %v", part, err)
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("failed to prepare %s: %v", part, err)
+	}
+	// line-ending conversion changes the size, so ASCII transfers can't
+	// preallocate
+	preallocated := f.settings.preallocate && size > offset && f.serverType != "A"
+	if preallocated {
+		if err := preallocate(file, offset, size); err != nil {
+			file.Close()
+			if offset == 0 {
+				os.Remove(part)
 			}
+			return 0, fmt.Errorf("failed to reserve %d bytes for %s: %v", size, part, err)
 		}
 	}
 
-	return fullResponse.String(), nil
+	if _, err := f.prepareData(); err == nil && offset > 0 {
+		err = f.restartAt(offset)
+	}
+	if err != nil {
+		file.Close()
+		if offset == 0 {
+			os.Remove(part)
+		}
+		return 0, err
+	}
+	journal := f.resumeJournal(remote, local, size)
+	var n int64
+	err = f.transfer(fmt.Sprintf("RETR %s", remote), func(dataConn net.Conn) error {
+		n, err = io.Copy(newCheckpointWriter(file, journal, offset), dataConn)
+		if err != nil {
+			return fmt.Errorf("failed to write file: %v", err)
+		}
+		return nil
+	})
+	// line-ending conversion changes the size, so ASCII transfers can't be
+	// checked
+	if err == nil && size >= 0 && offset+n < size && f.serverType != "A" {
+		err = fmt.Errorf("download of %s is truncated: %d of %d bytes arrived", remote, offset+n, size)
+	}
+	if err != nil && preallocated {
+		// give back the space reserved for what didn't arrive
+		file.Truncate(offset + n)
+	}
+	if err != nil && offset+n > 0 && file.Sync() == nil {
+		// what arrived is on disk, so the next try can resume after it
+		journal.checkpoint(offset + n)
+	}
+	file.Close()
+	if err != nil {
+		if offset+n == 0 {
+			os.Remove(part)
+			journal.remove()
+			return 0, err
+		}
+		return n, fmt.Errorf("%w - partial data kept in %s", err, part)
+	}
+	journal.remove()
+	if err := os.Rename(part, local); err != nil {
+		return n, fmt.Errorf("failed to move %s into place: %v", part, err)
+	}
+	return n, nil
 }
 
-func (f *FTPConnection) sendCommand(cmd string) (string, error) {
-	// Refresh write deadline for this operation
-	f.conn.SetWriteDeadline(time.Now().Add(15 * time.Second))
+// downloadRange retrieves length bytes of remote starting at offset, using
+// REST to skip ahead and closing the data connection once length bytes have
+// arrived. A negative length reads to the end of the file.
+func (f *FTPConnection) downloadRange(remote, local string, offset, length int64) (int64, error) {
+	if offset > 0 && !f.restStream() {
+		return 0, fmt.Errorf("starting at an offset needs REST STREAM, which the server doesn't support")
+	}
+	file, err := os.Create(local)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create file %s: %v", local, err)
+	}
+	defer file.Close()
+	preallocated := f.settings.preallocate && length > 0 && f.serverType != "A"
+	if preallocated {
+		if err := preallocate(file, 0, length); err != nil {
+			file.Close()
+			os.Remove(local)
+			return 0, fmt.Errorf("failed to reserve %d bytes for %s: %v", length, local, err)
+		}
+	}
+
+	if _, err := f.prepareData(); err != nil {
+		return 0, err
+	}
+	if offset > 0 {
+		if err := f.restartAt(offset); err != nil {
+			return 0, err
+		}
+	}
+
+	var n int64
+	err = f.transfer(fmt.Sprintf("RETR %s", remote), func(dataConn net.Conn) error {
+		var src io.Reader = dataConn
+		if length >= 0 {
+			src = io.LimitReader(dataConn, length)
+		}
+		n, err = io.Copy(file, src)
+		if err != nil {
+			return fmt.Errorf("failed to write file: %v", err)
+		}
+		if length >= 0 && n == length {
+			return errStoppedEarly
+		}
+		return nil
+	})
+	// closing early makes some servers report the transfer as aborted
+	if err != nil && length >= 0 && n == length {
+		err = nil
+	}
+	if err == nil && preallocated && n < length {
+		// the file ended before length bytes
+		file.Truncate(n)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(local)
+	}
+	return n, err
+}
+
+// restartAt sends REST so the next RETR or STOR starts offset bytes in.
+func (f *FTPConnection) restartAt(offset int64) error {
+	resp, err := f.sendCommand(fmt.Sprintf("REST %d", offset))
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(resp, "350") {
+		f.closeDataListener()
+		return fmt.Errorf("REST failed: %s", strings.TrimSpace(resp))
+	}
+	return nil
+}
+
+// uploadFile stores the local file path as remote over a fresh data
+// connection and returns the number of bytes sent.
+func (f *FTPConnection) uploadFile(local, remote string) (int64, error) {
+	return f.uploadFrom(local, remote, 0)
+}
+
+// uploadFrom is uploadFile resuming at offset: the server keeps the first
+// offset bytes of remote and the rest of local is sent after REST.
+func (f *FTPConnection) uploadFrom(local, remote string, offset int64) (int64, error) {
+	file, err := os.Open(local)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open local file %s: %v", local, err)
+	}
+	defer file.Close()
+	offset = f.resumeCheck(remote, offset)
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := f.uploadStream(file, remote, offset)
+	f.recordTransfer("put", remote, local, offset+n, err)
+	return n, err
+}
+
+// uploadReader stores everything read from r as remote.
+func (f *FTPConnection) uploadReader(r io.Reader, remote string) (int64, error) {
+	return f.uploadStream(r, remote, 0)
+}
+
+func (f *FTPConnection) uploadStream(r io.Reader, remote string, offset int64) (int64, error) {
+	commands := f.transferCommands()
+	if err := f.sendTransferCommands(commands.pre, remote); err != nil {
+		return 0, err
+	}
+	f.applyUmask()
+	if _, err := f.prepareData(); err != nil {
+		return 0, err
+	}
+	if offset > 0 {
+		if err := f.restartAt(offset); err != nil {
+			return 0, err
+		}
+	}
+	br := bufio.NewReaderSize(r, binarySampleSize)
+	sample, _ := br.Peek(binarySampleSize)
+	if err := f.checkASCIIUpload(remote, sample); err != nil {
+		f.closeDataListener()
+		return 0, err
+	}
+	r = br
+	var n int64
+	err := f.transfer(fmt.Sprintf("STOR %s", remote), func(dataConn net.Conn) error {
+		var err error
+		n, err = io.Copy(dataConn, r)
+		if err != nil {
+			return fmt.Errorf("failed to upload file: %v", err)
+		}
+		return nil
+	})
+	if err == nil {
+		f.applyDefaultChmod(remote)
+		err = f.sendTransferCommands(commands.post, remote)
+	}
+	return n, err
+}
 
-	_, err := fmt.Fprintf(f.conn, "%s\r\n", cmd)
+// copyRemote copies src to dst on the server. It asks the server to do it with
+// SITE CPFR/CPTO and, where that isn't supported, streams the file down this
+// connection and back up a sibling one. It returns the bytes that passed
+// through the client, and whether the server did the copy itself.
+func (f *FTPConnection) copyRemote(src, dst string) (int64, bool, error) {
+	resp, err := f.sendCommand(fmt.Sprintf("SITE CPFR %s", src))
+	if err != nil {
+		return 0, false, err
+	}
+	if strings.HasPrefix(resp, "350") {
+		resp, err = f.sendCommand(fmt.Sprintf("SITE CPTO %s", dst))
+		if err != nil {
+			return 0, false, err
+		}
+		if !isSuccessResponse(resp) {
+			return 0, true, fmt.Errorf("SITE CPTO failed: %s", strings.TrimSpace(resp))
+		}
+		return 0, true, nil
+	}
+	// 500/502/504 mean the server lacks CPFR; anything else is a real error
+	if !strings.HasPrefix(resp, "50") {
+		return 0, false, fmt.Errorf("SITE CPFR failed: %s", strings.TrimSpace(resp))
+	}
+
+	// a control connection runs one transfer at a time, so the upload needs
+	// its own
+	sibling, err := f.openSibling()
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to open connection for upload: %v", err)
+	}
+	defer func() {
+		sibling.sendCommand("QUIT")
+		sibling.Close()
+	}()
+
+	var n int64
+	if _, err := f.prepareData(); err != nil {
+		return 0, false, err
+	}
+	err = f.transfer(fmt.Sprintf("RETR %s", src), func(dataConn net.Conn) error {
+		// only start the upload once the source is known to be readable, so
+		// a failed RETR leaves no empty dst behind
+		pr, pw := io.Pipe()
+		uploaded := make(chan error, 1)
+		go func() {
+			_, err := sibling.prepareData()
+			if err == nil {
+				err = sibling.transfer(fmt.Sprintf("STOR %s", dst), func(dataConn net.Conn) error {
+					n, err = io.Copy(dataConn, pr)
+					return err
+				})
+			}
+			// unblock the download if the upload gave up
+			pr.CloseWithError(err)
+			uploaded <- err
+		}()
+
+		_, err := io.Copy(pw, dataConn)
+		pw.CloseWithError(err)
+		if uploadErr := <-uploaded; err == nil {
+			err = uploadErr
+		}
+		return err
+	})
+	return n, false, err
+}
+
+// currentDir returns the server's working directory as reported by PWD.
+func (f *FTPConnection) currentDir() (string, error) {
+	resp, err := f.sendCommand("PWD")
 	if err != nil {
 		return "", err
 	}
+	if !strings.HasPrefix(resp, "257") {
+		return "", fmt.Errorf("PWD failed: %s", strings.TrimSpace(resp))
+	}
+	_, after, found := strings.Cut(resp, "\"")
+	if !found {
+		return "", fmt.Errorf("unexpected PWD reply: %s", strings.TrimSpace(resp))
+	}
+	dir, _, found := strings.Cut(after, "\"")
+	if !found {
+		return "", fmt.Errorf("unexpected PWD reply: %s", strings.TrimSpace(resp))
+	}
+	return dir, nil
+}
+
+// makeRemoteDirs creates every missing directory along dir, probing each
+// level with CWD and issuing MKD where the probe fails. The working directory
+// is restored afterwards.
+func (f *FTPConnection) makeRemoteDirs(dir string) error {
+	start, err := f.currentDir()
+	if err != nil {
+		return err
+	}
+	defer f.sendCommand(fmt.Sprintf("CWD %s", start))
 
-	return f.readResponse()
+	if strings.HasPrefix(dir, "/") {
+		if resp, err := f.sendCommand("CWD /"); err != nil {
+			return err
+		} else if !isSuccessResponse(resp) {
+			return fmt.Errorf("CWD failed: %s", strings.TrimSpace(resp))
+		}
+	}
+
+	for _, part := range strings.Split(dir, "/") {
+		if part == "" || part == "." {
+			continue
+		}
+		resp, err := f.sendCommand(fmt.Sprintf("CWD %s", part))
+		if err != nil {
+			return err
+		}
+		if isSuccessResponse(resp) {
+			continue
+		}
+
+		resp, err = f.sendCommand(fmt.Sprintf("MKD %s", part))
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(resp, "257") {
+			return fmt.Errorf("MKD %s failed: %s", part, strings.TrimSpace(resp))
+		}
+		resp, err = f.sendCommand(fmt.Sprintf("CWD %s", part))
+		if err != nil {
+			return err
+		}
+		if !isSuccessResponse(resp) {
+			return fmt.Errorf("CWD failed: %s", strings.TrimSpace(resp))
+		}
+	}
+	return nil
+}
+
+// controlHostAddr keeps the port of a passive data address but replaces its
+// host with the control connection's, for devices behind NAT that advertise
+// their private address in PASV replies.
+func (f *FTPConnection) controlHostAddr(addr string) (string, error) {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("invalid data address %s: %v", addr, err)
+	}
+	host, _, err := net.SplitHostPort(f.session.RemoteAddr().String())
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// pasvBehindNAT reports whether a PASV reply's address is the server's own
+// behind NAT: unspecified, or private or loopback when the control
+// connection reached the server at a public address.
+func (f *FTPConnection) pasvBehindNAT(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	ip := net.ParseIP(host)
+	remote, ok := f.session.RemoteAddr().(*net.TCPAddr)
+	if err != nil || ip == nil || !ok || ip.Equal(remote.IP) {
+		return false
+	}
+	if ip.IsUnspecified() {
+		return true
+	}
+	public := !remote.IP.IsPrivate() && !remote.IP.IsLoopback()
+	return public && (ip.IsPrivate() || ip.IsLoopback())
+}
+
+// checkDataAddr rejects passive data addresses a well-behaved server would
+// never send, since a malicious one could otherwise aim the data connection
+// at an arbitrary host. With relaxPasv only the port is checked.
+func (f *FTPConnection) checkDataAddr(addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid data address %s: %v", addr, err)
+	}
+	if port, err := strconv.Atoi(portStr); err != nil || port < 1 || port > 65535 {
+		return fmt.Errorf("invalid data port %s", portStr)
+	}
+	if f.relaxPasv {
+		return nil
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("invalid data address %s", host)
+	}
+	if ip4 := ip.To4(); ip.IsUnspecified() || ip.IsMulticast() || (ip4 != nil && (ip4[0] == 0 || ip4[0] >= 240)) {
+		return fmt.Errorf("server sent reserved data address %s - use -relax-pasv to allow", host)
+	}
+
+	controlHost, _, err := net.SplitHostPort(f.session.RemoteAddr().String())
+	if err != nil {
+		return err
+	}
+	if !ip.Equal(net.ParseIP(controlHost)) {
+		return fmt.Errorf("server sent data address %s, which differs from control host %s - use -relax-pasv to allow", host, controlHost)
+	}
+	return nil
+}
+
+func (f *FTPConnection) readResponse() (string, error) {
+	f.session.setReplyTimeout(f.settings.replyTimeout)
+	resp, err := f.session.readResponse()
+	if err != nil {
+		return "", err
+	}
+	resp = f.fromServer(resp)
+	f.noteReply(resp)
+	return resp, nil
+}
+
+// noteReply records a reply read outside sendCommand, which may complete a
+// file transfer.
+func (f *FTPConnection) noteReply(resp string) {
+	f.recorder.reply(resp)
+	if f.activeTransfer != nil {
+		f.activeTransfer.done(resp)
+		f.activeTransfer = nil
+	}
+}
+
+// writeVerbs are the FTP commands that modify the server, blocked in
+// read-only mode whichever command issues them.
+var writeVerbs = map[string]bool{
+	"STOR": true, "STOU": true, "APPE": true, "DELE": true, "RNFR": true,
+	"RNTO": true, "MKD": true, "RMD": true, "SITE": true, "MFMT": true,
+}
+
+// quitReplyTimeout bounds the wait for QUIT's reply, so a server that
+// neither answers nor closes doesn't hold up the exit.
+const quitReplyTimeout = 5 * time.Second
+
+func (f *FTPConnection) sendCommand(cmd string) (string, error) {
+	verb, _, _ := strings.Cut(cmd, " ")
+	verb = strings.ToUpper(verb)
+	if f.settings.readOnly && writeVerbs[verb] {
+		return "", fmt.Errorf("%s refused in read-only mode", verb)
+	}
+	if f.aborting.Load() && verb != "QUIT" {
+		return "", errAborted
+	}
+	wire, err := f.toServer(cmd)
+	if err != nil {
+		return "", err
+	}
+	// cached listings are keyed by the path as typed, so they go stale both
+	// when the server changes and when relative paths change meaning
+	if writeVerbs[verb] || verb == "CWD" || verb == "CDUP" {
+		f.listings = nil
+	}
+	if verb == "CWD" || verb == "CDUP" || verb == "USER" {
+		f.workDir = ""
+	}
+	if verb == "USER" {
+		f.umaskSent, f.mlstSelected = "", false
+	}
+
+	if f.activeTransfer != nil {
+		// a handler gave up without reading the completion reply
+		f.activeTransfer.done("")
+		f.activeTransfer = nil
+	}
+
+	f.budget.pace(f.settings.commandDelay)
+	f.recorder.command(cmd)
+	timeout := f.settings.replyTimeout
+	if verb == "QUIT" {
+		f.quitSent = true
+		timeout = min(timeout, quitReplyTimeout)
+	}
+	f.session.setReplyTimeout(timeout)
+	sent := time.Now()
+	quiet := sent.Sub(f.lastCommand)
+	f.lastCommand = sent
+	resp, err := f.session.sendCommand(wire)
+	if err != nil && verb == "QUIT" && !isTimeout(err) && f.isConnectionDead(err) {
+		// closing without a 221 still does what QUIT asks
+		return "", nil
+	}
+	if err != nil {
+		f.stats.unanswered(verb, isTimeout(err))
+	} else {
+		f.stats.reply(verb, resp, time.Since(sent))
+	}
+	if isTimeout(err) && verb != "QUIT" {
+		return "", f.recoverControl(verb, err)
+	}
+	if err != nil {
+		return "", err
+	}
+	resp = f.fromServer(resp)
+	f.recorder.reply(resp)
+	if strings.HasPrefix(resp, "421") {
+		f.noteClosed(resp, quiet)
+	}
+	if strings.HasPrefix(resp, "150") || strings.HasPrefix(resp, "125") {
+		_, path, _ := strings.Cut(cmd, " ")
+		f.activeTransfer = f.events.startTransfer(verb, path)
+	}
+	return resp, nil
 }
 
 func (f *FTPConnection) startKeepAlive() {
+	f.stopKeepAlive() // re-authenticating must not leak a second goroutine
 	f.keepaliveStop = make(chan struct{})
 	f.keepaliveDone = make(chan struct{})
 
 	go func() {
 		defer close(f.keepaliveDone)
-		normalInterval := 30 * time.Second
-		extendedInterval := 2 * time.Minute
+		normalInterval, extendedInterval := f.keepaliveIntervals()
 		ticker := time.NewTicker(normalInterval)
 		consecutiveSuccess := 0
 		defer ticker.Stop()
@@ -157,20 +1370,35 @@ func (f *FTPConnection) startKeepAlive() {
 		for {
 			select {
 			case <-ticker.C:
-				if f.isAuthenticated {
+				// a command in progress keeps the connection alive itself, and a
+				// NOOP now would take the reply it is waiting for
+				if f.isAuthenticated && f.control.TryLock() {
+					if f.idle {
+						// a timed-out reply dropped the connection, and the
+						// next command reconnects
+						f.control.Unlock()
+						continue
+					}
 					resp, err := f.sendCommand("NOOP")
+					f.control.Unlock()
+					f.stats.keepalive(err)
 					if err != nil {
 						if f.isConnectionDead(err) {
-							fmt.Printf("\n*** Server connection lost: %v ***\n", err)
+							if f.quitSent {
+								f.out().Info("Server closed the connection after QUIT")
+							} else {
+								f.out().Error(fmt.Errorf("server connection lost: %v", err))
+							}
 							close(f.connectionLost) // signal to main
 						} else {
-							fmt.Printf("\n Keepalive failed: %v\n", err)
+							f.out().Warn("keepalive failed: %v", err)
 							consecutiveSuccess = 0
 						}
 						return
 					}
-					// Clean keepalive display - use \r to overwrite prompt temporarily
-					fmt.Printf("\rKeepalive: %s\ngo-ftp> ", strings.TrimSpace(resp))
+					// printed above the prompt, which is drawn again with
+					// whatever has been typed after it
+					f.out().Info("Keepalive: %s", strings.TrimSpace(resp))
 					consecutiveSuccess++
 					if consecutiveSuccess > 5 {
 						ticker.Reset(extendedInterval)
@@ -194,10 +1422,8 @@ func (f *FTPConnection) isConnectionDead(err error) bool {
 		return true
 	}
 
-	if netErr, ok := err.(net.Error); ok {
-		if netErr.Timeout() {
-			return true
-		}
+	if isTimeout(err) {
+		return true
 	}
 
 	errStr := err.Error()
@@ -215,71 +1441,274 @@ func (f *FTPConnection) stopKeepAlive() {
 	if f.keepaliveStop != nil {
 		close(f.keepaliveStop)
 		<-f.keepaliveDone // wait for goroutine to finish
+		f.keepaliveStop = nil
 	}
 }
 
+// shutdown is the single exit path for quit, EOF, SIGTERM, and connection
+// loss: it drains the keepalive goroutine, says QUIT while the server is still
+// reachable, and closes the control connection.
+func (f *FTPConnection) shutdown(sayQuit bool) {
+	f.stopKeepAlive()
+	f.events.metrics(f.stats.metrics())
+	if n := f.queue.pending(); n > 0 {
+		f.out().Warn("abandoning %d queued transfers", n)
+	}
+	f.queue.close()
+	if sayQuit {
+		if resp, err := f.sendCommand("QUIT"); err == nil && resp != "" {
+			f.out().Reply(resp)
+		}
+	}
+	f.Close()
+}
+
+// cleanInput splits a REPL line into words. Double quotes make one word of
+// text with spaces, as in --precmd "SITE UMASK 022". Only the command name is
+// lowercased; arguments such as remote paths are case-sensitive.
 func cleanInput(input string) []string {
-	return strings.Fields(strings.ToLower(strings.TrimSpace(input)))
+	words := splitQuoted(input)
+	if len(words) > 0 {
+		words[0] = strings.ToLower(words[0])
+	}
+	return words
+}
+
+// splitQuoted is strings.Fields, except that spaces between double quotes
+// don't split a word and the quotes themselves are dropped.
+func splitQuoted(input string) []string {
+	if !strings.Contains(input, `"`) {
+		return strings.Fields(input)
+	}
+	var words []string
+	var word strings.Builder
+	inWord, quoted := false, false
+	for _, r := range input {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			inWord = true
+		case !quoted && unicode.IsSpace(r):
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words
 }
 
 func (f *FTPConnection) Close() error {
-	return f.conn.Close()
+	f.recorder.close()
+	f.probes.close()
+	f.budget.release(f)
+	return f.session.Close()
+}
+
+// execute runs one command line through the command registry, piping its
+// output through any filters that follow a | and into a local file after a
+// trailing > or >>.
+func (f *FTPConnection) execute(line string) error {
+	if command, target, appending, ok := splitRedirect(line); ok {
+		return f.executeRedirected(command, target, appending)
+	}
+	if command, filters := splitPipeline(line); len(filters) > 0 {
+		return f.executePiped(command, filters)
+	}
+	args := cleanInput(line)
+	if len(args) == 0 {
+		return nil
+	}
+	cmd, ok := commandRegistry[args[0]]
+	if !ok {
+		if file, found := findPlugin(args[0]); found {
+			return f.runPlugin(file, args)
+		}
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+	if cmd.writes && f.settings.readOnly {
+		return fmt.Errorf("%s is disabled in read-only mode - use 'set readonly off' to allow it", args[0])
+	}
+	if question := f.confirmation(cmd, args); question != "" {
+		answer, err := promptLine(question + " [y/N] ")
+		if err != nil {
+			return err
+		}
+		if a := strings.ToLower(strings.TrimSpace(answer)); a != "y" && a != "yes" {
+			f.out().Info("Cancelled.")
+			return nil
+		}
+	}
+	return cmd.callback(f, args[1:])
+}
+
+// confirmation returns the question to ask before running the command line
+// args under the confirm policy, or "" to run it straight away. Prompts are only issued
+// when a user is at the terminal to answer them.
+func (f *FTPConnection) confirmation(cmd cliCommand, args []string) string {
+	if f.settings.confirm == "never" || !stdinIsTerminal() {
+		return ""
+	}
+	if cmd.destructive != nil {
+		if question := cmd.destructive(args[1:]); question != "" {
+			return question
+		}
+	}
+	if f.settings.confirm == "all" && cmd.writes {
+		return fmt.Sprintf("Run %s?", strings.Join(args, " "))
+	}
+	return ""
+}
+
+// runInitCommands executes the profile's post-login commands once per
+// session. Failures are reported but don't stop the remaining commands; a
+// quit does, and is returned so the session ends.
+func (f *FTPConnection) runInitCommands() error {
+	commands := f.initCommands
+	f.initCommands = nil
+	for i, line := range commands {
+		line, err := expandTemplate(fmt.Sprintf("init[%d]", i+1), line)
+		if err != nil {
+			f.out().Error(err)
+			f.events.error(err)
+			continue
+		}
+		f.out().Info("[init] %s", line)
+		f.commands.begin(line)
+		if err := f.execute(line); errors.Is(err, errQuit) {
+			return err
+		} else if err != nil {
+			f.out().Error(err)
+			f.events.error(err)
+			f.commands.fail()
+		}
+	}
+	return nil
+}
+
+// runLocked runs a REPL line. The caller holds f.control, which is released
+// when the line is done, or when its background job is if it ends in &.
+func (f *FTPConnection) runLocked(input string) error {
+	if f.idle && strings.TrimSpace(input) != "" {
+		if err := f.reconnect(); err != nil {
+			f.control.Unlock()
+			return err
+		}
+	}
+	if command, ok := backgroundCommand(input); ok {
+		return f.startBackground(command)
+	}
+	defer f.control.Unlock()
+	return f.execute(input)
 }
 
 func (f *FTPConnection) StartREPL() {
+	defer restoreTerminal()
 
 	welcome, err := f.readResponse()
 	if err != nil {
-		fmt.Printf("Error reading welcome message: %v\n", err)
+		f.out().Error(fmt.Errorf("error reading welcome message: %v", err))
+		f.events.error(fmt.Errorf("error reading welcome message: %v", err))
+		f.commands.fail()
 		return
 	}
-	fmt.Print(welcome)
+	f.machine.hello(f.addr, f.user)
+	f.out().Reply(welcome)
+	f.noteGreeting(welcome)
+	f.events.connected(f.addr, welcome)
 
-	// Create input channel and start input reader goroutine
-	inputChan := make(chan string)
-	go func() {
-		scanner := bufio.NewScanner(os.Stdin)
-		for {
-			if scanner.Scan() {
-				inputChan <- scanner.Text()
-			} else {
-				close(inputChan)
-				return
-			}
-		}
-	}()
+	inputChan := inputLines()
+
+	defer f.watchStopSignals()()
 
 	// Initial prompt
-	fmt.Print("go-ftp> ")
+	showPrompt(func() { f.out().Prompt("go-ftp> ") })
+	requestLine()
 
 	// Main REPL loop
 	for {
 		select {
+		case <-f.idleExpiry():
+			if f.control.TryLock() {
+				f.disconnectIdle()
+				f.control.Unlock()
+			}
 		case <-f.connectionLost:
-			fmt.Printf("*** Shutting down gracefully ***\n")
-			f.stopKeepAlive()
-			f.Close()
+			endPrompt()
+			f.out().Info("*** Shutting down gracefully ***")
+			if !f.quitSent {
+				f.commands.fail()
+			}
+			f.shutdown(false)
+			return
+		case <-f.terminating:
+			f.endOnSignal()
 			return
 		case input, ok := <-inputChan:
+			if f.terminated() {
+				// the signal came while the last command ran
+				f.endOnSignal()
+				return
+			}
 			if !ok {
 				// Input channel closed (EOF)
-				fmt.Printf("\nGoodbye!\n")
-				f.stopKeepAlive()
-				f.Close()
+				f.out().Prompt("\n")
+				if f.inBackground() {
+					f.out().Info("Waiting for the background %s to finish...", f.background.command)
+				}
+				f.control.Lock()
+				f.out().Info("Goodbye!")
+				f.shutdown(true)
 				return
 			}
-			args := cleanInput(input)
-			if len(args) > 0 {
-				if cmd, ok := commandRegistry[args[0]]; ok {
-					err := cmd.callback(f, args[1:])
-					if err != nil {
-						fmt.Printf("Error: %v\n", err)
-					}
-				} else {
-					fmt.Println("Unknown command")
+			var request machineRequest
+			if f.machine != nil {
+				if strings.TrimSpace(input) == "" {
+					requestLine()
+					continue
 				}
+				var err error
+				if request, err = parseMachineRequest(input); err != nil {
+					f.machine.result(nil, err)
+					requestLine()
+					continue
+				}
+				input = request.Line
+			}
+			f.commands.begin(input)
+			var err error
+			if f.control.TryLock() {
+				err = f.runLocked(input)
+			} else {
+				err = f.runAlongside(input)
+			}
+			if errors.Is(err, errQuit) {
+				f.machine.result(request.ID, nil)
+				f.out().Info("Goodbye!")
+				f.shutdown(true)
+				return
+			}
+			if err != nil {
+				f.out().Error(err)
+				f.events.error(err)
+				f.commands.fail()
+			}
+			f.machine.result(request.ID, err)
+			if f.quitSent && !f.idle {
+				// the command sent QUIT itself, e.g. with --precmd
+				f.out().Info("Goodbye!")
+				f.shutdown(false)
+				return
 			}
-			fmt.Print("go-ftp> ")
+			showPrompt(func() { f.out().Prompt("go-ftp> ") })
+			requestLine()
 		}
 	}
 }
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The byte count in a completion reply is only compared with the bytes read
+// when the transfer ran to its end and the server reports it complete.
+func TestTransferStatsCheck(t *testing.T) {
+	content := strings.Repeat("x", 100)
+	tests := []struct {
+		name string
+		args []string
+		end  string
+		warn bool
+	}{
+		{"counts agree", nil, "226 Transfer complete. 100 bytes transferred.", false},
+		{"truncated", nil, "226 Transfer complete. 200 bytes transferred.", true},
+		{"ranged to the end", []string{"--length", "500"}, "226 Transfer complete. 200 bytes transferred.", true},
+		{"ranged and closed early", []string{"--length", "10"}, "226 Transfer complete. 100 bytes transferred.", false},
+		{"ranged with 426", []string{"--length", "500"}, "426 Connection closed; 200 bytes transferred.", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTempDirs(t)
+			s := newFakeSession().withFeatures("SIZE", "REST STREAM")
+			s.files["RETR data.bin"] = content
+			s.ends["RETR data.bin"] = tt.end
+			f, out := newFakeConnection(s)
+
+			args := append(tt.args, "data.bin", filepath.Join(t.TempDir(), "data.bin"))
+			if err := handleGet(f, args); err != nil {
+				t.Fatalf("get: %v\n%s", err, out)
+			}
+			if warned := strings.Contains(out.String(), "likely truncated"); warned != tt.warn {
+				t.Errorf("truncation warning = %v, want %v, after %q\n%s", warned, tt.warn, tt.end, out)
+			}
+		})
+	}
+}
+
+// closingSession is a server that answers QUIT by closing the connection.
+type closingSession struct {
+	*fakeSession
+	timeout time.Duration // the last reply timeout set
+}
+
+func (s *closingSession) sendCommand(cmd string) (string, error) {
+	if strings.HasPrefix(cmd, "QUIT") {
+		s.fakeSession.sendCommand(cmd)
+		return "", io.EOF
+	}
+	return s.fakeSession.sendCommand(cmd)
+}
+
+func (s *closingSession) setReplyTimeout(d time.Duration) { s.timeout = d }
+
+func TestQuitWithoutReply(t *testing.T) {
+	s := &closingSession{fakeSession: newFakeSession()}
+	f := newFTPConnection(s, "127.0.0.1:21", "user", "pass")
+	f.stdout = io.Discard
+	resp, err := f.sendCommand("QUIT")
+	if resp != "" || err != nil {
+		t.Errorf("QUIT answered by a close = %q, %v, want no reply and no error", resp, err)
+	}
+	if !f.quitSent {
+		t.Error("QUIT wasn't recorded as sent")
+	}
+	if s.timeout > quitReplyTimeout {
+		t.Errorf("QUIT's reply was waited for up to %v", s.timeout)
+	}
+	if _, err := f.sendCommand("NOOP"); err != nil {
+		t.Fatal(err)
+	}
+	if s.timeout != f.settings.replyTimeout {
+		t.Errorf("the next command's reply timeout is %v, want the reply-timeout setting", s.timeout)
+	}
+}
+
+// A QUIT sent around a transfer ends the session, and the transfer fails
+// saying so rather than with the closed connection's error.
+func TestQuitAsPrecmd(t *testing.T) {
+	s := &closingSession{fakeSession: newFakeSession()}
+	f := newFTPConnection(s, "127.0.0.1:21", "user", "pass")
+	f.isAuthenticated = true
+	f.stdout = io.Discard
+	local := filepath.Join(t.TempDir(), "up.txt")
+	os.WriteFile(local, []byte("data"), 0644)
+	err := handlePut(&f, []string{"--precmd", "QUIT", local})
+	if err == nil || !strings.Contains(err.Error(), "QUIT ended the session") {
+		t.Errorf("put --precmd QUIT = %v", err)
+	}
+	if _, ok := s.uploads["STOR up.txt"]; ok {
+		t.Error("the upload went ahead after QUIT")
+	}
+}
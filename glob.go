@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// remoteMatch is a remote path produced by glob expansion.
+type remoteMatch struct {
+	path  string
+	entry RemoteEntry
+}
+
+// hasGlobMeta reports whether s contains any glob metacharacters.
+func hasGlobMeta(s string) bool {
+	return strings.ContainsAny(s, "*?[")
+}
+
+// shellPattern rewrites the shell's [!...] negated classes as path.Match's
+// [^...].
+func shellPattern(pattern string) string {
+	if !strings.Contains(pattern, "[!") {
+		return pattern
+	}
+	b := []byte(pattern)
+	for i := 0; i < len(b)-1; i++ {
+		switch {
+		case b[i] == '\\':
+			i++
+		case b[i] == '[' && b[i+1] == '!':
+			b[i+1] = '^'
+		}
+	}
+	return string(b)
+}
+
+// joinRemote joins a directory from a walk with an entry name, leaving names
+// in the working directory unprefixed.
+func joinRemote(dir, name string) string {
+	if dir == "" {
+		return name
+	}
+	return path.Join(dir, name)
+}
+
+// expandGlob expands a remote pattern using listings of each directory it
+// touches. Segments use path.Match syntax (*, ?, [...]), with the shell's
+// [!...] for a negated class; a "**" segment
+// matches any number of directories, including none. A pattern without
+// metacharacters is returned as-is, without checking that it exists.
+func (f *FTPConnection) expandGlob(pattern string) ([]remoteMatch, error) {
+	if !hasGlobMeta(pattern) {
+		return []remoteMatch{{path: pattern, entry: RemoteEntry{name: path.Base(pattern)}}}, nil
+	}
+
+	base := ""
+	if strings.HasPrefix(pattern, "/") {
+		base = "/"
+	}
+	segs := strings.Split(strings.Trim(pattern, "/"), "/")
+	for _, seg := range segs {
+		if _, err := path.Match(seg, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+	}
+
+	var matches []remoteMatch
+	if err := f.globFrom(base, segs, false, &matches); err != nil {
+		return nil, err
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].path < matches[j].path })
+	return matches, nil
+}
+
+// globFrom matches segs against the tree below dir, appending hits to out.
+// Beneath a wildcard (wild), dir's literal subdirectories may not exist, so
+// they are looked for in its listing.
+func (f *FTPConnection) globFrom(dir string, segs []string, wild bool, out *[]remoteMatch) error {
+	seg, rest := segs[0], segs[1:]
+
+	// literal directories are entered without listing their parent, unless
+	// the server's case must be found
+	if !hasGlobMeta(seg) && len(rest) > 0 && !f.settings.caseFold && !wild {
+		return f.globFrom(joinRemote(dir, seg), rest, false, out)
+	}
+
+	if seg == "**" && len(rest) > 0 {
+		// zero directories: match the rest right here
+		if err := f.globFrom(dir, rest, true, out); err != nil {
+			return err
+		}
+	}
+
+	entries, err := f.listDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		child := joinRemote(dir, entry.name)
+		switch {
+		case seg == "**" && len(rest) == 0:
+			// trailing ** matches everything beneath dir
+			*out = append(*out, remoteMatch{path: child, entry: entry})
+			if entry.isDir() {
+				if err := f.globFrom(child, segs, true, out); err != nil {
+					return err
+				}
+			}
+		case seg == "**":
+			if entry.isDir() {
+				if err := f.globFrom(child, segs, true, out); err != nil {
+					return err
+				}
+			}
+		default:
+			if !matchName(seg, entry.name, f.settings.caseFold) {
+				continue
+			}
+			if len(rest) == 0 {
+				*out = append(*out, remoteMatch{path: child, entry: entry})
+			} else if entry.isDir() {
+				if err := f.globFrom(child, rest, true, out); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// resolveEntry returns the entry for a match. Literal patterns come back from
+// expandGlob without a type, so it is looked up in the parent's listing.
+func (f *FTPConnection) resolveEntry(m remoteMatch) RemoteEntry {
+	if m.entry.kind != "" {
+		return m.entry
+	}
+	clean := path.Clean(m.path)
+	if clean == "." || clean == "/" || path.Base(clean) == ".." {
+		return RemoteEntry{name: clean, kind: "dir"}
+	}
+	dir := path.Dir(clean)
+	if dir == "." {
+		dir = ""
+	}
+	entries, err := f.listDir(dir)
+	if err != nil {
+		return m.entry
+	}
+	for _, entry := range entries {
+		if nameKey(entry.name, f.settings.caseFold) == nameKey(path.Base(clean), f.settings.caseFold) {
+			return entry
+		}
+	}
+	return m.entry
+}
+
+// expandGlobs expands every pattern, reporting patterns that match nothing.
+func (f *FTPConnection) expandGlobs(patterns []string) ([]remoteMatch, error) {
+	var all []remoteMatch
+	for _, pattern := range patterns {
+		matches, err := f.expandGlob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 {
+			f.out().Info("No match for %s", pattern)
+		}
+		all = append(all, matches...)
+	}
+	return all, nil
+}
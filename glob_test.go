@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// globTree is the remote tree the glob tests expand patterns against, as
+// paths from the working directory; directories end in a slash.
+var globTree = []string{
+	"a.txt", "b.txt", "ab.log", "README.md",
+	"src/", "src/main.go", "src/util.go",
+	"src/lib/", "src/lib/x.go",
+	"src/lib/deep/", "src/lib/deep/y.go",
+	"docs/", "docs/guide.txt", "docs/Notes.TXT",
+}
+
+// globListings scripts s with a listing of every directory in globTree,
+// in MLSD or LIST form.
+func globListings(s *fakeSession, mlsd bool) {
+	listings := map[string]*strings.Builder{"": {}}
+	for _, p := range globTree {
+		name, isDir := strings.TrimSuffix(p, "/"), strings.HasSuffix(p, "/")
+		dir := path.Dir(name)
+		if dir == "." {
+			dir = ""
+		}
+		if isDir {
+			listings[name] = &strings.Builder{}
+		}
+		b := listings[dir]
+		switch {
+		case mlsd && isDir:
+			fmt.Fprintf(b, "type=dir;modify=20240101000000; %s\r\n", path.Base(name))
+		case mlsd:
+			fmt.Fprintf(b, "type=file;size=10;modify=20240101000000; %s\r\n", path.Base(name))
+		case isDir:
+			fmt.Fprintf(b, "drwxr-xr-x   2 ftp      ftp          4096 Jan 01  2024 %s\r\n", path.Base(name))
+		default:
+			fmt.Fprintf(b, "-rw-r--r--   1 ftp      ftp            10 Jan 01  2024 %s\r\n", path.Base(name))
+		}
+	}
+	verb := "LIST"
+	if mlsd {
+		verb = "MLSD"
+		s.withFeatures("MLSD", "MLST type*;size*;modify*;")
+	}
+	for dir, b := range listings {
+		cmd := verb
+		if dir != "" {
+			cmd += " " + dir
+		}
+		s.files[cmd] = b.String()
+	}
+}
+
+func TestExpandGlob(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		caseFold bool
+		want     []string
+		listed   []string // the directories listed, when the test is about which
+	}{
+		{pattern: "*.txt", want: []string{"a.txt", "b.txt"}},
+		{pattern: "?.txt", want: []string{"a.txt", "b.txt"}},
+		{pattern: "a*", want: []string{"a.txt", "ab.log"}},
+		{pattern: "[ab].*", want: []string{"a.txt", "b.txt"}},
+		{pattern: "[!a]*.txt", want: []string{"b.txt"}},
+		{pattern: "[A-Z]*", want: []string{"README.md"}},
+		{pattern: "*.none", want: nil},
+		// ** at the start, in the middle, and at the end
+		{pattern: "**/*.go", want: []string{"src/lib/deep/y.go", "src/lib/x.go", "src/main.go", "src/util.go"}},
+		{pattern: "src/**/*.go", want: []string{"src/lib/deep/y.go", "src/lib/x.go", "src/main.go", "src/util.go"}},
+		{pattern: "src/**/deep/*.go", want: []string{"src/lib/deep/y.go"}},
+		{pattern: "src/**", want: []string{"src/lib", "src/lib/deep", "src/lib/deep/y.go", "src/lib/x.go", "src/main.go", "src/util.go"}},
+		// literal leading directories are entered without listing their parents
+		{pattern: "src/lib/*.go", want: []string{"src/lib/x.go"}, listed: []string{"src/lib"}},
+		{pattern: "src/*/*.go", want: []string{"src/lib/x.go"}, listed: []string{"src", "src/lib"}},
+		// after a wildcard they are looked for in each match's listing
+		{pattern: "*/lib/*.go", want: []string{"src/lib/x.go"}, listed: []string{"", "docs", "src", "src/lib"}},
+		// case folding
+		{pattern: "docs/*.txt", want: []string{"docs/guide.txt"}},
+		{pattern: "docs/*.txt", caseFold: true, want: []string{"docs/Notes.TXT", "docs/guide.txt"}},
+		{pattern: "DOCS/G*", caseFold: true, want: []string{"docs/guide.txt"}, listed: []string{"", "docs"}},
+		{pattern: "readme.*", caseFold: true, want: []string{"README.md"}},
+	}
+	for _, backend := range []string{"MLSD", "LIST"} {
+		for _, tt := range tests {
+			name := fmt.Sprintf("%s/%s", backend, tt.pattern)
+			if tt.caseFold {
+				name += "/casefold"
+			}
+			t.Run(name, func(t *testing.T) {
+				s := newFakeSession()
+				globListings(s, backend == "MLSD")
+				f, _ := newFakeConnection(s)
+				f.settings.caseFold = tt.caseFold
+
+				matches, err := f.expandGlob(tt.pattern)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var got []string
+				for _, m := range matches {
+					got = append(got, m.path)
+				}
+				if !slices.Equal(got, tt.want) {
+					t.Errorf("expandGlob(%q) = %q, want %q", tt.pattern, got, tt.want)
+				}
+				if tt.listed == nil {
+					return
+				}
+				var listed []string
+				for _, cmd := range s.sentCommands() {
+					if verb, dir, _ := strings.Cut(cmd, " "); verb == backend {
+						listed = append(listed, dir)
+					}
+				}
+				sort.Strings(listed)
+				if !slices.Equal(listed, tt.listed) {
+					t.Errorf("expandGlob(%q) listed %q, want %q", tt.pattern, listed, tt.listed)
+				}
+			})
+		}
+	}
+}
+
+func TestExpandGlobLiteral(t *testing.T) {
+	s := newFakeSession()
+	f, _ := newFakeConnection(s)
+	matches, err := f.expandGlob("src/main.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 || matches[0].path != "src/main.go" {
+		t.Errorf("expandGlob of a literal path = %v, want it back as-is", matches)
+	}
+	if sent := s.sentCommands(); len(sent) > 0 {
+		t.Errorf("expandGlob of a literal path sent %q, want nothing", sent)
+	}
+}
+
+func TestExpandGlobInvalid(t *testing.T) {
+	f, _ := newFakeConnection(newFakeSession())
+	if _, err := f.expandGlob("src/[a-"); err == nil {
+		t.Error("expandGlob of an unterminated class succeeded")
+	}
+}
+
+func TestExpandGlobAbsolute(t *testing.T) {
+	s := newFakeSession()
+	s.files["LIST /pub"] = "-rw-r--r--   1 ftp      ftp            10 Jan 01  2024 one.iso\r\n" +
+		"-rw-r--r--   1 ftp      ftp            10 Jan 01  2024 two.txt\r\n"
+	f, _ := newFakeConnection(s)
+	matches, err := f.expandGlob("/pub/*.iso")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 || matches[0].path != "/pub/one.iso" {
+		t.Errorf("expandGlob(/pub/*.iso) = %v, want /pub/one.iso", matches)
+	}
+}
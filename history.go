@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// transferRecord is one finished file transfer, as kept in the transfer log.
+type transferRecord struct {
+	Number    int       `json:"-"` // line in the transfer log, counting from 1
+	Time      time.Time `json:"time"`
+	Session   string    `json:"session"`
+	Host      string    `json:"host"`
+	User      string    `json:"user"`
+	Direction string    `json:"direction"` // "get" or "put"
+	Remote    string    `json:"remote"`    // absolute
+	Local     string    `json:"local"`     // absolute
+	Bytes     int64     `json:"bytes"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// transferHistory records a session's transfers in memory and appends them
+// to transfers.jsonl in the data directory, so later sessions can list and
+// retry them. Sibling connections share their owner's.
+type transferHistory struct {
+	mu      sync.Mutex
+	session string
+	path    string // empty when the log can't be written
+	next    int    // number of the next record
+	records []transferRecord
+	warned  bool
+}
+
+func newTransferHistory() *transferHistory {
+	h := &transferHistory{session: fmt.Sprintf("%d-%d", time.Now().Unix(), os.Getpid()), next: 1}
+	dir, err := appDir(dataDir)
+	if err != nil {
+		return h
+	}
+	h.path = filepath.Join(dir, "transfers.jsonl")
+	if _, lines, err := readTransferLog(h.path); err == nil {
+		h.next = lines + 1
+	}
+	return h
+}
+
+// recordTransfer logs a transfer of local to or from remote, relative to the
+// connection's working directory.
+func (f *FTPConnection) recordTransfer(direction, remote, local string, n int64, err error) {
+	h := f.history
+	if h == nil {
+		return
+	}
+	if !strings.HasPrefix(remote, "/") {
+		if dir, dirErr := f.currentDir(); dirErr == nil {
+			remote = path.Join(dir, remote)
+		}
+	}
+	if abs, absErr := filepath.Abs(local); absErr == nil {
+		local = abs
+	}
+	rec := transferRecord{Time: time.Now(), Session: h.session, Host: f.addr, User: f.user, Direction: direction, Remote: remote, Local: local, Bytes: n}
+	if err != nil {
+		rec.Error = redact(err.Error())
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	rec.Number = h.next
+	h.next++
+	h.records = append(h.records, rec)
+	if h.path == "" {
+		return
+	}
+	if err := appendTransferLog(h.path, rec); err != nil && !h.warned {
+		h.warned = true
+		f.out().Warn("could not write the transfer log: %v", err)
+	}
+}
+
+func appendTransferLog(logPath string, rec transferRecord) error {
+	file, err := os.OpenFile(logPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return json.NewEncoder(file).Encode(rec)
+}
+
+// readTransferLog returns every record in the log, numbered by line, and the
+// number of lines. Lines that don't parse keep their number but are skipped.
+func readTransferLog(logPath string) ([]transferRecord, int, error) {
+	file, err := os.Open(logPath)
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	var records []transferRecord
+	lines := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines++
+		var rec transferRecord
+		if json.Unmarshal(scanner.Bytes(), &rec) != nil {
+			continue
+		}
+		rec.Number = lines
+		records = append(records, rec)
+	}
+	return records, lines, scanner.Err()
+}
+
+// current returns copies of this session's records.
+func (h *transferHistory) current() []transferRecord {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]transferRecord(nil), h.records...)
+}
+
+// all returns the records of every session from the log, or this session's
+// alone when there is no log.
+func (h *transferHistory) all() ([]transferRecord, error) {
+	if h.path == "" {
+		return h.current(), nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	records, _, err := readTransferLog(h.path)
+	return records, err
+}
+
+// find returns record number n, from this session or an earlier one.
+func (h *transferHistory) find(n int) (transferRecord, error) {
+	records, err := h.all()
+	if err != nil {
+		return transferRecord{}, err
+	}
+	for _, rec := range records {
+		if rec.Number == n {
+			return rec, nil
+		}
+	}
+	return transferRecord{}, fmt.Errorf("no transfer %d in the history", n)
+}
+
+// format renders rec as history shows it, with its time in the timeFormat
+// style.
+func (rec transferRecord) format(timeFormat string) string {
+	result := fmt.Sprintf("%d bytes", rec.Bytes)
+	if rec.Error != "" {
+		result = "failed: " + rec.Error
+	}
+	source, target := rec.Remote, rec.Local
+	if rec.Direction == "put" {
+		source, target = rec.Local, rec.Remote
+	}
+	return fmt.Sprintf("%4d  %s  %s %s -> %s (%s)", rec.Number, formatTime(rec.Time, timeFormat), rec.Direction, source, target, result)
+}
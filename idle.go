@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// errConnectionLost ends a batch whose connection dropped and couldn't be
+// reopened.
+var errConnectionLost = errors.New("connection lost")
+
+// idleExpiry returns a channel that fires once the session has been idle
+// for the idle-timeout setting, or nil when there is nothing to disconnect.
+// Keepalive NOOPs don't count as activity; commands do, since the REPL asks
+// again after each one.
+func (f *FTPConnection) idleExpiry() <-chan time.Time {
+	if f.settings.idleTimeout <= 0 || f.idle || !f.isAuthenticated {
+		return nil
+	}
+	return time.After(f.settings.idleTimeout)
+}
+
+// disconnectIdle says QUIT to free the server slot, remembering the working
+// directory so reconnect can put the session back where it was.
+func (f *FTPConnection) disconnectIdle() {
+	if dir, err := f.currentDir(); err == nil {
+		f.workDir = dir
+	}
+	dir := f.workDir
+	f.stopKeepAlive()
+	f.probes.close()
+	f.closeDataListener()
+	f.sendCommand("QUIT")
+	f.session.Close()
+	f.idle = true
+	f.workDir = dir
+
+	f.out().Info("Idle for %v - disconnected; the next command reconnects", f.settings.idleTimeout)
+}
+
+// recoverLost is called when a command of a batch failed. If the control
+// connection has gone - the failure dropped it, or a NOOP finds it dead - it
+// reconnects and reports true, so the batch can carry on; an error means the
+// connection couldn't be reopened and wraps errConnectionLost.
+func (f *FTPConnection) recoverLost() (bool, error) {
+	if !f.idle {
+		_, err := f.sendCommand("NOOP")
+		if !f.idle && !f.isConnectionDead(err) {
+			return false, nil
+		}
+		if !f.idle {
+			// reconnect returns to workDir, if it is known
+			f.closeDataListener()
+			f.session.Close()
+			f.idle = true
+		}
+	}
+	f.out().Warn("connection to %s lost; reconnecting", f.addr)
+	if err := f.reconnect(); err != nil {
+		return true, fmt.Errorf("%w: %v", errConnectionLost, err)
+	}
+	return true, nil
+}
+
+// reconnect dials the server again after an idle disconnect, logs in, and
+// returns to the remembered directory. TYPE and MODE are sent again when the
+// next transfer needs them.
+func (f *FTPConnection) reconnect() error {
+	conn, err := dialControl(f.addr)
+	if err != nil {
+		return fmt.Errorf("failed to reconnect to %s: %v", f.addr, err)
+	}
+	f.session = newNetSession(conn)
+	f.quitSent = false
+	f.serverType, f.serverMode = "", ""
+	f.protP = false
+	dir := f.workDir // login's USER clears it
+	if _, err := f.readResponse(); err != nil {
+		f.session.Close()
+		return fmt.Errorf("error reading welcome message: %v", err)
+	}
+	if _, err := f.login(); err != nil {
+		f.session.Close()
+		return err
+	}
+	f.idle = false
+	if dir != "" {
+		resp, err := f.sendCommand("CWD " + dir)
+		if err != nil {
+			return err
+		}
+		if !isSuccessResponse(resp) {
+			f.out().Warn("could not return to %s: %s", dir, strings.TrimSpace(resp))
+		} else {
+			f.workDir = dir
+		}
+	}
+	f.startKeepAlive()
+	f.stats.reconnect()
+	f.out().Info("Reconnected to %s", f.addr)
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// droppingSession loses its connection when it is sent dropAt, as a link
+// that goes down mid-batch does: that command and every later one find the
+// connection closed.
+type droppingSession struct {
+	FTPSession
+	dropAt  string
+	dropped bool
+}
+
+func (s *droppingSession) sendCommand(cmd string) (string, error) {
+	if cmd == s.dropAt && !s.dropped {
+		s.FTPSession.Close()
+		s.dropped = true
+	}
+	if s.dropped {
+		return "", io.EOF
+	}
+	return s.FTPSession.sendCommand(cmd)
+}
+
+// mget reconnects when the connection drops and carries on with the batch,
+// in the same directory.
+func TestMgetReconnects(t *testing.T) {
+	useTempDirs(t)
+	served := t.TempDir()
+	os.MkdirAll(filepath.Join(served, "logs"), 0755)
+	for _, name := range []string{"a.log", "b.log", "c.log"} {
+		os.WriteFile(filepath.Join(served, "logs", name), []byte("contents of "+name+"\n"), 0644)
+	}
+	addr, err := startMockServer(served)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(t.TempDir())
+	f, out := dialMock(t, addr)
+	if err := f.execute("cwd logs"); err != nil {
+		t.Fatal(err)
+	}
+	f.session = &droppingSession{FTPSession: f.session, dropAt: "RETR b.log"}
+
+	if err := f.execute("mget *.log"); err != nil {
+		t.Fatalf("mget across a dropped connection: %v\n%s", err, out)
+	}
+	for _, name := range []string{"a.log", "b.log", "c.log"} {
+		if got, err := os.ReadFile(name); err != nil || string(got) != "contents of "+name+"\n" {
+			t.Errorf("%s holds %q, %v", name, got, err)
+		}
+	}
+	if !strings.Contains(out.String(), "Reconnected") {
+		t.Errorf("mget didn't say it reconnected:\n%s", out)
+	}
+}
+
+// When the server can't be reached again, the batch stops and reports the
+// files it didn't get to.
+func TestMgetConnectionLost(t *testing.T) {
+	useTempDirs(t)
+	served := t.TempDir()
+	for _, name := range []string{"a.log", "b.log", "c.log"} {
+		os.WriteFile(filepath.Join(served, name), []byte(name), 0644)
+	}
+	addr, err := startMockServer(served)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(t.TempDir())
+	f, out := dialMock(t, addr)
+	f.session = &droppingSession{FTPSession: f.session, dropAt: "RETR b.log"}
+	f.addr = "127.0.0.1:1" // nothing listens there
+
+	err = f.execute("mget --report failed.json *.log")
+	if err == nil || !strings.Contains(err.Error(), "2 of 3 files not transferred") {
+		t.Fatalf("mget = %v, want the connection lost with 2 files left\n%s", err, out)
+	}
+	data, err := os.ReadFile("failed.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report struct {
+		Failures []struct {
+			Source string `json:"source"`
+		} `json:"failures"`
+	}
+	if err := json.Unmarshal(data, &report); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Failures) != 2 || report.Failures[0].Source != "b.log" || report.Failures[1].Source != "c.log" {
+		t.Errorf("the report lists %+v, want b.log and c.log", report.Failures)
+	}
+}
@@ -0,0 +1,199 @@
+//go:build integration
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The integration tests run the command suite against real servers in
+// docker containers, to catch the quirks the fake session can't script:
+//
+//	go test -tags integration -run Integration .
+//
+// Each server's passive ports are published one to one on 127.0.0.1, since
+// the server announces them in its PASV and EPSV replies. The tests skip
+// when docker is missing.
+
+// containerServer is an FTP server image and how to configure it with the
+// goftp/goftp account.
+type containerServer struct {
+	name    string
+	image   string
+	port    int    // control port on 127.0.0.1
+	passive [2]int // passive port range, published as is
+	env     []string
+}
+
+var containerServers = []containerServer{
+	{
+		name:    "vsftpd",
+		image:   "fauria/vsftpd",
+		port:    22121,
+		passive: [2]int{21100, 21110},
+		env: []string{
+			"FTP_USER=goftp", "FTP_PASS=goftp", "PASV_ADDRESS=127.0.0.1",
+			"PASV_MIN_PORT=21100", "PASV_MAX_PORT=21110", "LOG_STDOUT=YES",
+		},
+	},
+	{
+		name:    "pure-ftpd",
+		image:   "stilliard/pure-ftpd",
+		port:    22122,
+		passive: [2]int{30000, 30009},
+		env: []string{
+			"PUBLICHOST=127.0.0.1", "FTP_USER_NAME=goftp", "FTP_USER_PASS=goftp",
+			"FTP_USER_HOME=/home/ftpusers/goftp",
+		},
+	},
+	{
+		name:    "proftpd",
+		image:   "kibatic/proftpd",
+		port:    22123,
+		passive: [2]int{50000, 50010},
+		env: []string{
+			"FTP_LIST=goftp:goftp", "MASQUERADE_ADDRESS=127.0.0.1",
+			"PASSIVE_MIN_PORT=50000", "PASSIVE_MAX_PORT=50010",
+		},
+	},
+}
+
+// startContainer runs srv in docker until the test ends, and returns its
+// control address once it greets.
+func startContainer(t *testing.T, srv containerServer) string {
+	t.Helper()
+	args := []string{"run", "-d", "--rm",
+		"-p", fmt.Sprintf("127.0.0.1:%d:21", srv.port),
+		"-p", fmt.Sprintf("127.0.0.1:%d-%d:%d-%d", srv.passive[0], srv.passive[1], srv.passive[0], srv.passive[1]),
+	}
+	for _, env := range srv.env {
+		args = append(args, "-e", env)
+	}
+	out, err := exec.Command("docker", append(args, srv.image)...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("docker run %s: %v\n%s", srv.image, err, out)
+	}
+	id := strings.TrimSpace(string(out))
+	t.Cleanup(func() {
+		if t.Failed() {
+			logs, _ := exec.Command("docker", "logs", "--tail", "50", id).CombinedOutput()
+			t.Logf("%s logs:\n%s", srv.name, logs)
+		}
+		exec.Command("docker", "rm", "-f", id).Run()
+	})
+
+	addr := fmt.Sprintf("127.0.0.1:%d", srv.port)
+	deadline := time.Now().Add(90 * time.Second)
+	for time.Now().Before(deadline) {
+		if greets(addr) {
+			return addr
+		}
+		time.Sleep(time.Second)
+	}
+	t.Fatalf("%s didn't greet on %s within 90s", srv.name, addr)
+	return ""
+}
+
+// greets reports whether an FTP server at addr sends its 220 greeting.
+func greets(addr string) bool {
+	conn, err := net.DialTimeout("tcp", addr, 2*time.Second)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	return err == nil && strings.HasPrefix(line, "220")
+}
+
+// integrationSuite is run in order against each server, from a local
+// directory holding hello.txt and tree/.
+var integrationSuite = []string{
+	"auth",
+	"pwd",
+	"features",
+	"status",
+	"put hello.txt",
+	"ls",
+	"list",
+	"size hello.txt",
+	"mdtm hello.txt",
+	"get hello.txt pasv.txt",
+	"epsv",
+	"get hello.txt epsv.txt",
+	"get --offset 7 --length 5 hello.txt range.txt",
+	"stat hello.txt",
+	"mirror -R tree it-tree",
+	"mirror it-tree tree-back",
+	"mget it-tree/*.txt",
+	"dele hello.txt",
+}
+
+func TestIntegration(t *testing.T) {
+	if _, err := exec.LookPath("docker"); err != nil {
+		t.Skip("docker is not installed")
+	}
+	for _, srv := range containerServers {
+		t.Run(srv.name, func(t *testing.T) {
+			useTempDirs(t)
+			addr := startContainer(t, srv)
+			dir := t.TempDir()
+			t.Chdir(dir)
+			writeTree(t, map[string]string{
+				"hello.txt":      "hello, world\n",
+				"tree/a.txt":     "first file\n",
+				"tree/sub/b.txt": "second file\n",
+				"tree/sub/c.bin": strings.Repeat("\x00\x01\x02\xff", 4096),
+				"tree/empty.txt": "",
+			})
+
+			f, err := NewFTPConnection(addr, "goftp", "goftp")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			var out bytes.Buffer
+			f.stdout = &out
+			f.settings.confirm = "never"
+			welcome, err := f.readResponse()
+			if err != nil {
+				t.Fatalf("reading the greeting: %v", err)
+			}
+			f.noteGreeting(welcome)
+
+			for _, line := range integrationSuite {
+				out.Reset()
+				if err := f.execute(line); err != nil {
+					t.Fatalf("%s: %v\n%s", line, err, out.String())
+				}
+			}
+
+			for local, want := range map[string]string{
+				"pasv.txt":            "hello, world\n",
+				"epsv.txt":            "hello, world\n",
+				"range.txt":           "world",
+				"tree-back/a.txt":     "first file\n",
+				"tree-back/sub/b.txt": "second file\n",
+				"tree-back/sub/c.bin": strings.Repeat("\x00\x01\x02\xff", 4096),
+				"tree-back/empty.txt": "",
+				"a.txt":               "first file\n",
+			} {
+				got, err := os.ReadFile(filepath.Join(dir, local))
+				if err != nil {
+					t.Errorf("%s: %v", local, err)
+				} else if string(got) != want {
+					t.Errorf("%s holds %q, want %q", local, got, want)
+				}
+			}
+		})
+	}
+}
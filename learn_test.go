@@ -0,0 +1,175 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// learningConnection returns a connection over s that learns workarounds
+// and saves them to profile cam in a config file of its own.
+func learningConnection(t *testing.T, s *fakeSession) (*FTPConnection, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.toml")
+	config := "# cameras\n[profile.cam]\nhost = \"cam.example\"\n\n[profile.other]\nhost = \"other.example\"\n"
+	if err := os.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	f, _ := newFakeConnection(s)
+	f.learns = true
+	f.profileName = "cam"
+	f.configPath = path
+	return f, path
+}
+
+// A server that advertises MLSD but refuses it is listed with LIST, and
+// the session saves no-mlsd so the next listing goes straight to LIST.
+func TestLearnNoMLSD(t *testing.T) {
+	s := newFakeSession().withFeatures("MLSD")
+	s.replies["MLSD"] = "502 Command not implemented"
+	s.files["LIST"] = "-rw-r--r-- 1 ftp ftp 3 Jan 01 12:00 a.txt\r\n"
+	f, path := learningConnection(t, s)
+
+	entries, err := f.listDir("")
+	if err != nil || len(entries) != 1 || entries[0].name != "a.txt" {
+		t.Fatalf("listDir = %v, %v, want a.txt from LIST", entries, err)
+	}
+	if !f.settings.workarounds.noMLSD {
+		t.Fatal("no-mlsd wasn't turned on")
+	}
+	saved, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "[profile.cam]\nhost = \"cam.example\"\n# learned "
+	if !strings.Contains(string(saved), want) || !strings.Contains(string(saved), "workaround = \"no-mlsd\"\n\n[profile.other]") {
+		t.Errorf("the workaround wasn't saved at the end of profile cam:\n%s", saved)
+	}
+
+	f.listings = nil
+	before := len(s.sentCommands())
+	if _, err := f.listDir(""); err != nil {
+		t.Fatal(err)
+	}
+	if slices.Contains(s.sentCommands()[before:], "MLSD") {
+		t.Errorf("MLSD was tried again once no-mlsd was learned: %q", s.sentCommands()[before:])
+	}
+}
+
+// Without learning, as on sibling connections, the fallback still lists
+// but nothing is turned on or saved.
+func TestNoMLSDWithoutLearning(t *testing.T) {
+	s := newFakeSession().withFeatures("MLSD")
+	s.replies["MLSD"] = "500 Unknown command"
+	s.files["LIST"] = "-rw-r--r-- 1 ftp ftp 3 Jan 01 12:00 a.txt\r\n"
+	f, path := learningConnection(t, s)
+	f.learns = false
+
+	if entries, err := f.listDir(""); err != nil || len(entries) != 1 {
+		t.Fatalf("listDir = %v, %v, want a.txt from LIST", entries, err)
+	}
+	if f.settings.workarounds.noMLSD {
+		t.Error("a connection that doesn't learn turned on no-mlsd")
+	}
+	if saved, _ := os.ReadFile(path); strings.Contains(string(saved), "learned") {
+		t.Errorf("a connection that doesn't learn saved to the profile:\n%s", saved)
+	}
+}
+
+// A device behind NAT names its private address in PASV replies; reached
+// at a public one, the session learns pasv-nat and uses the control host.
+func TestLearnPasvNAT(t *testing.T) {
+	s := newFakeSession()
+	s.remote = &net.TCPAddr{IP: net.IPv4(203, 0, 113, 5), Port: 21}
+	s.replies["PASV"] = "227 Entering Passive Mode (192,168,1,10,4,1)"
+	f, path := learningConnection(t, s)
+	f.profileName = ""
+
+	if _, err := f.enterPassive(); err != nil {
+		t.Fatal(err)
+	}
+	if !f.settings.workarounds.pasvNAT {
+		t.Fatal("pasv-nat wasn't turned on")
+	}
+	if f.dataAddr != "203.0.113.5:1025" {
+		t.Errorf("data address %s, want the control host's", f.dataAddr)
+	}
+	if saved, _ := os.ReadFile(path); strings.Contains(string(saved), "learned") {
+		t.Errorf("a session without a profile saved to one:\n%s", saved)
+	}
+}
+
+func TestPasvBehindNAT(t *testing.T) {
+	tests := []struct {
+		remote net.IP
+		pasv   string
+		want   bool
+	}{
+		{net.IPv4(203, 0, 113, 5), "192.168.1.10:1025", true},
+		{net.IPv4(203, 0, 113, 5), "0.0.0.0:1025", true},
+		{net.IPv4(203, 0, 113, 5), "203.0.113.5:1025", false},
+		{net.IPv4(203, 0, 113, 5), "198.51.100.7:1025", false},
+		{net.IPv4(192, 168, 1, 10), "10.0.0.2:1025", false},
+		{net.IPv4(192, 168, 1, 10), "0.0.0.0:1025", true},
+	}
+	for _, tt := range tests {
+		s := newFakeSession()
+		s.remote = &net.TCPAddr{IP: tt.remote, Port: 21}
+		f, _ := newFakeConnection(s)
+		if got := f.pasvBehindNAT(tt.pasv); got != tt.want {
+			t.Errorf("pasvBehindNAT(%s) reached at %s = %v, want %v", tt.pasv, tt.remote, got, tt.want)
+		}
+	}
+}
+
+// A server build known for unreachable EPSV ports gets PASV, and the
+// workaround is learned once.
+func TestLearnBrokenEPSV(t *testing.T) {
+	s := newFakeSession()
+	f, path := learningConnection(t, s)
+	f.noteGreeting("220 ProFTPD 1.3.0 Server ready.")
+
+	for range 2 {
+		if err := handleEpsv(f, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sent := s.sentCommands()
+	if slices.Contains(sent, "EPSV") || !slices.Contains(sent, "PASV") {
+		t.Errorf("sent %q, want PASV instead of EPSV", sent)
+	}
+	saved, _ := os.ReadFile(path)
+	if strings.Count(string(saved), "# learned") != 1 || !strings.Contains(string(saved), "workaround = \"broken-epsv\"") {
+		t.Errorf("broken-epsv wasn't saved once:\n%s", saved)
+	}
+}
+
+func TestSaveLearnedSetting(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	config := "[profile.cam]\n# learned 2026-01-01: no-mlsd\nworkaround = \"no-mlsd\"\nport = 2121\n\n[profile.other]\nworkaround = \"pasv-nat\"\n"
+	if err := os.WriteFile(path, []byte(config), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveLearnedSetting(path, "cam", "workaround", "no-mlsd,pasv-nat", "pasv-nat, as a test"); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(string(saved), "\n")
+	if len(lines) != 9 || lines[1] != "# learned 2026-01-01: no-mlsd" || !strings.HasSuffix(lines[2], ": pasv-nat, as a test") ||
+		lines[3] != `workaround = "no-mlsd,pasv-nat"` || lines[4] != "port = 2121" || lines[7] != `workaround = "pasv-nat"` {
+		t.Errorf("the setting wasn't replaced in place, under both notes:\n%s", saved)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0640 {
+		t.Errorf("the file's mode became %v", info.Mode().Perm())
+	}
+
+	if err := saveLearnedSetting(path, "missing", "workaround", "no-mlsd", "test"); err == nil {
+		t.Error("saving to a profile the file doesn't have succeeded")
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// lineEditor is the state of the prompt and the line being typed after it.
+// Output written while a prompt waits for input, such as a keepalive notice
+// or a queue job finishing, clears the line, prints above it, and draws the
+// prompt and the partial input again, so background messages never eat what
+// the user is typing.
+type lineEditor struct {
+	mu        sync.Mutex
+	prompt    []byte        // the prompt as last rendered
+	capturing *bytes.Buffer // collects the prompt while showPrompt renders it
+	waiting   bool          // a prompt is shown and its line not yet entered
+	editing   bool          // the terminal is in edit mode, reading a line
+	line      []rune        // typed so far, in edit mode
+	secret    bool          // don't echo the line, for passwords
+	ttyOnce   sync.Once
+	ttyOut    bool // standard output is a terminal
+}
+
+var editor lineEditor
+
+// terminalOutput is standard output as command output reaches it, with
+// background messages kept clear of the line being typed.
+var terminalOutput io.Writer = promptSafeWriter{}
+
+type promptSafeWriter struct{}
+
+func (promptSafeWriter) Write(p []byte) (int, error) {
+	editor.mu.Lock()
+	defer editor.mu.Unlock()
+	if editor.capturing != nil {
+		editor.capturing.Write(p)
+	}
+	if !editor.waiting || len(p) == 0 {
+		return os.Stdout.Write(p)
+	}
+	os.Stdout.WriteString(editor.clearLine())
+	n, err := os.Stdout.Write(p)
+	// redraw once the message is a whole line; progress updates stay on theirs
+	if p[len(p)-1] == '\n' {
+		os.Stdout.Write(editor.prompt)
+		if !editor.secret {
+			os.Stdout.WriteString(string(editor.line))
+		}
+	}
+	return n, err
+}
+
+// showPrompt runs render, which writes a prompt to terminalOutput, and
+// remembers the prompt so it can be drawn again after background output.
+func showPrompt(render func()) {
+	editor.mu.Lock()
+	editor.capturing = &bytes.Buffer{}
+	editor.mu.Unlock()
+	render()
+	editor.mu.Lock()
+	editor.prompt = editor.capturing.Bytes()
+	editor.capturing = nil
+	editor.waiting = true
+	editor.mu.Unlock()
+}
+
+// lineEntered stops redrawing the prompt once its line has been read.
+func lineEntered() {
+	editor.mu.Lock()
+	defer editor.mu.Unlock()
+	editor.waiting = false
+}
+
+// endPrompt takes down the prompt and anything typed after it, for messages
+// that end the session while it waits for input.
+func endPrompt() {
+	editor.mu.Lock()
+	defer editor.mu.Unlock()
+	if editor.waiting {
+		editor.waiting = false
+		os.Stdout.WriteString(editor.clearLine())
+	}
+}
+
+// clearLine returns what takes the cursor back over the prompt line: a
+// carriage return, and at a terminal an erase to the end of the line. The
+// caller holds the lock.
+func (e *lineEditor) clearLine() string {
+	e.ttyOnce.Do(func() { e.ttyOut = stdoutIsTerminal() })
+	if e.ttyOut {
+		return "\r\033[K"
+	}
+	return "\r"
+}
+
+// readLine reads the next line of input from r. At a terminal it reads in
+// edit mode, echoing and editing the line itself so that it can be redrawn;
+// elsewhere, or where stty is missing, it reads plainly.
+func readLine(r *bufio.Reader, terminal bool) (string, error) {
+	if terminal {
+		if err := stty("-icanon", "-echo", "-isig", "min", "1"); err == nil {
+			return readEditedLine(r)
+		}
+	}
+	line, err := r.ReadString('\n')
+	lineEntered()
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// readEditedLine reads a line with the terminal in edit mode, supporting
+// backspace, ^U (erase line), ^W (erase word), ^C (discard the line), and
+// ^D (end of input on an empty line). Escape sequences such as arrow keys
+// are ignored.
+func readEditedLine(r *bufio.Reader) (string, error) {
+	editor.mu.Lock()
+	editor.editing, editor.line = true, nil
+	editor.mu.Unlock()
+	defer restoreTerminal()
+
+	for {
+		ch, _, err := r.ReadRune()
+		if err != nil {
+			lineEntered()
+			return "", err
+		}
+		editor.mu.Lock()
+		switch {
+		case ch == '\r' || ch == '\n':
+			line := string(editor.line)
+			editor.line, editor.waiting = nil, false
+			editor.mu.Unlock()
+			os.Stdout.WriteString("\n")
+			return line, nil
+		case ch == 0x04 && len(editor.line) == 0: // ^D
+			editor.waiting = false
+			editor.mu.Unlock()
+			return "", io.EOF
+		case ch == 0x7f || ch == 0x08: // backspace
+			editor.erase(1)
+		case ch == 0x15: // ^U
+			editor.erase(len(editor.line))
+		case ch == 0x17: // ^W
+			end := len(editor.line)
+			for end > 0 && editor.line[end-1] == ' ' {
+				end--
+			}
+			for end > 0 && editor.line[end-1] != ' ' {
+				end--
+			}
+			editor.erase(len(editor.line) - end)
+		case ch == 0x03: // ^C
+			editor.line = nil
+			os.Stdout.WriteString("^C\n")
+			os.Stdout.Write(editor.prompt)
+		case ch == 0x1b:
+			skipEscape(r)
+		case ch >= ' ' || ch == '\t':
+			editor.line = append(editor.line, ch)
+			if !editor.secret {
+				os.Stdout.WriteString(string(ch))
+			}
+		}
+		editor.mu.Unlock()
+	}
+}
+
+// erase removes the last n runes of the line, from the screen too. The
+// caller holds the lock.
+func (e *lineEditor) erase(n int) {
+	n = min(n, len(e.line))
+	e.line = e.line[:len(e.line)-n]
+	if !e.secret {
+		os.Stdout.WriteString(strings.Repeat("\b \b", n))
+	}
+}
+
+// skipEscape consumes the rest of an escape sequence, e.g. "[A" for the up
+// arrow: an optional [ or O, then parameters up to a final letter or ~.
+func skipEscape(r *bufio.Reader) {
+	ch, _, err := r.ReadRune()
+	if err != nil || (ch != '[' && ch != 'O') {
+		return
+	}
+	for {
+		ch, _, err = r.ReadRune()
+		if err != nil || (ch >= 0x40 && ch <= 0x7e) {
+			return
+		}
+	}
+}
+
+// restoreTerminal leaves edit mode, if the terminal is in it. The REPL calls
+// it on the way out so the shell gets a working terminal back.
+func restoreTerminal() {
+	editor.mu.Lock()
+	defer editor.mu.Unlock()
+	if editor.editing {
+		editor.editing = false
+		stty("icanon", "echo", "isig")
+	}
+}
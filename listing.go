@@ -0,0 +1,638 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// RemoteEntry is a single file or directory parsed from a server listing.
+type RemoteEntry struct {
+	name    string
+	size    int64
+	modTime time.Time
+	kind    string // "file", "dir", or "link"
+	perm    string // UNIX permission bits as "rwxr-xr-x", when known
+	target  string // symlink destination, when kind is "link"
+	// modPrecision is the granularity of modTime as reported by the server;
+	// LIST output only carries minutes, or days for older files.
+	modPrecision time.Duration
+	// modUTC is set when modTime came from MLSD, which gives UTC; LIST
+	// gives the server's wall clock, zone unknown.
+	modUTC bool
+}
+
+func (e RemoteEntry) isDir() bool {
+	return e.kind == "dir"
+}
+
+// shortName is the entry's name as the names-only listings show it, with a
+// slash after directories.
+func (e RemoteEntry) shortName() string {
+	if e.isDir() {
+		return e.name + "/"
+	}
+	return e.name
+}
+
+// localModTime returns modTime as a moment in local time. LIST times have no
+// zone, so they are taken as local, as the server printed them.
+func (e RemoteEntry) localModTime() time.Time {
+	if e.modUTC {
+		return e.modTime.Local()
+	}
+	return serverClock(e.modTime)
+}
+
+// typeChar returns the leading character UNIX ls uses for the entry type.
+func (e RemoteEntry) typeChar() string {
+	switch e.kind {
+	case "dir":
+		return "d"
+	case "link":
+		return "l"
+	}
+	return "-"
+}
+
+// listDir returns the listing of dir, reusing the one fetched earlier in the
+// session if nothing has changed the server or working directory since.
+func (f *FTPConnection) listDir(dir string) ([]RemoteEntry, error) {
+	if entries, ok := f.listings[dir]; ok {
+		return entries, nil
+	}
+	entries, err := f.fetchListing(dir)
+	if err != nil {
+		return nil, err
+	}
+	if f.listings == nil {
+		f.listings = make(map[string][]RemoteEntry)
+	}
+	f.listings[dir] = entries
+	return entries, nil
+}
+
+// fetchListing lists dir on the server, bypassing the cache, preferring
+// machine-readable MLSD (RFC 3659) and falling back to LIST output.
+func (f *FTPConnection) fetchListing(dir string) ([]RemoteEntry, error) {
+	var entries []RemoteEntry
+	err := f.streamListing(dir, func(entry RemoteEntry) {
+		entries = append(entries, entry)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// scanListing runs a listing command and hands each entry to fn as it
+// arrives, so a huge directory can be shown before the server finishes
+// sending it.
+func (f *FTPConnection) scanListing(cmd string, parse func(string) (RemoteEntry, bool), fn func(RemoteEntry)) error {
+	if _, err := f.prepareData(); err != nil {
+		return err
+	}
+	return f.transfer(cmd, func(dataConn net.Conn) error {
+		scanner := bufio.NewScanner(dataConn)
+		for scanner.Scan() {
+			if entry, ok := parse(f.fromServer(scanner.Text())); ok {
+				fn(entry)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("error reading directory listing: %v", err)
+		}
+		return nil
+	})
+}
+
+// streamListing lists dir like fetchListing, handing each entry to fn as it
+// arrives instead of collecting them. The listing isn't cached. A server
+// that advertises MLSD but refuses it is listed with LIST instead.
+func (f *FTPConnection) streamListing(dir string, fn func(RemoteEntry)) error {
+	withDir := func(cmd string) string {
+		if dir != "" {
+			return fmt.Sprintf("%s %s", cmd, dir)
+		}
+		return cmd
+	}
+	if f.useMLSD() {
+		err := f.scanListing(withDir("MLSD"), parseMLSDLine, fn)
+		// transfer reports a refusal as "MLSD failed"; 500, 502, and 504
+		// say the command itself isn't there, whatever FEAT claimed
+		if !refusedAsUnknown(err, "MLSD") {
+			return err
+		}
+		f.learnWorkaround("no-mlsd", "the server advertises MLSD but refuses it")
+	}
+	return f.scanListing(withDir("LIST"), parseListLine, fn)
+}
+
+// refusedAsUnknown reports whether err is the server refusing cmd as a
+// command it doesn't implement.
+func refusedAsUnknown(err error, cmd string) bool {
+	if err == nil {
+		return false
+	}
+	code, found := strings.CutPrefix(err.Error(), cmd+" failed: ")
+	return found && (strings.HasPrefix(code, "500") || strings.HasPrefix(code, "502") || strings.HasPrefix(code, "504"))
+}
+
+// listMatching hands fn the entries of dir whose names match the glob
+// pattern. It asks the server to narrow the listing with "LIST
+// dir/pattern", which most servers expand, so a directory of hundreds of
+// thousands of entries isn't sent whole; names are matched again here in
+// case the server sends more. Some servers list a matching directory's
+// contents rather than the directory, which then doesn't show. A server
+// that refuses the wildcard gets a full listing, filtered here.
+func (f *FTPConnection) listMatching(dir, pattern string, fn func(RemoteEntry)) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid pattern %q: %v", pattern, err)
+	}
+	matching := func(entry RemoteEntry) {
+		if matchName(pattern, path.Base(entry.name), f.settings.caseFold) {
+			entry.name = path.Base(entry.name)
+			fn(entry)
+		}
+	}
+	// the server's wildcards would respect case
+	if !f.settings.caseFold {
+		err := f.scanListing("LIST "+joinRemote(dir, pattern), parseListLine, matching)
+		if err == nil {
+			return nil
+		}
+		// transfer reports a refusal, which comes before any data is shown,
+		// as "LIST failed"
+		if !strings.HasPrefix(err.Error(), "LIST failed: ") {
+			return err
+		}
+	}
+	if entries, ok := f.listings[dir]; ok {
+		for _, entry := range entries {
+			matching(entry)
+		}
+		return nil
+	}
+	return f.streamListing(dir, matching)
+}
+
+// parseMLSDLine parses one RFC 3659 fact line, e.g.
+// "type=file;size=1024;modify=20240102150405;perm=r; name.txt".
+func parseMLSDLine(line string) (RemoteEntry, bool) {
+	facts, name, found := strings.Cut(strings.TrimRight(line, "\r"), " ")
+	if !found || name == "" {
+		return RemoteEntry{}, false
+	}
+
+	entry := RemoteEntry{name: name, kind: "file", modPrecision: time.Second}
+	for _, fact := range strings.Split(facts, ";") {
+		key, value, found := strings.Cut(fact, "=")
+		if !found {
+			continue
+		}
+		switch strings.ToLower(key) {
+		case "type":
+			switch t := strings.ToLower(value); {
+			case t == "cdir" || t == "pdir":
+				return RemoteEntry{}, false
+			case t == "dir":
+				entry.kind = "dir"
+			case strings.HasPrefix(t, "os.unix=slink") || strings.HasPrefix(t, "os.unix=symlink"):
+				// OS.unix=slink:/path/to/target
+				entry.kind = "link"
+				_, entry.target, _ = strings.Cut(value, ":")
+			}
+		case "size":
+			entry.size = parseSize(value)
+		case "modify":
+			entry.modTime, _ = parseMLSDTime(value)
+			entry.modUTC = true
+		case "unix.mode":
+			if mode, err := strconv.ParseUint(value, 8, 32); err == nil {
+				entry.perm = fs.FileMode(mode).Perm().String()[1:]
+			}
+		}
+	}
+	if !validEntryName(entry.name) {
+		return RemoteEntry{}, false
+	}
+	return entry, true
+}
+
+// parseMLSDTime parses the YYYYMMDDHHMMSS[.sss] timestamps used by MLSD and
+// MDTM, which are always UTC.
+func parseMLSDTime(value string) (time.Time, error) {
+	value, _, _ = strings.Cut(value, ".")
+	return time.Parse("20060102150405", value)
+}
+
+// parseListLine parses one line of UNIX-style or DOS-style LIST output.
+func parseListLine(line string) (RemoteEntry, bool) {
+	line = strings.TrimRight(line, "\r")
+	if line == "" || strings.HasPrefix(line, "total ") {
+		return RemoteEntry{}, false
+	}
+	if line[0] >= '0' && line[0] <= '9' {
+		return parseDOSListLine(line)
+	}
+
+	// drwxr-xr-x 2 owner group 4096 Jan 02 15:04 name
+	fields, name := splitFields(line, 8)
+	if len(fields) < 8 || name == "" {
+		return RemoteEntry{}, false
+	}
+
+	entry := RemoteEntry{name: name, kind: "file"}
+	if len(fields[0]) >= 10 {
+		entry.perm = fields[0][1:10]
+	}
+	switch fields[0][0] {
+	case 'd':
+		entry.kind = "dir"
+	case 'l':
+		entry.kind = "link"
+		entry.name, entry.target, _ = strings.Cut(name, " -> ")
+	}
+	if !validEntryName(entry.name) {
+		return RemoteEntry{}, false
+	}
+	entry.size = parseSize(fields[4])
+	entry.modTime, entry.modPrecision = parseListTime(fields[5], fields[6], fields[7])
+	return entry, true
+}
+
+// parseDOSListLine parses IIS-style "01-02-24  03:04PM  <DIR>  name" lines.
+func parseDOSListLine(line string) (RemoteEntry, bool) {
+	fields, name := splitFields(line, 3)
+	if len(fields) < 3 || name == "" {
+		return RemoteEntry{}, false
+	}
+
+	entry := RemoteEntry{name: name, kind: "file", modPrecision: time.Minute}
+	if fields[2] == "<DIR>" {
+		entry.kind = "dir"
+	} else {
+		entry.size = parseSize(fields[2])
+	}
+	if !validEntryName(entry.name) {
+		return RemoteEntry{}, false
+	}
+	for _, layout := range []string{"01-02-06 03:04PM", "01-02-2006 03:04PM", "01-02-06 15:04"} {
+		if t, err := time.Parse(layout, fields[0]+" "+fields[1]); err == nil {
+			entry.modTime = t
+			break
+		}
+	}
+	return entry, true
+}
+
+// validEntryName rejects listing names that aren't a single path element.
+// Besides "." and "..", a name with a slash or NUL byte would let a hostile
+// server steer downloads outside the target directory, and so would one
+// with a backslash or drive letter on Windows, such as ..\evil.exe.
+func validEntryName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\x00") &&
+		filepath.IsLocal(name) && filepath.Base(name) == name
+}
+
+// parseSize parses a size column, treating garbage and negatives as unknown.
+func parseSize(value string) int64 {
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size < 0 {
+		return 0
+	}
+	return size
+}
+
+// modTimeOf returns an entry's modification time, falling back to a probe of
+// p, on the probe connection, when the listing didn't carry one.
+func (f *FTPConnection) modTimeOf(p string, entry RemoteEntry) (time.Time, bool) {
+	t := f.modTimesOf([]string{p}, []RemoteEntry{entry})[0]
+	return t, !t.IsZero()
+}
+
+// modTimesOf is modTimeOf for many entries, whose probes are pipelined. An
+// unknown time is zero.
+func (f *FTPConnection) modTimesOf(paths []string, entries []RemoteEntry) []time.Time {
+	times := make([]time.Time, len(entries))
+	var probed []int
+	for i, entry := range entries {
+		times[i] = entry.modTime
+		if entry.modTime.IsZero() && !entry.isDir() {
+			probed = append(probed, i)
+		}
+	}
+	if len(probed) == 0 || (!f.hasFeature("MDTM") && !f.hasFeature("MLST")) {
+		return times
+	}
+	var probePaths []string
+	for _, i := range probed {
+		probePaths = append(probePaths, paths[i])
+	}
+	f.probe(func(conn *FTPConnection) error {
+		metas, err := conn.probeFiles(probePaths, false, true)
+		for j, meta := range metas {
+			times[probed[j]] = meta.modTime
+		}
+		return err
+	})
+	return times
+}
+
+// statRemote describes the file or directory at p without SIZE or MDTM:
+// with MLST (RFC 3659) when the server has it, and otherwise from the parent
+// directory's listing.
+func (f *FTPConnection) statRemote(p string) (RemoteEntry, error) {
+	if f.hasFeature("MLST") {
+		f.selectMLSTFacts()
+		resp, err := f.sendCommand("MLST " + p)
+		if err != nil {
+			return RemoteEntry{}, err
+		}
+		if strings.HasPrefix(resp, "250") {
+			// the facts are on the one indented line, followed by the
+			// path as the server spells it
+			for _, line := range strings.Split(resp, "\n") {
+				if !strings.HasPrefix(line, " ") {
+					continue
+				}
+				facts, _, _ := strings.Cut(strings.TrimSpace(line), " ")
+				if entry, ok := parseMLSDLine(facts + " " + path.Base(p)); ok {
+					return entry, nil
+				}
+			}
+		}
+	}
+	entry := f.resolveEntry(remoteMatch{path: p})
+	if entry.kind == "" {
+		return RemoteEntry{}, fmt.Errorf("%s not found", p)
+	}
+	return entry, nil
+}
+
+// remoteSize returns the size of the file at p. It asks with SIZE when the
+// server advertises it, and falls back to statRemote when SIZE is missing or
+// refused, as many servers do in ASCII mode.
+func (f *FTPConnection) remoteSize(p string) (int64, error) {
+	if f.hasFeature("SIZE") {
+		if size, err := f.getFileSize(p); err == nil {
+			return size, nil
+		}
+	}
+	return f.statSize(p)
+}
+
+// statSize returns the size of the file at p from statRemote.
+func (f *FTPConnection) statSize(p string) (int64, error) {
+	entry, err := f.statRemote(p)
+	if err != nil {
+		return 0, err
+	}
+	if entry.kind != "file" {
+		return 0, fmt.Errorf("%s is not a file", p)
+	}
+	return entry.size, nil
+}
+
+// remoteModTime returns the modification time of the file at p, from MDTM
+// when the server advertises it and from statRemote otherwise.
+func (f *FTPConnection) remoteModTime(p string) (time.Time, error) {
+	if f.hasFeature("MDTM") {
+		if t, err := f.getModTime(p); err == nil {
+			return t, nil
+		}
+	}
+	return f.statModTime(p)
+}
+
+// statModTime returns the modification time of the file at p from
+// statRemote.
+func (f *FTPConnection) statModTime(p string) (time.Time, error) {
+	entry, err := f.statRemote(p)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if entry.modTime.IsZero() {
+		return time.Time{}, fmt.Errorf("no modification time for %s", p)
+	}
+	return entry.modTime, nil
+}
+
+// parseAge parses a lookback such as "90m", "24h", or "7d".
+func parseAge(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err == nil && n >= 0 {
+			return time.Duration(n) * 24 * time.Hour, nil
+		}
+	} else if d, err := time.ParseDuration(value); err == nil && d >= 0 {
+		return d, nil
+	}
+	return 0, fmt.Errorf("invalid age %q - expected e.g. 90m, 24h, or 7d", value)
+}
+
+// parseMmin parses a find(1)-style -mmin argument: "-N" matches entries
+// modified less than N minutes ago, "+N" more than N, and "N" exactly N
+// (rounding up, as find does).
+func parseMmin(value string) (func(age time.Duration) bool, error) {
+	n, err := strconv.Atoi(strings.TrimLeft(value, "+-"))
+	if err != nil || n < 0 || value == "" {
+		return nil, fmt.Errorf("invalid -mmin %q - expected N, -N, or +N minutes", value)
+	}
+	limit := time.Duration(n) * time.Minute
+	switch value[0] {
+	case '-':
+		return func(age time.Duration) bool { return age < limit }, nil
+	case '+':
+		return func(age time.Duration) bool { return age > limit }, nil
+	}
+	return func(age time.Duration) bool {
+		return age > limit-time.Minute && age <= limit
+	}, nil
+}
+
+// parseListTime interprets the "Jan 02 15:04" / "Jan 02 2006" date columns of
+// UNIX LIST output. Entries without a year are within the last six months.
+func parseListTime(month, day, clock string) (time.Time, time.Duration) {
+	if strings.Contains(clock, ":") {
+		now := time.Now()
+		t, err := time.Parse("Jan 2 15:04 2006", fmt.Sprintf("%s %s %s %d", month, day, clock, now.Year()))
+		if err != nil {
+			return time.Time{}, 0
+		}
+		if t.After(now.AddDate(0, 0, 1)) {
+			t = t.AddDate(-1, 0, 0)
+		}
+		return t, time.Minute
+	}
+
+	t, err := time.Parse("Jan 2 2006", fmt.Sprintf("%s %s %s", month, day, clock))
+	if err != nil {
+		return time.Time{}, 0
+	}
+	return t, 24 * time.Hour
+}
+
+// splitFields returns the first n whitespace-separated fields of line and the
+// untouched remainder, so names containing spaces survive intact.
+func splitFields(line string, n int) ([]string, string) {
+	var fields []string
+	rest := line
+	for len(fields) < n {
+		rest = strings.TrimLeft(rest, " \t")
+		if rest == "" {
+			return fields, ""
+		}
+		end := strings.IndexAny(rest, " \t")
+		if end == -1 {
+			return append(fields, rest), ""
+		}
+		fields = append(fields, rest[:end])
+		rest = rest[end:]
+	}
+	return fields, strings.TrimLeft(rest, " \t")
+}
+
+// renderListing writes entries as an ls-style table, with times in the
+// timeFormat style, or as CSV/TSV with a header row for spreadsheet import.
+func renderListing(w io.Writer, entries []RemoteEntry, format, timeFormat string) error {
+	lw, err := newListingWriter(w, format, timeFormat)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		lw.write(entry)
+	}
+	return lw.flush()
+}
+
+// renderColumns writes entry names in columns down then across, as GNU ls
+// does on a terminal, using as few rows as fit in width. Directories get a
+// trailing slash, as in the long form. A width of 0 writes one name per line.
+func renderColumns(w io.Writer, entries []RemoteEntry, width int) {
+	if len(entries) == 0 {
+		return
+	}
+	names := make([]string, len(entries))
+	for i, entry := range entries {
+		names[i] = entry.shortName()
+	}
+	const gap = 2
+	rows := len(names)
+	var widths []int
+	if width > 0 {
+		for try := 1; try < len(names); try++ {
+			cols := columnWidths(names, try)
+			total := gap * (len(cols) - 1)
+			for _, colWidth := range cols {
+				total += colWidth
+			}
+			if total <= width {
+				rows, widths = try, cols
+				break
+			}
+		}
+	}
+	if widths == nil {
+		widths = columnWidths(names, rows)
+	}
+	for row := 0; row < rows; row++ {
+		var line strings.Builder
+		for col := range widths {
+			i := col*rows + row
+			if i >= len(names) {
+				break
+			}
+			if col > 0 {
+				line.WriteString(strings.Repeat(" ", gap))
+			}
+			line.WriteString(names[i])
+			// pad unless this is the last name on the line
+			if next := i + rows; col < len(widths)-1 && next < len(names) {
+				line.WriteString(strings.Repeat(" ", widths[col]-utf8.RuneCountInString(names[i])))
+			}
+		}
+		fmt.Fprintln(w, line.String())
+	}
+}
+
+// columnWidths returns the width of each column when names are laid out
+// down rows rows.
+func columnWidths(names []string, rows int) []int {
+	var widths []int
+	for i, name := range names {
+		if i%rows == 0 {
+			widths = append(widths, 0)
+		}
+		widths[len(widths)-1] = max(widths[len(widths)-1], utf8.RuneCountInString(name))
+	}
+	return widths
+}
+
+// listingWriter renders entries one at a time in an ls output format, so
+// streamed listings look the same as cached ones.
+type listingWriter struct {
+	w          io.Writer
+	csv        *csv.Writer // nil for plain
+	namesOnly  bool        // plain names, one per line, as ls -1 shows them
+	timeFormat string      // the time-format style of plain listings
+}
+
+func newListingWriter(w io.Writer, format, timeFormat string) (*listingWriter, error) {
+	switch format {
+	case "plain":
+		return &listingWriter{w: w, timeFormat: timeFormat}, nil
+	case "csv", "tsv":
+		out := csv.NewWriter(w)
+		if format == "tsv" {
+			out.Comma = '\t'
+		}
+		out.Write([]string{"name", "size", "mtime", "type", "permissions"})
+		return &listingWriter{w: w, csv: out}, nil
+	}
+	return nil, fmt.Errorf("unknown format %q - expected plain, csv, or tsv", format)
+}
+
+func (lw *listingWriter) write(entry RemoteEntry) {
+	if lw.namesOnly {
+		fmt.Fprintln(lw.w, entry.shortName())
+		return
+	}
+	if lw.csv != nil {
+		modified := ""
+		if !entry.modTime.IsZero() {
+			modified = entry.modTime.UTC().Format(time.RFC3339)
+		}
+		lw.csv.Write([]string{entry.name, strconv.FormatInt(entry.size, 10), modified, entry.kind, entry.perm})
+		return
+	}
+	modified := ""
+	if !entry.modTime.IsZero() {
+		modified = formatTime(entry.localModTime(), lw.timeFormat)
+	}
+	name := entry.name
+	if entry.isDir() {
+		name += "/"
+	}
+	if entry.target != "" {
+		name += " -> " + entry.target
+	}
+	fmt.Fprintf(lw.w, "%s%-9s %12d %16s  %s\n", entry.typeChar(), entry.perm, entry.size, modified, name)
+}
+
+func (lw *listingWriter) flush() error {
+	if lw.csv == nil {
+		return nil
+	}
+	lw.csv.Flush()
+	return lw.csv.Error()
+}
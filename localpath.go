@@ -0,0 +1,96 @@
+package main
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Local paths are typed in the client platform's own form, e.g.
+// C:\data\file.bin on Windows, while remote paths always use slashes. The
+// helpers here are the only places the two meet.
+
+// localBase is the name a local file gets on the server when none is given:
+// its last element, without the drive letter or share a Windows path may
+// start with. A root such as C:\ or / has no name and gives "".
+func localBase(local string) string {
+	base := filepath.Base(local)
+	if base == "." || base == string(filepath.Separator) || base == "/" {
+		return ""
+	}
+	return base
+}
+
+// endsInSeparator reports whether a local path names a directory by ending
+// in a separator: / anywhere, or \ as well on Windows.
+func endsInSeparator(local string) bool {
+	return strings.HasSuffix(local, "/") || strings.HasSuffix(local, string(filepath.Separator))
+}
+
+// downloadPath resolves the local target of a download of remote. A target
+// that is an existing directory, or ends in a separator, receives the file
+// under its remote name.
+func downloadPath(target, remote string) string {
+	if info, err := os.Stat(target); (err == nil && info.IsDir()) || endsInSeparator(target) {
+		return filepath.Join(target, path.Base(remote))
+	}
+	return target
+}
+
+// uploadPath resolves the remote target of an upload of local. A target
+// ending in / is a directory and receives the file under its local name.
+func uploadPath(target, local string) string {
+	if strings.HasSuffix(target, "/") {
+		return target + localBase(local)
+	}
+	return target
+}
+
+// longPathAt is where Windows' path limit begins: MAX_PATH is 260
+// characters, and a directory must leave room for an 8.3 name inside it, so
+// 248. Longer paths only work in the \\?\ form, which turns off the Win32
+// path parsing that enforces the limit. Prefixing at 248 also leaves room
+// for a download's .part suffix.
+const longPathAt = 248
+
+// longPath returns local in a form Windows can open however long it is: the
+// \\?\ form when its absolute path reaches the limit. Elsewhere, and for
+// shorter paths, local is returned unchanged.
+func longPath(local string) string {
+	if runtime.GOOS != "windows" {
+		return local
+	}
+	abs, err := filepath.Abs(local)
+	if err != nil {
+		return local
+	}
+	if long := windowsLongPath(abs); long != abs {
+		return long
+	}
+	return local
+}
+
+// windowsLongPath prefixes an absolute Windows path of longPathAt or more
+// characters with \\?\, or a UNC path \\server\share\... with \\?\UNC\.
+// Windows takes such paths literally, so the result is cleaned and uses
+// backslashes only. Shorter, relative, and already prefixed paths are
+// returned unchanged.
+func windowsLongPath(p string) string {
+	if len(p) < longPathAt || strings.HasPrefix(p, `\\?\`) || strings.HasPrefix(p, `\\.\`) {
+		return p
+	}
+	slashed := strings.ReplaceAll(p, `\`, "/")
+	switch {
+	case strings.HasPrefix(slashed, "//"):
+		return `\\?\UNC\` + strings.ReplaceAll(path.Clean(slashed[2:]), "/", `\`)
+	case len(slashed) >= 3 && isDriveLetter(slashed[0]) && slashed[1] == ':' && slashed[2] == '/':
+		return `\\?\` + strings.ReplaceAll(path.Clean(slashed), "/", `\`)
+	}
+	return p
+}
+
+func isDriveLetter(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
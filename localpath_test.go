@@ -0,0 +1,122 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestLocalBase(t *testing.T) {
+	tests := []struct {
+		local   string
+		want    string
+		windows string // where \ separates too
+	}{
+		{"file.bin", "file.bin", "file.bin"},
+		{"/data/file.bin", "file.bin", "file.bin"},
+		{"data/", "data", "data"},
+		{"/", "", ""},
+		{".", "", ""},
+		{`C:\data\file.bin`, `C:\data\file.bin`, "file.bin"},
+		{`C:\`, `C:\`, ""},
+		{`\\server\share\dir\file.bin`, `\\server\share\dir\file.bin`, "file.bin"},
+		{`C:\data/sub\file.bin`, `sub\file.bin`, "file.bin"},
+		{`data\with\backslashes`, `data\with\backslashes`, "backslashes"},
+	}
+	for _, tt := range tests {
+		want := tt.want
+		if runtime.GOOS == "windows" {
+			want = tt.windows
+		}
+		if got := localBase(tt.local); got != want {
+			t.Errorf("localBase(%q) = %q, want %q", tt.local, got, want)
+		}
+	}
+}
+
+func TestEndsInSeparator(t *testing.T) {
+	tests := []struct {
+		local string
+		want  bool
+	}{
+		{"downloads/", true},
+		{"downloads", false},
+		{`C:\downloads\`, runtime.GOOS == "windows"},
+		{`C:\downloads/`, true},
+		{`\\server\share\`, runtime.GOOS == "windows"},
+	}
+	for _, tt := range tests {
+		if got := endsInSeparator(tt.local); got != tt.want {
+			t.Errorf("endsInSeparator(%q) = %v, want %v", tt.local, got, tt.want)
+		}
+	}
+}
+
+func TestDownloadPath(t *testing.T) {
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "existing")
+	if err := os.Mkdir(existing, 0755); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		target, remote, want string
+	}{
+		{existing, "/pub/file.bin", filepath.Join(existing, "file.bin")},
+		{filepath.Join(dir, "new") + "/", "/pub/file.bin", filepath.Join(dir, "new", "file.bin")},
+		{filepath.Join(dir, "renamed.bin"), "/pub/file.bin", filepath.Join(dir, "renamed.bin")},
+	}
+	for _, tt := range tests {
+		if got := downloadPath(tt.target, tt.remote); got != tt.want {
+			t.Errorf("downloadPath(%q, %q) = %q, want %q", tt.target, tt.remote, got, tt.want)
+		}
+	}
+}
+
+func TestUploadPath(t *testing.T) {
+	tests := []struct {
+		target, local, want string
+	}{
+		{"incoming/", "/data/file.bin", "incoming/file.bin"},
+		{"incoming/renamed.bin", "/data/file.bin", "incoming/renamed.bin"},
+		{"/", "/data/file.bin", "/file.bin"},
+	}
+	for _, tt := range tests {
+		if got := uploadPath(tt.target, tt.local); got != tt.want {
+			t.Errorf("uploadPath(%q, %q) = %q, want %q", tt.target, tt.local, got, tt.want)
+		}
+	}
+}
+
+func TestWindowsLongPath(t *testing.T) {
+	long := strings.Repeat(`very-long-directory-name\`, 12) + "file.bin" // 308 characters below the root
+	tests := []struct {
+		path, want string
+	}{
+		{`C:\data\file.bin`, `C:\data\file.bin`},
+		{`\\server\share\file.bin`, `\\server\share\file.bin`},
+		{`C:\` + long, `\\?\C:\` + long},
+		{`C:/` + strings.ReplaceAll(long, `\`, "/"), `\\?\C:\` + long},
+		{`C:\mixed/` + long, `\\?\C:\mixed\` + long},
+		{`C:\data\..\` + long, `\\?\C:\` + long},
+		{`\\server\share\` + long, `\\?\UNC\server\share\` + long},
+		{`\\?\C:\` + long, `\\?\C:\` + long},
+		{`relative\` + long, `relative\` + long},
+	}
+	for _, tt := range tests {
+		if got := windowsLongPath(tt.path); got != tt.want {
+			t.Errorf("windowsLongPath(%q)\n got %q\nwant %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestLongPathElsewhere(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows prefixes long paths")
+	}
+	local := "/" + strings.Repeat("d/", 200) + "file.bin"
+	if got := longPath(local); got != local {
+		t.Errorf("longPath(%q) = %q, want it unchanged", local, got)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// With --machine the client is a backend for a GUI or editor extension.
+// There is no prompt: each line of stdin is a JSON request, and stdout
+// carries only JSON lines. The session starts with a hello, command output
+// uses the json output style, events are those of -events, and each request
+// ends with a result carrying its id:
+//
+//	<- {"type":"hello","protocol":1,"client":"v1.2.3","host":"ftp.example.com:21","user":"anonymous","commands":[...]}
+//	-> {"id":1,"line":"cwd /pub"}
+//	<- {"type":"reply","code":250,"text":"250 Directory changed"}
+//	<- {"type":"result","id":1,"ok":true}
+//
+// Requests run one at a time, so a request's output comes before its result.
+
+// machineProtocol is the version of the --machine protocol, sent in the
+// hello. It changes only when existing messages change meaning.
+const machineProtocol = 1
+
+// machineRequest is a line of stdin in machine mode. id is echoed in the
+// request's result, whatever JSON value the frontend chose.
+type machineRequest struct {
+	ID   json.RawMessage `json:"id,omitempty"`
+	Line string          `json:"line"`
+}
+
+// machineMessage is a line of stdout in machine mode that isn't command
+// output or an event.
+type machineMessage struct {
+	Type     string          `json:"type"` // "hello" or "result"
+	Protocol int             `json:"protocol,omitempty"`
+	Client   string          `json:"client,omitempty"` // the client's version
+	Host     string          `json:"host,omitempty"`
+	User     string          `json:"user,omitempty"`
+	Commands []string        `json:"commands,omitempty"`
+	ID       json.RawMessage `json:"id,omitempty"`
+	OK       *bool           `json:"ok,omitempty"`
+	Error    string          `json:"error,omitempty"`
+}
+
+// machineOutput writes machine messages to stdout. Methods on a nil
+// machineOutput, outside machine mode, do nothing.
+type machineOutput struct {
+	enc *json.Encoder
+
+	mu      sync.Mutex
+	partial []byte // text written without its newline yet
+}
+
+func newMachineOutput() *machineOutput {
+	return &machineOutput{enc: json.NewEncoder(os.Stdout)}
+}
+
+// hello introduces the session: the protocol and client versions, where it
+// is connected, and the commands a request may start with.
+func (m *machineOutput) hello(host, user string) {
+	if m == nil {
+		return
+	}
+	commands := make([]string, 0, len(commandRegistry))
+	for name := range commandRegistry {
+		commands = append(commands, name)
+	}
+	sort.Strings(commands)
+	m.enc.Encode(machineMessage{Type: "hello", Protocol: machineProtocol, Client: clientVersion(), Host: host, User: user, Commands: commands})
+}
+
+// result ends the request with id: ok, or the error it failed with.
+func (m *machineOutput) result(id json.RawMessage, err error) {
+	if m == nil {
+		return
+	}
+	ok := err == nil
+	msg := machineMessage{Type: "result", ID: id, OK: &ok}
+	if err != nil {
+		msg.Error = redact(err.Error())
+	}
+	m.enc.Encode(msg)
+}
+
+// Write sends text a command writes straight to standard output as line
+// messages, one per line, like the json output style's.
+func (m *machineOutput) Write(p []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.partial = append(m.partial, p...)
+	for {
+		i := bytes.IndexByte(m.partial, '\n')
+		if i < 0 {
+			break
+		}
+		line := strings.TrimSuffix(string(m.partial[:i]), "\r")
+		m.partial = m.partial[i+1:]
+		if err := m.enc.Encode(map[string]any{"type": "line", "text": line}); err != nil {
+			return len(p), err
+		}
+	}
+	return len(p), nil
+}
+
+// parseMachineRequest decodes a line of stdin in machine mode into the
+// command line to run.
+func parseMachineRequest(input string) (machineRequest, error) {
+	var req machineRequest
+	if err := json.Unmarshal([]byte(input), &req); err != nil {
+		return req, fmt.Errorf("invalid request %q: %v", strings.TrimSpace(input), err)
+	}
+	return req, nil
+}
@@ -4,21 +4,268 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"os"
+	"strings"
 )
 
+// envFlags maps flags to the environment variables that can supply them.
+// The command line wins over the environment, which wins over the config file.
+var envFlags = map[string]string{
+	"host":        "GOFTP_HOST",
+	"user":        "GOFTP_USER",
+	"pass":        "GOFTP_PASSWORD",
+	"profile":     "GOFTP_PROFILE",
+	"config":      "GOFTP_CONFIG",
+	"credentials": "GOFTP_CREDENTIALS",
+	"relax-pasv":  "GOFTP_RELAX_PASV",
+	"record":      "GOFTP_RECORD",
+	"events":      "GOFTP_EVENTS",
+	"events-fd":   "GOFTP_EVENTS_FD",
+	"state-dir":   "GOFTP_STATE_DIR",
+}
+
 func main() {
 	host := flag.String("host", "", "FTP server hostname")
 	user := flag.String("user", "anonymous", "Username")
 	pass := flag.String("pass", "", "Password")
+	profileName := flag.String("profile", "", "Connect using a [profile.<name>] section of the config file")
+	configPath := flag.String("config", "", "Config file path (default <user config dir>/goftp/config.toml)")
+	relaxPasv := flag.Bool("relax-pasv", false, "Accept passive data addresses that differ from the control host or are reserved, and active-mode data connections from other hosts")
+	record := flag.String("record", "", "Record commands, replies, and transfer sizes to a JSONL file")
+	replay := flag.String("replay", "", "Serve a recorded session as a mock FTP server instead of connecting")
+	listen := flag.String("listen", "127.0.0.1:2121", "Address for the -replay mock server")
+	eventsSpec := flag.String("events", "", "Emit machine-readable JSONL events to this destination (stdout-jsonl)")
+	eventsFD := flag.Int("events-fd", 0, "Emit machine-readable JSONL events to this open file descriptor")
+	readOnly := flag.Bool("read-only", false, "Refuse commands that modify the server")
+	useTLS := flag.Bool("tls", false, "Use explicit FTPS: AUTH TLS before logging in (set tls on)")
+	tlsInsecure := flag.Bool("tls-insecure", false, "Trust and pin a self-signed or other unverifiable TLS certificate on first use (set tls-insecure on)")
+	machine := flag.Bool("machine", false, "Run as a backend for a GUI: read JSON requests on stdin and write only JSON to stdout")
+	var terse bool
+	flag.BoolVar(&terse, "q", false, "Quiet: don't echo the server's replies to successful commands (set terse on)")
+	flag.BoolVar(&terse, "quiet", false, "Same as -q")
+	credentialsPath := flag.String("credentials", "", "Encrypted credentials file (default <user config dir>/goftp/credentials.enc)")
+	flag.StringVar(&stateDirOverride, "state-dir", "", "Keep history, caches, journals, and logs under this directory instead of the per-user defaults")
+	addCred := flag.String("add-credential", "", "Store a user and password under this name in the credentials file and exit")
+
+	// curl-compatible flags for one-shot URL mode
+	curlUser := flag.String("u", "", "Credentials as user:pass (URL mode)")
+	upload := flag.String("T", "", "Upload local file to the URL (URL mode)")
+	output := flag.String("o", "", "Write download to file instead of stdout (URL mode)")
+	createDirs := flag.Bool("ftp-create-dirs", false, "Create missing remote directories on upload (URL mode)")
+	flag.Bool("ftp-pasv", true, "Use passive mode for data connections (URL mode, always on)")
+	// wget-style flags for fetching several URLs
+	inputFile := flag.String("i", "", "Fetch the ftp:// URLs listed in this file, one per line; - reads standard input")
+	prefix := flag.String("P", "", "Save files fetched from several URLs in this directory instead of the current one")
 	flag.Parse()
+	log.SetOutput(redactingWriter{os.Stderr})
+
+	if flag.Arg(0) == "version" {
+		printVersion()
+		return
+	}
+	if flag.Arg(0) == "proxy" {
+		if err := runProxy(flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if flag.Arg(0) == "completion" {
+		if err := runCompletion(os.Stdout, flag.Arg(1)); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// curl accepts flags after the URL, so keep parsing past positionals
+	var urls []string
+	for args := flag.Args(); len(args) > 0; args = flag.Args() {
+		urls = append(urls, args[0])
+		flag.CommandLine.Parse(args[1:])
+	}
+
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	for name, env := range envFlags {
+		if value, ok := os.LookupEnv(env); ok && !explicit[name] {
+			if err := flag.Set(name, value); err != nil {
+				log.Fatalf("invalid %s: %v", env, err)
+			}
+			explicit[name] = true
+		}
+	}
 
-	fmt.Printf("Attempting to create FTP connection to: %s with username/pass: %s/%s\n", *host, *user, *pass)
+	if *credentialsPath == "" {
+		if path, err := defaultCredentialsPath(); err == nil {
+			*credentialsPath = path
+		}
+	}
+	if *addCred != "" {
+		if err := addCredential(*credentialsPath, *addCred); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *replay != "" {
+		if err := runReplayServer(*replay, *listen); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
+	if *inputFile != "" {
+		listed, err := readURLList(*inputFile)
+		if err != nil {
+			log.Fatalf("failed to read URLs: %v", err)
+		}
+		if len(listed) == 0 {
+			log.Fatalf("no URLs in %s", *inputFile)
+		}
+		urls = append(urls, listed...)
+	}
+	for _, u := range urls {
+		if !strings.HasPrefix(u, "ftp://") {
+			log.Fatalf("unexpected argument %q - expected an ftp:// URL", u)
+		}
+	}
+	if len(urls) > 1 || *inputFile != "" {
+		switch {
+		case *upload != "":
+			log.Fatal("-T uploads to a single URL")
+		case *output != "":
+			log.Fatal("-o names the file for a single URL - use -P to choose where a batch is saved")
+		case *record != "":
+			log.Fatal("-record records a single URL's session")
+		}
+		opts := urlOptions{userPass: *curlUser, relaxPasv: *relaxPasv}
+		if err := runURLBatch(urls, *prefix, opts); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if len(urls) > 0 {
+		opts := urlOptions{
+			userPass:   *curlUser,
+			upload:     *upload,
+			output:     *output,
+			createDirs: *createDirs,
+			record:     *record,
+			relaxPasv:  *relaxPasv,
+		}
+		if err := runURLMode(urls[0], opts); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	var prof *profile
+	if *profileName != "" {
+		var err error
+		if prof, err = loadProfile(*configPath, *profileName); err != nil {
+			log.Fatal(err)
+		}
+		// flags and environment variables win over the profile
+		if !explicit["host"] && prof.host != "" {
+			*host = prof.host
+		}
+		if !explicit["user"] && prof.user != "" {
+			*user = prof.user
+		}
+		if !explicit["pass"] && prof.pass != "" {
+			*pass = prof.pass
+		}
+		if prof.credential != "" && !explicit["user"] && !explicit["pass"] {
+			cred, err := lookupCredential(*credentialsPath, prof.credential)
+			if err != nil {
+				log.Fatal(err)
+			}
+			*user, *pass = cred.User, cred.Pass
+		}
+	}
+
+	if dir, ok := strings.CutPrefix(*host, mockScheme); ok {
+		addr, err := startMockServer(dir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !terse && !*machine {
+			fmt.Printf("Serving %s with the built-in mock server on %s\n", dir, addr)
+		}
+		*host = addr
+		// the mock server takes any password, so don't ask for one
+		if *pass == "" {
+			*pass = "mock"
+		}
+	}
+
+	// stdin carries a machine frontend's requests, not a password
+	if *pass == "" && !isAnonymousUser(*user) && stdinIsTerminal() && !*machine {
+		var err error
+		if *pass, err = promptPassword(fmt.Sprintf("Password for %s: ", *user)); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	addSecret(*pass)
+	if !terse && !*machine {
+		fmt.Printf("Attempting to create FTP connection to: %s as %s\n", *host, *user)
+	}
+
+	events, err := openEventStream(*eventsSpec, *eventsFD)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var machineOut *machineOutput
+	if *machine {
+		machineOut = newMachineOutput()
+		if events == nil {
+			events, _ = openEventStream("stdout-jsonl", 0)
+		}
+	}
 	ftpConn, err := NewFTPConnection(*host, *user, *pass)
 	if err != nil {
+		events.error(err)
 		log.Fatal(err)
 	}
 	defer ftpConn.Close()
+	ftpConn.events = events
+	ftpConn.machine = machineOut
+	ftpConn.history = newTransferHistory()
+	ftpConn.relaxPasv = *relaxPasv
+	ftpConn.configPath = *configPath
+	ftpConn.learns = true
+	if prof != nil {
+		ftpConn.profileName = prof.name
+		ftpConn.initCommands = prof.initCommands
+		if err := prof.applySettings(&ftpConn.settings); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := applyEnvSettings(&ftpConn.settings); err != nil {
+		log.Fatal(err)
+	}
+	if *readOnly {
+		ftpConn.settings.readOnly = true
+	}
+	if terse {
+		ftpConn.settings.terse = true
+	}
+	if *useTLS {
+		ftpConn.settings.tls = true
+	}
+	if *tlsInsecure {
+		ftpConn.settings.tlsInsecure = true
+	}
+
+	if *record != "" {
+		if ftpConn.recorder, err = newSessionRecorder(*record); err != nil {
+			log.Fatal(err)
+		}
+	}
 
 	ftpConn.StartREPL()
+	if status := ftpConn.exitStatus(); status != 0 {
+		os.Exit(status)
+	}
 }
@@ -0,0 +1,910 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mirrorOptions holds the lftp-compatible flags accepted by mirror.
+type mirrorOptions struct {
+	reverse   bool
+	onlyNewer bool
+	delete    bool
+	parallel  int
+	excludes  stringList
+	links     string // symlink policy: "skip", "follow", or "recreate"
+	checksums bool   // -R: keep a checksumDB of uploaded files
+	calibrate bool   // measure the server's clock skew first, if not yet done
+	// onlyMissing transfers only files the target lacks, never replacing
+	// one; onlyExisting only replaces files the target has, never adding one.
+	onlyMissing  bool
+	onlyExisting bool
+	limit        batchLimit     // --max-files and --max-total-size
+	report       *failureReport // --report; nil when not wanted
+	caseFold     bool           // the case-insensitive setting
+	// compare is "size-time", or "hash" to compare the content of files up
+	// to hashMaxSize bytes, for servers whose timestamps can't be trusted.
+	compare     string
+	hashMaxSize int64
+	yes         bool // --yes: don't ask before carrying out the plan
+	dryRun      bool // --dry-run: show the plan and stop
+	verbose     bool // --verbose: say how the plan was worked out
+	renames     nameRules
+}
+
+// mirrorStats summarizes a mirror run.
+type mirrorStats struct {
+	transferred int
+	skipped     int
+	deleted     int
+	failed      int
+	bytes       int64
+	deferred    int // left for the next run by the batch limit
+}
+
+// mirrorTask is a single planned file transfer. rel is slash-separated and
+// relative to both mirror roots; target is rel as the target already names
+// it, which with case-insensitive on may differ in case, or as --name-rule
+// renames it.
+type mirrorTask struct {
+	rel     string
+	target  string
+	size    int64 // -1 when unknown
+	modTime time.Time
+	exists  bool // the target has the file, so it is updated
+}
+
+// mirrorLink is a planned symlink recreation, for --links recreate.
+type mirrorLink struct {
+	rel  string
+	make func() error
+}
+
+// mirrorPlan is everything a mirror run will change, worked out before it
+// changes anything so it can be shown and confirmed first.
+type mirrorPlan struct {
+	dirs  []string // target directories to create, parents first
+	links []mirrorLink
+	tasks []mirrorTask
+	stale []string // target paths to delete, with --delete
+}
+
+// summary describes the plan in one line, e.g. "3 new, 2 updated, 1
+// deleted (1.2 MB to transfer)".
+func (p mirrorPlan) summary() string {
+	var added, updated int
+	var bytes int64
+	for _, task := range p.tasks {
+		if task.exists {
+			updated++
+		} else {
+			added++
+		}
+		bytes += max(task.size, 0)
+	}
+	s := fmt.Sprintf("%d new, %d updated", added, updated)
+	if len(p.links) > 0 {
+		s += fmt.Sprintf(", %d links", len(p.links))
+	}
+	return s + fmt.Sprintf(", %d deleted (%s to transfer)", len(p.stale), formatBytes(bytes))
+}
+
+// errMirrorNotRun is returned when a mirror's plan was only shown, or the
+// user declined it.
+var errMirrorNotRun = errors.New("mirror not run")
+
+// approveMirror shows the plan and, at a terminal, asks whether to carry it
+// out, unless --yes was given or the confirm setting is never.
+func (f *FTPConnection) approveMirror(plan mirrorPlan, opts mirrorOptions) error {
+	if len(plan.tasks) == 0 && len(plan.links) == 0 && len(plan.stale) == 0 {
+		return nil
+	}
+	f.out().Info("Mirror plan: %s", plan.summary())
+	if opts.dryRun {
+		for _, task := range plan.tasks {
+			action := "new"
+			if task.exists {
+				action = "update"
+			}
+			line := fmt.Sprintf(" %-7s %s", action, task.rel)
+			if task.target != task.rel {
+				line += " -> " + task.target
+			}
+			f.out().Line(line)
+		}
+		for _, link := range plan.links {
+			f.out().Line(" link    " + link.rel)
+		}
+		for _, rel := range plan.stale {
+			f.out().Line(" delete  " + rel)
+		}
+		return errMirrorNotRun
+	}
+	if opts.yes || f.settings.confirm == "never" || !stdinIsTerminal() {
+		return nil
+	}
+	answer, err := promptLine("Proceed? [y/N] ")
+	if err != nil {
+		return err
+	}
+	if a := strings.ToLower(strings.TrimSpace(answer)); a != "y" && a != "yes" {
+		f.out().Info("Cancelled.")
+		return errMirrorNotRun
+	}
+	return nil
+}
+
+// excluded reports whether rel matches any --exclude-glob pattern. As in
+// lftp, directories are also tried with a trailing slash so "tmp/" only
+// excludes directories.
+func (o mirrorOptions) excluded(rel string, isDir bool) bool {
+	candidates := []string{path.Base(rel), rel}
+	if isDir {
+		candidates = append(candidates, path.Base(rel)+"/", rel+"/")
+	}
+	for _, pattern := range o.excludes {
+		for _, candidate := range candidates {
+			if matchName(pattern, candidate, o.caseFold) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// shouldTransfer decides whether an existing target must be replaced. With
+// --only-missing none is; with --only-newer only a newer source wins;
+// otherwise any size or timestamp difference does. Times are compared at the
+// coarser listing precision.
+func (o mirrorOptions) shouldTransfer(srcSize int64, srcTime time.Time, dstSize int64, dstTime time.Time, precision time.Duration) bool {
+	if o.onlyMissing {
+		return false
+	}
+	srcTime, dstTime = srcTime.Truncate(precision), dstTime.Truncate(precision)
+	if o.onlyNewer {
+		return srcTime.After(dstTime)
+	}
+	return srcSize != dstSize || !srcTime.Equal(dstTime)
+}
+
+// hashes reports whether a file and its existing target, of srcSize and
+// dstSize bytes, are compared by content rather than by shouldTransfer.
+// Files of different sizes differ anyway.
+func (o mirrorOptions) hashes(srcSize, dstSize int64) bool {
+	return o.compare == "hash" && !o.onlyMissing && srcSize == dstSize && srcSize >= 0 && srcSize <= o.hashMaxSize
+}
+
+// contentDiffers compares remote with local, which are the same size, by
+// checksum: the server's, if it offers a checksum command, or else one of
+// remote downloaded to a temporary file. If neither works, the answer is
+// fallback, the size and time comparison.
+func (f *FTPConnection) contentDiffers(remote, local string, fallback bool) bool {
+	differs, err := f.compareContent(remote, local)
+	if err != nil {
+		f.out().Warn("could not compare %s by hash, comparing size and time: %v", remote, err)
+		return fallback
+	}
+	return differs
+}
+
+func (f *FTPConnection) compareContent(remote, local string) (bool, error) {
+	if f.offersChecksum() {
+		algorithm, remoteSum, err := f.remoteChecksum(remote)
+		if err != nil {
+			return false, err
+		}
+		localSum, err := fileChecksum(local, algorithm)
+		if err != nil {
+			return false, err
+		}
+		return !strings.EqualFold(remoteSum, localSum), nil
+	}
+
+	tmp, err := os.CreateTemp("", "goftp-compare-*")
+	if err != nil {
+		return false, err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	if _, err := f.downloadRange(remote, tmp.Name(), 0, -1); err != nil {
+		return false, err
+	}
+	remoteSum, err := fileChecksum(tmp.Name(), "SHA-256")
+	if err != nil {
+		return false, err
+	}
+	localSum, err := fileChecksum(local, "SHA-256")
+	if err != nil {
+		return false, err
+	}
+	return remoteSum != localSum, nil
+}
+
+// calibrateForMirror measures the server's clock skew in dir for mirror
+// --calibrate, unless calibrate already has this session. A failure, such as
+// no write permission, is a warning: the mirror compares uncorrected times.
+func (f *FTPConnection) calibrateForMirror(dir string) {
+	if f.skew.measured {
+		return
+	}
+	skew, err := f.calibrateClock(dir)
+	if err != nil {
+		f.out().Warn("clock calibration failed, comparing times uncorrected: %v", err)
+		return
+	}
+	f.skew = skew
+	f.out().Info("Server time skew: %s", skew)
+}
+
+// probeLinks finds the size and modification time of each link in entries,
+// the listing of rel, that the mirror follows, by name. Links whose targets
+// share a directory are looked up in its listing when planStats finds that
+// cheaper. The rest are probed, their sizes together and then the times of
+// those that have one, the files.
+func (f *FTPConnection) probeLinks(remoteRoot, rel string, entries []RemoteEntry, opts mirrorOptions) (map[string]fileMeta, error) {
+	type link struct{ name, target string }
+	byDir := make(map[string][]link) // by the directory of the target
+	var dirs, names, paths []string
+	for _, entry := range entries {
+		if entry.kind != "link" || opts.excluded(path.Join(rel, entry.name), entry.isDir()) {
+			continue
+		}
+		if entry.target == "" {
+			names = append(names, entry.name)
+			paths = append(paths, path.Join(remoteRoot, rel, entry.name))
+			continue
+		}
+		target := entry.target
+		if !path.IsAbs(target) {
+			target = path.Join(remoteRoot, rel, target)
+		}
+		dir := path.Dir(target)
+		if byDir[dir] == nil {
+			dirs = append(dirs, dir)
+		}
+		byDir[dir] = append(byDir[dir], link{entry.name, target})
+	}
+
+	links := make(map[string]fileMeta)
+	for _, dir := range dirs {
+		group := byDir[dir]
+		plan := f.planStats(dir, len(group))
+		if opts.verbose {
+			f.out().Info("Links into %s (%d): %s", dir, len(group), plan)
+		}
+		listed := make(map[string]RemoteEntry)
+		if plan.list {
+			// a listing that fails leaves its links to the probes
+			dirEntries, _ := f.listDir(dir)
+			for _, entry := range dirEntries {
+				listed[entry.name] = entry
+			}
+		}
+		for _, l := range group {
+			entry, ok := listed[path.Base(l.target)]
+			switch {
+			case ok && entry.kind == "file" && !entry.modTime.IsZero():
+				links[l.name] = fileMeta{size: entry.size, modTime: entry.modTime}
+			case ok && entry.kind == "dir":
+				links[l.name] = fileMeta{sizeErr: fmt.Errorf("%s is not a file", l.target)}
+			default:
+				names = append(names, l.name)
+				paths = append(paths, path.Join(remoteRoot, rel, l.name))
+			}
+		}
+	}
+
+	metas, err := f.probeFiles(paths, true, false)
+	if err != nil {
+		return nil, err
+	}
+	var files []int
+	var filePaths []string
+	for i, meta := range metas {
+		if meta.sizeErr == nil {
+			files = append(files, i)
+			filePaths = append(filePaths, paths[i])
+		}
+	}
+	times, err := f.probeFiles(filePaths, false, true)
+	if err != nil {
+		return nil, err
+	}
+	for j, i := range files {
+		metas[i].modTime, metas[i].timeErr = times[j].modTime, times[j].timeErr
+	}
+	for i, name := range names {
+		links[name] = metas[i]
+	}
+	return links, nil
+}
+
+// mirrorDown makes localRoot a copy of the remote tree at remoteRoot.
+func (f *FTPConnection) mirrorDown(remoteRoot, localRoot string, opts mirrorOptions) (mirrorStats, error) {
+	var stats mirrorStats
+	var plan mirrorPlan
+	seen := make(map[string]bool)  // local rels
+	targets := map[string]string{} // remote rel -> local rel, where they differ in case or name
+
+	absRoot := remoteRoot
+	if opts.links == "follow" && !path.IsAbs(remoteRoot) {
+		// link targets are usually absolute, so loops can only be spotted
+		// against an absolute root
+		cwd, err := f.currentDir()
+		if err != nil {
+			return stats, err
+		}
+		absRoot = path.Join(cwd, remoteRoot)
+	}
+
+	if opts.calibrate {
+		f.calibrateForMirror(remoteRoot)
+	}
+
+	for dirs := []string{""}; len(dirs) > 0; dirs = dirs[1:] {
+		rel := dirs[0]
+		localRel := rel
+		if target, ok := targets[rel]; ok {
+			localRel = target
+		}
+		localDir := longPath(filepath.Join(localRoot, filepath.FromSlash(localRel)))
+		if opts.onlyExisting && rel != "" {
+			// a directory the target lacks holds nothing to update
+			if info, err := os.Stat(localDir); err != nil || !info.IsDir() {
+				continue
+			}
+		}
+		plan.dirs = append(plan.dirs, localDir)
+		entries, err := f.fetchListing(path.Join(remoteRoot, rel))
+		if err != nil {
+			return stats, err
+		}
+		localNames := make(map[string]string)
+		if opts.caseFold {
+			existing, _ := os.ReadDir(localDir)
+			for _, e := range existing {
+				localNames[nameKey(e.Name(), true)] = e.Name()
+			}
+		}
+		var links map[string]fileMeta
+		if opts.links == "follow" {
+			if links, err = f.probeLinks(remoteRoot, rel, entries, opts); err != nil {
+				return stats, err
+			}
+		}
+
+		for _, entry := range entries {
+			childRel := path.Join(rel, entry.name)
+			if opts.excluded(childRel, entry.isDir()) {
+				continue
+			}
+			name := entry.name
+			// a link mirrors as a file when it is followed to one
+			isFile := entry.kind != "link" && !entry.isDir() || entry.kind == "link" && opts.links == "follow" && links[entry.name].sizeErr == nil
+			if len(opts.renames) > 0 && isFile {
+				renamed, err := opts.renames.apply(name)
+				if err != nil {
+					f.out().Warn("skipping %s: %v", childRel, err)
+					continue
+				}
+				name = renamed
+			}
+			childLocal := path.Join(localRel, name)
+			if existing, ok := localNames[nameKey(name, true)]; ok && existing != name {
+				childLocal = path.Join(localRel, existing)
+			}
+			if len(opts.renames) > 0 && seen[childLocal] {
+				f.out().Warn("skipping %s: another file is already mirrored to %s", childRel, childLocal)
+				continue
+			}
+			if childLocal != childRel {
+				targets[childRel] = childLocal
+			}
+			seen[childLocal] = true
+			local := filepath.Join(localRoot, filepath.FromSlash(childLocal))
+
+			if entry.kind == "link" {
+				switch opts.links {
+				case "recreate":
+					plan.links = append(plan.links, mirrorLink{rel: childRel, make: func() error { return recreateLocalLink(entry.target, local) }})
+					continue
+				case "follow":
+					// a link with a file size is a file; anything else is
+					// walked as a directory
+					meta := links[entry.name]
+					if meta.sizeErr != nil {
+						if linkLoops(path.Join(absRoot, childRel), entry.target) {
+							f.out().Warn("skipping %s: link points back into its own parent", childRel)
+						} else {
+							dirs = append(dirs, childRel)
+						}
+						continue
+					}
+					entry.size, entry.modTime, entry.modPrecision = meta.size, meta.modTime, time.Second
+				default:
+					continue
+				}
+			}
+
+			if entry.isDir() {
+				dirs = append(dirs, childRel)
+				continue
+			}
+			entry.modTime = f.skew.correct(entry, true)
+			info, err := os.Stat(local)
+			if err == nil {
+				transfer := opts.shouldTransfer(entry.size, entry.modTime, info.Size(), info.ModTime(), entry.modPrecision)
+				if opts.hashes(entry.size, info.Size()) {
+					transfer = f.contentDiffers(path.Join(remoteRoot, childRel), local, transfer)
+				}
+				if !transfer {
+					stats.skipped++
+					continue
+				}
+			}
+			if err != nil && opts.onlyExisting {
+				stats.skipped++
+				continue
+			}
+			if opts.limit.admit(entry.size) != nil {
+				stats.deferred++
+				continue
+			}
+			plan.tasks = append(plan.tasks, mirrorTask{rel: childRel, target: childLocal, size: entry.size, modTime: entry.modTime, exists: err == nil})
+		}
+	}
+
+	if _, err := os.Stat(localRoot); err == nil && opts.delete {
+		err := filepath.WalkDir(localRoot, func(p string, d fs.DirEntry, err error) error {
+			if err != nil || p == localRoot {
+				return err
+			}
+			rel, err := filepath.Rel(localRoot, p)
+			if err != nil {
+				return err
+			}
+			rel = filepath.ToSlash(rel)
+			if opts.excluded(rel, d.IsDir()) {
+				if d.IsDir() {
+					return fs.SkipDir
+				}
+				return nil
+			}
+			if seen[rel] {
+				return nil
+			}
+			plan.stale = append(plan.stale, rel)
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		})
+		if err != nil {
+			return stats, err
+		}
+	}
+	if err := f.approveMirror(plan, opts); err != nil {
+		return stats, err
+	}
+
+	for _, dir := range plan.dirs {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return stats, err
+		}
+	}
+	f.makeMirrorLinks(plan.links, &stats)
+	f.runMirrorTasks(plan.tasks, opts.parallel, &stats, func(conn *FTPConnection, task mirrorTask) (int64, error) {
+		local := longPath(filepath.Join(localRoot, filepath.FromSlash(task.target)))
+		remote := path.Join(remoteRoot, task.rel)
+		n, err := conn.downloadFile(remote, local, task.size)
+		if err != nil {
+			opts.report.add(remote, local, err)
+		}
+		if err == nil && !task.modTime.IsZero() {
+			os.Chtimes(local, task.modTime, task.modTime)
+		}
+		return n, err
+	})
+
+	for _, rel := range plan.stale {
+		if err := os.RemoveAll(filepath.Join(localRoot, filepath.FromSlash(rel))); err != nil {
+			return stats, err
+		}
+		f.out().Info("Removed %s", rel)
+		stats.deleted++
+	}
+	return stats, nil
+}
+
+// makeMirrorLinks recreates the planned symlinks.
+func (f *FTPConnection) makeMirrorLinks(links []mirrorLink, stats *mirrorStats) {
+	for _, link := range links {
+		if err := link.make(); err != nil {
+			f.out().Error(fmt.Errorf("failed to link %s: %v", link.rel, err))
+			stats.failed++
+		}
+	}
+}
+
+// mirrorUp makes the remote tree at remoteRoot a copy of localRoot.
+func (f *FTPConnection) mirrorUp(localRoot, remoteRoot string, opts mirrorOptions) (mirrorStats, error) {
+	var stats mirrorStats
+	var plan mirrorPlan
+	targets := map[string]string{}   // local rel -> remote rel, where they differ in case or name
+	missing := make(map[string]bool) // local rels of directories the server lacks
+
+	var db *checksumDB
+	present := make(map[string]bool)
+	if opts.checksums {
+		absRemote := remoteRoot
+		if !path.IsAbs(remoteRoot) {
+			cwd, err := f.currentDir()
+			if err != nil {
+				return stats, err
+			}
+			absRemote = path.Join(cwd, remoteRoot)
+		}
+		var err error
+		if db, err = openChecksumDB(f.addr, localRoot, absRemote); err != nil {
+			return stats, fmt.Errorf("failed to open checksum database: %v", err)
+		}
+	}
+
+	for dirs := []string{""}; len(dirs) > 0; dirs = dirs[1:] {
+		rel := dirs[0]
+		remoteRel := rel
+		if target, ok := targets[rel]; ok {
+			remoteRel = target
+		}
+		remoteDir := path.Join(remoteRoot, remoteRel)
+
+		remote := make(map[string]RemoteEntry)
+		var entries []RemoteEntry
+		var err error
+		if !missing[rel] {
+			entries, err = f.fetchListing(remoteDir)
+		}
+		if missing[rel] || err != nil {
+			// most servers refuse to list a directory that doesn't exist yet
+			if opts.onlyExisting && rel != "" {
+				continue
+			}
+			missing[rel] = true
+			plan.dirs = append(plan.dirs, remoteDir)
+		}
+		if opts.calibrate && rel == "" {
+			f.calibrateForMirror(remoteRoot)
+		}
+		for _, entry := range entries {
+			// times this mirror set with MFMT carry no clock error
+			entry.modTime = f.skew.correct(entry, !f.hasFeature("MFMT"))
+			remote[nameKey(entry.name, opts.caseFold)] = entry
+		}
+
+		localEntries, err := os.ReadDir(filepath.Join(localRoot, filepath.FromSlash(rel)))
+		if err != nil {
+			return stats, err
+		}
+		seen := make(map[string]bool)
+		for _, local := range localEntries {
+			childRel := path.Join(rel, local.Name())
+			if opts.excluded(childRel, local.IsDir()) {
+				continue
+			}
+			localPath := filepath.Join(localRoot, filepath.FromSlash(childRel))
+			name := local.Name()
+			if len(opts.renames) > 0 && mirrorsAsFile(local, localPath, opts.links) {
+				renamed, err := opts.renames.apply(name)
+				if err != nil {
+					f.out().Warn("skipping %s: %v", childRel, err)
+					continue
+				}
+				name = renamed
+			}
+			key := nameKey(name, opts.caseFold)
+			if len(opts.renames) > 0 && seen[key] {
+				f.out().Warn("skipping %s: another file is already mirrored to %s", childRel, path.Join(remoteRel, name))
+				continue
+			}
+			seen[key] = true
+			childRemote := path.Join(remoteRel, name)
+			if existing, ok := remote[key]; ok {
+				childRemote = path.Join(remoteRel, existing.name)
+			}
+			if childRemote != childRel {
+				targets[childRel] = childRemote
+			}
+
+			info, err := local.Info()
+			if err != nil {
+				continue
+			}
+			if info.Mode()&fs.ModeSymlink != 0 {
+				switch opts.links {
+				case "recreate":
+					plan.links = append(plan.links, mirrorLink{rel: childRel, make: func() error { return f.recreateRemoteLink(localPath, path.Join(remoteRoot, childRemote)) }})
+					continue
+				case "follow":
+					if info, err = os.Stat(localPath); err != nil {
+						continue
+					}
+					if info.IsDir() && localLinkLoops(localPath) {
+						f.out().Warn("skipping %s: link points back into its own parent", childRel)
+						continue
+					}
+				default:
+					continue
+				}
+			}
+
+			if info.IsDir() {
+				// a directory inside one the server lacks is missing too
+				missing[childRel] = missing[rel]
+				dirs = append(dirs, childRel)
+				continue
+			}
+			if !info.Mode().IsRegular() {
+				continue
+			}
+			present[childRel] = true
+			if existing, ok := remote[key]; ok {
+				transfer := opts.shouldTransfer(info.Size(), info.ModTime(), existing.size, existing.modTime, existing.modPrecision)
+				if opts.hashes(info.Size(), existing.size) {
+					transfer = f.contentDiffers(path.Join(remoteRoot, childRemote), localPath, transfer)
+				} else if db.has(childRel) {
+					// the database knows whether the local file changed since
+					// it was uploaded, even where the server can't keep upload
+					// times or a same-size edit falls within their precision
+					transfer = existing.size != info.Size() || !db.unchanged(childRel, localPath, info)
+				}
+				if !transfer || opts.onlyMissing {
+					stats.skipped++
+					continue
+				}
+			} else if opts.onlyExisting {
+				stats.skipped++
+				continue
+			}
+			if opts.limit.admit(info.Size()) != nil {
+				stats.deferred++
+				continue
+			}
+			_, exists := remote[key]
+			plan.tasks = append(plan.tasks, mirrorTask{rel: childRel, target: childRemote, size: info.Size(), modTime: info.ModTime(), exists: exists})
+		}
+
+		for key, entry := range remote {
+			childRemote := path.Join(remoteRel, entry.name)
+			if opts.delete && !seen[key] && !opts.excluded(childRemote, entry.isDir()) {
+				plan.stale = append(plan.stale, childRemote)
+			}
+		}
+	}
+	sort.Strings(plan.stale)
+	if err := f.approveMirror(plan, opts); err != nil {
+		return stats, err
+	}
+
+	for _, dir := range plan.dirs {
+		if err := f.makeRemoteDirs(dir); err != nil {
+			return stats, err
+		}
+	}
+	f.makeMirrorLinks(plan.links, &stats)
+	f.runMirrorTasks(plan.tasks, opts.parallel, &stats, func(conn *FTPConnection, task mirrorTask) (int64, error) {
+		remote := path.Join(remoteRoot, task.target)
+		localPath := longPath(filepath.Join(localRoot, filepath.FromSlash(task.rel)))
+		n, err := conn.uploadFile(localPath, remote)
+		if err == nil && conn.hasFeature("MFMT") {
+			// keep remote timestamps in step so the next run can skip this file
+			conn.sendCommand(fmt.Sprintf("MFMT %s %s", task.modTime.UTC().Format("20060102150405"), remote))
+		}
+		if err == nil && db != nil {
+			if dbErr := db.record(task.rel, localPath); dbErr != nil {
+				conn.out().Warn("could not checksum %s: %v", task.rel, dbErr)
+			}
+		}
+		if err != nil {
+			opts.report.add(localPath, remote, err)
+		}
+		return n, err
+	})
+	if db != nil {
+		if err := db.save(present); err != nil {
+			f.out().Warn("failed to save checksum database: %v", err)
+		}
+	}
+
+	for _, rel := range plan.stale {
+		if err := f.removeRemote(path.Join(remoteRoot, rel)); err != nil {
+			f.out().Error(fmt.Errorf("failed to remove %s: %v", rel, err))
+			stats.failed++
+			continue
+		}
+		f.out().Info("Removed %s", rel)
+		stats.deleted++
+	}
+	return stats, nil
+}
+
+// mirrorsAsFile reports whether mirror -R uploads the local entry at
+// localPath as a file: a regular file, or a link to one that is followed.
+func mirrorsAsFile(entry fs.DirEntry, localPath, links string) bool {
+	if entry.Type()&fs.ModeSymlink == 0 {
+		return entry.Type().IsRegular()
+	}
+	info, err := os.Stat(localPath)
+	return links == "follow" && err == nil && info.Mode().IsRegular()
+}
+
+// recreateLocalLink replaces whatever is at local with a symlink to target.
+func recreateLocalLink(target, local string) error {
+	if target == "" {
+		return fmt.Errorf("server did not report the link target")
+	}
+	if existing, err := os.Readlink(local); err == nil && existing == target {
+		return nil
+	}
+	if err := os.RemoveAll(local); err != nil {
+		return err
+	}
+	return os.Symlink(target, local)
+}
+
+// recreateRemoteLink mirrors a local symlink with the non-standard SITE
+// SYMLINK command, which servers such as ProFTPD (mod_site_misc) provide.
+func (f *FTPConnection) recreateRemoteLink(localPath, remote string) error {
+	target, err := os.Readlink(localPath)
+	if err != nil {
+		return err
+	}
+	resp, err := f.sendCommand(fmt.Sprintf("SITE SYMLINK %s %s", filepath.ToSlash(target), remote))
+	if err != nil {
+		return err
+	}
+	if !isSuccessResponse(resp) {
+		return fmt.Errorf("SITE SYMLINK failed: %s", strings.TrimSpace(resp))
+	}
+	return nil
+}
+
+// linkLoops reports whether following the remote link at linkPath to target
+// would revisit one of the link's own ancestors.
+func linkLoops(linkPath, target string) bool {
+	if target == "" {
+		return false
+	}
+	if !path.IsAbs(target) {
+		target = path.Join(path.Dir(linkPath), target)
+	}
+	return strings.HasPrefix(linkPath+"/", path.Clean(target)+"/")
+}
+
+// localLinkLoops is linkLoops for a local directory symlink.
+func localLinkLoops(localPath string) bool {
+	target, err := filepath.EvalSymlinks(localPath)
+	if err != nil {
+		return true
+	}
+	parent, err := filepath.Abs(filepath.Dir(localPath))
+	if err != nil {
+		return true
+	}
+	if parent, err = filepath.EvalSymlinks(parent); err != nil {
+		return true
+	}
+	sep := string(filepath.Separator)
+	return strings.HasPrefix(parent+sep, target+sep)
+}
+
+// removeRemote deletes a remote file, or a directory and everything in it.
+func (f *FTPConnection) removeRemote(target string) error {
+	resp, err := f.sendCommand(fmt.Sprintf("DELE %s", target))
+	if err != nil {
+		return err
+	}
+	if isSuccessResponse(resp) {
+		return nil
+	}
+
+	// DELE refuses directories, so empty it out and RMD instead
+	entries, err := f.fetchListing(target)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := f.removeRemote(path.Join(target, entry.name)); err != nil {
+			return err
+		}
+	}
+	resp, err = f.sendCommand(fmt.Sprintf("RMD %s", target))
+	if err != nil {
+		return err
+	}
+	if !isSuccessResponse(resp) {
+		return fmt.Errorf("RMD failed: %s", strings.TrimSpace(resp))
+	}
+	return nil
+}
+
+// runMirrorTasks executes tasks on up to parallel connections: this one plus
+// freshly opened siblings, which are closed again when the work is done.
+// When the server's connection limit allows fewer, the tasks queue for the
+// workers there are.
+func (f *FTPConnection) runMirrorTasks(tasks []mirrorTask, parallel int, stats *mirrorStats, do func(*FTPConnection, mirrorTask) (int64, error)) {
+	workers := []*FTPConnection{f}
+	for i := 1; i < parallel && i < len(tasks); i++ {
+		sibling, err := f.openSibling()
+		if errors.Is(err, errConnectionLimit) {
+			f.out().Info("Mirroring over %d connections (%v)", len(workers), err)
+			break
+		}
+		if err != nil {
+			f.out().Warn("could not open parallel connection: %v", err)
+			break
+		}
+		defer func() {
+			sibling.sendCommand("QUIT")
+			sibling.Close()
+		}()
+		workers = append(workers, sibling)
+	}
+
+	paths := make([]string, len(tasks))
+	sizes := make(map[string]int64, len(tasks))
+	for i, task := range tasks {
+		paths[i], sizes[task.rel] = task.rel, task.size
+	}
+	batch := newBatchProgress(f.out(), paths, sizes)
+	defer batch.finish()
+	for _, worker := range workers {
+		worker.batch = batch
+		defer func() { worker.batch = nil }()
+	}
+	// the command's --bwlimit covers all of its workers together
+	for _, worker := range workers[1:] {
+		worker.jobLimit = f.jobLimit
+	}
+
+	queue := make(chan mirrorTask)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, worker := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for task := range queue {
+				start := time.Now()
+				n, err := do(worker, task)
+				elapsed := time.Since(start)
+
+				mu.Lock()
+				batch.fileDone(task.rel, n, func() {
+					if err != nil {
+						f.out().Error(fmt.Errorf("%s: %v", task.rel, err))
+						stats.failed++
+					} else {
+						f.out().Info("Transferred %s (%s)", task.rel, transferSummary(n, elapsed))
+						stats.transferred++
+						stats.bytes += n
+					}
+				})
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, task := range tasks {
+		queue <- task
+	}
+	close(queue)
+	wg.Wait()
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestMirrorHashes(t *testing.T) {
+	hash := mirrorOptions{compare: "hash", hashMaxSize: 100}
+	tests := []struct {
+		opts             mirrorOptions
+		srcSize, dstSize int64
+		want             bool
+	}{
+		{hash, 10, 10, true},
+		{hash, 10, 11, false}, // different sizes differ anyway
+		{hash, 200, 200, false},
+		{hash, -1, -1, false},
+		{mirrorOptions{compare: "size-time", hashMaxSize: 100}, 10, 10, false},
+		{mirrorOptions{compare: "hash", onlyMissing: true, hashMaxSize: 100}, 10, 10, false},
+	}
+	for _, tt := range tests {
+		if got := tt.opts.hashes(tt.srcSize, tt.dstSize); got != tt.want {
+			t.Errorf("%+v hashes(%d, %d) = %v, want %v", tt.opts, tt.srcSize, tt.dstSize, got, tt.want)
+		}
+	}
+}
+
+// compareContent uses the server's checksum when it offers one, and
+// otherwise downloads the file to hash it.
+func TestCompareContent(t *testing.T) {
+	local := filepath.Join(t.TempDir(), "a.txt")
+	if err := os.WriteFile(local, []byte("same content\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("same content\n"))
+	same := hex.EncodeToString(sum[:])
+	other := strings.Repeat("0", 64)
+
+	tests := []struct {
+		name     string
+		features []string
+		replies  map[string]string
+		remote   string // served for RETR when there is no checksum command
+		differs  bool
+		verb     string // the command that must have been sent
+	}{
+		{"HASH same", []string{"HASH SHA-256*"}, map[string]string{"HASH a.txt": "213 SHA-256 0-12 " + same + " a.txt"}, "", false, "HASH"},
+		{"HASH differs", []string{"HASH SHA-256*"}, map[string]string{"HASH a.txt": "213 SHA-256 0-12 " + other + " a.txt"}, "", true, "HASH"},
+		{"XSHA256", []string{"XSHA256"}, map[string]string{"XSHA256 a.txt": "250 " + strings.ToUpper(same)}, "", false, "XSHA256"},
+		{"download same", nil, nil, "same content\n", false, "RETR"},
+		{"download differs", nil, nil, "SAME CONTENT\n", true, "RETR"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newFakeSession().withFeatures(tt.features...)
+			for cmd, resp := range tt.replies {
+				s.replies[cmd] = resp
+			}
+			if tt.remote != "" {
+				s.files["RETR a.txt"] = tt.remote
+			}
+			f, out := newFakeConnection(s)
+			differs, err := f.compareContent("a.txt", local)
+			if err != nil {
+				t.Fatalf("compareContent: %v\n%s", err, out)
+			}
+			if differs != tt.differs {
+				t.Errorf("compareContent = %v, want %v", differs, tt.differs)
+			}
+			if !slices.ContainsFunc(s.sentCommands(), func(cmd string) bool { return strings.HasPrefix(cmd, tt.verb+" ") }) {
+				t.Errorf("compared without %s: sent %q", tt.verb, s.sentCommands())
+			}
+		})
+	}
+}
+
+// mirror plans the whole run first: --dry-run shows the plan and changes
+// nothing, and the run itself carries it out.
+func TestMirrorPlan(t *testing.T) {
+	useTempDirs(t)
+	served := t.TempDir()
+	for name, content := range map[string]string{
+		"data/a.txt":     "new file\n",
+		"data/b.txt":     "updated contents\n",
+		"data/sub/c.txt": "in a new directory\n",
+	} {
+		p := filepath.Join(served, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(p), 0755)
+		os.WriteFile(p, []byte(content), 0644)
+	}
+	addr, err := startMockServer(served)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(t.TempDir())
+	writeTree(t, map[string]string{
+		"local/b.txt":     "old\n",
+		"local/stale.txt": "gone from the server\n",
+	})
+	f, out := dialMock(t, addr)
+
+	out.Reset()
+	if err := f.execute("mirror --dry-run --delete data local"); err != nil {
+		t.Fatalf("mirror --dry-run: %v\n%s", err, out)
+	}
+	for _, want := range []string{"Mirror plan: 2 new, 1 updated, 1 deleted", " new     a.txt", " update  b.txt", " new     sub/c.txt", " delete  stale.txt"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("the dry run lacks %q:\n%s", want, out)
+		}
+	}
+	if _, err := os.Stat("local/sub"); !os.IsNotExist(err) {
+		t.Error("the dry run created a directory")
+	}
+	if got, _ := os.ReadFile("local/b.txt"); string(got) != "old\n" {
+		t.Error("the dry run changed b.txt")
+	}
+	if _, err := os.Stat("local/stale.txt"); err != nil {
+		t.Error("the dry run deleted stale.txt")
+	}
+
+	out.Reset()
+	if err := f.execute("mirror -y --delete data local"); err != nil {
+		t.Fatalf("mirror: %v\n%s", err, out)
+	}
+	for name, want := range map[string]string{"a.txt": "new file\n", "b.txt": "updated contents\n", "sub/c.txt": "in a new directory\n"} {
+		if got, err := os.ReadFile(filepath.Join("local", filepath.FromSlash(name))); err != nil || string(got) != want {
+			t.Errorf("%s holds %q, %v, want %q", name, got, err, want)
+		}
+	}
+	if _, err := os.Stat("local/stale.txt"); !os.IsNotExist(err) {
+		t.Error("mirror --delete left stale.txt")
+	}
+
+	out.Reset()
+	if err := f.execute("mirror --dry-run --delete data local"); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "Mirror plan") {
+		t.Errorf("a mirror with nothing to do showed a plan:\n%s", out)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"strings"
+)
+
+// Servers differ in which MLST facts (RFC 3659) they send by default, so
+// before the first MLSD or MLST of a login the client asks with OPTS MLST
+// for the ones it reads, among those the server lists in FEAT. A server
+// that refuses OPTS MLST, or doesn't have some of the facts, is used as it
+// is: a missing fact leaves its field unset, as with LIST. Only a server
+// without the type fact can't tell files from directories, so its listings
+// come from LIST instead.
+
+// mlstFacts are the facts parseMLSDLine reads.
+var mlstFacts = []string{"type", "size", "modify", "perm", "unix.mode"}
+
+// parseMLSTFacts parses FEAT's MLST parameters, e.g. "type*;size*;modify;",
+// into the facts the server has, each mapped to whether it is enabled.
+func parseMLSTFacts(params string) map[string]bool {
+	facts := make(map[string]bool)
+	for _, fact := range strings.Split(params, ";") {
+		fact = strings.ToLower(strings.TrimSpace(fact))
+		if name, ok := strings.CutSuffix(fact, "*"); ok {
+			facts[name] = true
+		} else if fact != "" {
+			facts[fact] = false
+		}
+	}
+	return facts
+}
+
+// selectMLSTFacts sends OPTS MLST for the facts the client reads, once per
+// login, if the server has some of them turned off.
+func (f *FTPConnection) selectMLSTFacts() {
+	if f.mlstSelected {
+		return
+	}
+	f.mlstSelected = true
+	params, ok := f.featureParams("MLST")
+	if !ok {
+		return
+	}
+	facts := parseMLSTFacts(params)
+	var want strings.Builder
+	changed := false
+	for _, name := range mlstFacts {
+		if enabled, ok := facts[name]; ok {
+			want.WriteString(name + ";")
+			changed = changed || !enabled
+		}
+	}
+	if !changed {
+		return
+	}
+	// a refusal leaves the server's default facts, which still parse
+	f.sendCommand("OPTS MLST " + want.String())
+}
+
+// useMLSD reports whether listings should come from MLSD: the server has it,
+// and its facts, when FEAT lists them, include type.
+func (f *FTPConnection) useMLSD() bool {
+	if !f.hasFeature("MLSD") {
+		return false
+	}
+	f.selectMLSTFacts()
+	if params, ok := f.featureParams("MLST"); ok {
+		if facts := parseMLSTFacts(params); len(facts) > 0 {
+			_, hasType := facts["type"]
+			return hasType
+		}
+	}
+	return true
+}
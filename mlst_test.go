@@ -0,0 +1,104 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseMLSTFacts(t *testing.T) {
+	got := parseMLSTFacts("Type*;Size*;modify;UNIX.mode;;")
+	want := map[string]bool{"type": true, "size": true, "modify": false, "unix.mode": false}
+	if len(got) != len(want) {
+		t.Fatalf("parseMLSTFacts = %v, want %v", got, want)
+	}
+	for name, enabled := range want {
+		if e, ok := got[name]; !ok || e != enabled {
+			t.Errorf("parseMLSTFacts = %v, want %v", got, want)
+		}
+	}
+}
+
+// OPTS MLST is sent once per login, for the facts the client reads that
+// the server has, and only when some of them are off.
+func TestSelectMLSTFacts(t *testing.T) {
+	tests := []struct {
+		name string
+		mlst string // FEAT's MLST line
+		want string // the OPTS MLST sent, if any
+	}{
+		{"some off", "MLST type*;size*;modify;perm;media-type;", "OPTS MLST type;size;modify;perm;"},
+		{"all on", "MLST type*;size*;modify*;", ""},
+		{"no facts listed", "MLST", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newFakeSession().withFeatures("MLSD", tt.mlst)
+			s.files["MLSD"] = "type=file;size=3; a.txt\r\n"
+			f, out := newFakeConnection(s)
+			for range 2 {
+				f.listings = nil
+				if _, err := f.listDir(""); err != nil {
+					t.Fatalf("listDir: %v\n%s", err, out)
+				}
+			}
+			var opts []string
+			for _, cmd := range s.sentCommands() {
+				if strings.HasPrefix(cmd, "OPTS MLST") {
+					opts = append(opts, cmd)
+				}
+			}
+			switch {
+			case tt.want == "" && len(opts) != 0:
+				t.Errorf("sent %q, want no OPTS MLST", opts)
+			case tt.want != "" && !slices.Equal(opts, []string{tt.want}):
+				t.Errorf("sent %q, want %q once", opts, tt.want)
+			}
+
+			s.mu.Lock()
+			s.sent = nil
+			s.mu.Unlock()
+			f.sendCommand("USER user")
+			f.listings = nil
+			f.listDir("")
+			if tt.want != "" && !slices.Contains(s.sentCommands(), tt.want) {
+				t.Errorf("OPTS MLST wasn't sent again after a new login: %q", s.sentCommands())
+			}
+		})
+	}
+}
+
+// A refused OPTS MLST leaves the default facts, which still list.
+func TestSelectMLSTFactsRefused(t *testing.T) {
+	s := newFakeSession().withFeatures("MLSD", "MLST type*;size;")
+	s.replies["OPTS"] = "501 Bad fact list"
+	s.files["MLSD"] = "type=dir; sub\r\ntype=file; a.txt\r\n"
+	f, out := newFakeConnection(s)
+	entries, err := f.listDir("")
+	if err != nil {
+		t.Fatalf("listDir: %v\n%s", err, out)
+	}
+	if len(entries) != 2 || entries[0].kind != "dir" || entries[1].size != 0 {
+		t.Errorf("listDir = %+v, want sub as a directory and a.txt without a size", entries)
+	}
+}
+
+// Without the type fact MLSD can't tell directories from files, so the
+// listing comes from LIST.
+func TestUseMLSDWithoutType(t *testing.T) {
+	tests := []struct {
+		features []string
+		want     bool
+	}{
+		{[]string{"MLSD", "MLST type*;size*;"}, true},
+		{[]string{"MLSD", "MLST size*;modify*;"}, false},
+		{[]string{"MLSD", "MLST"}, true},
+		{[]string{"MLST type*;"}, false},
+	}
+	for _, tt := range tests {
+		f, _ := newFakeConnection(newFakeSession().withFeatures(tt.features...))
+		if got := f.useMLSD(); got != tt.want {
+			t.Errorf("with %q useMLSD = %v, want %v", tt.features, got, tt.want)
+		}
+	}
+}
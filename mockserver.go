@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// -host mock:///path/to/dir connects to an FTP server built into the
+// client that serves a local directory, so scripts, mirrors, and list files
+// can be rehearsed offline before they touch the real server. The server
+// speaks enough of the protocol for every command: passive data connections
+// only, MLSD and LIST, SIZE, MDTM, REST, uploads, and the directory and
+// rename commands. Any user and password log in.
+
+// mockScheme starts a -host that names a directory to serve.
+const mockScheme = "mock://"
+
+// mockDataTimeout is how long the mock server waits for the client to open
+// a passive data connection.
+const mockDataTimeout = 30 * time.Second
+
+// startMockServer serves dir on a free loopback port and returns the
+// address to connect to.
+func startMockServer(dir string) (string, error) {
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		return "", fmt.Errorf("can't serve %s: %v", dir, err)
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("can't serve %s: not a directory", dir)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s := &mockSession{root: root, conn: conn, cwd: "/"}
+			go s.serve()
+		}
+	}()
+	return ln.Addr().String(), nil
+}
+
+// mockSession is one control connection to the mock server.
+type mockSession struct {
+	root   string // the served directory
+	conn   net.Conn
+	cwd    string // slash-separated, from the root
+	dataLn net.Listener
+	rest   int64
+	rnfr   string
+}
+
+func (s *mockSession) reply(format string, args ...any) {
+	fmt.Fprintf(s.conn, format+"\r\n", args...)
+}
+
+func (s *mockSession) serve() {
+	defer s.conn.Close()
+	defer s.closeData()
+	s.reply("220 goftp mock server ready, serving %s", s.root)
+	reader := bufio.NewReader(s.conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+		if !s.command(strings.ToUpper(verb), arg) {
+			return
+		}
+	}
+}
+
+// resolve maps a path as the client gives it to a virtual path and the local
+// file it stands for. Virtual paths are cleaned from the root, so .. can't
+// leave the served directory.
+func (s *mockSession) resolve(p string) (string, string) {
+	if !strings.HasPrefix(p, "/") {
+		p = path.Join(s.cwd, p)
+	}
+	virtual := path.Clean("/" + p)
+	return virtual, filepath.Join(s.root, filepath.FromSlash(virtual))
+}
+
+// command handles one command and reports whether the session goes on.
+func (s *mockSession) command(verb, arg string) bool {
+	// REST applies only to the command that follows it
+	rest := s.rest
+	s.rest = 0
+	switch verb {
+	case "USER":
+		s.reply("331 Any password will do")
+	case "PASS":
+		s.reply("230 Logged in")
+	case "SYST":
+		s.reply("215 UNIX Type: L8")
+	case "FEAT":
+		s.reply("211-Features:\r\n MLSD\r\n MLST type*;size*;modify*;unix.mode*;\r\n SIZE\r\n MDTM\r\n REST STREAM\r\n UTF8\r\n211 End")
+	case "OPTS", "TYPE", "MODE", "STRU", "NOOP", "ALLO":
+		s.reply("200 OK")
+	case "PWD", "XPWD":
+		s.reply("257 \"%s\" is the current directory", strings.ReplaceAll(s.cwd, `"`, `""`))
+	case "CWD", "CDUP":
+		if verb == "CDUP" {
+			arg = ".."
+		}
+		virtual, local := s.resolve(arg)
+		if info, err := os.Stat(local); err != nil || !info.IsDir() {
+			s.reply("550 %s: no such directory", arg)
+			return true
+		}
+		s.cwd = virtual
+		s.reply("250 Directory changed to %s", virtual)
+	case "PASV", "EPSV":
+		s.closeData()
+		host, _, _ := net.SplitHostPort(s.conn.LocalAddr().String())
+		ln, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+		if err != nil {
+			s.reply("425 Can't open data connection: %v", err)
+			return true
+		}
+		s.dataLn = ln
+		code := "227"
+		if verb == "EPSV" {
+			code = "229"
+		}
+		io.WriteString(s.conn, passiveReply(code, ln.Addr().(*net.TCPAddr)))
+	case "PORT", "EPRT":
+		s.reply("502 The mock server only supports passive mode")
+	case "REST":
+		n, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil || n < 0 {
+			s.reply("501 Invalid offset")
+			return true
+		}
+		s.rest = n
+		s.reply("350 Restarting at %d", n)
+	case "SIZE":
+		_, local := s.resolve(arg)
+		info, err := os.Stat(local)
+		if err != nil || !info.Mode().IsRegular() {
+			s.reply("550 %s: no such file", arg)
+			return true
+		}
+		s.reply("213 %d", info.Size())
+	case "MDTM":
+		_, local := s.resolve(arg)
+		info, err := os.Stat(local)
+		if err != nil {
+			s.reply("550 %s: no such file", arg)
+			return true
+		}
+		s.reply("213 %s", info.ModTime().UTC().Format("20060102150405"))
+	case "MLST":
+		_, local := s.resolve(arg)
+		info, err := os.Stat(local)
+		if err != nil {
+			s.reply("550 %s: no such file or directory", arg)
+			return true
+		}
+		s.reply("250-Listing %s\r\n %s\r\n250 End", arg, mlsdFacts(info)+path.Base(arg))
+	case "LIST", "NLST", "MLSD":
+		s.list(verb, arg)
+	case "RETR":
+		s.retrieve(arg, rest)
+	case "STOR", "APPE":
+		s.store(arg, rest, verb == "APPE")
+	case "DELE":
+		_, local := s.resolve(arg)
+		if info, err := os.Stat(local); err != nil || info.IsDir() {
+			s.reply("550 %s: no such file", arg)
+		} else if err := os.Remove(local); err != nil {
+			s.reply("550 %v", err)
+		} else {
+			s.reply("250 Deleted %s", arg)
+		}
+	case "MKD", "XMKD":
+		virtual, local := s.resolve(arg)
+		if err := os.Mkdir(local, 0755); err != nil {
+			s.reply("550 %v", mockError(err))
+		} else {
+			s.reply("257 \"%s\" created", virtual)
+		}
+	case "RMD", "XRMD":
+		_, local := s.resolve(arg)
+		if info, err := os.Stat(local); err != nil || !info.IsDir() {
+			s.reply("550 %s: no such directory", arg)
+		} else if err := os.Remove(local); err != nil {
+			s.reply("550 %v", mockError(err))
+		} else {
+			s.reply("250 Removed %s", arg)
+		}
+	case "RNFR":
+		_, local := s.resolve(arg)
+		if _, err := os.Stat(local); err != nil {
+			s.reply("550 %s: no such file or directory", arg)
+			return true
+		}
+		s.rnfr = local
+		s.reply("350 Ready for RNTO")
+	case "RNTO":
+		from := s.rnfr
+		s.rnfr = ""
+		_, local := s.resolve(arg)
+		if from == "" {
+			s.reply("503 RNFR first")
+		} else if err := os.Rename(from, local); err != nil {
+			s.reply("550 %v", mockError(err))
+		} else {
+			s.reply("250 Renamed")
+		}
+	case "SITE":
+		s.site(arg)
+	case "ABOR":
+		s.closeData()
+		s.reply("226 Aborted")
+	case "QUIT":
+		s.reply("221 Goodbye")
+		return false
+	default:
+		s.reply("502 %s not implemented", verb)
+	}
+	return true
+}
+
+// site handles SITE CHMOD, the only SITE command the mock server knows.
+func (s *mockSession) site(arg string) {
+	sub, rest, _ := strings.Cut(arg, " ")
+	mode, name, _ := strings.Cut(rest, " ")
+	if !strings.EqualFold(sub, "CHMOD") {
+		s.reply("502 SITE %s not implemented", sub)
+		return
+	}
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		s.reply("501 Invalid mode %s", mode)
+		return
+	}
+	_, local := s.resolve(name)
+	if err := os.Chmod(local, fs.FileMode(perm)); err != nil {
+		s.reply("550 %v", mockError(err))
+		return
+	}
+	s.reply("200 SITE CHMOD OK")
+}
+
+func (s *mockSession) closeData() {
+	if s.dataLn != nil {
+		s.dataLn.Close()
+		s.dataLn = nil
+	}
+}
+
+// openData accepts the data connection the last PASV or EPSV set up,
+// replying 425 if there isn't one. As on most servers, a listener outlives
+// a command refused before its 150, so the client may still use it.
+func (s *mockSession) openData() (net.Conn, bool) {
+	ln := s.dataLn
+	s.dataLn = nil
+	if ln == nil {
+		s.reply("425 Use PASV or EPSV first")
+		return nil, false
+	}
+	defer ln.Close()
+	ln.(*net.TCPListener).SetDeadline(time.Now().Add(mockDataTimeout))
+	conn, err := ln.Accept()
+	if err != nil {
+		s.reply("425 Can't open data connection: %v", err)
+		return nil, false
+	}
+	return conn, true
+}
+
+// list sends a directory listing, or a file's own line, in the form verb
+// asks for. Options such as -a are ignored.
+func (s *mockSession) list(verb, arg string) {
+	if strings.HasPrefix(arg, "-") {
+		_, arg, _ = strings.Cut(arg, " ")
+	}
+	_, local := s.resolve(arg)
+	info, err := os.Stat(local)
+	if err != nil {
+		s.reply("550 %s: no such file or directory", arg)
+		return
+	}
+	var infos []fs.FileInfo
+	if info.IsDir() {
+		entries, err := os.ReadDir(local)
+		if err != nil {
+			s.reply("550 %v", mockError(err))
+			return
+		}
+		for _, entry := range entries {
+			if info, err := entry.Info(); err == nil {
+				infos = append(infos, info)
+			}
+		}
+	} else if verb != "MLSD" {
+		infos = append(infos, info)
+	} else {
+		s.reply("501 %s is not a directory", arg)
+		return
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+
+	s.reply("150 Opening data connection for %s", verb)
+	conn, ok := s.openData()
+	if !ok {
+		return
+	}
+	w := bufio.NewWriter(conn)
+	for _, info := range infos {
+		switch verb {
+		case "NLST":
+			fmt.Fprintf(w, "%s\r\n", info.Name())
+		case "MLSD":
+			fmt.Fprintf(w, "%s%s\r\n", mlsdFacts(info), info.Name())
+		default:
+			fmt.Fprintf(w, "%s\r\n", listLine(info))
+		}
+	}
+	w.Flush()
+	conn.Close()
+	s.reply("226 Transfer complete")
+}
+
+// retrieve sends a file from offset on.
+func (s *mockSession) retrieve(arg string, offset int64) {
+	_, local := s.resolve(arg)
+	file, err := os.Open(local)
+	if err == nil {
+		var info fs.FileInfo
+		if info, err = file.Stat(); err == nil && info.IsDir() {
+			err = errors.New("is a directory")
+		}
+	}
+	if err != nil {
+		if file != nil {
+			file.Close()
+		}
+		s.reply("550 %s: %v", arg, mockError(err))
+		return
+	}
+	defer file.Close()
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		s.reply("550 %v", err)
+		return
+	}
+	s.reply("150 Opening data connection for %s", arg)
+	conn, ok := s.openData()
+	if !ok {
+		return
+	}
+	_, err = io.Copy(conn, file)
+	conn.Close()
+	if err != nil {
+		s.reply("426 Transfer aborted: %v", err)
+		return
+	}
+	s.reply("226 Transfer complete")
+}
+
+// store receives a file, replacing it, appending to it, or writing from
+// offset on after REST.
+func (s *mockSession) store(arg string, offset int64, appending bool) {
+	_, local := s.resolve(arg)
+	flags := os.O_WRONLY | os.O_CREATE
+	switch {
+	case appending:
+		flags |= os.O_APPEND
+	case offset == 0:
+		flags |= os.O_TRUNC
+	}
+	file, err := os.OpenFile(local, flags, 0644)
+	if err != nil {
+		s.reply("550 %s: %v", arg, mockError(err))
+		return
+	}
+	defer file.Close()
+	if offset > 0 && !appending {
+		if err := file.Truncate(offset); err == nil {
+			_, err = file.Seek(offset, io.SeekStart)
+		}
+		if err != nil {
+			s.reply("550 %v", err)
+			return
+		}
+	}
+	s.reply("150 Ready to receive %s", arg)
+	conn, ok := s.openData()
+	if !ok {
+		return
+	}
+	_, err = io.Copy(file, conn)
+	conn.Close()
+	if err != nil {
+		s.reply("426 Transfer aborted: %v", err)
+		return
+	}
+	s.reply("226 Transfer complete")
+}
+
+// mlsdFacts gives info's MLSD facts, ending in the space before the name.
+func mlsdFacts(info fs.FileInfo) string {
+	kind := "file"
+	if info.IsDir() {
+		kind = "dir"
+	}
+	return fmt.Sprintf("type=%s;size=%d;modify=%s;unix.mode=%04o; ", kind, info.Size(), info.ModTime().UTC().Format("20060102150405"), info.Mode().Perm())
+}
+
+// listLine gives info as a line of ls -l style LIST output.
+func listLine(info fs.FileInfo) string {
+	mode := info.Mode().Perm().String()[1:]
+	kind := "-"
+	if info.IsDir() {
+		kind = "d"
+	}
+	stamp := info.ModTime().Format("Jan _2 15:04")
+	if time.Since(info.ModTime()) > 180*24*time.Hour {
+		stamp = info.ModTime().Format("Jan _2  2006")
+	}
+	return fmt.Sprintf("%s%s 1 owner group %12d %s %s", kind, mode, info.Size(), stamp, info.Name())
+}
+
+// mockError gives err without the local path, which the client shouldn't
+// see.
+func mockError(err error) error {
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		return pathErr.Err
+	}
+	var linkErr *os.LinkError
+	if errors.As(err, &linkErr) {
+		return linkErr.Err
+	}
+	return err
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The mock server is a real FTP server, so the session runs against it as
+// it would against any other.
+func TestMockServer(t *testing.T) {
+	useTempDirs(t)
+	served := t.TempDir()
+	os.WriteFile(filepath.Join(served, "hello.txt"), []byte("hello, world\n"), 0644)
+	os.WriteFile(filepath.Join(filepath.Dir(served), "secret.txt"), []byte("outside\n"), 0644)
+	addr, err := startMockServer(served)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(t.TempDir())
+	writeTree(t, map[string]string{
+		"up.txt":         "uploaded\n",
+		"tree/a.txt":     "first file\n",
+		"tree/sub/b.txt": "second file\n",
+	})
+
+	f, out := dialMock(t, addr)
+	for _, line := range []string{
+		"pwd",
+		"ls",
+		"size hello.txt",
+		"mdtm hello.txt",
+		"get hello.txt got.txt",
+		"get --offset 7 --length 5 hello.txt range.txt",
+		"put up.txt",
+		"mirror -R tree remote-tree",
+		"mirror remote-tree tree-back",
+		"dele up.txt",
+	} {
+		out.Reset()
+		if err := f.execute(line); err != nil {
+			t.Fatalf("%s: %v\n%s", line, err, out.String())
+		}
+	}
+
+	for local, want := range map[string]string{
+		"got.txt":             "hello, world\n",
+		"range.txt":           "world",
+		"tree-back/a.txt":     "first file\n",
+		"tree-back/sub/b.txt": "second file\n",
+	} {
+		if got, err := os.ReadFile(filepath.FromSlash(local)); err != nil || string(got) != want {
+			t.Errorf("%s holds %q, %v, want %q", local, got, err, want)
+		}
+	}
+	if got, err := os.ReadFile(filepath.Join(served, "remote-tree", "sub", "b.txt")); err != nil || string(got) != "second file\n" {
+		t.Errorf("mirror -R left remote-tree/sub/b.txt holding %q, %v", got, err)
+	}
+	if _, err := os.Stat(filepath.Join(served, "up.txt")); !os.IsNotExist(err) {
+		t.Errorf("dele left up.txt on the server: %v", err)
+	}
+
+	out.Reset()
+	if err := f.execute("get ../secret.txt secret.txt"); err == nil {
+		t.Errorf("a file outside the served directory was downloaded:\n%s", out.String())
+	}
+}
+
+// dialMock logs in to the mock server at addr, and returns the connection
+// and the buffer its output goes to.
+func dialMock(t *testing.T, addr string) (*FTPConnection, *bytes.Buffer) {
+	t.Helper()
+	f, err := NewFTPConnection(addr, "anyone", "anything")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	var out bytes.Buffer
+	f.stdout = &out
+	f.settings.confirm = "never"
+	if _, err := f.readResponse(); err != nil {
+		t.Fatalf("reading the greeting: %v", err)
+	}
+	if err := f.execute("auth"); err != nil {
+		t.Fatalf("auth: %v\n%s", err, out.String())
+	}
+	return &f, &out
+}
+
+func TestMockResolve(t *testing.T) {
+	s := &mockSession{root: filepath.FromSlash("/srv/ftp"), cwd: "/sub"}
+	tests := []struct {
+		in, virtual string
+	}{
+		{"a.txt", "/sub/a.txt"},
+		{"/a.txt", "/a.txt"},
+		{"../../../etc/passwd", "/etc/passwd"},
+		{"/../..", "/"},
+	}
+	for _, tt := range tests {
+		virtual, local := s.resolve(tt.in)
+		if virtual != tt.virtual || local != filepath.Join(s.root, filepath.FromSlash(tt.virtual)) {
+			t.Errorf("resolve(%q) = %q, %q, want %q under the root", tt.in, virtual, local, tt.virtual)
+		}
+	}
+}
+
+func TestStartMockServerNeedsDirectory(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(file, nil, 0644)
+	for _, dir := range []string{file, filepath.Join(t.TempDir(), "missing")} {
+		if _, err := startMockServer(dir); err == nil || !strings.Contains(err.Error(), "can't serve") {
+			t.Errorf("startMockServer(%s) = %v", dir, err)
+		}
+	}
+}
+
+// writeTree creates files, by slash-separated path, in the working directory.
+func writeTree(t *testing.T, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		local := filepath.FromSlash(name)
+		if err := os.MkdirAll(filepath.Dir(local), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(local, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
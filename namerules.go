@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Name rules rename files on their way from source to target, for mirror
+// and put, e.g. to lowercase a camera's file names or date-stamp a drop.
+// Each --name-rule is one of:
+//
+//	lower, upper           change the name's case
+//	s/regexp/replacement/  replace every match; $1 is the first group, and
+//	                       any character after the s can stand for the /
+//	"{stem}-{{date `20060102`}}{ext}"
+//	                       a pattern, as upload-rename takes, where {name},
+//	                       {stem}, and {ext} are the name, the name without
+//	                       its extension, and the extension with its dot;
+//	                       {{date}} and {{env}} are expanded once, when the
+//	                       command starts
+//
+// Rules apply in the order given, each to the result of the one before.
+// Only files are renamed; directories keep their names.
+
+// nameRule rewrites one file name.
+type nameRule func(name string) string
+
+// nameRules are a command's --name-rule flags, parsed.
+type nameRules []nameRule
+
+// parseNameRules parses the rules in specs, in order.
+func parseNameRules(specs []string) (nameRules, error) {
+	var rules nameRules
+	for _, spec := range specs {
+		rule, err := parseNameRule(spec)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func parseNameRule(spec string) (nameRule, error) {
+	switch {
+	case spec == "lower":
+		return strings.ToLower, nil
+	case spec == "upper":
+		return strings.ToUpper, nil
+	case len(spec) > 1 && spec[0] == 's' && !isNameChar(spec[1]):
+		parts := strings.Split(spec[2:], spec[1:2])
+		if len(parts) != 3 || parts[2] != "" {
+			return nil, fmt.Errorf("invalid name rule %q - expected s/regexp/replacement/", spec)
+		}
+		re, err := regexp.Compile(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid name rule %q: %v", spec, err)
+		}
+		replacement := parts[1]
+		return func(name string) string { return re.ReplaceAllString(name, replacement) }, nil
+	case strings.Contains(spec, "{"):
+		pattern, err := expandTemplate("name rule", spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid name rule %q: %v", spec, err)
+		}
+		if err := validateRenamePattern(pattern); err != nil {
+			return nil, err
+		}
+		return func(name string) string { return path.Base(renameUpload(name, pattern)) }, nil
+	}
+	return nil, fmt.Errorf("invalid name rule %q - expected lower, upper, s/regexp/replacement/, or a pattern such as {stem}.bak{ext}", spec)
+}
+
+// isNameChar reports whether c can follow the s of a word such as "stem", so
+// that it isn't taken for the delimiter of a substitution.
+func isNameChar(c byte) bool {
+	return c == '_' || c == '-' || c == '.' || c == '{' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
+}
+
+// apply returns name as the rules rename it. A rule that leaves no usable
+// name is an error, so the file is skipped rather than misplaced.
+func (rules nameRules) apply(name string) (string, error) {
+	renamed := name
+	for _, rule := range rules {
+		renamed = rule(renamed)
+	}
+	if renamed == "" || renamed == "." || renamed == ".." || strings.ContainsAny(renamed, `/\`) {
+		return "", fmt.Errorf("name rules turn %s into %q, which can't be a file name", name, renamed)
+	}
+	return renamed, nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNameRules(t *testing.T) {
+	today := time.Now().Format("20060102")
+	tests := []struct {
+		rules   []string
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{[]string{"lower"}, "IMG_0001.JPG", "img_0001.jpg", false},
+		{[]string{"upper"}, "readme.md", "README.MD", false},
+		{[]string{`s/^IMG_(\d+)/photo-$1/`}, "IMG_0001.JPG", "photo-0001.JPG", false},
+		{[]string{"s|a|b|"}, "banana", "bbnbnb", false},
+		{[]string{"{stem}.bak{ext}"}, "report.pdf", "report.bak.pdf", false},
+		{[]string{"{stem}-{{date `20060102`}}{ext}"}, "log.txt", "log-" + today + ".txt", false},
+		{[]string{`s/ /_/`, "lower"}, "My File.TXT", "my_file.txt", false},
+		{[]string{"lower", "{stem}{ext}.gz"}, "A.TAR", "a.tar.gz", false},
+		{[]string{`s/.*//`}, "gone.txt", "", true},
+		{[]string{"s|x|a/b|"}, "x", "", true},
+	}
+	for _, tt := range tests {
+		rules, err := parseNameRules(tt.rules)
+		if err != nil {
+			t.Errorf("parseNameRules(%q): %v", tt.rules, err)
+			continue
+		}
+		got, err := rules.apply(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%q renamed %s to %q, want an error", tt.rules, tt.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%q renamed %s to %q, %v, want %q", tt.rules, tt.in, got, err, tt.want)
+		}
+	}
+
+	for _, spec := range []string{"title", "s/a/b", "s/(/x/", "{stem}/x", "stem"} {
+		if _, err := parseNameRules([]string{spec}); err == nil {
+			t.Errorf("name rule %q was accepted", spec)
+		}
+	}
+}
+
+// mirror renames files but not directories, compares under the new names,
+// and skips a second file that would get the same one.
+func TestMirrorNameRules(t *testing.T) {
+	useTempDirs(t)
+	served := t.TempDir()
+	for name, content := range map[string]string{
+		"DCIM/IMG_01.JPG":     "first\n",
+		"DCIM/IMG_01.jpeg":    "clash\n",
+		"DCIM/Sub/IMG_02.JPG": "second\n",
+	} {
+		p := filepath.Join(served, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(p), 0755)
+		os.WriteFile(p, []byte(content), 0644)
+	}
+	addr, err := startMockServer(served)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(t.TempDir())
+	f, out := dialMock(t, addr)
+
+	if err := f.execute("mirror --dry-run --name-rule lower --name-rule s/jpeg$/jpg/ DCIM photos"); err != nil {
+		t.Fatalf("mirror --dry-run: %v\n%s", err, out)
+	}
+	for _, want := range []string{" new     IMG_01.JPG -> img_01.jpg", " new     Sub/IMG_02.JPG -> Sub/img_02.jpg", "skipping IMG_01.jpeg: another file is already mirrored to img_01.jpg"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("the dry run lacks %q:\n%s", want, out)
+		}
+	}
+
+	out.Reset()
+	if err := f.execute("mirror -y --name-rule lower --name-rule s/jpeg$/jpg/ DCIM photos"); err != nil {
+		t.Fatalf("mirror: %v\n%s", err, out)
+	}
+	for name, want := range map[string]string{"img_01.jpg": "first\n", "Sub/img_02.jpg": "second\n"} {
+		if got, err := os.ReadFile(filepath.Join("photos", filepath.FromSlash(name))); err != nil || string(got) != want {
+			t.Errorf("%s holds %q, %v, want %q", name, got, err, want)
+		}
+	}
+
+	out.Reset()
+	if err := f.execute("mirror --dry-run --delete --name-rule lower --name-rule s/jpeg$/jpg/ DCIM photos"); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "Mirror plan") {
+		t.Errorf("the renamed copies weren't taken as up to date:\n%s", out)
+	}
+}
+
+// put renames only where the remote name comes from the local one.
+func TestPutNameRules(t *testing.T) {
+	useTempDirs(t)
+	served := t.TempDir()
+	addr, err := startMockServer(served)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(t.TempDir())
+	writeTree(t, map[string]string{"notes.txt": "notes\n"})
+	f, out := dialMock(t, addr)
+
+	for _, line := range []string{"put --name-rule upper notes.txt", "put --name-rule upper notes.txt kept.txt"} {
+		if err := f.execute(line); err != nil {
+			t.Fatalf("%s: %v\n%s", line, err, out)
+		}
+	}
+	for _, name := range []string{"NOTES.TXT", "kept.txt"} {
+		if got, err := os.ReadFile(filepath.Join(served, name)); err != nil || string(got) != "notes\n" {
+			t.Errorf("the server's %s holds %q, %v", name, got, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(served, "notes.txt")); !os.IsNotExist(err) {
+		t.Error("put uploaded under the local name too")
+	}
+}
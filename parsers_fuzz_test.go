@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// The parsers below read what a server sends, so a broken or hostile server
+// must not be able to crash the client or get a malformed value past them.
+// Seeds are replies and listing lines from real servers.
+
+var replySeeds = []string{
+	"220 (vsFTPd 3.0.5)\r\n",
+	"220-Welcome to test.rebex.net!\r\n220-\r\n220 Rebex FTP Server ready.\r\n",
+	"211-Features:\r\n MDTM\r\n REST STREAM\r\n SIZE\r\n MLST type*;size*;modify*;\r\n UTF8\r\n211 End\r\n",
+	"230 Login successful.\r\n",
+	"227 Entering Passive Mode (192,168,1,10,195,80).\r\n",
+	"229 Entering Extended Passive Mode (|||6446|)\r\n",
+	"150 Opening BINARY mode data connection for file.bin (1048576 bytes).\r\n",
+	"226-File successfully transferred\r\n226 0.012 seconds (measured here), 82.31 Mbytes per second\r\n",
+	"213 20240102150405\r\n",
+	"257 \"/home/ftp\" is the current directory\r\n",
+	"550 file.txt: No such file or directory\r\n",
+	"421 Timeout.\r\n",
+	"250-Listing /pub\r\n type=dir;modify=20240101000000; /pub\r\n250 End\r\n",
+	"211-Status of 'ftp.example.com'\r\n Connected from 10.0.0.5\r\n211-nested-looking line\r\n211 End of status\r\n",
+	"220-truncated multi-line reply\r\n220-",
+	"123",
+	"12",
+	"",
+}
+
+func FuzzParseReplyLine(f *testing.F) {
+	for _, seed := range replySeeds {
+		line, _, _ := strings.Cut(seed, "\n")
+		f.Add(line)
+	}
+	f.Fuzz(func(t *testing.T, line string) {
+		code, multi := parseReplyLine(line)
+		if code == "" {
+			if multi {
+				t.Errorf("parseReplyLine(%q) reports a multi-line reply without a code", line)
+			}
+			return
+		}
+		if len(code) != 3 || !strings.HasPrefix(line, code) {
+			t.Errorf("parseReplyLine(%q) = %q, not the line's first three characters", line, code)
+		}
+		if _, err := strconv.Atoi(code); err != nil {
+			t.Errorf("parseReplyLine(%q) = %q, not a number", line, code)
+		}
+		if multi != (len(line) > 3 && line[3] == '-') {
+			t.Errorf("parseReplyLine(%q) multi = %v", line, multi)
+		}
+	})
+}
+
+func FuzzReadReply(f *testing.F) {
+	for _, seed := range replySeeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data string) {
+		s := &netSession{reader: bufio.NewReader(strings.NewReader(data))}
+		reply, err := s.readReply()
+		if err != nil {
+			return
+		}
+		if !strings.HasPrefix(data, reply) {
+			t.Fatalf("readReply returned %q, which isn't what was sent: %q", reply, data)
+		}
+		if len(reply) > maxReplyBytes+maxReplyLine {
+			t.Fatalf("readReply returned %d bytes, over the %d-byte limit", len(reply), maxReplyBytes)
+		}
+		lines := strings.SplitAfter(reply, "\n")
+		if lines[len(lines)-1] == "" {
+			lines = lines[:len(lines)-1]
+		}
+		code, multi := parseReplyLine(lines[0])
+		if !multi {
+			if len(lines) != 1 {
+				t.Fatalf("readReply returned %d lines for a single-line reply: %q", len(lines), reply)
+			}
+			return
+		}
+		// a multi-line reply ends with the first line that has its code
+		// and no hyphen
+		last, more := parseReplyLine(lines[len(lines)-1])
+		if last != code || more {
+			t.Fatalf("readReply ended a %s reply on %q", code, lines[len(lines)-1])
+		}
+		for _, line := range lines[1 : len(lines)-1] {
+			if c, more := parseReplyLine(line); c == code && !more {
+				t.Fatalf("readReply read past the end of its reply at %q", line)
+			}
+		}
+	})
+}
+
+func FuzzParseAddr(f *testing.F) {
+	for _, seed := range []string{
+		"227 Entering Passive Mode (192,168,1,10,195,80).\r\n",
+		"227 Entering Passive Mode (10,0,0,5,4,1)\r\n",
+		"227 =127,0,0,1,200,10\r\n",
+		"227 Entering passive mode 127, 0, 0, 1, 39, 16\r\n",
+		"227 Entering Passive Mode (256,0,0,1,4,1)\r\n",
+		"227 Entering Passive Mode (1,2,3,4,0,0)\r\n",
+		"227 Entering Passive Mode (1,2,3,4,5)\r\n",
+		"227\r\n",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, resp string) {
+		addr, err := parseAddr(resp)
+		if err != nil {
+			return
+		}
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			t.Fatalf("parseAddr(%q) = %q: %v", resp, addr, err)
+		}
+		if ip := net.ParseIP(host); ip == nil || ip.To4() == nil {
+			t.Errorf("parseAddr(%q) = %q, not an IPv4 address", resp, addr)
+		}
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			t.Errorf("parseAddr(%q) = %q, port out of range", resp, addr)
+		}
+	})
+}
+
+func FuzzParseEPSVPort(f *testing.F) {
+	for _, seed := range []string{
+		"229 Entering Extended Passive Mode (|||6446|)\r\n",
+		"229 Entering Extended Passive Mode (!!!6446!)\r\n",
+		"229 EPSV ok (|||65535|)\r\n",
+		"229 Entering Extended Passive Mode (|||0|)\r\n",
+		"229 Entering Extended Passive Mode (|||99999|)\r\n",
+		"229 Entering Extended Passive Mode (|1|::1|6446|)\r\n",
+		"229 Entering Extended Passive Mode (|||6446\r\n",
+		"229 ()\r\n",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, resp string) {
+		port, err := parseEPSVPort(resp)
+		if err == nil && (port < 1 || port > 65535) {
+			t.Errorf("parseEPSVPort(%q) = %d, out of range", resp, port)
+		}
+	})
+}
+
+// checkEntry fails t if a parsed listing entry could steer a download or
+// report nonsense.
+func checkEntry(t *testing.T, line string, entry RemoteEntry) {
+	t.Helper()
+	if !filepath.IsLocal(entry.name) || filepath.Base(entry.name) != entry.name || strings.Contains(entry.name, "/") {
+		t.Errorf("%q parsed to the name %q, which isn't one local path element", line, entry.name)
+	}
+	if entry.size < 0 {
+		t.Errorf("%q parsed to the size %d", line, entry.size)
+	}
+	switch entry.kind {
+	case "file", "dir", "link":
+	default:
+		t.Errorf("%q parsed to the type %q", line, entry.kind)
+	}
+}
+
+func FuzzParseListLine(f *testing.F) {
+	for _, seed := range []string{
+		"-rw-r--r--    1 ftp      ftp        403701 Mar 12 14:01 readme.txt",
+		"drwxr-xr-x    2 ftp      ftp          4096 Jan 03  2024 pub",
+		"lrwxrwxrwx    1 root     root           11 Feb 28 09:00 latest -> releases/v2",
+		"-rw-r--r--    1 owner    group    1048576 Dec 31 23:59 name with spaces.bin",
+		"total 12",
+		"01-02-24  03:04PM       <DIR>          aspnet_client",
+		"10-15-2026  11:30AM              12345 report.pdf",
+		"-rw-r--r--    1 ftp      ftp            -5 Mar 12 14:01 negative",
+		"drwxr-xr-x    2 ftp      ftp          4096 Jan 03  2024 ..",
+		"-rw-r--r--    1 ftp      ftp            10 Jan 03  2024 ../../etc/passwd",
+		`-rw-r--r--    1 ftp      ftp            10 Jan 03  2024 ..\..\evil.exe`,
+		"-",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, line string) {
+		if entry, ok := parseListLine(line); ok {
+			checkEntry(t, line, entry)
+		}
+	})
+}
+
+func FuzzParseMLSDLine(f *testing.F) {
+	for _, seed := range []string{
+		"type=file;size=1024;modify=20240102150405;perm=r; name.txt",
+		"type=dir;modify=20240101000000;unix.mode=0755; pub",
+		"type=cdir;modify=20240101000000; .",
+		"type=OS.unix=slink:/srv/target;modify=20240101000000; link",
+		"Type=file;Size=10;Modify=20240102150405.123; Mixed Case.TXT",
+		"type=file;size=-1; negative",
+		"type=file;size=1; ../escape",
+		"size=1;",
+		"; ",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, line string) {
+		if entry, ok := parseMLSDLine(line); ok {
+			checkEntry(t, line, entry)
+		}
+	})
+}
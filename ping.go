@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// ping checks the path to the server the way a transfer uses it. The control
+// channel is timed with NOOPs. Each way of opening a data connection is then
+// tried in turn: PORT by an NLST of the working directory, since the server
+// only connects out for a transfer, and PASV and EPSV by connecting to the
+// port the server offers and closing again. PORT goes first, so no server
+// is left holding a passive connection it might hand the NLST. A firewall or
+// NAT that lets the control connection through but not the data connections
+// shows up as the modes that fail.
+
+// pingResult is how one data connection mode fared.
+type pingResult struct {
+	mode    string
+	elapsed time.Duration
+	err     error
+}
+
+func (r pingResult) String() string {
+	if r.err != nil {
+		return "failed: " + r.err.Error()
+	}
+	return "ok, connected in " + roundRTT(r.elapsed).String()
+}
+
+// pingControl sends count NOOPs and returns their round-trip times.
+func (f *FTPConnection) pingControl(count int) ([]time.Duration, error) {
+	var rtts []time.Duration
+	for range count {
+		start := time.Now()
+		resp, err := f.sendCommand("NOOP")
+		if err != nil {
+			return rtts, err
+		}
+		if !isSuccessResponse(resp) {
+			return rtts, fmt.Errorf("NOOP failed: %s", strings.TrimSpace(resp))
+		}
+		rtts = append(rtts, time.Since(start))
+	}
+	return rtts, nil
+}
+
+// pingPassive negotiates a passive data address with enter, then connects
+// to it and closes the connection again.
+func (f *FTPConnection) pingPassive(mode string, enter func() (string, error)) pingResult {
+	result := pingResult{mode: mode}
+	if _, result.err = enter(); result.err != nil {
+		return result
+	}
+	addr := f.dataAddr
+	f.dataAddr = ""
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", addr, f.settings.replyTimeout)
+	result.elapsed = time.Since(start)
+	if err != nil {
+		result.err = fmt.Errorf("can't connect to %s: %v", addr, err)
+		return result
+	}
+	conn.Close()
+	return result
+}
+
+// pingTransfer negotiates a data connection with enter and lists the
+// working directory over it.
+func (f *FTPConnection) pingTransfer(mode string, enter func() (string, error)) pingResult {
+	result := pingResult{mode: mode}
+	if _, result.err = enter(); result.err != nil {
+		return result
+	}
+	start := time.Now()
+	result.err = f.transfer("NLST", func(dataConn net.Conn) error {
+		result.elapsed = time.Since(start)
+		_, err := io.Copy(io.Discard, dataConn)
+		return err
+	})
+	return result
+}
+
+// pingData tries each data connection mode. None of them leaves a data
+// address behind for the next transfer.
+func (f *FTPConnection) pingData() []pingResult {
+	defer func() {
+		f.closeDataListener()
+		f.dataAddr = ""
+	}()
+	return []pingResult{
+		f.pingTransfer("PORT", f.enterActive),
+		f.pingPassive("PASV", f.enterPassive),
+		f.pingPassive("EPSV", f.enterExtendedPassive),
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// The mock server only has passive mode, so ping finds PORT blocked.
+func TestPing(t *testing.T) {
+	useTempDirs(t)
+	addr, err := startMockServer(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, out := dialMock(t, addr)
+
+	out.Reset()
+	if err := handlePing(f, []string{"--count", "2"}); err != nil {
+		t.Fatalf("ping in passive mode: %v\n%s", err, out)
+	}
+	for _, want := range []string{"over 2 NOOPs", "PORT: failed", "PASV: ok", "EPSV: ok", "works in passive mode (PASV)"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("ping output lacks %q:\n%s", want, out)
+		}
+	}
+
+	f.settings.passive = false
+	err = handlePing(f, nil)
+	if err == nil || !strings.Contains(err.Error(), "try set passive on") {
+		t.Errorf("ping in active mode = %v, want advice to set passive on", err)
+	}
+	if f.dataAddr != "" {
+		t.Errorf("ping left the data address %s for the next transfer", f.dataAddr)
+	}
+
+	if err := handlePing(f, []string{"--count", "0"}); err == nil {
+		t.Error("ping --count 0 succeeded")
+	}
+}
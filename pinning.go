@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Certificate pinning, trust on first use, for servers no certificate
+// authority vouches for. The first TLS connection to a host records the
+// SHA-256 fingerprint of its certificate in known_certs in the data
+// directory, one "host:port SHA256:hex" line per server, and every later
+// control and data connection must present the same certificate. A pinned
+// certificate is accepted without CA verification; a changed one aborts the
+// handshake unless a CA vouches for the new one, as when a public
+// certificate is renewed. trust and untrust edit the pins by hand.
+
+const knownCertsFile = "known_certs"
+
+// knownCertsMu serializes reads and writes of known_certs across the data
+// connections of parallel transfers.
+var knownCertsMu sync.Mutex
+
+// certFingerprint is the SHA-256 fingerprint of cert as pinned and shown.
+func certFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return "SHA256:" + hex.EncodeToString(sum[:])
+}
+
+// parseFingerprint normalizes a fingerprint typed by the user, with or
+// without the SHA256: prefix and colons between the bytes.
+func parseFingerprint(s string) (string, error) {
+	hexPart := strings.ReplaceAll(s, ":", "")
+	if len(hexPart) > 6 && strings.EqualFold(hexPart[:6], "SHA256") {
+		hexPart = hexPart[6:]
+	}
+	if b, err := hex.DecodeString(hexPart); err != nil || len(b) != sha256.Size {
+		return "", fmt.Errorf("%q is not a SHA-256 fingerprint (64 hex digits)", s)
+	}
+	return "SHA256:" + strings.ToLower(hexPart), nil
+}
+
+// knownCertsPath is where the pins are kept.
+func knownCertsPath() (string, error) {
+	dir, err := appDir(dataDir)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, knownCertsFile), nil
+}
+
+// loadKnownCerts reads the pinned fingerprints by host:port. A missing file
+// has none.
+func loadKnownCerts() (map[string]string, error) {
+	path, err := knownCertsPath()
+	if err != nil {
+		return nil, err
+	}
+	certs := make(map[string]string)
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return certs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		certs[fields[0]] = fields[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	return certs, nil
+}
+
+// saveKnownCerts replaces known_certs with certs, sorted by host.
+func saveKnownCerts(certs map[string]string) error {
+	path, err := knownCertsPath()
+	if err != nil {
+		return err
+	}
+	hosts := make([]string, 0, len(certs))
+	for host := range certs {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	var b strings.Builder
+	for _, host := range hosts {
+		fmt.Fprintf(&b, "%s %s\n", host, certs[host])
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0600); err != nil {
+		return fmt.Errorf("failed to save %s: %v", path, err)
+	}
+	return os.Rename(tmp, path)
+}
+
+// pinCert records fingerprint as the certificate of addr.
+func pinCert(addr, fingerprint string) error {
+	knownCertsMu.Lock()
+	defer knownCertsMu.Unlock()
+	certs, err := loadKnownCerts()
+	if err != nil {
+		return err
+	}
+	certs[addr] = fingerprint
+	return saveKnownCerts(certs)
+}
+
+// unpinCert forgets the certificates pinned for host, which is host:port or
+// a bare host name for every port on it, and returns the entries removed.
+func unpinCert(host string) ([]string, error) {
+	knownCertsMu.Lock()
+	defer knownCertsMu.Unlock()
+	certs, err := loadKnownCerts()
+	if err != nil {
+		return nil, err
+	}
+	var removed []string
+	for addr := range certs {
+		if h, _, err := net.SplitHostPort(addr); addr == host || (err == nil && h == host) {
+			removed = append(removed, addr)
+			delete(certs, addr)
+		}
+	}
+	if len(removed) == 0 {
+		return nil, nil
+	}
+	sort.Strings(removed)
+	return removed, saveKnownCerts(certs)
+}
+
+// verifyChain checks the server's certificate chain and host name against
+// the system roots, as the TLS stack would by default.
+func verifyChain(cs tls.ConnectionState) error {
+	opts := x509.VerifyOptions{DNSName: cs.ServerName, Intermediates: x509.NewCertPool()}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+// verifyCert is the tls.Config VerifyConnection hook for the control and
+// data connections: it accepts the pinned certificate, pins the first one
+// seen for a host, and refuses a changed one.
+func (f *FTPConnection) verifyCert(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("server sent no certificate")
+	}
+	got := certFingerprint(cs.PeerCertificates[0])
+	caErr := verifyChain(cs)
+
+	knownCertsMu.Lock()
+	defer knownCertsMu.Unlock()
+	certs, err := loadKnownCerts()
+	if err != nil {
+		return err
+	}
+	pinned, known := certs[f.addr]
+	switch {
+	case known && pinned == got:
+		return nil
+	case known && caErr == nil:
+		f.out().Warn("the certificate of %s changed from %s to %s, which a certificate authority vouches for; pinning the new one", f.addr, pinned, got)
+	case known:
+		return fmt.Errorf("the certificate of %s has changed: %s is pinned, but the server presented %s (if the change is expected, run untrust and connect again)", f.addr, pinned, got)
+	case caErr == nil:
+	case f.settings.tlsInsecure:
+		f.out().Warn("trusting the unverified certificate of %s on first use: %s", f.addr, got)
+	case f.askTrust(caErr, got):
+	default:
+		return fmt.Errorf("%v (set tls-insecure on, or run trust %s, to pin this certificate)", caErr, got)
+	}
+	certs[f.addr] = got
+	return saveKnownCerts(certs)
+}
+
+// askTrust asks at the terminal whether to pin a certificate that can't be
+// verified. It is false when there is no one to ask.
+func (f *FTPConnection) askTrust(caErr error, fingerprint string) bool {
+	if f.settings.confirm == "never" || !stdinIsTerminal() {
+		return false
+	}
+	f.out().Warn("the certificate of %s can't be verified: %v", f.addr, caErr)
+	answer, err := promptLine(fmt.Sprintf("Trust %s and pin it? [y/N] ", fingerprint))
+	if err != nil {
+		return false
+	}
+	a := strings.ToLower(strings.TrimSpace(answer))
+	return a == "y" || a == "yes"
+}
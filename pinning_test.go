@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// selfSignedCert makes a certificate for 127.0.0.1 that no CA vouches for.
+func selfSignedCert(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "goftp test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// mustParse returns cert's leaf as an x509.Certificate.
+func mustParse(t *testing.T, cert tls.Certificate) *x509.Certificate {
+	t.Helper()
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+// handshake runs a TLS handshake from f against a server presenting cert.
+func handshake(f *FTPConnection, cert tls.Certificate) error {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		tls.Server(server, &tls.Config{Certificates: []tls.Certificate{cert}}).Handshake()
+	}()
+	config := f.tlsConfig()
+	config.ClientSessionCache = nil
+	return tls.Client(client, config).Handshake()
+}
+
+func TestCertPinning(t *testing.T) {
+	useTempDirs(t)
+	f, out := newFakeConnection(newFakeSession())
+	f.settings.confirm = "never"
+	first, second := selfSignedCert(t), selfSignedCert(t)
+	firstPrint := certFingerprint(mustParse(t, first))
+
+	err := handshake(f, first)
+	if err == nil || !strings.Contains(err.Error(), "trust "+firstPrint) {
+		t.Fatalf("an unverifiable certificate was accepted, or the error doesn't say how to trust it: %v", err)
+	}
+	if certs, _ := loadKnownCerts(); len(certs) != 0 {
+		t.Fatalf("a refused certificate was pinned: %v", certs)
+	}
+
+	f.settings.tlsInsecure = true
+	if err := handshake(f, first); err != nil {
+		t.Fatalf("tls-insecure didn't trust on first use: %v", err)
+	}
+	if certs, _ := loadKnownCerts(); certs[f.addr] != firstPrint {
+		t.Fatalf("pinned %v, want %s for %s", certs, firstPrint, f.addr)
+	}
+	if !strings.Contains(out.String(), "on first use") {
+		t.Errorf("trusting on first use didn't warn:\n%s", out)
+	}
+
+	f.settings.tlsInsecure = false
+	if err := handshake(f, first); err != nil {
+		t.Errorf("the pinned certificate was refused: %v", err)
+	}
+	f.settings.tlsInsecure = true
+	if err := handshake(f, second); err == nil || !strings.Contains(err.Error(), "has changed") {
+		t.Errorf("a changed certificate was accepted even with tls-insecure on: %v", err)
+	}
+
+	if err := handleUntrust(f, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := handshake(f, second); err != nil {
+		t.Errorf("after untrust the new certificate wasn't pinned: %v", err)
+	}
+}
+
+func TestTrustFingerprint(t *testing.T) {
+	useTempDirs(t)
+	f, _ := newFakeConnection(newFakeSession())
+	f.settings.confirm = "never"
+	cert := selfSignedCert(t)
+	want := certFingerprint(mustParse(t, cert))
+
+	// pinned out of band, as shown by the server's administrator
+	colons := strings.ToUpper(strings.TrimPrefix(want, "SHA256:"))
+	var pairs []string
+	for i := 0; i < len(colons); i += 2 {
+		pairs = append(pairs, colons[i:i+2])
+	}
+	if err := handleTrust(f, []string{strings.Join(pairs, ":")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := handshake(f, cert); err != nil {
+		t.Errorf("a certificate pinned with trust was refused: %v", err)
+	}
+	if err := handleUntrust(f, []string{"127.0.0.1"}); err != nil {
+		t.Errorf("untrust of a bare host: %v", err)
+	}
+	if err := handleUntrust(f, nil); err == nil {
+		t.Error("untrust succeeded with nothing pinned")
+	}
+}
+
+func TestParseFingerprint(t *testing.T) {
+	hexPrint := strings.Repeat("ab", 32)
+	tests := []struct {
+		in, want string
+	}{
+		{"SHA256:" + hexPrint, "SHA256:" + hexPrint},
+		{"sha256:" + strings.ToUpper(hexPrint), "SHA256:" + hexPrint},
+		{hexPrint, "SHA256:" + hexPrint},
+		{strings.TrimSuffix(strings.Repeat("AB:", 32), ":"), "SHA256:" + hexPrint},
+		{"SHA256:abcd", ""},
+		{"SHA256:" + strings.Repeat("zz", 32), ""},
+	}
+	for _, tt := range tests {
+		got, err := parseFingerprint(tt.in)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("parseFingerprint(%q) = %q, want an error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseFingerprint(%q) = %q, %v, want %q", tt.in, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// lineFilter transforms a command's output lines, as a filter after | does.
+type lineFilter func(lines []string) []string
+
+// pipeFilters are the built-in filters a command's output can be piped
+// through, e.g. "ls | grep iso | head -5". No shell is involved.
+var pipeFilters = map[string]func(args []string) (lineFilter, error){
+	"grep": grepFilter,
+	"head": func(args []string) (lineFilter, error) {
+		n, err := lineCount("head", args)
+		return func(lines []string) []string { return lines[:min(n, len(lines))] }, err
+	},
+	"tail": func(args []string) (lineFilter, error) {
+		n, err := lineCount("tail", args)
+		return func(lines []string) []string { return lines[len(lines)-min(n, len(lines)):] }, err
+	},
+	"sort": sortFilter,
+	"wc":   wcFilter,
+}
+
+// splitPipeline splits a command line at each | that is followed by a
+// filter name, returning the command and the filters' words. A | followed
+// by anything else stays in the command or filter before it, so a regexp
+// such as "grep iso|img" needs no quoting, and a | between double quotes is
+// part of its word.
+func splitPipeline(line string) (string, [][]string) {
+	var parts []string
+	start := 0
+	for _, i := range unquotedIndexes(line, '|') {
+		parts = append(parts, line[start:i])
+		start = i + 1
+	}
+	parts = append(parts, line[start:])
+	command := parts[0]
+	var filters [][]string
+	for _, part := range parts[1:] {
+		words := strings.Fields(part)
+		if len(words) > 0 && pipeFilters[words[0]] != nil {
+			filters = append(filters, words)
+			continue
+		}
+		if len(filters) == 0 {
+			command += "|" + part
+		} else {
+			last := filters[len(filters)-1]
+			filters[len(filters)-1] = strings.Fields(strings.Join(last, " ") + "|" + part)
+		}
+	}
+	return command, filters
+}
+
+// unquotedIndexes returns the positions of c in line that aren't between
+// double quotes, tracking quotes the way splitQuoted does.
+func unquotedIndexes(line string, c byte) []int {
+	var indexes []int
+	quoted := false
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '"':
+			quoted = !quoted
+		case c:
+			if !quoted {
+				indexes = append(indexes, i)
+			}
+		}
+	}
+	return indexes
+}
+
+// splitRedirect splits a trailing redirection, "> file" or ">> file", off a
+// command line, returning the command, the local file, and whether to append
+// to it. The operator needs whitespace before it, so a regexp such as
+// "grep a>b" isn't taken for one, and a > between double quotes is part of
+// its word.
+func splitRedirect(line string) (string, string, bool, bool) {
+	op := -1
+	for _, i := range unquotedIndexes(line, '>') {
+		if i > 0 && (line[i-1] == ' ' || line[i-1] == '\t') {
+			op = i
+		}
+	}
+	if op < 0 {
+		return line, "", false, false
+	}
+	command := strings.TrimRight(line[:op], " \t")
+	appending := strings.HasPrefix(line[op:], ">>")
+	target := splitQuoted(strings.TrimPrefix(line[op+1:], ">"))
+	if command == "" || len(target) != 1 || target[0] == "" || strings.Contains(target[0], ">") {
+		return line, "", false, false
+	}
+	return command, target[0], appending, true
+}
+
+// executeRedirected runs command, pipeline included, with its output written
+// to the local file target instead of the terminal.
+func (f *FTPConnection) executeRedirected(command, target string, appending bool) error {
+	// don't create or truncate the file for a typo
+	if args := cleanInput(command); len(args) == 0 || !knownCommand(args[0]) {
+		return f.execute(command)
+	}
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if appending {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	file, err := os.OpenFile(target, flags, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", target, err)
+	}
+	saved := f.stdout
+	f.stdout = file
+	err = f.execute(command)
+	f.stdout = saved
+	if closeErr := file.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("failed to write %s: %v", target, closeErr)
+	}
+	return err
+}
+
+// executePiped runs command with its output collected, then writes the
+// output through filters. The command's error is returned after whatever
+// output it produced has been shown.
+func (f *FTPConnection) executePiped(command string, filterWords [][]string) error {
+	var filters []lineFilter
+	for _, words := range filterWords {
+		filter, err := pipeFilters[words[0]](words[1:])
+		if err != nil {
+			return err
+		}
+		filters = append(filters, filter)
+	}
+
+	var buf bytes.Buffer
+	saved := f.stdout
+	f.stdout = &buf
+	err := f.execute(command)
+	f.stdout = saved
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if buf.Len() == 0 {
+		lines = nil
+	}
+	for _, filter := range filters {
+		lines = filter(lines)
+	}
+	for _, line := range lines {
+		fmt.Fprintln(f.output(), line)
+	}
+	return err
+}
+
+// lineCount parses head and tail's "-n N" or "-N", defaulting to 10.
+func lineCount(name string, args []string) (int, error) {
+	value := "10"
+	switch {
+	case len(args) == 0:
+	case len(args) == 2 && args[0] == "-n":
+		value = args[1]
+	case len(args) == 1 && strings.HasPrefix(args[0], "-"):
+		value = args[0][1:]
+	default:
+		return 0, fmt.Errorf("usage: %s [-n N | -N]", name)
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%s: invalid line count %q", name, value)
+	}
+	return n, nil
+}
+
+// grepFilter keeps lines matching a regexp: grep [-i] [-v] [-c] <pattern>.
+func grepFilter(args []string) (lineFilter, error) {
+	fs := newCommandFlags("grep")
+	ignoreCase := fs.Bool("i", false, "ignore case")
+	invert := fs.Bool("v", false, "keep lines that don't match")
+	count := fs.Bool("c", false, "print the number of matching lines")
+	positional, err := parseCommandFlags(fs, args)
+	if err != nil {
+		return nil, fmt.Errorf("grep: %v", err)
+	}
+	if len(positional) == 0 {
+		return nil, fmt.Errorf("usage: grep [-i] [-v] [-c] <pattern>")
+	}
+	pattern := strings.Join(positional, " ")
+	if *ignoreCase {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("grep: %v", err)
+	}
+	return func(lines []string) []string {
+		var kept []string
+		for _, line := range lines {
+			if re.MatchString(line) != *invert {
+				kept = append(kept, line)
+			}
+		}
+		if *count {
+			return []string{strconv.Itoa(len(kept))}
+		}
+		return kept
+	}, nil
+}
+
+// sortFilter sorts lines: sort [-r] [-n] [-u] [-k N]. -n compares the leading
+// number of each line, or of its -k'th whitespace-separated field.
+func sortFilter(args []string) (lineFilter, error) {
+	fs := newCommandFlags("sort")
+	reverse := fs.Bool("r", false, "reverse the order")
+	numeric := fs.Bool("n", false, "compare numbers")
+	unique := fs.Bool("u", false, "drop repeated lines")
+	key := fs.Int("k", 0, "sort by this field, counting from 1")
+	if positional, err := parseCommandFlags(fs, args); err != nil || len(positional) > 0 {
+		return nil, fmt.Errorf("usage: sort [-r] [-n] [-u] [-k N]")
+	}
+	field := func(line string) string {
+		if *key <= 0 {
+			return line
+		}
+		fields := strings.Fields(line)
+		if *key > len(fields) {
+			return ""
+		}
+		return strings.Join(fields[*key-1:], " ")
+	}
+	number := func(s string) float64 {
+		s = strings.TrimSpace(s)
+		end := 0
+		if strings.HasPrefix(s, "-") {
+			end++
+		}
+		for end < len(s) && strings.ContainsRune("0123456789.", rune(s[end])) {
+			end++
+		}
+		n, _ := strconv.ParseFloat(s[:end], 64)
+		return n
+	}
+	return func(lines []string) []string {
+		sorted := append([]string(nil), lines...)
+		sort.SliceStable(sorted, func(i, j int) bool {
+			a, b := field(sorted[i]), field(sorted[j])
+			if *reverse {
+				a, b = b, a
+			}
+			if *numeric {
+				return number(a) < number(b)
+			}
+			return a < b
+		})
+		if !*unique {
+			return sorted
+		}
+		var kept []string
+		for i, line := range sorted {
+			if i == 0 || line != sorted[i-1] {
+				kept = append(kept, line)
+			}
+		}
+		return kept
+	}, nil
+}
+
+// wcFilter counts lines, words, and bytes: wc [-l] [-w] [-c].
+func wcFilter(args []string) (lineFilter, error) {
+	fs := newCommandFlags("wc")
+	countLines := fs.Bool("l", false, "count lines")
+	countWords := fs.Bool("w", false, "count words")
+	countBytes := fs.Bool("c", false, "count bytes")
+	if positional, err := parseCommandFlags(fs, args); err != nil || len(positional) > 0 {
+		return nil, fmt.Errorf("usage: wc [-l] [-w] [-c]")
+	}
+	if !*countLines && !*countWords && !*countBytes {
+		*countLines, *countWords, *countBytes = true, true, true
+	}
+	return func(lines []string) []string {
+		words, size := 0, 0
+		for _, line := range lines {
+			words += len(strings.Fields(line))
+			size += len(line) + 1
+		}
+		var counts []string
+		if *countLines {
+			counts = append(counts, strconv.Itoa(len(lines)))
+		}
+		if *countWords {
+			counts = append(counts, strconv.Itoa(words))
+		}
+		if *countBytes {
+			counts = append(counts, strconv.Itoa(size))
+		}
+		return []string{strings.Join(counts, " ")}
+	}, nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestSplitRedirect(t *testing.T) {
+	tests := []struct {
+		line, command, target string
+		appending, ok         bool
+	}{
+		{"ls > out.txt", "ls", "out.txt", false, true},
+		{"ls -l >> out.txt  ", "ls -l", "out.txt", true, true},
+		{"ls >out.txt", "ls", "out.txt", false, true},
+		{`ls > "my list.txt"`, "ls", "my list.txt", false, true},
+		{"ls | grep a>b", "ls | grep a>b", "", false, false},
+		{"ls > a > b", "ls > a", "b", false, true},
+		{"> out.txt", "> out.txt", "", false, false},
+		{"ls > a b", "ls > a b", "", false, false},
+		// a > between quotes is part of its word
+		{`get "Q1 > Q2.txt"`, `get "Q1 > Q2.txt"`, "", false, false},
+		{`get "Q1 > Q2.txt" > log.txt`, `get "Q1 > Q2.txt"`, "log.txt", false, true},
+	}
+	for _, tt := range tests {
+		command, target, appending, ok := splitRedirect(tt.line)
+		if command != tt.command || target != tt.target || appending != tt.appending || ok != tt.ok {
+			t.Errorf("splitRedirect(%q) = %q, %q, %v, %v, want %q, %q, %v, %v",
+				tt.line, command, target, appending, ok, tt.command, tt.target, tt.appending, tt.ok)
+		}
+	}
+}
+
+func TestSplitPipeline(t *testing.T) {
+	tests := []struct {
+		line, command string
+		filters       [][]string
+	}{
+		{"ls", "ls", nil},
+		{"ls | grep iso | head -5", "ls ", [][]string{{"grep", "iso"}, {"head", "-5"}}},
+		{"ls | grep iso|img", "ls ", [][]string{{"grep", "iso|img"}}},
+		{"ls a|b", "ls a|b", nil},
+		// a | between quotes is part of its word
+		{`get "a | grep b"`, `get "a | grep b"`, nil},
+		{`ls "a | b" | wc -l`, `ls "a | b" `, [][]string{{"wc", "-l"}}},
+	}
+	for _, tt := range tests {
+		command, filters := splitPipeline(tt.line)
+		if command != tt.command || !slices.EqualFunc(filters, tt.filters, slices.Equal) {
+			t.Errorf("splitPipeline(%q) = %q, %q, want %q, %q", tt.line, command, filters, tt.command, tt.filters)
+		}
+	}
+}
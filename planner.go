@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// When a plan needs the sizes and times of several files in one directory,
+// it can probe each with SIZE and MDTM or list the directory once with MLSD,
+// whose facts carry both. planStats weighs the two by what they cost on this
+// connection: probes a round trip per pipelined batch, a listing a fixed
+// handful of round trips, and each command any command-delay. Probing a few
+// files wins on a fast link; on a slow one, or without pipelining, a listing
+// soon does. A directory already listed this session costs nothing. LIST
+// times are too coarse to stand in for MDTM, so only a server with MLSD is
+// listed instead.
+
+// listingRoundTrips is what a listing costs in round trips: PASV, the
+// listing command, the data connection, and the completion reply.
+const listingRoundTrips = 4
+
+// listingCommands is how many control commands a listing sends.
+const listingCommands = 2
+
+// statPlan is planStats' choice for a directory, and its estimates.
+type statPlan struct {
+	list      bool
+	cached    bool // the listing is at hand
+	noMLSD    bool
+	probeCost time.Duration
+	listCost  time.Duration
+}
+
+func (p statPlan) String() string {
+	switch {
+	case p.cached:
+		return "read from the listing already fetched"
+	case p.noMLSD:
+		return "probed with SIZE and MDTM, the server having no MLSD to list with"
+	case p.list:
+		return fmt.Sprintf("listed with MLSD, ~%v against ~%v of probes", roundCost(p.listCost), roundCost(p.probeCost))
+	}
+	return fmt.Sprintf("probed with SIZE and MDTM, ~%v against ~%v for a listing", roundCost(p.probeCost), roundCost(p.listCost))
+}
+
+// planStats decides whether the sizes and times of n files in dir are
+// better found by listing dir or by probing the files.
+func (f *FTPConnection) planStats(dir string, n int) statPlan {
+	if _, ok := f.listings[dir]; ok {
+		return statPlan{list: true, cached: true}
+	}
+	if !f.useMLSD() {
+		return statPlan{noMLSD: true}
+	}
+	rtt, delay := f.stats.roundTrip(), f.settings.commandDelay
+	commands, depth := 2*n, f.pipelineDepth()
+	batches := (commands + depth - 1) / depth
+	p := statPlan{
+		probeCost: time.Duration(batches)*rtt + time.Duration(commands)*delay,
+		listCost:  listingRoundTrips*rtt + listingCommands*delay,
+	}
+	p.list = p.listCost < p.probeCost
+	return p
+}
+
+// roundCost rounds an estimate for display.
+func roundCost(d time.Duration) time.Duration {
+	if d < time.Second {
+		return roundRTT(d)
+	}
+	return d.Round(10 * time.Millisecond)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPlanStats(t *testing.T) {
+	const rtt = 10 * time.Millisecond
+	tests := []struct {
+		name      string
+		n         int
+		delay     time.Duration
+		pipelined bool
+		want      bool // list rather than probe
+	}{
+		{"one file", 1, 0, false, false},
+		{"a few files", 3, 0, false, true},
+		{"command delay, one file", 1, 100 * time.Millisecond, false, false},
+		{"command delay, two files", 2, 100 * time.Millisecond, false, true},
+		{"pipelined, ten files", 10, 0, true, false},
+		{"pipelined, forty files", 40, 0, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, _ := newFakeConnection(newFakeSession())
+			if tt.pipelined {
+				client, server := net.Pipe()
+				defer client.Close()
+				defer server.Close()
+				f.session = newNetSession(client)
+			}
+			f.features = map[string]string{"MLSD": ""}
+			f.settings.commandDelay = tt.delay
+			f.stats.reply("NOOP", "200 OK", rtt)
+
+			p := f.planStats("/data", tt.n)
+			if p.list != tt.want || p.cached || p.noMLSD {
+				t.Errorf("planStats = %+v (%s), want list %v", p, p, tt.want)
+			}
+		})
+	}
+
+	f, _ := newFakeConnection(newFakeSession())
+	f.features = map[string]string{}
+	if p := f.planStats("/data", 100); p.list || !p.noMLSD {
+		t.Errorf("without MLSD, planStats = %+v, want probes", p)
+	}
+	f.listings = map[string][]RemoteEntry{"/data": nil}
+	if p := f.planStats("/data", 1); !p.list || !p.cached {
+		t.Errorf("with the listing at hand, planStats = %+v, want it read", p)
+	}
+}
+
+// Links into a directory worth listing are resolved from its MLSD; those
+// the listing can't resolve are still probed.
+func TestProbeLinksListsTargets(t *testing.T) {
+	s := newFakeSession().withFeatures("MLSD", "SIZE", "MDTM")
+	s.files["MLSD /data"] = "type=file;size=5;modify=20260102030405; a.txt\r\n" +
+		"type=file;size=6;modify=20260102030406; b.txt\r\n" +
+		"type=dir;modify=20260102030407; sub\r\n"
+	s.replies["SIZE /links/c"] = "213 7"
+	s.replies["MDTM /links/c"] = "213 20260102030408"
+	f, out := newFakeConnection(s)
+	f.settings.commandDelay = time.Millisecond
+	entries := []RemoteEntry{
+		{name: "a", kind: "link", target: "/data/a.txt"},
+		{name: "b", kind: "link", target: "../data/b.txt"},
+		{name: "c", kind: "link", target: "/data/c.txt"},
+		{name: "d", kind: "link", target: "/data/sub"},
+		{name: "plain.txt", kind: "file"},
+	}
+
+	links, err := f.probeLinks("/", "links", entries, mirrorOptions{verbose: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "Links into /data (4): listed with MLSD") {
+		t.Errorf("the choice wasn't shown:\n%s", out)
+	}
+	want := map[string]int64{"a": 5, "b": 6, "c": 7}
+	for name, size := range want {
+		if m := links[name]; m.sizeErr != nil || m.size != size || m.modTime.IsZero() {
+			t.Errorf("link %s = %+v, want size %d and a time", name, m, size)
+		}
+	}
+	if m, ok := links["d"]; !ok || m.sizeErr == nil {
+		t.Errorf("link d to a directory = %+v, want it not a file", m)
+	}
+	if _, ok := links["plain.txt"]; ok {
+		t.Error("a file that isn't a link was looked up")
+	}
+
+	var probes []string
+	for _, cmd := range s.sentCommands() {
+		if strings.HasPrefix(cmd, "SIZE") || strings.HasPrefix(cmd, "MDTM") {
+			probes = append(probes, cmd)
+		}
+	}
+	if !slices.Equal(probes, []string{"SIZE /links/c", "MDTM /links/c"}) {
+		t.Errorf("probed %q, want only the link the listing lacks", probes)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// A command the registry doesn't know runs the executable goftp-<name> from
+// PATH, if there is one, the way git runs git-<name>. The plugin gets the
+// session's context as the first line of its stdin, then makes requests of
+// the session by writing JSON lines to stdout, each answered with a line on
+// its stdin. Lines it writes that aren't JSON are shown as output, and its
+// stderr goes straight to the terminal. A plugin that exits with a non-zero
+// status fails the command.
+
+// pluginPrefix starts the names of plugin executables.
+const pluginPrefix = "goftp-"
+
+// pluginName is what a plugin command may be called, so that a command
+// line can't name a path.
+var pluginName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// findPlugin returns the path of the plugin for command, if one is on PATH.
+func findPlugin(command string) (string, bool) {
+	if !pluginName.MatchString(command) {
+		return "", false
+	}
+	file, err := exec.LookPath(pluginPrefix + command)
+	return file, err == nil
+}
+
+// knownCommand reports whether command is in the registry or a plugin.
+func knownCommand(command string) bool {
+	if _, ok := commandRegistry[command]; ok {
+		return true
+	}
+	_, ok := findPlugin(command)
+	return ok
+}
+
+// pluginContext is the first line a plugin reads.
+type pluginContext struct {
+	Type     string            `json:"type"`   // "context"
+	Client   string            `json:"client"` // the client's version
+	Command  string            `json:"command"`
+	Args     []string          `json:"args"`
+	Host     string            `json:"host"`
+	User     string            `json:"user"`
+	Profile  string            `json:"profile,omitempty"`
+	Cwd      string            `json:"cwd,omitempty"` // remote; empty before auth
+	LocalDir string            `json:"local_dir"`
+	Settings map[string]string `json:"settings"`
+}
+
+// pluginRequest is a line a plugin writes. Ops are:
+//
+//	print  show text
+//	get    download remote to local (default: its base name)
+//	put    upload local to remote (default: its base name)
+//	list   list path (default: the working directory)
+//	run    run a REPL command line, returning its output
+type pluginRequest struct {
+	ID     int    `json:"id"`
+	Op     string `json:"op"`
+	Text   string `json:"text,omitempty"`
+	Remote string `json:"remote,omitempty"`
+	Local  string `json:"local,omitempty"`
+	Path   string `json:"path,omitempty"`
+	Line   string `json:"line,omitempty"`
+}
+
+// pluginReply answers a request with the same id.
+type pluginReply struct {
+	ID      int           `json:"id"`
+	OK      bool          `json:"ok"`
+	Error   string        `json:"error,omitempty"`
+	Bytes   int64         `json:"bytes,omitempty"`
+	Entries []pluginEntry `json:"entries,omitempty"`
+	Output  []string      `json:"output,omitempty"`
+}
+
+type pluginEntry struct {
+	Name     string    `json:"name"`
+	Type     string    `json:"type"` // "file", "dir", or "link"
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified,omitzero"`
+}
+
+// runPlugin runs the plugin at file for the command line args.
+func (f *FTPConnection) runPlugin(file string, args []string) error {
+	ctx := pluginContext{
+		Type:     "context",
+		Client:   clientVersion(),
+		Command:  args[0],
+		Args:     args[1:],
+		Host:     f.addr,
+		User:     f.user,
+		Profile:  f.profileName,
+		Settings: make(map[string]string, len(settingRegistry)),
+	}
+	if f.isAuthenticated {
+		ctx.Cwd, _ = f.currentDir()
+	}
+	ctx.LocalDir, _ = os.Getwd()
+	for name, setting := range settingRegistry {
+		ctx.Settings[name] = setting.get(&f.settings)
+	}
+
+	cmd := exec.Command(file, args[1:]...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start %s: %v", file, err)
+	}
+	replies := json.NewEncoder(stdin)
+	replies.Encode(ctx)
+
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		var req pluginRequest
+		if !strings.HasPrefix(strings.TrimSpace(line), "{") || json.Unmarshal([]byte(line), &req) != nil {
+			f.out().Line(line)
+			continue
+		}
+		// a plugin that stopped reading only loses its replies
+		replies.Encode(f.pluginRequest(req))
+	}
+	stdin.Close()
+	// drain what the plugin writes after a scan error, so it can exit
+	io.Copy(io.Discard, stdout)
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("%s: %v", pluginPrefix+args[0], err)
+	}
+	return scanner.Err()
+}
+
+// pluginRequest carries out one request from a plugin.
+func (f *FTPConnection) pluginRequest(req pluginRequest) pluginReply {
+	reply := pluginReply{ID: req.ID}
+	var err error
+	switch req.Op {
+	case "print":
+		f.out().Line(req.Text)
+	case "get":
+		local := req.Local
+		if local == "" {
+			local = path.Base(req.Remote)
+		}
+		if err = requireAuth(f); err == nil {
+			reply.Bytes, err = f.downloadFile(req.Remote, local, -1)
+		}
+	case "put":
+		remote := req.Remote
+		if remote == "" {
+			remote = localBase(req.Local)
+		}
+		if err = requireAuth(f); err == nil {
+			reply.Bytes, err = f.uploadFile(req.Local, remote)
+		}
+	case "list":
+		var entries []RemoteEntry
+		if err = requireAuth(f); err == nil {
+			entries, err = f.fetchListing(req.Path)
+		}
+		for _, e := range entries {
+			reply.Entries = append(reply.Entries, pluginEntry{Name: e.name, Type: e.kind, Size: e.size, Modified: e.modTime})
+		}
+	case "run":
+		if args := cleanInput(req.Line); len(args) > 0 && commandRegistry[args[0]].callback == nil {
+			// plugins can't start one another, which could loop
+			err = fmt.Errorf("unknown command %q", args[0])
+			break
+		}
+		var buf bytes.Buffer
+		saved := f.stdout
+		f.stdout = &buf
+		err = f.execute(req.Line)
+		f.stdout = saved
+		if buf.Len() > 0 {
+			reply.Output = strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+		}
+	default:
+		err = fmt.Errorf("unknown op %q - expected print, get, put, list, or run", req.Op)
+	}
+	if err != nil {
+		reply.Error = err.Error()
+	}
+	reply.OK = err == nil
+	return reply
+}
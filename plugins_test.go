@@ -0,0 +1,85 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestPluginRequest(t *testing.T) {
+	useTempDirs(t)
+	t.Chdir(t.TempDir())
+	s := newFakeSession()
+	s.files["LIST /pub"] = "-rw-r--r--   1 ftp      ftp             9 Jan 02  2024 report.pdf\r\n"
+	s.files["RETR /pub/report.pdf"] = "pdf bytes"
+	f, _ := newFakeConnection(s)
+
+	reply := f.pluginRequest(pluginRequest{ID: 1, Op: "list", Path: "/pub"})
+	if !reply.OK || reply.ID != 1 || len(reply.Entries) != 1 || reply.Entries[0].Name != "report.pdf" || reply.Entries[0].Size != 9 {
+		t.Errorf("list reply = %+v", reply)
+	}
+	reply = f.pluginRequest(pluginRequest{ID: 2, Op: "get", Remote: "/pub/report.pdf"})
+	if !reply.OK || reply.Bytes != 9 {
+		t.Errorf("get reply = %+v", reply)
+	}
+	if data, _ := os.ReadFile("report.pdf"); string(data) != "pdf bytes" {
+		t.Errorf("get saved %q", data)
+	}
+	reply = f.pluginRequest(pluginRequest{ID: 3, Op: "run", Line: "pwd"})
+	if !reply.OK || len(reply.Output) == 0 || !strings.Contains(reply.Output[0], "/") {
+		t.Errorf("run pwd reply = %+v", reply)
+	}
+	reply = f.pluginRequest(pluginRequest{ID: 4, Op: "run", Line: "some-plugin"})
+	if reply.OK || !strings.Contains(reply.Error, "unknown command") {
+		t.Errorf("run of a plugin reply = %+v, want it refused", reply)
+	}
+	reply = f.pluginRequest(pluginRequest{ID: 5, Op: "delete-everything"})
+	if reply.OK || reply.ID != 5 {
+		t.Errorf("unknown op reply = %+v", reply)
+	}
+}
+
+func TestFindPluginName(t *testing.T) {
+	for _, name := range []string{"../goftp-x", "/bin/sh", "Upper", "-flag", ""} {
+		if _, ok := findPlugin(name); ok {
+			t.Errorf("findPlugin(%q) found a plugin", name)
+		}
+	}
+}
+
+func TestRunPlugin(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the test plugin is a shell script")
+	}
+	dir := t.TempDir()
+	script := `#!/bin/sh
+read context
+case "$context" in *'"command":"hello"'*'"args":["world"]'*) ;; *) echo "bad context: $context" >&2; exit 2 ;; esac
+echo "hello from the plugin"
+echo '{"id":1,"op":"list","path":"/pub"}'
+read reply
+case "$reply" in *'"name":"report.pdf"'*) echo listed ;; esac
+`
+	if err := os.WriteFile(filepath.Join(dir, pluginPrefix+"hello"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, pluginPrefix+"fail"), []byte("#!/bin/sh\nexit 3\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	s := newFakeSession()
+	s.files["LIST /pub"] = "-rw-r--r--   1 ftp      ftp          1024 Jan 02  2024 report.pdf\r\n"
+	f, out := newFakeConnection(s)
+	if err := f.execute("hello world"); err != nil {
+		t.Fatalf("hello: %v\n%s", err, out)
+	}
+	if got := out.String(); got != "hello from the plugin\nlisted\n" {
+		t.Errorf("plugin printed %q", got)
+	}
+	if err := f.execute("fail"); err == nil {
+		t.Error("a plugin exiting with status 3 succeeded")
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// uploadHooks are the steps put runs on a file after the server has stored
+// it, for exchanges where partners watch for a mode, a name, or a callback
+// before picking the file up. They come from the upload-* settings, which
+// put's flags override. Empty fields are skipped.
+type uploadHooks struct {
+	chmod  string // octal mode for SITE CHMOD
+	rename string // new name pattern, e.g. "{name}.done"
+	notify string // URL to POST a JSON description of the upload to
+}
+
+func (h uploadHooks) empty() bool {
+	return h.chmod == "" && h.rename == "" && h.notify == ""
+}
+
+func validateUploadMode(mode string) error {
+	if _, err := strconv.ParseUint(mode, 8, 32); err != nil {
+		return fmt.Errorf("invalid mode %q - expected octal, e.g. 644", mode)
+	}
+	return nil
+}
+
+func validateRenamePattern(pattern string) error {
+	if !strings.Contains(pattern, "{") || strings.Contains(pattern, "/") {
+		return fmt.Errorf("invalid rename pattern %q - expected a name using {name}, {stem}, or {ext}, e.g. {name}.done", pattern)
+	}
+	return nil
+}
+
+func validateNotifyURL(target string) error {
+	if !strings.HasPrefix(target, "http://") && !strings.HasPrefix(target, "https://") {
+		return fmt.Errorf("invalid notify URL %q - expected http:// or https://", redact(target))
+	}
+	return nil
+}
+
+// renameUpload applies a rename pattern to remote's base name: {name} is the
+// whole name, {stem} the name without its extension, and {ext} the extension
+// with its dot.
+func renameUpload(remote, pattern string) string {
+	name := path.Base(remote)
+	ext := path.Ext(name)
+	renamed := strings.NewReplacer("{name}", name, "{stem}", strings.TrimSuffix(name, ext), "{ext}", ext).Replace(pattern)
+	return path.Join(path.Dir(remote), renamed)
+}
+
+// uploadNotice is the JSON body an upload-notify webhook receives.
+type uploadNotice struct {
+	Event  string    `json:"event"`
+	Time   time.Time `json:"time"`
+	Host   string    `json:"host"`
+	User   string    `json:"user"`
+	Remote string    `json:"remote"` // after any rename
+	Local  string    `json:"local"`  // absolute
+	Bytes  int64     `json:"bytes"`
+}
+
+var notifyClient = &http.Client{Timeout: 30 * time.Second}
+
+// runUploadHooks applies hooks to remote, just uploaded from local, and
+// returns its final name. Each step runs only if the ones before it
+// succeeded, so a partner never gets a callback for a file whose mode or name
+// isn't final.
+func (f *FTPConnection) runUploadHooks(hooks uploadHooks, local, remote string, n int64) (string, error) {
+	if hooks.chmod != "" {
+		resp, err := f.sendCommand(fmt.Sprintf("SITE CHMOD %s %s", hooks.chmod, remote))
+		if err != nil {
+			return remote, err
+		}
+		if !isSuccessResponse(resp) {
+			return remote, fmt.Errorf("uploaded, but SITE CHMOD failed: %s", strings.TrimSpace(resp))
+		}
+	}
+	if hooks.rename != "" {
+		renamed := renameUpload(remote, hooks.rename)
+		if err := f.renameRemote(remote, renamed); err != nil {
+			return remote, fmt.Errorf("uploaded, but renaming to %s failed: %v", renamed, err)
+		}
+		remote = renamed
+	}
+	if hooks.notify != "" {
+		absRemote := remote
+		if !strings.HasPrefix(remote, "/") {
+			if dir, err := f.currentDir(); err == nil {
+				absRemote = path.Join(dir, remote)
+			}
+		}
+		if abs, err := filepath.Abs(local); err == nil {
+			local = abs
+		}
+		notice := uploadNotice{Event: "upload", Time: time.Now(), Host: f.addr, User: f.user, Remote: absRemote, Local: local, Bytes: n}
+		if err := postNotice(hooks.notify, notice); err != nil {
+			return remote, fmt.Errorf("uploaded, but notifying %s failed: %v", redact(hooks.notify), err)
+		}
+	}
+	return remote, nil
+}
+
+func postNotice(target string, notice uploadNotice) error {
+	body, err := json.Marshal(notice)
+	if err != nil {
+		return err
+	}
+	resp, err := notifyClient.Post(target, "application/json", bytes.NewReader(body))
+	if urlErr, ok := err.(*url.Error); ok {
+		// the caller names the URL, redacted
+		return urlErr.Err
+	} else if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// fallocKeepSize reserves blocks without changing the file's size, so a
+// .part file still shows how much has arrived.
+const fallocKeepSize = 0x1
+
+// preallocate reserves disk space for bytes offset to size of file. File
+// systems without fallocate are left to allocate as data arrives.
+func preallocate(file *os.File, offset, size int64) error {
+	err := syscall.Fallocate(int(file.Fd()), fallocKeepSize, offset, size-offset)
+	if errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.ENOSYS) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import "os"
+
+// preallocate reserves disk space for bytes offset to size of file by
+// extending it; on NTFS that allocates the space. The caller truncates the
+// file back to what arrived if the download fails.
+func preallocate(file *os.File, offset, size int64) error {
+	return file.Truncate(size)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Preallocated space past what arrived is given back, so a file or .part
+// file never claims bytes that weren't downloaded.
+func TestPreallocatedDownloads(t *testing.T) {
+	tests := []struct {
+		name  string
+		size  string // SIZE reply
+		args  []string
+		fails bool
+		want  int64 // size of the file, or of the .part file when the get fails
+	}{
+		{name: "complete", size: "213 13", want: 13},
+		{name: "truncated", size: "213 40", fails: true, want: 13},
+		{name: "ranged past the end", size: "213 13", args: []string{"--length", "50"}, want: 13},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTempDirs(t)
+			s := newFakeSession().withFeatures("SIZE", "REST STREAM")
+			s.replies["SIZE hello.txt"] = tt.size
+			s.files["RETR hello.txt"] = "hello, world\n"
+			f, out := newFakeConnection(s)
+			f.settings.preallocate = true
+
+			local := filepath.Join(t.TempDir(), "hello.txt")
+			err := handleGet(f, append(tt.args, "hello.txt", local))
+			if (err != nil) != tt.fails {
+				t.Fatalf("get returned %v\n%s", err, out)
+			}
+			name := local
+			if tt.fails {
+				name += ".part"
+			}
+			info, err := os.Stat(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Size() != tt.want {
+				t.Errorf("%s is %d bytes, want %d", filepath.Base(name), info.Size(), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// probePool holds a secondary control connection for metadata probes such as
+// SIZE and MDTM, so they never interleave with a command or transfer in
+// progress on the main connection. It is opened on first use and kept for
+// the rest of the session.
+type probePool struct {
+	mu   sync.Mutex
+	conn *FTPConnection
+	dir  string // the probe connection's working directory
+}
+
+// probe runs fn on the probe connection, after moving it to this session's
+// working directory so relative paths mean the same thing on both. If no
+// probe connection can be opened, fn runs on this connection instead.
+func (f *FTPConnection) probe(fn func(*FTPConnection) error) error {
+	if f.probes == nil {
+		f.probes = &probePool{}
+	}
+	p := f.probes
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if f.workDir == "" {
+		dir, err := f.currentDir()
+		if err != nil {
+			return fn(f)
+		}
+		f.workDir = dir
+	}
+
+	for attempt := 0; ; attempt++ {
+		conn, err := p.ready(f)
+		if err != nil {
+			return fn(f)
+		}
+		err = fn(conn)
+		if attempt == 0 && conn.isConnectionDead(err) {
+			// the server dropped the idle probe connection; reopen it once
+			p.close()
+			f.stats.retry()
+			continue
+		}
+		return err
+	}
+}
+
+// ready returns the probe connection in f's working directory, opening it if
+// needed.
+func (p *probePool) ready(f *FTPConnection) (*FTPConnection, error) {
+	if p.conn == nil {
+		conn, err := f.openSibling()
+		if err != nil {
+			return nil, err
+		}
+		p.conn, p.dir = conn, ""
+	}
+	if p.dir != f.workDir {
+		resp, err := p.conn.sendCommand("CWD " + f.workDir)
+		if err != nil {
+			p.close()
+			return nil, err
+		}
+		if !isSuccessResponse(resp) {
+			return nil, fmt.Errorf("CWD %s failed on probe connection: %s", f.workDir, strings.TrimSpace(resp))
+		}
+		p.dir = f.workDir
+	}
+	return p.conn, nil
+}
+
+func (p *probePool) close() {
+	if p == nil || p.conn == nil {
+		return
+	}
+	p.conn.sendCommand("QUIT")
+	p.conn.Close()
+	p.conn = nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// batchProgress tracks a bulk transfer as a whole: files finished out of the
+// batch, and bytes moved out of the total its listings promised. Parallel
+// mirror workers share one, so it is safe for concurrent use.
+type batchProgress struct {
+	out        Renderer
+	sizes      map[string]int64 // expected size by path; missing when unknown
+	totalFiles int
+	totalBytes int64
+
+	mu        sync.Mutex
+	files     int
+	doneBytes int64 // expected sizes of finished files
+	moving    int64 // bytes moved by files still in flight
+	drawn     time.Time
+	showing   bool // the progress line is on screen
+}
+
+func newBatchProgress(out Renderer, paths []string, sizes map[string]int64) *batchProgress {
+	b := &batchProgress{out: out, sizes: sizes, totalFiles: len(paths)}
+	for _, p := range paths {
+		b.totalBytes += sizes[p]
+	}
+	return b
+}
+
+// add counts n bytes of an in-flight file, redrawing at most ten times a
+// second.
+func (b *batchProgress) add(n int) {
+	if b == nil || n == 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.moving += int64(n)
+	if time.Since(b.drawn) >= 100*time.Millisecond {
+		b.draw()
+	}
+}
+
+// fileDone counts p as finished, whether it transferred, failed, or was
+// skipped, after it moved n bytes. report prints the file's own result line,
+// which goes below the progress line rather than over it.
+func (b *batchProgress) fileDone(p string, n int64, report func()) {
+	if b == nil {
+		report()
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.files++
+	b.moving -= n
+	b.doneBytes += max(b.sizes[p], n)
+	if b.showing {
+		b.out.EndProgress()
+		b.showing = false
+	}
+	report()
+	b.draw()
+}
+
+// finish ends the progress line, so other output can follow it. The line
+// is redrawn on the next update.
+func (b *batchProgress) finish() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.showing {
+		b.out.EndProgress()
+		b.showing = false
+	}
+}
+
+func (b *batchProgress) draw() {
+	done := b.doneBytes + b.moving
+	if b.totalBytes > 0 {
+		done = min(done, b.totalBytes)
+	}
+	b.out.BatchProgress(b.files, b.totalFiles, done, b.totalBytes)
+	b.drawn, b.showing = time.Now(), true
+}
+
+// batchConn reports the bytes of a file transfer to its batch.
+type batchConn struct {
+	net.Conn
+	batch *batchProgress
+}
+
+func (c batchConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.batch.add(n)
+	return n, err
+}
+
+func (c batchConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.batch.add(n)
+	return n, err
+}
+
+func (c batchConn) CloseWrite() error {
+	if hc, ok := c.Conn.(halfCloser); ok {
+		return hc.CloseWrite()
+	}
+	return nil
+}
+
+func (c batchConn) CloseRead() error {
+	if hc, ok := c.Conn.(halfCloser); ok {
+		return hc.CloseRead()
+	}
+	return nil
+}
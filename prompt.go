@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	stdinOnce  sync.Once
+	stdinWant  chan struct{}
+	stdinLines chan string
+)
+
+// inputLines returns a channel of lines read from standard input, closed at
+// EOF. The REPL and prompts issued mid-command share this single reader so
+// that no buffered input is lost between them. A line is only read after
+// requestLine, leaving the terminal free for child processes such as an
+// editor in between.
+func inputLines() <-chan string {
+	stdinOnce.Do(func() {
+		stdinWant = make(chan struct{}, 1)
+		stdinLines = make(chan string)
+		go func() {
+			reader := bufio.NewReader(os.Stdin)
+			terminal := stdinIsTerminal()
+			for range stdinWant {
+				line, err := readLine(reader, terminal)
+				if err != nil {
+					break
+				}
+				stdinLines <- line
+			}
+			close(stdinLines)
+		}()
+	})
+	return stdinLines
+}
+
+// requestLine asks the reader for the next line of input.
+func requestLine() {
+	inputLines()
+	select {
+	case stdinWant <- struct{}{}:
+	default: // a request is already pending, or input has ended
+	}
+}
+
+// promptLine prints prompt and waits for the next line of input.
+func promptLine(prompt string) (string, error) {
+	showPrompt(func() { io.WriteString(terminalOutput, prompt) })
+	requestLine()
+	line, ok := <-inputLines()
+	if !ok {
+		return "", io.EOF
+	}
+	return line, nil
+}
+
+// promptPassword reads a line without echoing it where the terminal can be
+// put in edit mode.
+func promptPassword(prompt string) (string, error) {
+	editor.mu.Lock()
+	editor.secret = true
+	editor.mu.Unlock()
+	defer func() {
+		editor.mu.Lock()
+		editor.secret = false
+		editor.mu.Unlock()
+	}()
+	return promptLine(prompt)
+}
+
+func stdinIsTerminal() bool {
+	info, err := os.Stdin.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func stdoutIsTerminal() bool {
+	info, err := os.Stdout.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// terminalWidth returns the width of the terminal in columns: $COLUMNS if
+// set, otherwise what `stty size` reports for the controlling terminal, or
+// 80 if neither is available.
+func terminalWidth() int {
+	if n, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && n > 0 {
+		return n
+	}
+	cmd := exec.Command("stty", "size")
+	if tty, err := os.Open("/dev/tty"); err == nil {
+		defer tty.Close()
+		cmd.Stdin = tty
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		return 80
+	}
+	// "rows cols"
+	fields := strings.Fields(string(out))
+	if len(fields) == 2 {
+		if n, err := strconv.Atoi(fields[1]); err == nil && n > 0 {
+			return n
+		}
+	}
+	return 80
+}
+
+func stty(args ...string) error {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	return cmd.Run()
+}
@@ -0,0 +1,507 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// goftp proxy --listen :8021 --upstream host[:port] is a caching FTP proxy
+// for build farms that fetch the same artifacts from a slow server again and
+// again. Clients log in to the proxy as they would to the server: each
+// control connection is relayed to the upstream, logins included, and data
+// connections pass through the proxy, so clients need only reach it, in
+// passive mode. Files downloaded in full are kept in the cache directory,
+// keyed by server, user, path, size, and modification time, and a RETR of a
+// file the server still has at the same size and time is served from there.
+// The server is still asked for SIZE and MDTM, but its data connection, the
+// slow part, is skipped. A file changed on the server is fetched again. TLS
+// is not relayed, and the cache is never pruned: delete old files from it as
+// disk space requires.
+
+// proxyDataTimeout is how long the proxy waits for a client to open the
+// passive data connection it set up.
+const proxyDataTimeout = 30 * time.Second
+
+// ftpProxy is the proxy's configuration, shared by its sessions.
+type ftpProxy struct {
+	upstream string // host:port
+	cache    string // directory of cached files
+}
+
+// runProxy parses the proxy subcommand's arguments and serves until the
+// listener fails.
+func runProxy(args []string) error {
+	fs := flag.NewFlagSet("proxy", flag.ContinueOnError)
+	listen := fs.String("listen", ":8021", "Address to accept FTP clients on")
+	upstream := fs.String("upstream", "", "FTP server to relay to, as host[:port]")
+	if err := fs.Parse(args); err == flag.ErrHelp {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if *upstream == "" || fs.NArg() > 0 {
+		return fmt.Errorf("usage: goftp proxy --listen :8021 --upstream host[:port]")
+	}
+	addr := *upstream
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		// the port -host defaults to
+		addr = net.JoinHostPort(addr, "2121")
+	}
+	dir, err := appDir(cacheDir)
+	if err != nil {
+		return err
+	}
+	p := &ftpProxy{upstream: addr, cache: filepath.Join(dir, "proxy")}
+	if err := os.MkdirAll(p.cache, 0700); err != nil {
+		return fmt.Errorf("failed to create proxy cache: %v", err)
+	}
+
+	ln, err := net.Listen("tcp", *listen)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	fmt.Printf("Proxying %s on %s, caching downloads in %s\n", addr, ln.Addr(), p.cache)
+	return p.serve(ln)
+}
+
+// serve relays each client that connects to ln until the listener fails.
+func (p *ftpProxy) serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		s := &proxySession{proxy: p, client: conn}
+		go s.serve()
+	}
+}
+
+// proxySession is one client's control connection and its upstream twin.
+type proxySession struct {
+	proxy    *ftpProxy
+	client   net.Conn
+	upstream *netSession
+	dataLn   net.Listener
+	user     string
+	typ      string // last TYPE the server accepted; empty for its default
+	rest     int64
+}
+
+func (s *proxySession) reply(format string, args ...any) {
+	fmt.Fprintf(s.client, format+"\r\n", args...)
+}
+
+// logf prints a line about the session to the proxy's output.
+func (s *proxySession) logf(format string, args ...any) {
+	fmt.Printf("[%s] %s\n", s.client.RemoteAddr(), fmt.Sprintf(format, args...))
+}
+
+func (s *proxySession) serve() {
+	defer s.client.Close()
+	defer s.closeData()
+	s.logf("connected")
+	defer s.logf("disconnected")
+
+	conn, err := dialControl(s.proxy.upstream)
+	if err != nil {
+		s.reply("421 Can't reach %s: %v", s.proxy.upstream, err)
+		return
+	}
+	s.upstream = newNetSession(conn)
+	defer s.upstream.Close()
+	greeting, err := s.upstream.readResponse()
+	if err != nil {
+		s.reply("421 No greeting from %s: %v", s.proxy.upstream, err)
+		return
+	}
+	io.WriteString(s.client, greeting)
+
+	reader := bufio.NewReader(s.client)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		verb, arg, _ := strings.Cut(line, " ")
+		if !s.command(strings.ToUpper(verb), arg, line) {
+			return
+		}
+	}
+}
+
+// command handles one client command and reports whether the session goes
+// on. Commands the proxy has no part in are relayed as they are.
+func (s *proxySession) command(verb, arg, line string) bool {
+	// REST applies only to the command that follows it
+	rest := s.rest
+	s.rest = 0
+	switch verb {
+	case "USER":
+		s.user = arg
+		return s.relay(line) != ""
+	case "TYPE":
+		resp := s.relay(line)
+		if strings.HasPrefix(resp, "2") {
+			s.typ = strings.ToUpper(arg)
+		}
+		return resp != ""
+	case "PASV", "EPSV":
+		if strings.EqualFold(arg, "ALL") {
+			s.reply("200 EPSV ALL OK")
+			return true
+		}
+		s.closeData()
+		host, _, _ := net.SplitHostPort(s.client.LocalAddr().String())
+		ln, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+		if err != nil {
+			s.reply("425 Can't open data connection: %v", err)
+			return true
+		}
+		s.dataLn = ln
+		code := "227"
+		if verb == "EPSV" {
+			code = "229"
+		}
+		io.WriteString(s.client, passiveReply(code, ln.Addr().(*net.TCPAddr)))
+	case "PORT", "EPRT":
+		s.reply("502 The proxy only supports passive mode")
+	case "AUTH", "PBSZ", "PROT", "CCC":
+		s.reply("502 The proxy doesn't relay TLS")
+	case "REST":
+		n, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil || n < 0 {
+			s.reply("501 Invalid offset")
+			return true
+		}
+		s.rest = n
+		s.reply("350 Restarting at %d", n)
+	case "RETR":
+		return s.retrieve(arg, rest)
+	case "LIST", "NLST", "MLSD":
+		_, ok := s.transfer(line, rest, false, nil)
+		return ok
+	case "STOR", "STOU", "APPE":
+		_, ok := s.transfer(line, rest, true, nil)
+		return ok
+	case "ABOR":
+		// a transfer the client broke off has already been aborted upstream
+		s.closeData()
+		s.reply("226 Abort OK")
+	case "QUIT":
+		s.relay(line)
+		return false
+	default:
+		return s.relay(line) != ""
+	}
+	return true
+}
+
+// relay sends line to the upstream server and passes its reply back. It
+// returns the reply, or "" when the upstream connection has failed, which
+// ends the session.
+func (s *proxySession) relay(line string) string {
+	resp, err := s.upstream.sendCommand(line)
+	if err != nil {
+		s.reply("421 Lost the connection to %s: %v", s.proxy.upstream, err)
+		return ""
+	}
+	io.WriteString(s.client, resp)
+	return resp
+}
+
+func (s *proxySession) closeData() {
+	if s.dataLn != nil {
+		s.dataLn.Close()
+		s.dataLn = nil
+	}
+}
+
+// acceptData accepts the client's data connection on the listener the last
+// PASV or EPSV set up. Connections from any host but the client's are
+// refused, so no one else can take the data.
+func (s *proxySession) acceptData(ln net.Listener) (net.Conn, error) {
+	clientHost, _, _ := net.SplitHostPort(s.client.RemoteAddr().String())
+	ln.(*net.TCPListener).SetDeadline(time.Now().Add(proxyDataTimeout))
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if host, _, _ := net.SplitHostPort(conn.RemoteAddr().String()); host == clientHost {
+			return conn, nil
+		}
+		conn.Close()
+	}
+}
+
+// dialUpstreamData opens a passive data connection to the upstream server,
+// with EPSV or, failing that, PASV.
+func (s *proxySession) dialUpstreamData() (net.Conn, error) {
+	resp, err := s.upstream.sendCommand("EPSV")
+	if err != nil {
+		return nil, err
+	}
+	var addr string
+	if strings.HasPrefix(resp, "229") {
+		port, err := parseEPSVPort(resp)
+		if err != nil {
+			return nil, err
+		}
+		host, _, _ := net.SplitHostPort(s.upstream.RemoteAddr().String())
+		addr = net.JoinHostPort(host, strconv.Itoa(port))
+	} else {
+		if resp, err = s.upstream.sendCommand("PASV"); err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(resp, "227") {
+			return nil, fmt.Errorf("PASV failed: %s", strings.TrimSpace(resp))
+		}
+		if addr, err = parseAddr(resp); err != nil {
+			return nil, err
+		}
+	}
+	return net.DialTimeout("tcp", addr, proxyDataTimeout)
+}
+
+// transfer relays a data command: it sets up the upstream data connection,
+// sends REST and the command, and copies the data between the server and
+// the client, in the direction upload says. Downloaded data is also written
+// to tee, when there is one. It returns the server's final reply, "" if the
+// transfer didn't complete, and whether the session goes on.
+func (s *proxySession) transfer(line string, rest int64, upload bool, tee io.Writer) (string, bool) {
+	ln := s.dataLn
+	s.dataLn = nil
+	if ln == nil {
+		s.reply("425 Use PASV or EPSV first")
+		return "", true
+	}
+	defer ln.Close()
+	up, err := s.dialUpstreamData()
+	if err != nil {
+		s.reply("425 Can't open a data connection to %s: %v", s.proxy.upstream, err)
+		return "", true
+	}
+	defer up.Close()
+	if rest > 0 {
+		resp, err := s.upstream.sendCommand(fmt.Sprintf("REST %d", rest))
+		if err != nil {
+			s.reply("421 Lost the connection to %s: %v", s.proxy.upstream, err)
+			return "", false
+		}
+		if !strings.HasPrefix(resp, "3") {
+			io.WriteString(s.client, resp)
+			return "", true
+		}
+	}
+	resp := s.relay(line)
+	if resp == "" {
+		return "", false
+	}
+	if !strings.HasPrefix(resp, "1") {
+		return "", true
+	}
+
+	client, err := s.acceptData(ln)
+	if err == nil {
+		if upload {
+			_, err = io.Copy(up, client)
+		} else {
+			var w io.Writer = client
+			if tee != nil {
+				w = io.MultiWriter(client, tee)
+			}
+			_, err = io.Copy(w, up)
+		}
+		client.Close()
+	}
+	up.Close()
+	if err != nil {
+		s.abortUpstream()
+		s.reply("426 Transfer aborted: %v", err)
+		return "", true
+	}
+	if resp = s.upstreamReply(); resp == "" {
+		return "", false
+	}
+	return resp, true
+}
+
+// upstreamReply passes the server's next reply to the client, returning ""
+// when the upstream connection has failed.
+func (s *proxySession) upstreamReply() string {
+	resp, err := s.upstream.readResponse()
+	if err != nil {
+		s.reply("421 Lost the connection to %s: %v", s.proxy.upstream, err)
+		return ""
+	}
+	io.WriteString(s.client, resp)
+	return resp
+}
+
+// abortUpstream ends a transfer cut off on either side with ABOR, and reads
+// the server's replies to it so none is left for the next command.
+func (s *proxySession) abortUpstream() {
+	if s.upstream.writeCommands([]string{"ABOR"}) != nil {
+		return
+	}
+	timeout := s.upstream.timeout
+	s.upstream.setReplyTimeout(abortDrain)
+	defer s.upstream.setReplyTimeout(timeout)
+	for {
+		if _, err := s.upstream.readResponse(); err != nil {
+			return
+		}
+	}
+}
+
+// retrieve handles RETR, from the cache when it holds the file as the
+// server now has it, and otherwise from the server, caching the file as it
+// passes through.
+func (s *proxySession) retrieve(arg string, rest int64) bool {
+	file, size, ok := s.cacheFile(arg)
+	if !ok {
+		_, ok := s.transfer("RETR "+arg, rest, false, nil)
+		return ok
+	}
+	if s.serveCached(file, size, rest) {
+		s.logf("served %s from the cache (%d bytes)", arg, size-rest)
+		return true
+	}
+	if rest > 0 {
+		_, ok := s.transfer("RETR "+arg, rest, false, nil)
+		return ok
+	}
+
+	tmp, err := os.CreateTemp(s.proxy.cache, ".part-*")
+	if err != nil {
+		s.logf("can't cache %s: %v", arg, err)
+		_, ok := s.transfer("RETR "+arg, 0, false, nil)
+		return ok
+	}
+	w := &cacheWriter{file: tmp}
+	resp, ok := s.transfer("RETR "+arg, 0, false, w)
+	if err := tmp.Close(); w.err == nil {
+		w.err = err
+	}
+	switch {
+	case !strings.HasPrefix(resp, "2"):
+	case w.err != nil:
+		s.logf("can't cache %s: %v", arg, w.err)
+	case w.n != size:
+		s.logf("not caching %s: got %d bytes where SIZE said %d", arg, w.n, size)
+	default:
+		if err := os.Rename(tmp.Name(), file); err != nil {
+			s.logf("can't cache %s: %v", arg, err)
+			break
+		}
+		s.logf("cached %s (%d bytes)", arg, size)
+		return ok
+	}
+	os.Remove(tmp.Name())
+	return ok
+}
+
+// cacheFile returns the file the cache keeps name in, and the size the
+// server gives it. ok is false when the server won't give the file's size
+// and modification time, which are part of the key, so a file changed on
+// the server is never served stale.
+func (s *proxySession) cacheFile(name string) (file string, size int64, ok bool) {
+	full := name
+	if !strings.HasPrefix(name, "/") {
+		resp, err := s.upstream.sendCommand("PWD")
+		if err != nil || !strings.HasPrefix(resp, "257") {
+			return "", 0, false
+		}
+		_, after, _ := strings.Cut(resp, "\"")
+		dir, _, found := strings.Cut(after, "\"")
+		if !found {
+			return "", 0, false
+		}
+		full = path.Join(dir, name)
+	}
+	resp, err := s.upstream.sendCommand("SIZE " + name)
+	if err != nil {
+		return "", 0, false
+	}
+	if size, err = parseSizeReply(resp); err != nil {
+		return "", 0, false
+	}
+	if resp, err = s.upstream.sendCommand("MDTM " + name); err != nil {
+		return "", 0, false
+	}
+	modTime, err := parseMDTMReply(resp)
+	if err != nil {
+		return "", 0, false
+	}
+	// the TYPE is part of the key too: the server may convert line endings
+	key := sha256.Sum256([]byte(strings.Join([]string{s.proxy.upstream, s.user, full, s.typ,
+		strconv.FormatInt(size, 10), modTime.UTC().Format(time.RFC3339)}, "\x00")))
+	return filepath.Join(s.proxy.cache, hex.EncodeToString(key[:16])), size, true
+}
+
+// serveCached sends the cached file to the client, from offset on, in
+// place of the server. It returns false, having sent nothing, if the cache
+// doesn't hold the file.
+func (s *proxySession) serveCached(file string, size, offset int64) bool {
+	f, err := os.Open(file)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err != nil || info.Size() != size {
+		return false
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return false
+	}
+	ln := s.dataLn
+	s.dataLn = nil
+	if ln == nil {
+		s.reply("425 Use PASV or EPSV first")
+		return true
+	}
+	defer ln.Close()
+	s.reply("150 Opening data connection (%d bytes, from the proxy's cache)", size-offset)
+	conn, err := s.acceptData(ln)
+	if err != nil {
+		s.reply("425 Can't open data connection: %v", err)
+		return true
+	}
+	_, err = io.Copy(conn, f)
+	conn.Close()
+	if err != nil {
+		s.reply("426 Transfer aborted: %v", err)
+		return true
+	}
+	s.reply("226 Transfer complete")
+	return true
+}
+
+// cacheWriter writes a download to the cache without ever failing it: a
+// full disk costs the cache entry, not the client's transfer.
+type cacheWriter struct {
+	file *os.File
+	n    int64
+	err  error
+}
+
+func (w *cacheWriter) Write(p []byte) (int, error) {
+	if w.err == nil {
+		_, w.err = w.file.Write(p)
+		w.n += int64(len(p))
+	}
+	return len(p), nil
+}
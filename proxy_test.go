@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startProxy runs a proxy to upstream until the test ends, caching in a
+// directory of its own, and returns its address and the cache directory.
+func startProxy(t *testing.T, upstream string) (string, string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	p := &ftpProxy{upstream: upstream, cache: t.TempDir()}
+	go p.serve(ln)
+	return ln.Addr().String(), p.cache
+}
+
+// cached lists the files in the proxy's cache.
+func cached(t *testing.T, cache string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(cache, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+// A file downloaded through the proxy is served from its cache while the
+// server reports the same size and time, and fetched again once it doesn't.
+func TestProxyCache(t *testing.T) {
+	useTempDirs(t)
+	served := t.TempDir()
+	original := filepath.Join(served, "a.txt")
+	writeFile := func(content string, modTime time.Time) {
+		t.Helper()
+		if err := os.WriteFile(original, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(original, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stamp := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	writeFile("cached contents\n", stamp)
+	upstream, err := startMockServer(served)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy, cache := startProxy(t, upstream)
+	t.Chdir(t.TempDir())
+	f, out := dialMock(t, proxy)
+
+	get := func(args, local, want string) {
+		t.Helper()
+		out.Reset()
+		if err := f.execute("get " + args + " a.txt " + local); err != nil {
+			t.Fatalf("get: %v\n%s", err, out)
+		}
+		if got, _ := os.ReadFile(local); string(got) != want {
+			t.Errorf("%s holds %q, want %q", local, got, want)
+		}
+	}
+	get("", "first.txt", "cached contents\n")
+	if files := cached(t, cache); len(files) != 1 {
+		t.Fatalf("cache holds %v, want the download", files)
+	}
+
+	// same size and time: the server's copy isn't read
+	writeFile("changed content\n", stamp)
+	get("", "second.txt", "cached contents\n")
+	get("--offset 7", "offset.txt", "contents\n")
+
+	writeFile("changed content\n", stamp.Add(time.Hour))
+	get("", "third.txt", "changed content\n")
+	if files := cached(t, cache); len(files) != 2 {
+		t.Errorf("cache holds %v, want both versions", files)
+	}
+}
+
+// Listings and uploads are relayed; active mode and TLS are refused.
+func TestProxyRelay(t *testing.T) {
+	useTempDirs(t)
+	served := t.TempDir()
+	os.WriteFile(filepath.Join(served, "listed.txt"), []byte("x"), 0644)
+	upstream, err := startMockServer(served)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy, cache := startProxy(t, upstream)
+	t.Chdir(t.TempDir())
+	writeTree(t, map[string]string{"up.txt": "uploaded\n"})
+	f, out := dialMock(t, proxy)
+
+	if err := f.execute("ls"); err != nil || !strings.Contains(out.String(), "listed.txt") {
+		t.Errorf("ls through the proxy: %v\n%s", err, out)
+	}
+	if err := f.execute("put up.txt"); err != nil {
+		t.Fatalf("put: %v\n%s", err, out)
+	}
+	if got, _ := os.ReadFile(filepath.Join(served, "up.txt")); string(got) != "uploaded\n" {
+		t.Errorf("the server's up.txt holds %q", got)
+	}
+	if files := cached(t, cache); len(files) != 0 {
+		t.Errorf("the cache holds %v after no downloads", files)
+	}
+
+	for _, cmd := range []string{"PORT 127,0,0,1,4,1", "EPRT |1|127.0.0.1|1025|", "AUTH TLS"} {
+		if resp, err := f.sendCommand(cmd); err != nil || !strings.HasPrefix(resp, "502") {
+			t.Errorf("%s = %q, %v, want 502", cmd, resp, err)
+		}
+	}
+	if resp, err := f.sendCommand("PWD"); err != nil || !strings.HasPrefix(resp, "257") {
+		t.Errorf("after the refusals PWD = %q, %v", resp, err)
+	}
+}
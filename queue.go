@@ -0,0 +1,474 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// queueJob is one transfer waiting in, or run by, the transfer queue.
+type queueJob struct {
+	id       int
+	upload   bool
+	remote   string // absolute, so the worker connection's directory doesn't matter
+	local    string
+	priority int        // higher runs first; equal priorities run in the order queued
+	limit    *rateLimit // the job's own --bwlimit, if any
+	held     bool
+	state    string // "pending", "running", "paused", "done", or "failed"
+	offset   int64  // where a paused job resumes
+	bytes    int64
+	elapsed  time.Duration // of the run that finished the job
+	err      error
+}
+
+func (j *queueJob) direction() string {
+	if j.upload {
+		return "put"
+	}
+	return "get"
+}
+
+// transferQueue runs queued transfers one at a time in the background, on a
+// connection of its own so the REPL stays free for other commands.
+type transferQueue struct {
+	owner *FTPConnection
+
+	mu      sync.Mutex
+	jobs    []*queueJob
+	nextID  int
+	running bool // the worker goroutine is active
+	waiting bool // the worker waits for a free connection
+	conn    *FTPConnection
+	pausing atomic.Bool // the running job has been asked to pause
+}
+
+// errPaused stops a transfer whose job was paused.
+var errPaused = errors.New("transfer paused")
+
+// pausableConn fails reads and writes once pausing is set, so the transfer
+// stops where it is and its data connection is closed.
+type pausableConn struct {
+	net.Conn
+	pausing *atomic.Bool
+}
+
+func (c pausableConn) Read(p []byte) (int, error) {
+	if c.pausing.Load() {
+		return 0, errPaused
+	}
+	return c.Conn.Read(p)
+}
+
+func (c pausableConn) Write(p []byte) (int, error) {
+	if c.pausing.Load() {
+		return 0, errPaused
+	}
+	return c.Conn.Write(p)
+}
+
+func (c pausableConn) CloseWrite() error {
+	if hc, ok := c.Conn.(halfCloser); ok {
+		return hc.CloseWrite()
+	}
+	return nil
+}
+
+func (c pausableConn) CloseRead() error {
+	if hc, ok := c.Conn.(halfCloser); ok {
+		return hc.CloseRead()
+	}
+	return nil
+}
+
+// add queues job and starts the worker if it is idle.
+func (q *transferQueue) add(job *queueJob) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.start(); err != nil {
+		return err
+	}
+	q.nextID++
+	job.id, job.state = q.nextID, "pending"
+	q.jobs = append(q.jobs, job)
+	return nil
+}
+
+// restore queues a job from a saved session, paused if it was paused then.
+func (q *transferQueue) restore(job *queueJob, paused bool) error {
+	if !paused {
+		return q.add(job)
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.nextID++
+	job.id, job.state = q.nextID, "paused"
+	q.jobs = append(q.jobs, job)
+	return nil
+}
+
+// start opens the queue's connection and starts the worker, unless it is
+// already running. q.mu must be held.
+func (q *transferQueue) start() error {
+	if q.running {
+		return nil
+	}
+	conn, err := q.owner.openSibling()
+	if errors.Is(err, errConnectionLimit) {
+		if !q.waiting {
+			q.waiting = true
+			q.owner.out().Info("The queue will start when a connection is free (%v)", err)
+			go q.waitForConnection()
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open connection for the queue: %v", err)
+	}
+	conn.pausing = &q.pausing
+	q.conn, q.running = conn, true
+	go q.work()
+	return nil
+}
+
+// duplicate returns a job that already covers job: the same direction and
+// remote path, and not failed, so queueing it again would repeat the
+// transfer.
+func (q *transferQueue) duplicate(job *queueJob) *queueJob {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, other := range q.jobs {
+		if other.upload == job.upload && other.remote == job.remote && other.state != "failed" {
+			return other
+		}
+	}
+	return nil
+}
+
+// retry starts the worker if jobs are waiting for it, e.g. after the
+// max-connections setting was raised.
+func (q *transferQueue) retry() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.next() == nil {
+		return nil
+	}
+	return q.start()
+}
+
+// waitForConnection tries to start the worker again each time another of
+// the session's connections closes, instead of dialing a server that is
+// already full. It returns once the worker runs or nothing is left to run.
+func (q *transferQueue) waitForConnection() {
+	for {
+		q.owner.budget.waitChange()
+		// opening a connection reads the owner's settings and probe pool
+		q.owner.control.Lock()
+		q.mu.Lock()
+		var err error
+		if !q.running && q.next() != nil {
+			err = q.start()
+		}
+		done := err != nil || q.running || q.next() == nil
+		if done {
+			q.waiting = false
+		}
+		q.mu.Unlock()
+		q.owner.control.Unlock()
+		if err != nil {
+			out := q.owner.out()
+			out.Prompt("\r")
+			out.Error(err)
+			out.Prompt("go-ftp> ")
+		}
+		if done {
+			return
+		}
+	}
+}
+
+// next returns the pending job to run next: the highest priority that isn't
+// held, first queued among equals.
+func (q *transferQueue) next() *queueJob {
+	var best *queueJob
+	for _, job := range q.jobs {
+		if job.state != "pending" || job.held {
+			continue
+		}
+		if best == nil || job.priority > best.priority {
+			best = job
+		}
+	}
+	return best
+}
+
+func (q *transferQueue) work() {
+	for {
+		q.mu.Lock()
+		job := q.next()
+		if job == nil {
+			// an idle connection would only be dropped by the server
+			q.conn.sendCommand("QUIT")
+			q.conn.Close()
+			q.conn, q.running = nil, false
+			q.mu.Unlock()
+			return
+		}
+		job.state = "running"
+		conn := q.conn
+		q.pausing.Store(false)
+		q.mu.Unlock()
+
+		var n int64
+		var err error
+		start := time.Now()
+		conn.jobLimit = job.limit
+		if job.upload {
+			n, err = conn.uploadFrom(job.local, job.remote, job.offset)
+		} else {
+			n, err = conn.downloadFrom(job.remote, job.local, -1, job.offset)
+		}
+
+		aborted := err != nil && q.owner.aborting.Load()
+		if err != nil && q.pausing.Load() || aborted {
+			how := "paused"
+			if aborted {
+				// an upload's offset can't be asked for until the abort is
+				// over, so it starts again from the beginning
+				how = "aborted"
+			}
+			offset := q.resumeOffset(conn, job)
+			q.mu.Lock()
+			job.state, job.offset = "paused", offset
+			q.mu.Unlock()
+			out := q.owner.out()
+			out.Prompt("\r")
+			out.Info("[queue %d] %s %s %s at %d bytes", job.id, job.direction(), job.remote, how, offset)
+			out.Prompt("go-ftp> ")
+			continue
+		}
+
+		q.mu.Lock()
+		job.bytes, job.elapsed, job.err = job.offset+n, time.Since(start), err
+		job.state = "done"
+		if err != nil {
+			job.state = "failed"
+		}
+		q.mu.Unlock()
+		q.report(job)
+	}
+}
+
+// resumeOffset works out how much of a paused job's file is already across:
+// what the .part file holds for a download, or what the server reports for
+// an upload. If that can't be told, the job starts again from the beginning.
+func (q *transferQueue) resumeOffset(conn *FTPConnection, job *queueJob) int64 {
+	if !job.upload {
+		info, err := os.Stat(job.local + ".part")
+		if err != nil {
+			return 0
+		}
+		return info.Size()
+	}
+	size, err := conn.remoteSize(job.remote)
+	if err != nil {
+		return 0
+	}
+	return size
+}
+
+// report announces a finished job over whatever the user is typing, the way
+// keepalive replies are shown.
+func (q *transferQueue) report(job *queueJob) {
+	out := q.owner.out()
+	out.Prompt("\r")
+	if job.err != nil {
+		out.Error(fmt.Errorf("[queue %d] %s %s: %v", job.id, job.direction(), job.remote, job.err))
+	} else {
+		out.Info("[queue %d] %s %s done (%s)", job.id, job.direction(), job.remote, transferSummary(job.bytes, job.elapsed))
+	}
+	out.Prompt("go-ftp> ")
+}
+
+// find returns the job with id, which must not have started yet.
+func (q *transferQueue) find(id int) (*queueJob, error) {
+	for _, job := range q.jobs {
+		if job.id != id {
+			continue
+		}
+		if job.state != "pending" {
+			return nil, fmt.Errorf("job %d is already %s", id, job.state)
+		}
+		return job, nil
+	}
+	return nil, fmt.Errorf("no queued job %d", id)
+}
+
+// bump raises a job above every other pending job, so it runs as soon as the
+// current transfer finishes.
+func (q *transferQueue) bump(id int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job, err := q.find(id)
+	if err != nil {
+		return err
+	}
+	top := job.priority
+	for _, other := range q.jobs {
+		if other != job && other.state == "pending" && other.priority >= top {
+			top = other.priority + 1
+		}
+	}
+	job.priority, job.held = top, false
+	return nil
+}
+
+// hold keeps a pending job from starting until it is released.
+func (q *transferQueue) hold(id int, held bool) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job, err := q.find(id)
+	if err != nil {
+		return err
+	}
+	job.held = held
+	if !held {
+		return q.start()
+	}
+	return nil
+}
+
+// pause stops a running job, keeping what it has transferred, or sets a
+// pending one aside. Either way it waits for resume.
+func (q *transferQueue) pause(id int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, job := range q.jobs {
+		if job.id != id {
+			continue
+		}
+		switch job.state {
+		case "running":
+			q.pausing.Store(true)
+		case "pending":
+			job.state = "paused"
+		default:
+			return fmt.Errorf("job %d is already %s", id, job.state)
+		}
+		return nil
+	}
+	return fmt.Errorf("no queued job %d", id)
+}
+
+// resume puts a paused job back in the queue, to continue from its offset.
+func (q *transferQueue) resume(id int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, job := range q.jobs {
+		if job.id != id {
+			continue
+		}
+		if job.state != "paused" {
+			return fmt.Errorf("job %d is %s, not paused", id, job.state)
+		}
+		job.state = "pending"
+		return q.start()
+	}
+	return fmt.Errorf("no queued job %d", id)
+}
+
+// halt sets every pending job aside as paused, so the worker stops after the
+// job it is running.
+func (q *transferQueue) halt() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, job := range q.jobs {
+		if job.state == "pending" {
+			job.state = "paused"
+		}
+	}
+}
+
+// busy reports whether the worker is running.
+func (q *transferQueue) busy() bool {
+	if q == nil {
+		return false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.running
+}
+
+// unfinished counts the jobs not yet done or failed.
+func (q *transferQueue) unfinished() int {
+	n := 0
+	for _, job := range q.snapshot() {
+		if job.state != "done" && job.state != "failed" {
+			n++
+		}
+	}
+	return n
+}
+
+// flush drops the jobs not yet done or failed, once they have been saved.
+func (q *transferQueue) flush() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.jobs = slices.DeleteFunc(q.jobs, func(job *queueJob) bool {
+		return job.state != "done" && job.state != "failed"
+	})
+}
+
+// snapshot returns copies of the jobs, pending ones first in the order they
+// will run.
+func (q *transferQueue) snapshot() []queueJob {
+	if q == nil {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	jobs := make([]queueJob, len(q.jobs))
+	for i, job := range q.jobs {
+		jobs[i] = *job
+	}
+	rank := map[string]int{"running": 0, "pending": 1, "paused": 2, "done": 3, "failed": 3}
+	sort.SliceStable(jobs, func(a, b int) bool {
+		if rank[jobs[a].state] != rank[jobs[b].state] {
+			return rank[jobs[a].state] < rank[jobs[b].state]
+		}
+		if jobs[a].state == "pending" && jobs[a].priority != jobs[b].priority {
+			return jobs[a].priority > jobs[b].priority
+		}
+		return jobs[a].id < jobs[b].id
+	})
+	return jobs
+}
+
+// pending counts jobs that have not finished.
+func (q *transferQueue) pending() int {
+	count := 0
+	for _, job := range q.snapshot() {
+		if job.state == "pending" || job.state == "running" || job.state == "paused" {
+			count++
+		}
+	}
+	return count
+}
+
+// close drops the queue's connection, abandoning any transfer in progress.
+func (q *transferQueue) close() {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.conn != nil {
+		q.conn.Close()
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// quotaFigure is one limit, usage, or free-space figure a server reported.
+type quotaFigure struct {
+	name  string
+	value string
+}
+
+// remoteQuota collects the storage limits and usage the server exposes, in
+// the ways servers do: SITE QUOTA (ProFTPD's mod_quotatab), AVBL (free space
+// in dir), and quota or disk lines in the STAT reply. Each is tried, as
+// hosting setups often offer one and not the others.
+func (f *FTPConnection) remoteQuota(dir string) ([]quotaFigure, error) {
+	var figures []quotaFigure
+	// SITE counts as a write, so read-only mode refuses it; the rest still
+	// apply
+	if resp, err := f.sendCommand("SITE QUOTA"); err == nil && isSuccessResponse(resp) {
+		figures = append(figures, parseSiteQuota(resp)...)
+	}
+
+	cmd := "AVBL"
+	if dir != "" {
+		cmd += " " + dir
+	}
+	resp, err := f.sendCommand(cmd)
+	if err != nil {
+		return nil, err
+	}
+	// 213 1073741824
+	if fields := strings.Fields(resp); strings.HasPrefix(resp, "213") && len(fields) >= 2 {
+		if n, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+			figures = append(figures, quotaFigure{"Available", fmt.Sprintf("%s (%d bytes)", formatBytes(n), n)})
+		}
+	}
+
+	resp, err = f.sendCommand("STAT")
+	if err != nil {
+		return nil, err
+	}
+	if isSuccessResponse(resp) {
+		for _, line := range replyBody(resp) {
+			if mentionsQuota(line) {
+				figures = append(figures, quotaFigure{"STAT", strings.TrimSpace(line)})
+			}
+		}
+	}
+
+	if len(figures) == 0 {
+		return nil, fmt.Errorf("the server reports no quota or free space (tried SITE QUOTA, AVBL, and STAT)")
+	}
+	return figures, nil
+}
+
+// parseSiteQuota reads the "name: value" lines of a SITE QUOTA reply, e.g.
+//
+//	200-The current quota for this session are [current/limit]:
+//	200-Name: alice
+//	200-  Uploaded Mb:	12.50/100.00
+//	200 Please contact root if these entries are inaccurate
+func parseSiteQuota(resp string) []quotaFigure {
+	var figures []quotaFigure
+	for _, line := range replyBody(resp) {
+		name, value, ok := strings.Cut(line, ":")
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if !ok || name == "" || value == "" {
+			continue
+		}
+		if used, limit, ok := strings.Cut(value, "/"); ok {
+			value = used + " of " + limit
+		}
+		figures = append(figures, quotaFigure{name, value})
+	}
+	return figures
+}
+
+// mentionsQuota reports whether a STAT line looks like a storage figure.
+func mentionsQuota(line string) bool {
+	line = strings.ToLower(line)
+	for _, word := range []string{"quota", "disk", "space", "storage", "free", "used"} {
+		if strings.Contains(line, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// formatBytes gives n in the binary units bwlimit takes, e.g. "1.5 GB".
+func formatBytes(n int64) string {
+	size := float64(n)
+	for _, unit := range []string{"B", "KB", "MB", "GB", "TB"} {
+		if size < 1024 {
+			return fmt.Sprintf("%.1f %s", size, unit)
+		}
+		size /= 1024
+	}
+	return fmt.Sprintf("%.1f PB", size)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// Bulk metadata probes, such as the SIZE and MDTM of every link a mirror
+// follows or every entry ls --since has no time for, are pipelined: up to
+// the pipelining setting's number of commands are written to the control
+// connection before any reply is read, and replies are matched to commands
+// by order, as RFC 959 has a server answer them. Only commands that change
+// nothing on the server and get exactly one reply go out this way, so
+// nothing can be done out of turn. On a slow link a batch costs one round
+// trip rather than one per command.
+//
+// A server or middlebox that drops commands arriving together shows it as a
+// reply that never comes. The connection is brought back into step as for
+// any reply timeout, the rest of the batch is sent one command at a time,
+// and the connection stops pipelining.
+
+// pipelineVerbs are the commands that may be pipelined.
+var pipelineVerbs = map[string]bool{"SIZE": true, "MDTM": true}
+
+// pipelineSession is an FTPSession that can write several commands before
+// reading their replies.
+type pipelineSession interface {
+	writeCommands(cmds []string) error
+}
+
+// sendPipelined sends cmds and returns their replies in order. Runs of
+// pipelineVerbs are pipelined, when the session allows; anything else goes
+// through sendCommand. On an error the replies so far are returned with it.
+func (f *FTPConnection) sendPipelined(cmds []string) ([]string, error) {
+	replies := make([]string, 0, len(cmds))
+	for len(replies) < len(cmds) {
+		rest := cmds[len(replies):]
+		if n := f.pipelineRun(rest); n > 1 {
+			batch, err := f.sendBatch(rest[:n])
+			replies = append(replies, batch...)
+			if err != nil {
+				return replies, err
+			}
+			continue
+		}
+		resp, err := f.sendCommand(rest[0])
+		if err != nil {
+			return replies, err
+		}
+		replies = append(replies, resp)
+	}
+	return replies, nil
+}
+
+// pipelineRun returns how many of cmds, from the first, may go out as one
+// batch.
+func (f *FTPConnection) pipelineRun(cmds []string) int {
+	depth := f.pipelineDepth()
+	n := 0
+	for n < len(cmds) && n < depth {
+		verb, _, _ := strings.Cut(cmds[n], " ")
+		if !pipelineVerbs[strings.ToUpper(verb)] {
+			break
+		}
+		n++
+	}
+	return n
+}
+
+// pipelineDepth is how many commands may go out as one batch, 1 when the
+// connection doesn't pipeline.
+func (f *FTPConnection) pipelineDepth() int {
+	if _, ok := f.session.(pipelineSession); !ok || f.pipelineOff || f.settings.commandDelay > 0 || f.settings.pipelining == 0 {
+		return 1
+	}
+	return f.settings.pipelining
+}
+
+// sendBatch writes cmds together and reads their replies, keeping the same
+// books sendCommand does. If a reply doesn't come, the connection is
+// recovered and the commands still unanswered are sent one at a time.
+func (f *FTPConnection) sendBatch(cmds []string) ([]string, error) {
+	wires := make([]string, len(cmds))
+	for i, cmd := range cmds {
+		wire, err := f.toServer(cmd)
+		if err != nil {
+			return nil, err
+		}
+		wires[i] = wire
+		f.recorder.command(cmd)
+	}
+	if f.activeTransfer != nil {
+		f.activeTransfer.done("")
+		f.activeTransfer = nil
+	}
+
+	f.session.setReplyTimeout(f.settings.replyTimeout)
+	sent := time.Now()
+	quiet := sent.Sub(f.lastCommand)
+	f.lastCommand = sent
+	if err := f.session.(pipelineSession).writeCommands(wires); err != nil {
+		return nil, err
+	}
+	var replies []string
+	for i, cmd := range cmds {
+		verb, _, _ := strings.Cut(cmd, " ")
+		verb = strings.ToUpper(verb)
+		resp, err := f.session.readResponse()
+		if err != nil {
+			f.stats.unanswered(verb, isTimeout(err))
+			if !isTimeout(err) {
+				return replies, err
+			}
+			if err := f.recoverControl(verb, err); f.idle {
+				return replies, err
+			}
+			f.pipelineOff = true
+			f.out().Warn("the server lost pipelined commands - sending them one at a time from now on")
+			rest, err := f.sendPipelined(cmds[i:])
+			return append(replies, rest...), err
+		}
+		f.stats.reply(verb, resp, time.Since(sent))
+		resp = f.fromServer(resp)
+		f.recorder.reply(resp)
+		if strings.HasPrefix(resp, "421") {
+			f.noteClosed(resp, quiet)
+		}
+		replies = append(replies, resp)
+	}
+	return replies, nil
+}
+
+// fileMeta is what probeFiles found out about a file.
+type fileMeta struct {
+	size    int64
+	modTime time.Time
+	sizeErr error // why size is unknown
+	timeErr error // why modTime is unknown
+}
+
+// probeFiles returns the size, the modification time, or both, of each of
+// paths, the way remoteSize and remoteModTime find them, but with SIZE and
+// MDTM pipelined. A path the server won't answer for is described with
+// statRemote. The error is the control connection failing.
+func (f *FTPConnection) probeFiles(paths []string, sizes, times bool) ([]fileMeta, error) {
+	askSize := sizes && f.hasFeature("SIZE")
+	askTime := times && f.hasFeature("MDTM")
+	var cmds []string
+	for _, p := range paths {
+		if askSize {
+			cmds = append(cmds, "SIZE "+p)
+		}
+		if askTime {
+			cmds = append(cmds, "MDTM "+p)
+		}
+	}
+	replies, err := f.sendPipelined(cmds)
+	if err != nil {
+		return nil, err
+	}
+	next := func() string {
+		resp := replies[0]
+		replies = replies[1:]
+		return resp
+	}
+
+	metas := make([]fileMeta, len(paths))
+	for i, p := range paths {
+		m := &metas[i]
+		var sizeReply, timeReply string
+		if askSize {
+			sizeReply = next()
+		}
+		if askTime {
+			timeReply = next()
+		}
+		if sizes {
+			if m.size, m.sizeErr = parseSizeReply(sizeReply); m.sizeErr != nil {
+				m.size, m.sizeErr = f.statSize(p)
+			}
+		}
+		if times {
+			if m.modTime, m.timeErr = parseMDTMReply(timeReply); m.timeErr != nil {
+				m.modTime, m.timeErr = f.statModTime(p)
+			}
+		}
+	}
+	return metas, nil
+}
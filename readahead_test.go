@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// probeServer answers SIZE and MDTM over a pipe and records how many
+// commands arrived in each write. A naive one reads a write at a time and
+// answers only its first command, losing the rest, as some servers and
+// middleboxes do with pipelined commands.
+type probeServer struct {
+	mu      sync.Mutex
+	batches []int // commands per write
+}
+
+func (s *probeServer) serve(conn net.Conn, naive bool) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	buf := make([]byte, 4096)
+	for {
+		var lines []string
+		if naive {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			lines = strings.SplitAfter(strings.TrimSuffix(string(buf[:n]), "\r\n"), "\r\n")
+		} else {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			lines = []string{line}
+			for reader.Buffered() > 0 {
+				line, _ := reader.ReadString('\n')
+				lines = append(lines, line)
+			}
+		}
+		s.mu.Lock()
+		s.batches = append(s.batches, len(lines))
+		s.mu.Unlock()
+		if naive {
+			lines = lines[:1]
+		}
+		for _, line := range lines {
+			verb, arg, _ := strings.Cut(strings.TrimSpace(line), " ")
+			switch verb {
+			case "SIZE":
+				fmt.Fprintf(conn, "213 %d\r\n", len(arg))
+			case "MDTM":
+				fmt.Fprintf(conn, "213 20260102030405\r\n")
+			case "ABOR":
+				fmt.Fprintf(conn, "225 ABOR command successful\r\n")
+			default:
+				fmt.Fprintf(conn, "502 %s not implemented\r\n", verb)
+			}
+		}
+	}
+}
+
+// probeConnection returns a connection to a probeServer that advertises
+// SIZE and MDTM.
+func probeConnection(t *testing.T, naive bool) (*FTPConnection, *probeServer) {
+	t.Helper()
+	client, server := net.Pipe()
+	s := &probeServer{}
+	go s.serve(server, naive)
+	f, _ := newFakeConnection(newFakeSession())
+	f.session = newNetSession(client)
+	f.features = map[string]string{"SIZE": "", "MDTM": ""}
+	t.Cleanup(func() { client.Close() })
+	return f, s
+}
+
+// checkMetas checks that each path got its own size and the server's time.
+func checkMetas(t *testing.T, paths []string, metas []fileMeta) {
+	t.Helper()
+	want := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	if len(metas) != len(paths) {
+		t.Fatalf("got %d results for %d paths", len(metas), len(paths))
+	}
+	for i, m := range metas {
+		if m.sizeErr != nil || m.timeErr != nil || m.size != int64(len(paths[i])) || !m.modTime.Equal(want) {
+			t.Errorf("%s: size %d (%v), time %v (%v), want %d and %v", paths[i], m.size, m.sizeErr, m.modTime, m.timeErr, len(paths[i]), want)
+		}
+	}
+}
+
+func TestProbeFilesPipelined(t *testing.T) {
+	f, s := probeConnection(t, false)
+	f.settings.pipelining = 4
+	paths := []string{"a", "bb", "ccc", "dddd", "eeeee"}
+
+	metas, err := f.probeFiles(paths, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkMetas(t, paths, metas)
+	if got := fmt.Sprint(s.batches); got != "[4 4 2]" {
+		t.Errorf("commands per write %s, want [4 4 2]", got)
+	}
+}
+
+// Pipelining off, or a command delay, sends one command at a time.
+func TestProbeFilesUnpipelined(t *testing.T) {
+	for _, off := range []func(*sessionSettings){
+		func(s *sessionSettings) { s.pipelining = 0 },
+		func(s *sessionSettings) { s.commandDelay = time.Millisecond },
+	} {
+		f, s := probeConnection(t, false)
+		off(&f.settings)
+		paths := []string{"a", "bb"}
+		metas, err := f.probeFiles(paths, true, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkMetas(t, paths, metas)
+		if got := fmt.Sprint(s.batches); got != "[1 1 1 1]" {
+			t.Errorf("commands per write %s, want one at a time", got)
+		}
+	}
+}
+
+// A server that loses pipelined commands costs one reply timeout; the rest
+// are sent one at a time, and so is everything after.
+func TestProbeFilesLostCommands(t *testing.T) {
+	f, s := probeConnection(t, true)
+	var out strings.Builder
+	f.stdout = &out
+	f.settings.replyTimeout = 200 * time.Millisecond
+	paths := []string{"a", "bb"}
+
+	metas, err := f.probeFiles(paths, true, true)
+	if err != nil {
+		t.Fatalf("%v\n%s", err, out.String())
+	}
+	checkMetas(t, paths, metas)
+	if !f.pipelineOff || !strings.Contains(out.String(), "one at a time") {
+		t.Errorf("pipelining wasn't turned off with a warning:\n%s", out.String())
+	}
+	// the batch, ABOR, and the three commands it lost
+	if got := fmt.Sprint(s.batches); got != "[4 1 1 1 1]" {
+		t.Errorf("commands per write %s, want [4 1 1 1 1]", got)
+	}
+
+	s.batches = nil
+	if _, err := f.probeFiles(paths, true, false); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(s.batches); got != "[1 1]" {
+		t.Errorf("after the loss, commands per write %s, want one at a time", got)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sessionEvent is one line of a --record session file.
+type sessionEvent struct {
+	Time      time.Time `json:"time"`
+	Type      string    `json:"type"` // "command", "reply", or "transfer"
+	Text      string    `json:"text,omitempty"`
+	Direction string    `json:"direction,omitempty"` // "download" or "upload"
+	Bytes     int64     `json:"bytes,omitempty"`
+}
+
+// sessionRecorder appends timestamped protocol events to a JSONL file. All
+// methods are safe to call on a nil recorder, which records nothing.
+type sessionRecorder struct {
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+func newSessionRecorder(filename string) (*sessionRecorder, error) {
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create recording %s: %v", filename, err)
+	}
+	return &sessionRecorder{file: file, enc: json.NewEncoder(file)}, nil
+}
+
+func (r *sessionRecorder) record(event sessionEvent) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	event.Time = time.Now()
+	r.enc.Encode(event)
+}
+
+func (r *sessionRecorder) command(cmd string) {
+	// never write passwords to disk
+	r.record(sessionEvent{Type: "command", Text: redactCommand(cmd)})
+}
+
+func (r *sessionRecorder) reply(resp string) {
+	r.record(sessionEvent{Type: "reply", Text: resp})
+}
+
+func (r *sessionRecorder) transfer(verb string, n int64) {
+	direction := "download"
+	switch strings.ToUpper(verb) {
+	case "STOR", "APPE", "STOU":
+		direction = "upload"
+	}
+	r.record(sessionEvent{Type: "transfer", Direction: direction, Bytes: n})
+}
+
+func (r *sessionRecorder) close() error {
+	if r == nil {
+		return nil
+	}
+	return r.file.Close()
+}
+
+// countingConn counts the bytes moved over a data connection.
+type countingConn struct {
+	net.Conn
+	n int64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// runReplayServer serves a recorded session to each client that connects,
+// acting as a mock server that answers every command with the replies the
+// real server gave. Passive replies are rewritten to point at a local data
+// listener, and transfers move the recorded number of filler bytes.
+func runReplayServer(recording, listenAddr string) error {
+	events, err := loadRecording(recording)
+	if err != nil {
+		return err
+	}
+
+	ln, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	fmt.Printf("Replaying %s (%d events) on %s\n", recording, len(events), ln.Addr())
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Client connected from %s\n", conn.RemoteAddr())
+		replaySession(conn, events)
+		fmt.Println("Client disconnected")
+	}
+}
+
+func loadRecording(filename string) ([]sessionEvent, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open recording %s: %v", filename, err)
+	}
+	defer file.Close()
+
+	var events []sessionEvent
+	dec := json.NewDecoder(file)
+	for {
+		var event sessionEvent
+		if err := dec.Decode(&event); err == io.EOF {
+			return events, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("invalid recording %s: %v", filename, err)
+		}
+		events = append(events, event)
+	}
+}
+
+func replaySession(conn net.Conn, events []sessionEvent) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	var dataLn net.Listener
+	defer func() {
+		if dataLn != nil {
+			dataLn.Close()
+		}
+	}()
+
+	// greeting and anything else the server sent before the first command
+	i := 0
+	for ; i < len(events) && events[i].Type != "command"; i++ {
+		if events[i].Type == "reply" {
+			io.WriteString(conn, events[i].Text)
+		}
+	}
+
+	for i < len(events) {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		got, _, _ := strings.Cut(strings.TrimSpace(line), " ")
+		want, _, _ := strings.Cut(events[i].Text, " ")
+		if !strings.EqualFold(got, want) {
+			fmt.Printf("Warning: client sent %s where the recording has %s\n", strings.TrimSpace(line), events[i].Text)
+		}
+
+		// replay everything the server did in response to this command
+		for i++; i < len(events) && events[i].Type != "command"; i++ {
+			event := events[i]
+			switch event.Type {
+			case "reply":
+				text := event.Text
+				if strings.HasPrefix(text, "227") || strings.HasPrefix(text, "229") {
+					if dataLn != nil {
+						dataLn.Close()
+					}
+					host, _, _ := net.SplitHostPort(conn.LocalAddr().String())
+					if dataLn, err = net.Listen("tcp", net.JoinHostPort(host, "0")); err != nil {
+						fmt.Printf("Warning: could not open data listener: %v\n", err)
+						return
+					}
+					text = passiveReply(text[:3], dataLn.Addr().(*net.TCPAddr))
+				}
+				io.WriteString(conn, text)
+			case "transfer":
+				if err := replayTransfer(dataLn, event); err != nil {
+					fmt.Printf("Warning: replayed transfer failed: %v\n", err)
+				}
+			}
+		}
+	}
+}
+
+func passiveReply(code string, addr *net.TCPAddr) string {
+	ip := addr.IP.To4()
+	if code == "229" || ip == nil {
+		return fmt.Sprintf("229 Entering Extended Passive Mode (|||%d|)\r\n", addr.Port)
+	}
+	return fmt.Sprintf("227 Entering Passive Mode (%d,%d,%d,%d,%d,%d)\r\n",
+		ip[0], ip[1], ip[2], ip[3], addr.Port/256, addr.Port%256)
+}
+
+func replayTransfer(dataLn net.Listener, event sessionEvent) error {
+	if dataLn == nil {
+		return fmt.Errorf("transfer without a preceding PASV/EPSV")
+	}
+	dataConn, err := dataLn.Accept()
+	if err != nil {
+		return err
+	}
+	defer dataConn.Close()
+
+	if event.Direction == "upload" {
+		_, err = io.Copy(io.Discard, dataConn)
+		return err
+	}
+	_, err = io.CopyN(dataConn, fillerReader{}, event.Bytes)
+	return err
+}
+
+// fillerReader stands in for file contents that were never recorded.
+type fillerReader struct{}
+
+func (fillerReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 'x'
+	}
+	return len(p), nil
+}
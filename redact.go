@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+var (
+	secretsMu sync.Mutex
+	secrets   []string
+)
+
+// urlUserinfo matches the password part of user:pass@ in URLs.
+var urlUserinfo = regexp.MustCompile(`([a-zA-Z][a-zA-Z0-9+.-]*://[^/@\s:]*):[^/@\s]*@`)
+
+// addSecret registers a value, such as the login password, that output must
+// never contain. Very short values are ignored since masking them would
+// garble unrelated text.
+func addSecret(secret string) {
+	if len(secret) < 3 {
+		return
+	}
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	secrets = append(secrets, secret)
+}
+
+// redact masks URL passwords and registered secrets in s.
+func redact(s string) string {
+	s = urlUserinfo.ReplaceAllString(s, "$1:****@")
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	for _, secret := range secrets {
+		s = strings.ReplaceAll(s, secret, "****")
+	}
+	return s
+}
+
+// redactCommand masks the argument of PASS in a control connection command.
+func redactCommand(cmd string) string {
+	if verb, _, _ := strings.Cut(cmd, " "); strings.EqualFold(verb, "PASS") {
+		return "PASS ****"
+	}
+	return redact(cmd)
+}
+
+// redactingWriter passes writes through redact, for use as log output.
+type redactingWriter struct {
+	w io.Writer
+}
+
+func (r redactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(r.w, redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
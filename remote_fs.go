@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"path"
+	"strings"
+	"time"
+)
+
+// remoteFS presents the server tree below root as an fs.FS, so standard
+// library walkers such as fs.WalkDir can read it. Opened files stream over the
+// session's data connection, so only one may be open at a time.
+type remoteFS struct {
+	conn *FTPConnection
+	root string
+}
+
+func newRemoteFS(conn *FTPConnection, root string) remoteFS {
+	return remoteFS{conn: conn, root: root}
+}
+
+func (r remoteFS) remotePath(name string) string {
+	if name == "." {
+		return r.root
+	}
+	return joinRemote(r.root, name)
+}
+
+func (r remoteFS) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		return remoteInfo{RemoteEntry{name: path.Base(r.root), kind: "dir"}}, nil
+	}
+	dir, base := path.Split(name)
+	entries, err := r.conn.listDir(r.remotePath(path.Clean(dir)))
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	for _, entry := range entries {
+		if entry.name == base {
+			return remoteInfo{entry}, nil
+		}
+	}
+	return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+}
+
+func (r remoteFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	entries, err := r.conn.listDir(r.remotePath(name))
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	dirEntries := make([]fs.DirEntry, len(entries))
+	for i, entry := range entries {
+		dirEntries[i] = remoteInfo{entry}
+	}
+	return dirEntries, nil
+}
+
+// Open returns a directory handle, or a file whose contents are read
+// straight off a RETR data connection.
+func (r remoteFS) Open(name string) (fs.File, error) {
+	info, err := r.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return &remoteDir{fsys: r, name: name, info: info}, nil
+	}
+
+	if _, err := r.conn.prepareData(); err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	resp, err := r.conn.sendCommand(fmt.Sprintf("RETR %s", r.remotePath(name)))
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	if !strings.HasPrefix(resp, "150") && !strings.HasPrefix(resp, "125") {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fmt.Errorf("RETR failed: %s", strings.TrimSpace(resp))}
+	}
+	dataConn, err := r.conn.openDataConn()
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &remoteFile{conn: r.conn, data: dataConn, info: info}, nil
+}
+
+// remoteFile is an open RETR. Close reads the server's completion reply.
+type remoteFile struct {
+	conn *FTPConnection
+	data net.Conn
+	info fs.FileInfo
+}
+
+func (f *remoteFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+
+func (f *remoteFile) Read(p []byte) (int, error) { return f.data.Read(p) }
+
+func (f *remoteFile) Close() error {
+	f.data.Close()
+	resp, err := f.conn.readResponse()
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(resp, "226") && !strings.HasPrefix(resp, "426") {
+		return fmt.Errorf("transfer did not complete successfully: %s", strings.TrimSpace(resp))
+	}
+	return nil
+}
+
+// remoteDir is an opened directory, listed lazily by ReadDir.
+type remoteDir struct {
+	fsys    remoteFS
+	name    string
+	info    fs.FileInfo
+	entries []fs.DirEntry
+	listed  bool
+}
+
+func (d *remoteDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+
+func (d *remoteDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: fs.ErrInvalid}
+}
+
+func (d *remoteDir) Close() error { return nil }
+
+func (d *remoteDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.listed {
+		entries, err := d.fsys.ReadDir(d.name)
+		if err != nil {
+			return nil, err
+		}
+		d.entries, d.listed = entries, true
+	}
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(d.entries))
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
+
+// remoteInfo adapts a RemoteEntry to fs.FileInfo and fs.DirEntry.
+type remoteInfo struct {
+	entry RemoteEntry
+}
+
+func (i remoteInfo) Name() string       { return i.entry.name }
+func (i remoteInfo) Size() int64        { return i.entry.size }
+func (i remoteInfo) ModTime() time.Time { return i.entry.modTime }
+func (i remoteInfo) IsDir() bool        { return i.entry.isDir() }
+func (i remoteInfo) Sys() any           { return i.entry }
+func (i remoteInfo) Type() fs.FileMode  { return i.Mode().Type() }
+
+func (i remoteInfo) Info() (fs.FileInfo, error) { return i, nil }
+
+// Mode combines the entry type with its "rwxr-xr-x" permissions, falling back
+// to 0755 for directories and 0644 for files when the listing has none.
+func (i remoteInfo) Mode() fs.FileMode {
+	var mode fs.FileMode
+	if len(i.entry.perm) == 9 {
+		for bit, c := range i.entry.perm {
+			// S and T are setuid/setgid/sticky without the execute bit
+			if c != '-' && c != 'S' && c != 'T' {
+				mode |= 1 << (8 - bit)
+			}
+		}
+	} else if i.entry.isDir() {
+		mode = 0755
+	} else {
+		mode = 0644
+	}
+	switch i.entry.kind {
+	case "dir":
+		mode |= fs.ModeDir
+	case "link":
+		mode |= fs.ModeSymlink
+	}
+	return mode
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Renderer is how command handlers present results, so the same command can
+// print for a terminal, emit JSON for scripts, or stay quiet.
+type Renderer interface {
+	// Reply shows a raw server reply, e.g. "250 Directory changed\r\n".
+	Reply(resp string)
+	// Info reports what a command did, e.g. "Downloaded a.txt (10 bytes)".
+	Info(format string, args ...any)
+	Warn(format string, args ...any)
+	Error(err error)
+	// Field shows one named value of a report such as status or config.
+	Field(key, value string)
+	// Line is one line of command output proper, e.g. a path printed by find.
+	Line(text string)
+	// Progress updates a transfer's byte count; EndProgress finishes it.
+	Progress(done, total int64)
+	// BatchProgress updates a bulk transfer's file and byte counts; a total
+	// of 0 means the byte count is unknown. EndProgress also finishes it.
+	BatchProgress(files, totalFiles int, done, total int64)
+	EndProgress()
+	Prompt(prompt string)
+}
+
+// renderers lists the available output styles for `set output`.
+var renderers = map[string]func(io.Writer) Renderer{
+	"plain": func(w io.Writer) Renderer { return plainRenderer{w} },
+	"color": func(w io.Writer) Renderer { return colorRenderer{plainRenderer{w}} },
+	"json":  func(w io.Writer) Renderer { return jsonRenderer{w} },
+	"quiet": func(w io.Writer) Renderer { return quietRenderer{plainRenderer{w}} },
+}
+
+// output returns where command output goes: standard output, or the buffer
+// or file a pipeline or redirection collects it in. In --machine mode, text
+// written straight to standard output, such as a listing, is sent as line
+// messages, since the frontend parses every line.
+func (f *FTPConnection) output() io.Writer {
+	if f.stdout == nil && f.machine != nil {
+		return f.machine
+	}
+	return f.destination()
+}
+
+// destination is output without the --machine wrapping, for renderers.
+func (f *FTPConnection) destination() io.Writer {
+	if f.stdout != nil {
+		return f.stdout
+	}
+	return terminalOutput
+}
+
+// out returns the renderer selected by the output setting.
+func (f *FTPConnection) out() Renderer {
+	newRenderer, ok := renderers[f.settings.output]
+	if !ok {
+		newRenderer = renderers["plain"]
+	}
+	// a --machine frontend parses every line
+	if f.machine != nil {
+		newRenderer = renderers["json"]
+	}
+	r := newRenderer(f.destination())
+	if f.inBackground() {
+		r = noProgressRenderer{r}
+	}
+	r = warningRenderer{r, f.commands, f.events}
+	// JSON consumers get every reply
+	if f.settings.terse && f.settings.output != "json" {
+		return terseRenderer{r}
+	}
+	return r
+}
+
+// plainRenderer writes human-readable text.
+type plainRenderer struct {
+	w io.Writer
+}
+
+func (r plainRenderer) Reply(resp string) { fmt.Fprint(r.w, resp) }
+
+func (r plainRenderer) Info(format string, args ...any) {
+	fmt.Fprintf(r.w, format+"\n", args...)
+}
+
+func (r plainRenderer) Warn(format string, args ...any) {
+	fmt.Fprintf(r.w, "Warning: "+format+"\n", args...)
+}
+
+func (r plainRenderer) Error(err error) {
+	fmt.Fprintf(r.w, "Error: %s\n", redact(err.Error()))
+}
+
+func (r plainRenderer) Field(key, value string) { fmt.Fprintf(r.w, " %s: %s\n", key, value) }
+
+func (r plainRenderer) Line(text string) { fmt.Fprintln(r.w, text) }
+
+func (r plainRenderer) Progress(done, total int64) {
+	if total > 0 {
+		fmt.Fprintf(r.w, "\rProgress: %d/%d bytes (%.1f%%)", done, total, float64(done)/float64(total)*100)
+	}
+}
+
+func (r plainRenderer) BatchProgress(files, totalFiles int, done, total int64) {
+	if total > 0 {
+		fmt.Fprintf(r.w, "\rBatch: %d/%d files, %d/%d bytes (%.1f%%)", files, totalFiles, done, total, float64(done)/float64(total)*100)
+	} else {
+		fmt.Fprintf(r.w, "\rBatch: %d/%d files", files, totalFiles)
+	}
+}
+
+func (r plainRenderer) EndProgress() { fmt.Fprintln(r.w) }
+
+func (r plainRenderer) Prompt(prompt string) { fmt.Fprint(r.w, prompt) }
+
+// colorRenderer highlights reply codes, warnings, and errors with ANSI colors.
+type colorRenderer struct {
+	plainRenderer
+}
+
+const (
+	ansiReset  = "\033[0m"
+	ansiBold   = "\033[1m"
+	ansiRed    = "\033[31m"
+	ansiGreen  = "\033[32m"
+	ansiYellow = "\033[33m"
+	ansiCyan   = "\033[36m"
+)
+
+func (r colorRenderer) Reply(resp string) {
+	color := ansiCyan
+	switch {
+	case strings.HasPrefix(resp, "2"):
+		color = ansiGreen
+	case strings.HasPrefix(resp, "4"), strings.HasPrefix(resp, "5"):
+		color = ansiRed
+	}
+	fmt.Fprint(r.w, color+strings.TrimRight(resp, "\r\n")+ansiReset+"\n")
+}
+
+func (r colorRenderer) Warn(format string, args ...any) {
+	fmt.Fprintf(r.w, ansiYellow+"Warning: "+format+ansiReset+"\n", args...)
+}
+
+func (r colorRenderer) Error(err error) {
+	fmt.Fprintf(r.w, ansiRed+"Error: %s"+ansiReset+"\n", redact(err.Error()))
+}
+
+func (r colorRenderer) Prompt(prompt string) { fmt.Fprint(r.w, ansiBold+prompt+ansiReset) }
+
+// quietRenderer prints only results, warnings, and errors.
+type quietRenderer struct {
+	plainRenderer
+}
+
+func (quietRenderer) Reply(string)                         {}
+func (quietRenderer) Info(string, ...any)                  {}
+func (quietRenderer) Progress(int64, int64)                {}
+func (quietRenderer) BatchProgress(int, int, int64, int64) {}
+func (quietRenderer) EndProgress()                         {}
+
+// noProgressRenderer draws no progress bars, for a background job: they would
+// cover the prompt of the commands typed meanwhile.
+type noProgressRenderer struct {
+	Renderer
+}
+
+func (noProgressRenderer) Progress(int64, int64)                {}
+func (noProgressRenderer) BatchProgress(int, int, int64, int64) {}
+func (noProgressRenderer) EndProgress()                         {}
+
+// terseRenderer leaves out the raw replies to successful commands, showing
+// only what a reply reports: the directory in a 257, the value in a 213, and
+// the text of multi-line status and help replies. Failure replies are shown
+// in full.
+type terseRenderer struct {
+	Renderer
+}
+
+func (r terseRenderer) Reply(resp string) {
+	if strings.HasPrefix(resp, "4") || strings.HasPrefix(resp, "5") {
+		r.Renderer.Reply(resp)
+		return
+	}
+	for _, line := range terseResult(resp) {
+		r.Line(line)
+	}
+}
+
+// terseResult returns the lines of resp worth showing in terse mode.
+func terseResult(resp string) []string {
+	lines := strings.Split(strings.TrimRight(resp, "\r\n"), "\n")
+	for i := range lines {
+		lines[i] = strings.TrimRight(lines[i], "\r")
+	}
+	code, _ := parseReplyLine(lines[0])
+	switch code {
+	case "257":
+		// 257 "/pub" is the current directory
+		if _, rest, ok := strings.Cut(lines[0], `"`); ok {
+			if dir, _, ok := strings.Cut(rest, `"`); ok {
+				return []string{dir}
+			}
+		}
+	case "211", "212", "213", "214":
+		if len(lines) == 1 {
+			if code == "213" {
+				return []string{strings.TrimSpace(lines[0][3:])}
+			}
+			return nil
+		}
+		return replyBody(resp)
+	}
+	return nil
+}
+
+// replyBody returns the text of a multi-line reply between its first and
+// last lines, which carry the code, without any code prefixes.
+func replyBody(resp string) []string {
+	lines := strings.Split(strings.TrimRight(resp, "\r\n"), "\n")
+	if len(lines) < 3 {
+		return nil
+	}
+	code, _ := parseReplyLine(lines[0])
+	var body []string
+	for _, line := range lines[1 : len(lines)-1] {
+		line = strings.TrimRight(line, "\r")
+		body = append(body, strings.TrimPrefix(strings.TrimPrefix(line, code+"-"), " "))
+	}
+	return body
+}
+
+// jsonRenderer writes one JSON object per event, e.g.
+// {"type":"reply","code":250,"text":"Directory changed"}.
+type jsonRenderer struct {
+	w io.Writer
+}
+
+func (r jsonRenderer) emit(event map[string]any) {
+	json.NewEncoder(r.w).Encode(event)
+}
+
+func (r jsonRenderer) Reply(resp string) {
+	text := strings.TrimRight(resp, "\r\n")
+	code, _ := strconv.Atoi(text[:min(3, len(text))])
+	r.emit(map[string]any{"type": "reply", "code": code, "text": text})
+}
+
+func (r jsonRenderer) Info(format string, args ...any) {
+	r.emit(map[string]any{"type": "info", "text": fmt.Sprintf(format, args...)})
+}
+
+func (r jsonRenderer) Warn(format string, args ...any) {
+	r.emit(map[string]any{"type": "warning", "text": fmt.Sprintf(format, args...)})
+}
+
+func (r jsonRenderer) Error(err error) {
+	r.emit(map[string]any{"type": "error", "text": redact(err.Error())})
+}
+
+func (r jsonRenderer) Field(key, value string) {
+	r.emit(map[string]any{"type": "field", "key": key, "value": value})
+}
+
+func (r jsonRenderer) Line(text string) {
+	r.emit(map[string]any{"type": "line", "text": text})
+}
+
+func (jsonRenderer) Progress(int64, int64)                {}
+func (jsonRenderer) BatchProgress(int, int, int64, int64) {}
+func (jsonRenderer) EndProgress()                         {}
+func (jsonRenderer) Prompt(string)                        {}
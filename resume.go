@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// checkpointEvery is how much of a download arrives between checkpoints.
+const checkpointEvery = 64 << 20
+
+// A download that stops short keeps its .part file, but after a crash or a
+// power cut the end of that file may never have reached the disk. Every
+// checkpointEvery bytes the .part file is synced and the offset recorded in a
+// resume journal in the state directory, so the next get of the same file
+// continues from the last checkpoint instead of starting again. A download
+// that fails, as when the connection drops, checkpoints what did arrive.
+
+// restStream reports whether the server restarts stream-mode transfers at a
+// byte offset, so a resumed transfer continues where the last one stopped
+// instead of splicing the wrong data onto it. FEAT listing REST STREAM says
+// so; otherwise a REST 0 is tried, once per connection, for servers that
+// restart without advertising it.
+func (f *FTPConnection) restStream() bool {
+	if params, ok := f.featureParams("REST"); ok && strings.EqualFold(strings.TrimSpace(params), "STREAM") {
+		return true
+	}
+	if !f.restProbed {
+		f.restProbed = true
+		resp, err := f.sendCommand("REST 0")
+		f.restProbeOK = err == nil && strings.HasPrefix(resp, "350")
+	}
+	return f.restProbeOK
+}
+
+// resumeCheck returns offset if the server can resume there, or 0, with a
+// warning, if the transfer has to start again from the beginning.
+func (f *FTPConnection) resumeCheck(remote string, offset int64) int64 {
+	if offset > 0 && !f.restStream() {
+		f.out().Warn("the server doesn't support REST STREAM, so %s can't resume at %d bytes; transferring all of it again", remote, offset)
+		return 0
+	}
+	return offset
+}
+
+// resumeEntry is a journal's record of an unfinished download.
+type resumeEntry struct {
+	Host   string `json:"host"`
+	Remote string `json:"remote"`
+	Size   int64  `json:"size"`
+	Offset int64  `json:"offset"` // bytes of the .part file known to be on disk
+}
+
+// resumeJournal is the journal of the download of one remote file to one
+// local path. Methods on a nil journal do nothing.
+type resumeJournal struct {
+	path  string
+	part  string // the download's .part file
+	entry resumeEntry
+}
+
+// resumeJournal returns the journal for downloading remote, of size bytes, to
+// local, or nil if the download couldn't resume from it: its size is
+// unknown, it is an ASCII transfer whose offsets don't match the local file,
+// or the server has no REST STREAM.
+func (f *FTPConnection) resumeJournal(remote, local string, size int64) *resumeJournal {
+	if size < 0 || f.serverType == "A" || !f.restStream() {
+		return nil
+	}
+	dir, err := appDir(stateDir)
+	if err != nil {
+		return nil
+	}
+	absLocal, err := filepath.Abs(local)
+	if err != nil {
+		return nil
+	}
+	key := sha256.Sum256([]byte(f.addr + "\x00" + absLocal))
+	return &resumeJournal{
+		path:  filepath.Join(dir, "resume", hex.EncodeToString(key[:8])+".json"),
+		part:  local + ".part",
+		entry: resumeEntry{Host: f.addr, Remote: remote, Size: size},
+	}
+}
+
+// offset returns where the download can resume: the last checkpoint, if the
+// journal is for the same remote file at the same size and the .part file
+// still holds that much. Otherwise it is 0.
+func (j *resumeJournal) offset() int64 {
+	if j == nil {
+		return 0
+	}
+	data, err := os.ReadFile(j.path)
+	if err != nil {
+		return 0
+	}
+	var saved resumeEntry
+	if json.Unmarshal(data, &saved) != nil || saved.Host != j.entry.Host || saved.Remote != j.entry.Remote || saved.Size != j.entry.Size {
+		return 0
+	}
+	info, err := os.Stat(j.part)
+	if err != nil || info.Size() < saved.Offset {
+		return 0
+	}
+	return saved.Offset
+}
+
+// checkpoint records offset as safely on disk. A journal that can't be
+// written only costs the checkpoint, so errors are ignored.
+func (j *resumeJournal) checkpoint(offset int64) {
+	if j == nil {
+		return
+	}
+	j.entry.Offset = offset
+	data, err := json.Marshal(j.entry)
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(j.path), 0700); err != nil {
+		return
+	}
+	tmp := j.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return
+	}
+	os.Rename(tmp, j.path)
+}
+
+// remove drops the journal once the download is complete or has nothing to
+// resume from.
+func (j *resumeJournal) remove() {
+	if j != nil {
+		os.Remove(j.path)
+	}
+}
+
+// checkpointWriter writes a download to its .part file, checkpointing the
+// journal every checkpointEvery bytes.
+type checkpointWriter struct {
+	file    *os.File
+	journal *resumeJournal
+	written int64 // bytes in the file, including those before a resume
+	next    int64
+}
+
+func newCheckpointWriter(file *os.File, journal *resumeJournal, offset int64) *checkpointWriter {
+	return &checkpointWriter{file: file, journal: journal, written: offset, next: offset + checkpointEvery}
+}
+
+func (w *checkpointWriter) Write(p []byte) (int, error) {
+	n, err := w.file.Write(p)
+	w.written += int64(n)
+	if err == nil && w.journal != nil && w.written >= w.next {
+		w.next = w.written + checkpointEvery
+		// only data that has reached the disk may be resumed from
+		if w.file.Sync() == nil {
+			w.journal.checkpoint(w.written)
+		}
+	}
+	return n, err
+}
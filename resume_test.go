@@ -0,0 +1,123 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestResumeJournal(t *testing.T) {
+	useTempDirs(t)
+	f, _ := newFakeConnection(newFakeSession().withFeatures("REST STREAM"))
+	local := filepath.Join(t.TempDir(), "big.iso")
+	if err := os.WriteFile(local+".part", make([]byte, 100), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	j := f.resumeJournal("big.iso", local, 1000)
+	if j == nil {
+		t.Fatal("no journal for a server with REST STREAM")
+	}
+	if got := j.offset(); got != 0 {
+		t.Errorf("offset before any checkpoint = %d", got)
+	}
+	j.checkpoint(64)
+	if got := f.resumeJournal("big.iso", local, 1000).offset(); got != 64 {
+		t.Errorf("offset after a checkpoint at 64 = %d", got)
+	}
+	if got := f.resumeJournal("big.iso", local, 2000).offset(); got != 0 {
+		t.Errorf("offset for a file whose size changed = %d, want 0", got)
+	}
+	if got := f.resumeJournal("other.iso", local, 1000).offset(); got != 0 {
+		t.Errorf("offset for another remote file = %d, want 0", got)
+	}
+	j.checkpoint(200) // past the end of the .part file
+	if got := j.offset(); got != 0 {
+		t.Errorf("offset past the end of the .part file = %d, want 0", got)
+	}
+	j.remove()
+	if _, err := os.Stat(j.path); !os.IsNotExist(err) {
+		t.Errorf("journal %s left after remove", j.path)
+	}
+
+	f.serverType = "A"
+	if f.resumeJournal("big.iso", local, 1000) != nil {
+		t.Error("an ASCII download got a journal")
+	}
+}
+
+// get continues from the journal's checkpoint with REST.
+func TestGetResumesFromCheckpoint(t *testing.T) {
+	useTempDirs(t)
+	s := newFakeSession().withFeatures("SIZE", "REST STREAM")
+	s.replies["SIZE hello.txt"] = "213 13"
+	s.replies["REST"] = "350 Restarting"
+	s.files["RETR hello.txt"] = "hello, world\n"
+	f, out := newFakeConnection(s)
+
+	local := filepath.Join(t.TempDir(), "hello.txt")
+	if err := os.WriteFile(local+".part", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f.resumeJournal("hello.txt", local, 13).checkpoint(5)
+
+	if err := handleGet(f, []string{"hello.txt", local}); err != nil {
+		t.Fatalf("get: %v\n%s", err, out)
+	}
+	if data, _ := os.ReadFile(local); string(data) != "hello, world\n" {
+		t.Errorf("resumed download holds %q", data)
+	}
+	if !slices.Contains(s.sentCommands(), "REST 5") {
+		t.Errorf("get didn't resume at the checkpoint: sent %q", s.sentCommands())
+	}
+}
+
+func TestResumeCheckWithoutRestStream(t *testing.T) {
+	s := newFakeSession()
+	s.replies["REST"] = "502 REST not implemented"
+	f, out := newFakeConnection(s)
+	if got := f.resumeCheck("file.bin", 100); got != 0 {
+		t.Errorf("resumeCheck without REST STREAM = %d, want 0", got)
+	}
+	if out.Len() == 0 {
+		t.Error("starting again from 0 didn't warn")
+	}
+}
+
+// restStream believes FEAT, and otherwise tries REST 0 once per connection.
+func TestRestStream(t *testing.T) {
+	s := newFakeSession().withFeatures("REST STREAM")
+	f, _ := newFakeConnection(s)
+	if !f.restStream() || slices.Contains(s.sentCommands(), "REST 0") {
+		t.Errorf("with REST STREAM in FEAT: %v after sending %q", f.restStream(), s.sentCommands())
+	}
+
+	for _, reply := range []string{"350 Restarting at 0", "502 REST not implemented"} {
+		s = newFakeSession()
+		s.replies["REST"] = reply
+		f, _ = newFakeConnection(s)
+		want := reply[0] == '3'
+		if f.restStream() != want || f.restStream() != want {
+			t.Errorf("after %q restStream = %v, want %v", reply, f.restStream(), want)
+		}
+		if n := len(slices.DeleteFunc(s.sentCommands(), func(cmd string) bool { return cmd != "REST 0" })); n != 1 {
+			t.Errorf("REST 0 was tried %d times, want once", n)
+		}
+	}
+}
+
+// get --offset fails before transferring anything rather than downloading
+// from the start.
+func TestGetOffsetNeedsRestStream(t *testing.T) {
+	s := newFakeSession()
+	s.files["RETR big.iso"] = "whole file"
+	f, _ := newFakeConnection(s)
+	err := handleGet(f, []string{"--offset", "4", "big.iso", filepath.Join(t.TempDir(), "big.iso")})
+	if err == nil {
+		t.Fatal("get --offset succeeded without REST STREAM")
+	}
+	if slices.Contains(s.sentCommands(), "RETR big.iso") {
+		t.Errorf("get --offset downloaded anyway: %q", s.sentCommands())
+	}
+}
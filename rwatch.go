@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// rwatch polls a remote directory's listing and reports the files that
+// appear, disappear, or change between polls, optionally downloading new and
+// changed ones: a lightweight way to pick files up from a partner's drop
+// box. It runs until interrupted with Ctrl-C or for --count polls.
+
+// maxPollFailures is how many polls in a row may fail before rwatch or
+// tailsync gives up.
+const maxPollFailures = 5
+
+type watchOptions struct {
+	dir      string
+	interval time.Duration
+	match    string // glob the names must match; empty matches all
+	getDir   string // where to download new and changed files; empty means don't
+	count    int    // polls to make, including the first; 0 means until interrupted
+}
+
+// watchState is what rwatch saw of a file at the last poll.
+type watchState struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+// watchSnapshot lists the watched directory's files that match, keyed by name.
+func (f *FTPConnection) watchSnapshot(opts watchOptions) (map[string]watchState, error) {
+	entries, err := f.fetchListing(opts.dir)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]watchState)
+	for _, entry := range entries {
+		if entry.kind != "file" || (opts.match != "" && !matchName(opts.match, entry.name, f.settings.caseFold)) {
+			continue
+		}
+		files[nameKey(entry.name, f.settings.caseFold)] = watchState{name: entry.name, size: entry.size, modTime: entry.modTime}
+	}
+	return files, nil
+}
+
+// watchRemote runs rwatch.
+func (f *FTPConnection) watchRemote(opts watchOptions) error {
+	var previous map[string]watchState
+	return f.poll(opts.interval, opts.count, "watching "+displayDir(opts.dir), func() error {
+		current, err := f.watchSnapshot(opts)
+		if err != nil {
+			return err
+		}
+		if previous == nil {
+			f.out().Info("Watching %s every %v: %d files; Ctrl-C stops", displayDir(opts.dir), opts.interval, len(current))
+		} else {
+			f.reportWatchChanges(opts, previous, current)
+		}
+		previous = current
+		return nil
+	})
+}
+
+// poll calls fn straight away and then every interval, until Ctrl-C or
+// until it has been called count times (0 means no limit). The first call
+// must succeed; later ones that fail are warned about and tried again at the
+// next interval, up to maxPollFailures in a row. what describes the work for
+// messages, e.g. "watching /drop".
+func (f *FTPConnection) poll(interval time.Duration, count int, what string, fn func() error) error {
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	defer signal.Stop(interrupts)
+
+	if err := fn(); err != nil {
+		return err
+	}
+	failures := 0
+	for calls := 1; count == 0 || calls < count; calls++ {
+		select {
+		case <-interrupts:
+			f.out().Info("Stopped %s", what)
+			return nil
+		case <-time.After(interval):
+		}
+		if err := fn(); err != nil {
+			if failures++; failures >= maxPollFailures {
+				return fmt.Errorf("gave up %s after %d failures in a row: %v", what, failures, err)
+			}
+			f.out().Warn("%s failed, retrying in %v: %v", what, interval, err)
+			continue
+		}
+		failures = 0
+	}
+	return nil
+}
+
+// reportWatchChanges shows how current differs from previous, downloading
+// new and changed files if asked to.
+func (f *FTPConnection) reportWatchChanges(opts watchOptions, previous, current map[string]watchState) {
+	stamp := time.Now().Format("15:04:05")
+	for _, key := range sortedKeys(current) {
+		file := current[key]
+		old, seen := previous[key]
+		switch {
+		case !seen:
+			f.out().Line(fmt.Sprintf("%s new      %s (%d bytes)", stamp, file.name, file.size))
+		case old.size != file.size || !old.modTime.Equal(file.modTime):
+			f.out().Line(fmt.Sprintf("%s changed  %s (%d bytes)", stamp, file.name, file.size))
+		default:
+			continue
+		}
+		if opts.getDir != "" {
+			f.watchDownload(opts, file)
+		}
+	}
+	for _, key := range sortedKeys(previous) {
+		if _, ok := current[key]; !ok {
+			f.out().Line(fmt.Sprintf("%s removed  %s", stamp, previous[key].name))
+		}
+	}
+}
+
+// watchDownload fetches file into the --get directory. A failure is a
+// warning, so one bad file doesn't stop the watch.
+func (f *FTPConnection) watchDownload(opts watchOptions, file watchState) {
+	remote := path.Join(opts.dir, file.name)
+	local, err := f.localTarget(filepath.Join(opts.getDir, file.name))
+	if errors.Is(err, errSkipped) {
+		f.out().Info("Skipped %s: %v", remote, err)
+		return
+	}
+	if err == nil {
+		var n int64
+		if n, err = f.downloadFile(remote, local, file.size); err == nil {
+			f.out().Info("Downloaded %s to %s (%d bytes)", remote, local, n)
+			return
+		}
+	}
+	f.out().Warn("failed to download %s: %v", remote, err)
+}
+
+func sortedKeys(files map[string]watchState) []string {
+	keys := make([]string, 0, len(files))
+	for key := range files {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// displayDir names dir for messages, where "" is the working directory.
+func displayDir(dir string) string {
+	if dir == "" {
+		return "."
+	}
+	return dir
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWatchChanges(t *testing.T) {
+	s := newFakeSession()
+	s.files["RETR drop/new.csv"] = "new\n"
+	s.files["RETR drop/grown.csv"] = "grown twice\n"
+	f, out := newFakeConnection(s)
+	getDir := t.TempDir()
+	opts := watchOptions{dir: "drop", getDir: getDir}
+	then := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	previous := map[string]watchState{
+		"grown.csv": {name: "grown.csv", size: 6, modTime: then},
+		"same.csv":  {name: "same.csv", size: 4, modTime: then},
+		"gone.csv":  {name: "gone.csv", size: 1, modTime: then},
+	}
+	current := map[string]watchState{
+		"grown.csv": {name: "grown.csv", size: 12, modTime: then},
+		"same.csv":  {name: "same.csv", size: 4, modTime: then},
+		"new.csv":   {name: "new.csv", size: 4, modTime: then},
+	}
+	f.reportWatchChanges(opts, previous, current)
+
+	for _, want := range []string{"changed  grown.csv (12 bytes)", "new      new.csv (4 bytes)", "removed  gone.csv"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output lacks %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out.String(), "same.csv") {
+		t.Errorf("an unchanged file was reported:\n%s", out)
+	}
+	for name, want := range map[string]string{"new.csv": "new\n", "grown.csv": "grown twice\n"} {
+		got, err := os.ReadFile(filepath.Join(getDir, name))
+		if err != nil || string(got) != want {
+			t.Errorf("--get left %s holding %q, %v, want %q", name, got, err, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(getDir, "same.csv")); err == nil {
+		t.Error("--get downloaded an unchanged file")
+	}
+}
+
+// A failed download is a warning, and the watch goes on.
+func TestWatchDownloadFails(t *testing.T) {
+	f, out := newFakeConnection(newFakeSession())
+	opts := watchOptions{getDir: t.TempDir()}
+	f.reportWatchChanges(opts, map[string]watchState{}, map[string]watchState{"a.csv": {name: "a.csv", size: 3}})
+	if !strings.Contains(out.String(), "failed to download a.csv") {
+		t.Errorf("a failed download wasn't warned about:\n%s", out)
+	}
+}
+
+func TestWatchSnapshotMatch(t *testing.T) {
+	s := newFakeSession().withFeatures("MLSD")
+	s.files["MLSD drop"] = "type=file;size=3; a.csv\r\ntype=file;size=4; b.txt\r\ntype=dir; sub.csv\r\n"
+	f, _ := newFakeConnection(s)
+	files, err := f.watchSnapshot(watchOptions{dir: "drop", match: "*.csv"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files["a.csv"].size != 3 {
+		t.Errorf("watchSnapshot = %+v, want only the file a.csv", files)
+	}
+}
+
+// A failed poll is retried, and maxPollFailures in a row end it.
+func TestPollFailures(t *testing.T) {
+	f, out := newFakeConnection(newFakeSession())
+	calls := 0
+	err := f.poll(time.Millisecond, 3, "polling", func() error {
+		if calls++; calls == 2 {
+			return errors.New("connection reset")
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Errorf("poll = %v after %d calls, want nil after 3", err, calls)
+	}
+	if !strings.Contains(out.String(), "connection reset") {
+		t.Errorf("the failed poll wasn't warned about:\n%s", out)
+	}
+
+	calls = 0
+	err = f.poll(time.Millisecond, 0, "polling", func() error {
+		if calls++; calls > 1 {
+			return errors.New("connection reset")
+		}
+		return nil
+	})
+	if err == nil || calls != 1+maxPollFailures {
+		t.Errorf("poll = %v after %d calls, want to give up after %d failures", err, calls, maxPollFailures)
+	}
+
+	if err := f.poll(time.Millisecond, 0, "polling", func() error { return errors.New("no such directory") }); err == nil {
+		t.Error("a failing first poll was retried")
+	}
+}
+
+func TestHandleRwatchArgs(t *testing.T) {
+	f, _ := newFakeConnection(newFakeSession())
+	for _, args := range [][]string{
+		{"--interval", "10ms"},
+		{"--count", "-1"},
+		{"--match", "[", "drop"},
+		{"--get", filepath.Join(t.TempDir(), "missing")},
+		{"a", "b"},
+	} {
+		if err := handleRwatch(f, args); err == nil {
+			t.Errorf("rwatch %q succeeded", args)
+		}
+	}
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Scripts run with source are command lines, as typed at the prompt, plus a
+// few statements for automation beyond a fixed list:
+//
+//	# comment
+//	let name = text                 set a variable
+//	foreach name in command         run command, looping over its output lines
+//	foreach name in [a b c]         loop over words
+//	if a == b | a != b | a matches glob | ok command
+//	else
+//	end
+//	echo text
+//	fail text                       stop the script with an error
+//	-command                        run command, ignoring its failure
+//
+// ${name} expands a variable anywhere in a line, ${1}, ${2}, ... the script's
+// arguments, and ${date %Y%m%d 1d} the date a day ago (or now, without an
+// age) with strftime-style %Y %y %m %d %H %M %S %j %b.
+//
+// {{date}} and {{env}} template substitutions (see template.go) are
+// expanded once, as the script is read.
+//
+// A script is parsed before anything runs, so a syntax error never leaves
+// it half done. Any other failing command stops it.
+
+// maxSourceDepth limits scripts that source one another.
+const maxSourceDepth = 8
+
+type scriptStatement struct {
+	line int
+	kind string // "command", "let", "foreach", "if", "echo", or "fail"
+	text string // the command line, value, list, or condition
+	name string // let and foreach's variable
+	// ignore is set for a "-command", whose failure doesn't stop the script
+	ignore     bool
+	body, alt  []scriptStatement // foreach and if's bodies; alt is if's else
+	literalFor bool              // foreach over [words] rather than a command
+}
+
+// parseScript parses a script's lines into statements.
+func parseScript(name string, lines []string) ([]scriptStatement, error) {
+	p := &scriptParser{name: name, lines: lines}
+	statements, end, err := p.block()
+	if err != nil {
+		return nil, err
+	}
+	if end != "" {
+		return nil, fmt.Errorf("%s:%d: %s without if or foreach", name, p.pos, end)
+	}
+	return statements, nil
+}
+
+type scriptParser struct {
+	name  string
+	lines []string
+	pos   int // the line number of the line last read
+}
+
+// block parses statements up to the end of the script or an else or end
+// line, which it returns.
+func (p *scriptParser) block() ([]scriptStatement, string, error) {
+	var statements []scriptStatement
+	for p.pos < len(p.lines) {
+		text := strings.TrimSpace(p.lines[p.pos])
+		p.pos++
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		keyword, rest, _ := strings.Cut(text, " ")
+		rest = strings.TrimSpace(rest)
+		s := scriptStatement{line: p.pos, kind: keyword, text: rest}
+		switch keyword {
+		case "end", "else":
+			if rest != "" {
+				return nil, "", p.errorf("unexpected %q after %s", rest, keyword)
+			}
+			return statements, keyword, nil
+		case "let":
+			name, value, ok := strings.Cut(rest, "=")
+			s.name, s.text = strings.TrimSpace(name), strings.TrimSpace(value)
+			if !ok || !scriptVariable.MatchString(s.name) {
+				return nil, "", p.errorf("expected let <name> = <text>")
+			}
+		case "foreach":
+			name, list, ok := strings.Cut(rest, " in ")
+			s.name, s.text = strings.TrimSpace(name), strings.TrimSpace(list)
+			if !ok || !scriptVariable.MatchString(s.name) || s.text == "" {
+				return nil, "", p.errorf("expected foreach <name> in <command> or [words]")
+			}
+			if words, ok := strings.CutPrefix(s.text, "["); ok {
+				if s.text, ok = strings.CutSuffix(words, "]"); !ok {
+					return nil, "", p.errorf("unclosed [ in foreach")
+				}
+				s.literalFor = true
+			}
+			body, end, err := p.block()
+			if err != nil {
+				return nil, "", err
+			}
+			if end != "end" {
+				return nil, "", p.errorf("foreach from line %d needs an end", s.line)
+			}
+			s.body = body
+		case "if":
+			if rest == "" {
+				return nil, "", p.errorf("expected if <condition>")
+			}
+			body, end, err := p.block()
+			if err != nil {
+				return nil, "", err
+			}
+			s.body = body
+			if end == "else" {
+				if s.alt, end, err = p.block(); err != nil {
+					return nil, "", err
+				}
+			}
+			if end != "end" {
+				return nil, "", p.errorf("if from line %d needs an end", s.line)
+			}
+		case "echo", "fail":
+		default:
+			s.kind, s.text = "command", text
+			if command, ok := strings.CutPrefix(text, "-"); ok {
+				s.text, s.ignore = strings.TrimSpace(command), true
+			}
+		}
+		statements = append(statements, s)
+	}
+	return statements, "", nil
+}
+
+func (p *scriptParser) errorf(format string, args ...any) error {
+	return fmt.Errorf("%s:%d: %s", p.name, p.pos, fmt.Sprintf(format, args...))
+}
+
+var (
+	scriptVariable  = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	scriptExpansion = regexp.MustCompile(`\$\{([^}]*)\}`)
+)
+
+// scriptRun is a script being run: its variables and where it came from.
+type scriptRun struct {
+	f    *FTPConnection
+	name string
+	vars map[string]string
+}
+
+// sourceScript runs the script in file with args as ${1}, ${2}, ...
+func (f *FTPConnection) sourceScript(file string, args []string) error {
+	if f.sourceDepth >= maxSourceDepth {
+		return fmt.Errorf("scripts sourced more than %d deep", maxSourceDepth)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	text, err := expandTemplate(file, string(data))
+	if err != nil {
+		return err
+	}
+	statements, err := parseScript(file, strings.Split(text, "\n"))
+	if err != nil {
+		return err
+	}
+	run := &scriptRun{f: f, name: file, vars: map[string]string{}}
+	for i, arg := range args {
+		run.vars[strconv.Itoa(i+1)] = arg
+	}
+	f.sourceDepth++
+	defer func() { f.sourceDepth-- }()
+	return run.block(statements)
+}
+
+func (r *scriptRun) block(statements []scriptStatement) error {
+	for _, s := range statements {
+		if err := r.statement(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *scriptRun) statement(s scriptStatement) error {
+	text, err := r.expand(s.text)
+	if err != nil {
+		return r.errorf(s, "%w", err)
+	}
+	switch s.kind {
+	case "let":
+		r.vars[s.name] = text
+	case "echo":
+		r.f.out().Line(text)
+	case "fail":
+		return r.errorf(s, "%s", text)
+	case "if":
+		truth, err := r.condition(text)
+		if err != nil {
+			return r.errorf(s, "%w", err)
+		}
+		if truth {
+			return r.block(s.body)
+		}
+		return r.block(s.alt)
+	case "foreach":
+		items := strings.Fields(text)
+		if !s.literalFor {
+			if items, err = r.capture(text); err != nil {
+				return r.errorf(s, "%w", err)
+			}
+		}
+		for _, item := range items {
+			r.vars[s.name] = item
+			if err := r.block(s.body); err != nil {
+				return err
+			}
+		}
+	case "command":
+		if err := r.f.execute(text); err != nil {
+			if s.ignore && !r.f.aborting.Load() {
+				r.f.out().Info("%s:%d: %v (ignored)", r.name, s.line, err)
+				return nil
+			}
+			return r.errorf(s, "%w", err)
+		}
+	}
+	return nil
+}
+
+// errorf prefixes an error with the script's name and the statement's line.
+// Errors given with %w stay wrapped, so a quit inside a script still ends
+// the session.
+func (r *scriptRun) errorf(s scriptStatement, format string, args ...any) error {
+	return fmt.Errorf("%s:%d: "+format, append([]any{r.name, s.line}, args...)...)
+}
+
+// capture runs command and returns its non-empty output lines, trimmed.
+func (r *scriptRun) capture(command string) ([]string, error) {
+	var buf bytes.Buffer
+	saved := r.f.stdout
+	r.f.stdout = &buf
+	err := r.f.execute(command)
+	r.f.stdout = saved
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
+
+// condition evaluates an if condition, already expanded.
+func (r *scriptRun) condition(text string) (bool, error) {
+	if command, ok := strings.CutPrefix(text, "ok "); ok {
+		_, err := r.capture(command)
+		return err == nil, nil
+	}
+	for _, op := range []string{" == ", " != ", " matches "} {
+		a, b, ok := strings.Cut(text, op)
+		if !ok {
+			continue
+		}
+		a, b = strings.TrimSpace(a), strings.TrimSpace(b)
+		switch op {
+		case " == ":
+			return a == b, nil
+		case " != ":
+			return a != b, nil
+		}
+		matched, err := path.Match(b, a)
+		if err != nil {
+			return false, fmt.Errorf("invalid pattern %q: %v", b, err)
+		}
+		return matched, nil
+	}
+	return false, fmt.Errorf("expected a == b, a != b, a matches glob, or ok <command>, got %q", text)
+}
+
+// expand replaces each ${...} in text.
+func (r *scriptRun) expand(text string) (string, error) {
+	var err error
+	expanded := scriptExpansion.ReplaceAllStringFunc(text, func(match string) string {
+		inner := strings.TrimSpace(match[2 : len(match)-1])
+		if spec, ok := strings.CutPrefix(inner, "date "); ok {
+			value, dateErr := scriptDate(spec, time.Now())
+			if dateErr != nil && err == nil {
+				err = dateErr
+			}
+			return value
+		}
+		value, ok := r.vars[inner]
+		if !ok && err == nil {
+			err = fmt.Errorf("undefined variable %q", inner)
+		}
+		return value
+	})
+	return expanded, err
+}
+
+// scriptDate formats now, less an optional age such as 1d, with a strftime
+// layout: "%Y%m%d 1d" is yesterday's date as 20240131.
+func scriptDate(spec string, now time.Time) (string, error) {
+	fields := strings.Fields(spec)
+	if len(fields) == 0 || len(fields) > 2 {
+		return "", fmt.Errorf("expected ${date <format> [age]}")
+	}
+	if len(fields) == 2 {
+		age, err := parseAge(fields[1])
+		if err != nil {
+			return "", err
+		}
+		now = now.Add(-age)
+	}
+	var b strings.Builder
+	format := fields[0]
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' || i+1 == len(format) {
+			b.WriteByte(format[i])
+			continue
+		}
+		i++
+		switch format[i] {
+		case 'Y':
+			b.WriteString(now.Format("2006"))
+		case 'y':
+			b.WriteString(now.Format("06"))
+		case 'm':
+			b.WriteString(now.Format("01"))
+		case 'd':
+			b.WriteString(now.Format("02"))
+		case 'H':
+			b.WriteString(now.Format("15"))
+		case 'M':
+			b.WriteString(now.Format("04"))
+		case 'S':
+			b.WriteString(now.Format("05"))
+		case 'j':
+			b.WriteString(fmt.Sprintf("%03d", now.YearDay()))
+		case 'b':
+			b.WriteString(now.Format("Jan"))
+		case '%':
+			b.WriteByte('%')
+		default:
+			return "", fmt.Errorf("unknown date directive %%%c", format[i])
+		}
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// runScript sources text as a script on f with args.
+func runScript(t *testing.T, f *FTPConnection, text string, args ...string) error {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "script.ftp")
+	if err := os.WriteFile(file, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return f.sourceScript(file, args)
+}
+
+func TestSourceScript(t *testing.T) {
+	s := newFakeSession()
+	s.files["NLST"] = "a.log\r\nb.txt\r\nc.log\r\n"
+	s.files["LIST"] = "-rw-r--r--   1 ftp      ftp             5 Jan 01  2024 a.log\r\n" +
+		"-rw-r--r--   1 ftp      ftp             5 Jan 01  2024 b.txt\r\n" +
+		"-rw-r--r--   1 ftp      ftp             5 Jan 01  2024 c.log\r\n"
+	f, out := newFakeConnection(s)
+	err := runScript(t, f, `# greet, then list the logs
+let who = ${1}
+echo hello ${who}
+foreach n in [one two]
+  echo word ${n}
+end
+foreach name in ls -1
+  if ${name} matches *.log
+    echo log ${name}
+  else
+    echo other ${name}
+  end
+end
+if ok pwd
+  echo pwd works
+end
+-no-such-command
+echo still running
+`, "world")
+	if err != nil {
+		t.Fatalf("script: %v\n%s", err, out)
+	}
+	want := "hello world\nword one\nword two\nlog a.log\nother b.txt\nlog c.log\npwd works\n"
+	got := out.String()
+	if !strings.HasPrefix(got, want) || !strings.HasSuffix(got, "still running\n") || !strings.Contains(got, "(ignored)") {
+		t.Errorf("script printed:\n%s\nwant it to start with:\n%s", got, want)
+	}
+}
+
+func TestSourceScriptStops(t *testing.T) {
+	tests := []struct {
+		name, script, err string
+		printed           string
+	}{
+		{"fail", "echo before\nfail stopped here\necho after\n", "script.ftp:2: stopped here", "before\n"},
+		{"failed command", "echo before\nno-such-command\necho after\n", "script.ftp:2:", "before\n"},
+		{"undefined variable", "echo ${nope}\n", `undefined variable "nope"`, ""},
+		// a syntax error is found before anything runs
+		{"unterminated if", "echo before\nif a == a\necho inside\n", "", ""},
+		{"stray end", "echo before\nend\n", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, out := newFakeConnection(newFakeSession())
+			err := runScript(t, f, tt.script)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("script returned %v, want an error containing %q", err, tt.err)
+			}
+			if out.String() != tt.printed {
+				t.Errorf("script printed %q before stopping, want %q", out, tt.printed)
+			}
+		})
+	}
+}
+
+// quit inside a script, or among a profile's init commands, ends the
+// session rather than failing the script.
+func TestScriptQuit(t *testing.T) {
+	s := newFakeSession()
+	f, out := newFakeConnection(s)
+	err := runScript(t, f, "echo before\nif ok pwd\n  quit\nend\necho after\n")
+	if !errors.Is(err, errQuit) {
+		t.Errorf("script returned %v, want the quit", err)
+	}
+	if out.String() != "before\n" {
+		t.Errorf("script printed %q, want it to stop at the quit", out)
+	}
+
+	s = newFakeSession()
+	f, _ = newFakeConnection(s)
+	f.initCommands = []string{"pwd", "quit", "cd elsewhere"}
+	if err := f.runInitCommands(); !errors.Is(err, errQuit) {
+		t.Errorf("init commands returned %v, want the quit", err)
+	}
+	for _, cmd := range s.sentCommands() {
+		if strings.HasPrefix(cmd, "CWD") {
+			t.Errorf("init commands went on after the quit: %q", s.sentCommands())
+		}
+	}
+}
+
+func TestScriptDate(t *testing.T) {
+	now := time.Date(2024, 3, 1, 14, 5, 9, 0, time.UTC)
+	tests := map[string]string{
+		"%Y%m%d":        "20240301",
+		"%Y-%m-%d 1d":   "2024-02-29",
+		"%y%j":          "24061",
+		"%H:%M:%S":      "14:05:09",
+		"%d-%b-%Y":      "01-Mar-2024",
+		"backup-%Y.tar": "backup-2024.tar",
+	}
+	for spec, want := range tests {
+		got, err := scriptDate(spec, now)
+		if err != nil || got != want {
+			t.Errorf("scriptDate(%q) = %q, %v, want %q", spec, got, err, want)
+		}
+	}
+	if _, err := scriptDate("%Y 1 2", now); err == nil {
+		t.Error("scriptDate with three fields succeeded")
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The keepalive NOOPs are timed to the server's own idle timeout when it
+// can be found: many servers state it in their greeting (Pure-FTPd's "You
+// will be disconnected after 15 minutes of inactivity"), their STAT reply
+// (vsftpd's "Session timeout in seconds is 300"), or the 421 they close an
+// idle connection with (ProFTPD's "Idle timeout (600 seconds)"). A 421 that
+// names no figure still bounds the timeout by how long the connection had
+// been quiet, so the next login keeps it busier. Without any of these the
+// keepalive falls back to its fixed 30s/2m schedule.
+
+// Bounds on an adaptive keepalive interval. The upper one keeps NAT gateways
+// and firewalls, which drop quiet flows after a few minutes, from closing a
+// connection the server itself would keep.
+const (
+	minKeepalive = 5 * time.Second
+	maxKeepalive = 5 * time.Minute
+)
+
+// minLearnedIdle is the shortest quiet spell before a 421 that is taken to
+// bound the server's idle timeout; anything quicker had another cause.
+const minLearnedIdle = 10 * time.Second
+
+var idleTimeoutPatterns = []*regexp.Regexp{
+	// vsftpd STAT: "Session timeout in seconds is 300"
+	regexp.MustCompile(`(?i)timeout in (seconds|minutes) is (\d+)`),
+	// "disconnected after 15 minutes of inactivity"
+	regexp.MustCompile(`(?i)(\d+)\s*(seconds?|secs?|minutes?|mins?)\s+of\s+(?:inactivity|idle)`),
+	// "Idle timeout (600 seconds)", "idle timeout is 10 minutes", wu-ftpd's
+	// "Current IDLE time limit is 900 seconds"
+	regexp.MustCompile(`(?i)\b(?:idle|inactivity|session)\s*(?:time-?out|time limit)\D{0,20}?(\d+)\s*(seconds?|secs?|minutes?|mins?)\b`),
+}
+
+// parseIdleTimeout finds an idle timeout stated in a server reply.
+func parseIdleTimeout(text string) (time.Duration, bool) {
+	for _, pattern := range idleTimeoutPatterns {
+		m := pattern.FindStringSubmatch(text)
+		if m == nil {
+			continue
+		}
+		number, unit := m[1], m[2]
+		if _, err := strconv.Atoi(number); err != nil {
+			number, unit = unit, number
+		}
+		n, err := strconv.Atoi(number)
+		if err != nil || n <= 0 {
+			continue
+		}
+		if strings.HasPrefix(strings.ToLower(unit), "min") {
+			return time.Duration(n) * time.Minute, true
+		}
+		return time.Duration(n) * time.Second, true
+	}
+	return 0, false
+}
+
+// noteIdleTimeout records an idle timeout stated in text, if any.
+func (f *FTPConnection) noteIdleTimeout(text string) {
+	if limit, ok := parseIdleTimeout(text); ok {
+		f.serverIdle = limit
+	}
+}
+
+// noteClosed learns from a 421 the server answered a command with after the
+// connection had been quiet for idle.
+func (f *FTPConnection) noteClosed(resp string, idle time.Duration) {
+	if limit, ok := parseIdleTimeout(resp); ok {
+		f.serverIdle = limit
+		return
+	}
+	lower := strings.ToLower(resp)
+	if !strings.Contains(lower, "timeout") && !strings.Contains(lower, "timed out") && !strings.Contains(lower, "idle") && !strings.Contains(lower, "inactiv") {
+		return
+	}
+	if idle >= minLearnedIdle && (f.serverIdle == 0 || idle < f.serverIdle) {
+		f.serverIdle = idle.Truncate(time.Second)
+	}
+}
+
+// keepaliveIntervals returns the keepalive's starting interval and the one
+// it settles into once the server has answered a few NOOPs.
+func (f *FTPConnection) keepaliveIntervals() (normal, extended time.Duration) {
+	if f.serverIdle == 0 {
+		return 30 * time.Second, 2 * time.Minute
+	}
+	interval := min(max(f.serverIdle*4/5, minKeepalive), maxKeepalive)
+	return interval, interval
+}
+
+// keepaliveSchedule describes the keepalive interval for status.
+func (f *FTPConnection) keepaliveSchedule() string {
+	normal, extended := f.keepaliveIntervals()
+	if f.serverIdle == 0 {
+		return "every " + normal.String() + ", then " + extended.String() + "; server idle timeout unknown"
+	}
+	return "every " + normal.String() + ", under the server's " + f.serverIdle.String() + " idle timeout"
+}
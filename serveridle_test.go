@@ -0,0 +1,94 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseIdleTimeout(t *testing.T) {
+	tests := []struct {
+		text string
+		want time.Duration
+	}{
+		{"220-You will be disconnected after 15 minutes of inactivity.", 15 * time.Minute},
+		{"211-     Session timeout in seconds is 300", 300 * time.Second},
+		{"421 Idle timeout (600 seconds): closing control connection", 600 * time.Second},
+		{"211-Current IDLE time limit is 900 seconds", 900 * time.Second},
+		{"220 idle timeout is 10 minutes", 10 * time.Minute},
+		{"220 ProFTPD 1.3.8 Server ready", 0},
+		{"421 Timeout.", 0},
+	}
+	for _, tt := range tests {
+		got, ok := parseIdleTimeout(tt.text)
+		if got != tt.want || ok != (tt.want != 0) {
+			t.Errorf("parseIdleTimeout(%q) = %v, %v, want %v", tt.text, got, ok, tt.want)
+		}
+	}
+}
+
+func TestKeepaliveIntervals(t *testing.T) {
+	tests := []struct {
+		serverIdle       time.Duration
+		normal, extended time.Duration
+	}{
+		{0, 30 * time.Second, 2 * time.Minute},
+		{5 * time.Minute, 4 * time.Minute, 4 * time.Minute},
+		{3 * time.Second, minKeepalive, minKeepalive},
+		{time.Hour, maxKeepalive, maxKeepalive},
+	}
+	for _, tt := range tests {
+		f := &FTPConnection{serverIdle: tt.serverIdle}
+		normal, extended := f.keepaliveIntervals()
+		if normal != tt.normal || extended != tt.extended {
+			t.Errorf("with a %v idle timeout keepalives run every %v then %v, want %v then %v", tt.serverIdle, normal, extended, tt.normal, tt.extended)
+		}
+	}
+}
+
+// A 421 names the timeout, or bounds it by how long the connection was
+// quiet when it gives none and the closing looks like an idle one.
+func TestNoteClosed(t *testing.T) {
+	tests := []struct {
+		known time.Duration
+		resp  string
+		quiet time.Duration
+		want  time.Duration
+	}{
+		{0, "421 Idle timeout (600 seconds)", time.Minute, 600 * time.Second},
+		{0, "421 Timeout.", 90*time.Second + 300*time.Millisecond, 90 * time.Second},
+		{0, "421 Timeout.", 2 * time.Second, 0},             // too quick to be the idle timeout
+		{0, "421 Too many connections", 5 * time.Minute, 0}, // not an idle closing
+		{time.Minute, "421 Timeout.", 5 * time.Minute, time.Minute},
+		{5 * time.Minute, "421 Connection timed out", time.Minute, time.Minute},
+	}
+	for _, tt := range tests {
+		f := &FTPConnection{serverIdle: tt.known}
+		f.noteClosed(tt.resp, tt.quiet)
+		if f.serverIdle != tt.want {
+			t.Errorf("with %v known, %q after %v quiet learned %v, want %v", tt.known, tt.resp, tt.quiet, f.serverIdle, tt.want)
+		}
+	}
+}
+
+func TestIdleTimeoutFromGreetingAndStat(t *testing.T) {
+	s := newFakeSession()
+	s.replies["STAT"] = "211-FTP server status:\r\n     Session timeout in seconds is 300\r\n211 End of status"
+	f, _ := newFakeConnection(s)
+	f.noteGreeting("220 (vsFTPd 3.0.5)")
+	f.identifyFromStat()
+	if !slices.Contains(s.sentCommands(), "STAT") {
+		t.Error("STAT wasn't asked for the timeout the greeting didn't state")
+	}
+	if f.server.software != "vsFTPd" || f.serverIdle != 300*time.Second {
+		t.Errorf("server %q with a %v idle timeout, want vsFTPd with 5m0s", f.server.software, f.serverIdle)
+	}
+
+	s = newFakeSession()
+	f, _ = newFakeConnection(s)
+	f.noteGreeting("220---------- Welcome to Pure-FTPd [privsep] ----------\r\n220 You will be disconnected after 15 minutes of inactivity.")
+	f.identifyFromStat()
+	if len(s.sentCommands()) != 0 || f.serverIdle != 15*time.Minute {
+		t.Errorf("with everything in the greeting sent %q and learned %v", s.sentCommands(), f.serverIdle)
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// FTPSession is the wire protocol beneath the command handlers: writing
+// commands, reading replies, and opening negotiated data connections. Every
+// handler reaches the server through it, so a scripted fake can stand in for
+// the network and alternate backends can be plugged in.
+type FTPSession interface {
+	// sendCommand writes cmd and returns the complete reply.
+	sendCommand(cmd string) (string, error)
+	// readResponse reads one complete, possibly multi-line, reply.
+	readResponse() (string, error)
+	// setReplyTimeout sets how long a reply may take to arrive.
+	setReplyTimeout(d time.Duration)
+	// openDataConn accepts on ln when active mode set one up, and otherwise
+	// dials the passive address addr.
+	openDataConn(addr string, ln net.Listener) (net.Conn, error)
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+	Close() error
+}
+
+// netSession is the FTPSession for a real server over TCP.
+type netSession struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+	pending []string // replies read early, while waiting for a data connection
+}
+
+func newNetSession(conn net.Conn) *netSession {
+	return &netSession{conn: conn, reader: bufio.NewReader(conn), timeout: 45 * time.Second}
+}
+
+func (s *netSession) sendCommand(cmd string) (string, error) {
+	// Refresh write deadline for this operation
+	s.conn.SetWriteDeadline(time.Now().Add(15 * time.Second))
+
+	_, err := fmt.Fprintf(s.conn, "%s\r\n", cmd)
+	if err != nil {
+		return "", err
+	}
+
+	return s.readResponse()
+}
+
+// writeCommands writes cmds in one go, for their replies to be read in turn.
+func (s *netSession) writeCommands(cmds []string) error {
+	s.conn.SetWriteDeadline(time.Now().Add(15 * time.Second))
+	_, err := fmt.Fprintf(s.conn, "%s\r\n", strings.Join(cmds, "\r\n"))
+	return err
+}
+
+// Limits on what a server may send as one reply, so a broken or hostile
+// server can't grow memory without bound.
+const (
+	maxReplyLine  = 64 << 10
+	maxReplyBytes = 1 << 20
+)
+
+func (s *netSession) readResponse() (string, error) {
+	if len(s.pending) > 0 {
+		resp := s.pending[0]
+		s.pending = s.pending[1:]
+		return resp, nil
+	}
+	// Refresh read deadline for this operation
+	s.conn.SetReadDeadline(time.Now().Add(s.timeout))
+	return s.readReply()
+}
+
+// readReply reads a reply under the read deadline already set.
+func (s *netSession) readReply() (string, error) {
+	var fullResponse strings.Builder
+
+	line, err := s.readLine()
+	if err != nil {
+		return "", err
+	}
+	fullResponse.WriteString(line)
+
+	// check if multiline
+	if code, multi := parseReplyLine(line); multi {
+		for {
+			line, err = s.readLine()
+			if err != nil {
+				return "", err
+			}
+			fullResponse.WriteString(line)
+			if fullResponse.Len() > maxReplyBytes {
+				return "", fmt.Errorf("reply exceeds %d bytes", maxReplyBytes)
+			}
+
+			if c, more := parseReplyLine(line); c == code && !more {
+				break
+			}
+		}
+	}
+
+	return fullResponse.String(), nil
+}
+
+// readLine reads one newline-terminated line of at most maxReplyLine bytes.
+func (s *netSession) readLine() (string, error) {
+	var line []byte
+	for {
+		chunk, err := s.reader.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > maxReplyLine {
+			return "", fmt.Errorf("reply line exceeds %d bytes", maxReplyLine)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return string(line), nil
+	}
+}
+
+// parseReplyLine returns the three-digit code a reply line starts with, and
+// whether the line opens or continues a multi-line reply ("123-text"). Lines
+// that don't start with a code, such as the middle of a multi-line reply,
+// return an empty code.
+func parseReplyLine(line string) (code string, multi bool) {
+	if len(line) < 3 {
+		return "", false
+	}
+	for i := 0; i < 3; i++ {
+		if line[i] < '0' || line[i] > '9' {
+			return "", false
+		}
+	}
+	if len(line) > 3 {
+		switch line[3] {
+		case '-':
+			return line[:3], true
+		case ' ', '\r', '\n':
+		default:
+			return "", false
+		}
+	}
+	return line[:3], false
+}
+
+func (s *netSession) openDataConn(addr string, ln net.Listener) (net.Conn, error) {
+	if ln != nil {
+		return s.acceptDataConn(ln)
+	}
+
+	dataConn, err := net.DialTimeout("tcp", addr, s.timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to data port: %v", err)
+	}
+	return dataConn, nil
+}
+
+// acceptDataConn waits for the server to connect to ln in active mode, for
+// no longer than a reply may take. It watches the control connection too: a
+// server that can't reach the data port says so with a 425 there, which ends
+// the wait at once rather than at the deadline and keeps the replies in step.
+func (s *netSession) acceptDataConn(ln net.Listener) (net.Conn, error) {
+	defer ln.Close()
+	if d, ok := ln.(interface{ SetDeadline(time.Time) error }); ok {
+		d.SetDeadline(time.Now().Add(s.timeout))
+	}
+
+	type result struct {
+		conn net.Conn
+		resp string
+		err  error
+	}
+	accepted := make(chan result, 1)
+	go func() {
+		conn, err := ln.Accept()
+		accepted <- result{conn: conn, err: err}
+	}()
+	replied := make(chan result, 1)
+	s.conn.SetReadDeadline(time.Now().Add(s.timeout))
+	go func() {
+		resp, err := s.readReply()
+		replied <- result{resp: resp, err: err}
+	}()
+	// stopWatching ends the control read, keeping any reply it got for the
+	// caller to read next
+	stopWatching := func() {
+		s.conn.SetReadDeadline(time.Now())
+		if r := <-replied; r.err == nil {
+			s.pending = append(s.pending, r.resp)
+		}
+	}
+
+	select {
+	case a := <-accepted:
+		stopWatching()
+		if a.err != nil {
+			return nil, s.acceptError(ln, a.err)
+		}
+		return a.conn, nil
+	case r := <-replied:
+		if r.err == nil && (strings.HasPrefix(r.resp, "4") || strings.HasPrefix(r.resp, "5")) {
+			ln.Close()
+			if a := <-accepted; a.conn != nil {
+				a.conn.Close()
+			}
+			return nil, fmt.Errorf("server could not connect to data port %s: %s", ln.Addr(), strings.TrimSpace(r.resp))
+		}
+		if r.err == nil {
+			// a completion reply can overtake the accept for a tiny file
+			s.pending = append(s.pending, r.resp)
+		}
+		a := <-accepted
+		if a.err != nil {
+			return nil, s.acceptError(ln, a.err)
+		}
+		return a.conn, nil
+	}
+}
+
+// acceptError explains a failed wait for the server's data connection.
+func (s *netSession) acceptError(ln net.Listener, err error) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return fmt.Errorf("server did not connect to data port %s within %v - a firewall or NAT is probably blocking incoming connections; use passive mode (set passive on), or set external-ip and a forwarded port-range", ln.Addr(), s.timeout)
+	}
+	return fmt.Errorf("server did not connect to data port: %v", err)
+}
+
+// startTLS upgrades the control connection after the server accepted AUTH
+// TLS.
+func (s *netSession) startTLS(config *tls.Config) error {
+	tc := tls.Client(s.conn, config)
+	tc.SetDeadline(time.Now().Add(s.timeout))
+	if err := tc.Handshake(); err != nil {
+		return err
+	}
+	tc.SetDeadline(time.Time{})
+	s.conn = tc
+	s.reader = bufio.NewReader(tc)
+	return nil
+}
+
+func (s *netSession) tlsState() *tls.ConnectionState {
+	if tc, ok := s.conn.(*tls.Conn); ok {
+		state := tc.ConnectionState()
+		return &state
+	}
+	return nil
+}
+
+func (s *netSession) setReplyTimeout(d time.Duration) { s.timeout = d }
+
+func (s *netSession) LocalAddr() net.Addr  { return s.conn.LocalAddr() }
+func (s *netSession) RemoteAddr() net.Addr { return s.conn.RemoteAddr() }
+func (s *netSession) Close() error         { return s.conn.Close() }
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// savedSession is the state save-session writes and load-session restores,
+// so a long piece of work can be picked up in a later run: where the session
+// was, how it was set up, and what the queue still had to do. Passwords are
+// not saved; the later run logs in as usual.
+type savedSession struct {
+	Host     string            `json:"host"`
+	User     string            `json:"user"`
+	Profile  string            `json:"profile,omitempty"`
+	Dir      string            `json:"dir"`
+	Settings map[string]string `json:"settings"`
+	Queue    []savedJob        `json:"queue,omitempty"`
+	Saved    time.Time         `json:"saved"`
+}
+
+// savedJob is a queue job that hadn't finished. A job that was running is
+// saved as pending and starts again, or continues from its resume
+// checkpoint.
+type savedJob struct {
+	Upload   bool   `json:"upload"`
+	Remote   string `json:"remote"`
+	Local    string `json:"local"`
+	Priority int    `json:"priority,omitempty"`
+	Held     bool   `json:"held,omitempty"`
+	Paused   bool   `json:"paused,omitempty"`
+	Offset   int64  `json:"offset,omitempty"` // where a paused job resumes
+	Bwlimit  string `json:"bwlimit,omitempty"`
+}
+
+// saveSession writes the session's state to file.
+func (f *FTPConnection) saveSession(file string) (savedSession, error) {
+	dir, err := f.currentDir()
+	if err != nil {
+		return savedSession{}, err
+	}
+	state := savedSession{
+		Host:     f.addr,
+		User:     f.user,
+		Profile:  f.profileName,
+		Dir:      dir,
+		Settings: make(map[string]string, len(settingRegistry)),
+		Saved:    time.Now(),
+	}
+	for name, setting := range settingRegistry {
+		state.Settings[name] = setting.get(&f.settings)
+	}
+	for _, job := range f.queue.snapshot() {
+		if job.state == "done" || job.state == "failed" {
+			continue
+		}
+		saved := savedJob{Upload: job.upload, Remote: job.remote, Local: job.local, Priority: job.priority, Held: job.held}
+		if job.state == "paused" {
+			saved.Paused, saved.Offset = true, job.offset
+		}
+		if job.limit != nil {
+			saved.Bwlimit = job.limit.schedule.spec
+		}
+		state.Queue = append(state.Queue, saved)
+	}
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return savedSession{}, err
+	}
+	// settings such as upload-notify may hold URLs with tokens
+	if err := os.WriteFile(file, append(data, '\n'), 0600); err != nil {
+		return savedSession{}, fmt.Errorf("failed to write %s: %v", file, err)
+	}
+	return state, nil
+}
+
+// loadSession restores the state in file, which must have been saved on a
+// session with the same server and user. Settings that no longer apply are
+// warned about and skipped, so one stale value doesn't lose the rest.
+func (f *FTPConnection) loadSession(file string) (savedSession, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return savedSession{}, err
+	}
+	var state savedSession
+	if err := json.Unmarshal(data, &state); err != nil {
+		return savedSession{}, fmt.Errorf("%s is not a saved session: %v", file, err)
+	}
+	if state.Host != f.addr || state.User != f.user {
+		how := "-host " + state.Host + " -user " + state.User
+		if state.Profile != "" {
+			how = "-profile " + state.Profile
+		}
+		return savedSession{}, fmt.Errorf("%s was saved for %s@%s; start goftp with %s to load it", file, state.User, state.Host, how)
+	}
+
+	names := make([]string, 0, len(state.Settings))
+	for name := range state.Settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		setting, ok := settingRegistry[name]
+		if !ok {
+			f.out().Warn("skipping unknown setting %s", name)
+			continue
+		}
+		if err := setting.set(&f.settings, state.Settings[name]); err != nil {
+			f.out().Warn("skipping setting %s: %v", name, err)
+		}
+	}
+
+	if state.Dir != "" {
+		resp, err := f.sendCommand("CWD " + state.Dir)
+		if err != nil {
+			return state, err
+		}
+		if !isSuccessResponse(resp) {
+			f.out().Warn("could not return to %s: %s", state.Dir, strings.TrimSpace(resp))
+		}
+	}
+
+	if len(state.Queue) > 0 && f.queue == nil {
+		f.queue = &transferQueue{owner: f}
+	}
+	for _, saved := range state.Queue {
+		job := &queueJob{upload: saved.Upload, remote: saved.Remote, local: saved.Local, priority: saved.Priority, held: saved.Held, offset: saved.Offset}
+		if saved.Bwlimit != "" {
+			if job.limit, err = newRateLimit(saved.Bwlimit); err != nil {
+				f.out().Warn("queue %s %s: ignoring --bwlimit: %v", job.direction(), job.remote, err)
+			}
+		}
+		if dup := f.queue.duplicate(job); dup != nil {
+			continue
+		}
+		if err := f.queue.restore(job, saved.Paused); err != nil {
+			return state, err
+		}
+	}
+	return state, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSaveLoadSession(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "session.json")
+	s := newFakeSession()
+	s.replies["PWD"] = `257 "/data/in" is the current directory`
+	f, out := newFakeConnection(s)
+	f.pass = "s3cret-pw"
+	f.settings.clobber = "rename"
+	f.settings.encoding = "cp1251"
+	if err := handleSaveSession(f, []string{file}); err != nil {
+		t.Fatalf("save-session: %v\n%s", err, out)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), f.pass) {
+		t.Errorf("the password was saved:\n%s", data)
+	}
+
+	s2 := newFakeSession()
+	f2, out2 := newFakeConnection(s2)
+	if err := handleLoadSession(f2, []string{file}); err != nil {
+		t.Fatalf("load-session: %v\n%s", err, out2)
+	}
+	if f2.settings.clobber != "rename" || f2.settings.encoding != "cp1251" {
+		t.Errorf("settings not restored: clobber %q, encoding %q", f2.settings.clobber, f2.settings.encoding)
+	}
+	if !slices.Contains(s2.sentCommands(), "CWD /data/in") {
+		t.Errorf("load-session didn't return to the saved directory: sent %q", s2.sentCommands())
+	}
+}
+
+func TestLoadSessionChecks(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "session.json")
+	write := func(state savedSession) {
+		data, _ := json.Marshal(state)
+		if err := os.WriteFile(file, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, out := newFakeConnection(newFakeSession())
+	write(savedSession{Host: "other.example.com:21", User: f.user, Profile: "work"})
+	if err := handleLoadSession(f, []string{file}); err == nil || !strings.Contains(err.Error(), "-profile work") {
+		t.Errorf("loading another server's session returned %v, want a hint to use its profile", err)
+	}
+
+	// a stale setting is skipped, and the rest still load
+	write(savedSession{Host: f.addr, User: f.user, Settings: map[string]string{
+		"no-such-setting": "on", "clobber": "sideways", "readonly": "on",
+	}})
+	if err := handleLoadSession(f, []string{file}); err != nil {
+		t.Fatal(err)
+	}
+	if !f.settings.readOnly {
+		t.Error("a valid setting wasn't loaded alongside stale ones")
+	}
+	for _, warning := range []string{"unknown setting no-such-setting", "skipping setting clobber"} {
+		if !strings.Contains(out.String(), warning) {
+			t.Errorf("no warning %q:\n%s", warning, out)
+		}
+	}
+}
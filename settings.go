@@ -0,0 +1,601 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sessionSettings holds the options adjustable at runtime with `set`.
+type sessionSettings struct {
+	passive          bool
+	tls              bool // explicit FTPS: AUTH TLS before logging in
+	tlsInsecure      bool // pin an unverifiable certificate on first use
+	portMin          int
+	portMax          int
+	externalIP       string
+	anonPassword     string
+	clobber          string
+	uploadClobber    string
+	readOnly         bool
+	confirm          string
+	output           string
+	bandwidth        *bandwidthSchedule // nil means unlimited
+	blockMode        bool
+	transferType     string
+	binaryCheck      bool
+	preallocate      bool
+	verifySidecar    bool          // check downloads against a checksum file beside them
+	idleTimeout      time.Duration // 0 means stay connected
+	maxConnections   int           // 0 means as many as the server accepts
+	replyTimeout     time.Duration
+	commandDelay     time.Duration
+	pipelining       int // commands sent ahead of their replies in bulk probes; 0 sends one at a time
+	workarounds      workarounds
+	uploadHooks      uploadHooks
+	transferCommands transferCommands
+	umask            string // octal, sent with SITE UMASK before uploads
+	defaultChmod     string // octal, set with SITE CHMOD after every upload
+	terse            bool
+	timeFormat       string
+	caseFold         bool   // case-insensitive name matching
+	encoding         string // code page of remote names; utf-8 passes them through
+}
+
+func defaultSettings() sessionSettings {
+	return sessionSettings{passive: true, anonPassword: "goftp-" + clientVersion() + "@", clobber: "overwrite", uploadClobber: "overwrite", transferType: "server", binaryCheck: true, confirm: "destructive", output: "plain", timeFormat: "default", encoding: "utf-8", replyTimeout: 45 * time.Second, pipelining: 16}
+}
+
+type settingDef struct {
+	name        string
+	description string
+	get         func(*sessionSettings) string
+	set         func(*sessionSettings, string) error
+}
+
+var settingRegistry map[string]settingDef
+
+func init() {
+	settingRegistry = map[string]settingDef{
+		"passive": {
+			name:        "passive on|off",
+			description: "Use passive (PASV/EPSV) data connections; off selects active mode (PORT/EPRT).",
+			get:         func(s *sessionSettings) string { return formatBool(s.passive) },
+			set: func(s *sessionSettings, value string) (err error) {
+				s.passive, err = parseBool(value)
+				return err
+			},
+		},
+		"tls": {
+			name:        "tls on|off",
+			description: "Explicit FTPS: send AUTH TLS before logging in and PROT P after, encrypting the control and data connections. Takes effect at the next auth.",
+			get:         func(s *sessionSettings) string { return formatBool(s.tls) },
+			set: func(s *sessionSettings, value string) (err error) {
+				s.tls, err = parseBool(value)
+				return err
+			},
+		},
+		"tls-insecure": {
+			name:        "tls-insecure on|off",
+			description: "Trust a TLS certificate that can't be verified, such as a self-signed one, on first use and pin it.",
+			get:         func(s *sessionSettings) string { return formatBool(s.tlsInsecure) },
+			set: func(s *sessionSettings, value string) (err error) {
+				s.tlsInsecure, err = parseBool(value)
+				return err
+			},
+		},
+		"type": {
+			name:        "type server|ascii|binary",
+			description: "Transfer TYPE: leave the server's default, or send TYPE A (converting CRLF line endings to the local convention) or TYPE I.",
+			get:         func(s *sessionSettings) string { return s.transferType },
+			set: func(s *sessionSettings, value string) error {
+				switch value {
+				case "server", "ascii", "binary":
+					s.transferType = value
+					return nil
+				}
+				return fmt.Errorf("expected server, ascii, or binary, got %q", value)
+			},
+		},
+		"binary-check": {
+			name:        "binary-check on|off",
+			description: "Refuse to upload files that look binary (judged from their first 8 KB) while TYPE is ascii.",
+			get:         func(s *sessionSettings) string { return formatBool(s.binaryCheck) },
+			set: func(s *sessionSettings, value string) (err error) {
+				s.binaryCheck, err = parseBool(value)
+				return err
+			},
+		},
+		"preallocate": {
+			name:        "preallocate on|off",
+			description: "Reserve disk space for a download's full SIZE before writing, so a disk that can't hold it fails at once and the file is less fragmented.",
+			get:         func(s *sessionSettings) string { return formatBool(s.preallocate) },
+			set: func(s *sessionSettings, value string) (err error) {
+				s.preallocate, err = parseBool(value)
+				return err
+			},
+		},
+		"verify-sidecar": {
+			name:        "verify-sidecar on|off",
+			description: "After each get, look for a checksum file beside the download (name.sha256, SHA256SUMS, MD5SUMS, ...) and verify the download against it; a mismatch fails the get.",
+			get:         func(s *sessionSettings) string { return formatBool(s.verifySidecar) },
+			set: func(s *sessionSettings, value string) (err error) {
+				s.verifySidecar, err = parseBool(value)
+				return err
+			},
+		},
+		"transfer-mode": {
+			name:        "transfer-mode stream|block",
+			description: "Data framing: stream (the default) or MODE B blocks with restart markers, required by some mainframe and record-oriented servers.",
+			get: func(s *sessionSettings) string {
+				if s.blockMode {
+					return "block"
+				}
+				return "stream"
+			},
+			set: func(s *sessionSettings, value string) error {
+				switch value {
+				case "stream", "block":
+					s.blockMode = value == "block"
+					return nil
+				}
+				return fmt.Errorf("expected stream or block, got %q", value)
+			},
+		},
+		"bwlimit": {
+			name:        "bwlimit <rate>|<HH:MM-HH:MM>=<rate>,...|off",
+			description: "Limit transfer bandwidth in bytes/s (k, m, g suffixes), optionally by time of day, e.g. 09:00-18:00=500k,off.",
+			get: func(s *sessionSettings) string {
+				if s.bandwidth == nil {
+					return "off"
+				}
+				return s.bandwidth.spec
+			},
+			set: func(s *sessionSettings, value string) error {
+				if value == "off" {
+					s.bandwidth = nil
+					return nil
+				}
+				schedule, err := parseBandwidthSchedule(value)
+				if err != nil {
+					return err
+				}
+				s.bandwidth = schedule
+				return nil
+			},
+		},
+		"idle-timeout": {
+			name:        "idle-timeout <duration>|off",
+			description: "QUIT after this long without a command, e.g. 10m, freeing the server slot; the next command reconnects and returns to the same directory.",
+			get: func(s *sessionSettings) string {
+				if s.idleTimeout == 0 {
+					return "off"
+				}
+				return s.idleTimeout.String()
+			},
+			set: func(s *sessionSettings, value string) error {
+				if value == "off" {
+					s.idleTimeout = 0
+					return nil
+				}
+				d, err := time.ParseDuration(value)
+				if err != nil || d <= 0 {
+					return fmt.Errorf("invalid duration %q - expected e.g. 10m, or off", value)
+				}
+				s.idleTimeout = d
+				return nil
+			},
+		},
+		"reply-timeout": {
+			name:        "reply-timeout <duration>",
+			description: "How long to wait for the server to answer a command, e.g. 10s, before sending ABOR to recover the control connection, or dropping it so that the next command reconnects.",
+			get:         func(s *sessionSettings) string { return s.replyTimeout.String() },
+			set: func(s *sessionSettings, value string) error {
+				d, err := time.ParseDuration(value)
+				if err != nil || d <= 0 {
+					return fmt.Errorf("invalid duration %q - expected e.g. 10s", value)
+				}
+				s.replyTimeout = d
+				return nil
+			},
+		},
+		"max-connections": {
+			name:        "max-connections <n>|auto",
+			description: "Most control connections to hold to the server at once, counting this one, parallel mirror workers, the queue, and probes. auto learns the limit from the server refusing a connection.",
+			get: func(s *sessionSettings) string {
+				if s.maxConnections == 0 {
+					return "auto"
+				}
+				return strconv.Itoa(s.maxConnections)
+			},
+			set: func(s *sessionSettings, value string) error {
+				if value == "auto" {
+					s.maxConnections = 0
+					return nil
+				}
+				n, err := strconv.Atoi(value)
+				if err != nil || n < 1 {
+					return fmt.Errorf("expected a positive number or auto, got %q", value)
+				}
+				s.maxConnections = n
+				return nil
+			},
+		},
+		"command-delay": {
+			name:        "command-delay <duration>|off",
+			description: "Least time between control commands across all of the session's connections, e.g. 250ms, to go easy on volunteer-run servers.",
+			get: func(s *sessionSettings) string {
+				if s.commandDelay == 0 {
+					return "off"
+				}
+				return s.commandDelay.String()
+			},
+			set: func(s *sessionSettings, value string) error {
+				if value == "off" {
+					s.commandDelay = 0
+					return nil
+				}
+				d, err := time.ParseDuration(value)
+				if err != nil || d <= 0 {
+					return fmt.Errorf("invalid duration %q - expected e.g. 250ms, or off", value)
+				}
+				s.commandDelay = d
+				return nil
+			},
+		},
+		"umask": {
+			name:        "umask <mode>|off",
+			description: "Send SITE UMASK with this octal mask before the first upload of each login, e.g. 022.",
+			get: func(s *sessionSettings) string {
+				if s.umask == "" {
+					return "off"
+				}
+				return s.umask
+			},
+			set: func(s *sessionSettings, value string) error {
+				if value == "off" {
+					s.umask = ""
+					return nil
+				}
+				if err := validateUploadMode(value); err != nil {
+					return err
+				}
+				s.umask = value
+				return nil
+			},
+		},
+		"default-chmod": {
+			name:        "default-chmod <mode>|off",
+			description: "After every upload, by any command, set the file's permissions with SITE CHMOD, e.g. 644.",
+			get: func(s *sessionSettings) string {
+				if s.defaultChmod == "" {
+					return "off"
+				}
+				return s.defaultChmod
+			},
+			set: func(s *sessionSettings, value string) error {
+				if value == "off" {
+					s.defaultChmod = ""
+					return nil
+				}
+				if err := validateUploadMode(value); err != nil {
+					return err
+				}
+				s.defaultChmod = value
+				return nil
+			},
+		},
+		"upload-chmod": {
+			name:        "upload-chmod <mode>|off",
+			description: "After each put, set the file's permissions with SITE CHMOD, e.g. 644.",
+			get: func(s *sessionSettings) string {
+				if s.uploadHooks.chmod == "" {
+					return "off"
+				}
+				return s.uploadHooks.chmod
+			},
+			set: func(s *sessionSettings, value string) error {
+				if value == "off" {
+					s.uploadHooks.chmod = ""
+					return nil
+				}
+				if err := validateUploadMode(value); err != nil {
+					return err
+				}
+				s.uploadHooks.chmod = value
+				return nil
+			},
+		},
+		"upload-rename": {
+			name:        "upload-rename <pattern>|off",
+			description: "After each put, rename the file; {name}, {stem}, and {ext} stand for its name, e.g. {name}.done.",
+			get: func(s *sessionSettings) string {
+				if s.uploadHooks.rename == "" {
+					return "off"
+				}
+				return s.uploadHooks.rename
+			},
+			set: func(s *sessionSettings, value string) error {
+				if value == "off" {
+					s.uploadHooks.rename = ""
+					return nil
+				}
+				if err := validateRenamePattern(value); err != nil {
+					return err
+				}
+				s.uploadHooks.rename = value
+				return nil
+			},
+		},
+		"upload-notify": {
+			name:        "upload-notify <url>|off",
+			description: "After each put, POST a JSON description of the upload to this URL.",
+			get: func(s *sessionSettings) string {
+				if s.uploadHooks.notify == "" {
+					return "off"
+				}
+				return redact(s.uploadHooks.notify)
+			},
+			set: func(s *sessionSettings, value string) error {
+				if value == "off" {
+					s.uploadHooks.notify = ""
+					return nil
+				}
+				if err := validateNotifyURL(value); err != nil {
+					return err
+				}
+				s.uploadHooks.notify = value
+				return nil
+			},
+		},
+		"precmd": {
+			name:        "precmd <command>[; <command>...]|off",
+			description: "Send these FTP commands before each get or put, e.g. SITE UMASK 022; {remote} and {name} stand for the file.",
+			get:         func(s *sessionSettings) string { return formatCommandList(s.transferCommands.pre) },
+			set: func(s *sessionSettings, value string) error {
+				s.transferCommands.pre = nil
+				if value != "off" {
+					s.transferCommands.pre = parseCommandList(value)
+				}
+				return nil
+			},
+		},
+		"postcmd": {
+			name:        "postcmd <command>[; <command>...]|off",
+			description: "Send these FTP commands after each successful get or put; {remote} and {name} stand for the file.",
+			get:         func(s *sessionSettings) string { return formatCommandList(s.transferCommands.post) },
+			set: func(s *sessionSettings, value string) error {
+				s.transferCommands.post = nil
+				if value != "off" {
+					s.transferCommands.post = parseCommandList(value)
+				}
+				return nil
+			},
+		},
+		"pipelining": {
+			name:        "pipelining <n>|off",
+			description: "Most SIZE and MDTM probes to send before reading their replies, when checking many files at once; off sends one at a time. Ignored while command-delay is set.",
+			get: func(s *sessionSettings) string {
+				if s.pipelining == 0 {
+					return "off"
+				}
+				return strconv.Itoa(s.pipelining)
+			},
+			set: func(s *sessionSettings, value string) error {
+				if value == "off" {
+					s.pipelining = 0
+					return nil
+				}
+				n, err := strconv.Atoi(value)
+				if err != nil || n < 1 {
+					return fmt.Errorf("expected a positive number or off, got %q", value)
+				}
+				s.pipelining = n
+				return nil
+			},
+		},
+		"workaround": {
+			name:        "workaround <name> on|off | <name>,...|none",
+			description: "Fixes for quirky servers: broken-epsv (epsv uses PASV), no-mlsd (parse LIST even if MLSD is advertised), pasv-nat (connect passive data to the control host).",
+			get:         func(s *sessionSettings) string { return s.workarounds.String() },
+			set:         func(s *sessionSettings, value string) error { return s.workarounds.set(value) },
+		},
+		"port-range": {
+			name:        "port-range <min>-<max>|any",
+			description: "Local ports to listen on in active mode, e.g. a range forwarded through NAT.",
+			get: func(s *sessionSettings) string {
+				if s.portMin == 0 {
+					return "any"
+				}
+				return fmt.Sprintf("%d-%d", s.portMin, s.portMax)
+			},
+			set: func(s *sessionSettings, value string) error {
+				if value == "any" {
+					s.portMin, s.portMax = 0, 0
+					return nil
+				}
+				lo, hi, found := strings.Cut(value, "-")
+				first, err1 := strconv.Atoi(lo)
+				last, err2 := strconv.Atoi(hi)
+				if !found || err1 != nil || err2 != nil || first < 1 || last > 65535 || first > last {
+					return fmt.Errorf("invalid port range %q - expected <min>-<max> within 1-65535", value)
+				}
+				s.portMin, s.portMax = first, last
+				return nil
+			},
+		},
+		"external-ip": {
+			name:        "external-ip <address>|auto",
+			description: "Address advertised in PORT/EPRT when the client sits behind NAT.",
+			get: func(s *sessionSettings) string {
+				if s.externalIP == "" {
+					return "auto"
+				}
+				return s.externalIP
+			},
+			set: func(s *sessionSettings, value string) error {
+				if value == "auto" {
+					s.externalIP = ""
+					return nil
+				}
+				if net.ParseIP(value) == nil {
+					return fmt.Errorf("invalid IP address %q", value)
+				}
+				s.externalIP = value
+				return nil
+			},
+		},
+		"clobber": {
+			name:        "clobber overwrite|rename|skip",
+			description: "What downloads do when the local file exists: replace it, save as name.1, name.2, ..., or skip.",
+			get:         func(s *sessionSettings) string { return s.clobber },
+			set: func(s *sessionSettings, value string) error {
+				switch value {
+				case "overwrite", "rename", "skip":
+					s.clobber = value
+					return nil
+				}
+				return fmt.Errorf("expected overwrite, rename, or skip, got %q", value)
+			},
+		},
+		"upload-clobber": {
+			name:        "upload-clobber overwrite|rename|skip|skip-identical|prompt",
+			description: "What uploads do when the remote file exists (checked with SIZE/MDTM): replace it, upload as name.1, ..., skip it, skip it when size matches and the remote copy is as new, or ask.",
+			get:         func(s *sessionSettings) string { return s.uploadClobber },
+			set: func(s *sessionSettings, value string) error {
+				switch value {
+				case "overwrite", "rename", "skip", "skip-identical", "prompt":
+					s.uploadClobber = value
+					return nil
+				}
+				return fmt.Errorf("expected overwrite, rename, skip, skip-identical, or prompt, got %q", value)
+			},
+		},
+		"case-insensitive": {
+			name:        "case-insensitive on|off",
+			description: "Match glob patterns and pair mirror names regardless of case, for servers whose file systems ignore it.",
+			get:         func(s *sessionSettings) string { return formatBool(s.caseFold) },
+			set: func(s *sessionSettings, value string) (err error) {
+				s.caseFold, err = parseBool(value)
+				return err
+			},
+		},
+		"encoding": {
+			name:        "encoding utf-8|<code page>",
+			description: "Code page the server keeps names in, for servers without UTF8 support: cp1251, koi8-r, iso-8859-1, ... Names are shown, matched, and saved locally as UTF-8.",
+			get:         func(s *sessionSettings) string { return s.encoding },
+			set: func(s *sessionSettings, value string) error {
+				name, ok := charsetName(value)
+				if !ok {
+					return fmt.Errorf("expected utf-8 or one of %s, got %q", strings.Join(charsetNames(), ", "), value)
+				}
+				s.encoding = name
+				return nil
+			},
+		},
+		"readonly": {
+			name:        "readonly on|off",
+			description: "Refuse every command that modifies the server (STOR, DELE, RNFR, MKD, RMD, SITE, ...).",
+			get:         func(s *sessionSettings) string { return formatBool(s.readOnly) },
+			set: func(s *sessionSettings, value string) (err error) {
+				s.readOnly, err = parseBool(value)
+				return err
+			},
+		},
+		"confirm": {
+			name:        "confirm destructive|all|never",
+			description: "Which commands ask before running: those that delete or overwrite data, every command that modifies the server, or none.",
+			get:         func(s *sessionSettings) string { return s.confirm },
+			set: func(s *sessionSettings, value string) error {
+				switch value {
+				case "destructive", "all", "never":
+					s.confirm = value
+					return nil
+				}
+				return fmt.Errorf("expected destructive, all, or never, got %q", value)
+			},
+		},
+		"output": {
+			name:        "output plain|color|json|quiet",
+			description: "How command results are shown: plain text, ANSI colors, one JSON object per line, or results and errors only.",
+			get:         func(s *sessionSettings) string { return s.output },
+			set: func(s *sessionSettings, value string) error {
+				if _, ok := renderers[value]; !ok {
+					return fmt.Errorf("expected plain, color, json, or quiet, got %q", value)
+				}
+				s.output = value
+				return nil
+			},
+		},
+		"terse": {
+			name:        "terse on|off",
+			description: "Leave out the server's replies to successful commands, showing only results such as the directory from pwd; failures are still shown in full.",
+			get:         func(s *sessionSettings) string { return formatBool(s.terse) },
+			set: func(s *sessionSettings, value string) (err error) {
+				s.terse, err = parseBool(value)
+				return err
+			},
+		},
+		"time-format": {
+			name:        "time-format default|iso|relative|locale",
+			description: "How ls, mdtm, history, and overwrite prompts show times: 2006-01-02 15:04, RFC 3339, an age such as 3h ago, or the date order of $LANG. All are in local time; MDTM and MLSD times are converted from UTC.",
+			get:         func(s *sessionSettings) string { return s.timeFormat },
+			set: func(s *sessionSettings, value string) error {
+				switch value {
+				case "default", "iso", "relative", "locale":
+					s.timeFormat = value
+					return nil
+				}
+				return fmt.Errorf("expected default, iso, relative, or locale, got %q", value)
+			},
+		},
+		"anon-password": {
+			name:        "anon-password <email>",
+			description: "Password sent for anonymous/ftp logins when none is given.",
+			get:         func(s *sessionSettings) string { return s.anonPassword },
+			set: func(s *sessionSettings, value string) error {
+				s.anonPassword = value
+				return nil
+			},
+		},
+	}
+}
+
+// settingEnvVar returns the environment variable for a setting, e.g.
+// GOFTP_PORT_RANGE for port-range.
+func settingEnvVar(key string) string {
+	return "GOFTP_" + strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+}
+
+// applyEnvSettings applies every setting given in the environment.
+func applyEnvSettings(s *sessionSettings) error {
+	for key, def := range settingRegistry {
+		env := settingEnvVar(key)
+		if value, ok := os.LookupEnv(env); ok {
+			if err := def.set(s, value); err != nil {
+				return fmt.Errorf("invalid %s: %v", env, err)
+			}
+		}
+	}
+	return nil
+}
+
+func parseBool(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "on", "true", "yes", "1":
+		return true, nil
+	case "off", "false", "no", "0":
+		return false, nil
+	}
+	return false, fmt.Errorf("expected on or off, got %q", value)
+}
+
+func formatBool(value bool) string {
+	if value {
+		return "on"
+	}
+	return "off"
+}
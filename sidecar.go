@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Public mirrors publish checksums next to their downloads, either one file
+// per download (foo.iso.sha256) or one list per directory (SHA256SUMS). get
+// --verify-sidecar, or the verify-sidecar setting, fetches the first such
+// file it finds in the download's directory and checks the download against
+// it, as users of distro FTP sites otherwise do by hand. The algorithm is
+// told from the length of the checksum.
+
+// sidecarNames are the checksum files looked for, strongest first; {name}
+// stands for the download's name.
+var sidecarNames = []string{
+	"{name}.sha512", "{name}.sha256", "{name}.sha1", "{name}.md5",
+	"SHA512SUMS", "SHA256SUMS", "SHA1SUMS", "MD5SUMS",
+}
+
+// maxSidecarSize bounds a checksum file, which is read into memory.
+const maxSidecarSize = 1 << 20
+
+// sidecarAlgorithms names the algorithm of a hex checksum by its length.
+var sidecarAlgorithms = map[int]string{32: "MD5", 40: "SHA-1", 64: "SHA-256", 128: "SHA-512"}
+
+// bsdSumLine matches the BSD checksum format, "SHA256 (foo.iso) = <hex>".
+var bsdSumLine = regexp.MustCompile(`^[A-Za-z0-9-]+ \((.+)\) = ([0-9A-Fa-f]+)$`)
+
+// sidecarSum finds the checksum for name in the contents of a checksum file:
+// lines of "<hex>  name" or "<hex> *name" as written by sha256sum, BSD-style
+// lines, or, in a per-file sidecar, a bare checksum.
+func sidecarSum(content, name string) (string, bool) {
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		sum, file := "", ""
+		if m := bsdSumLine.FindStringSubmatch(line); m != nil {
+			sum, file = m[2], m[1]
+		} else {
+			fields := strings.Fields(line)
+			sum = fields[0]
+			if len(fields) > 1 {
+				file = strings.TrimPrefix(strings.Join(fields[1:], " "), "*")
+			}
+		}
+		if _, ok := sidecarAlgorithms[len(sum)]; !ok {
+			continue
+		}
+		if file == "" || path.Base(file) == name {
+			return strings.ToLower(sum), true
+		}
+	}
+	return "", false
+}
+
+// verifySidecar checks local, just downloaded from remote, against a
+// checksum file beside remote. A mismatch is an error. Finding no checksum
+// file is a warning when required, and otherwise only noted.
+func (f *FTPConnection) verifySidecar(remote, local string, required bool) error {
+	dir, name := path.Dir(remote), path.Base(remote)
+	if dir == "." {
+		dir = ""
+	}
+	entries, err := f.listDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to look for a checksum file for %s: %v", remote, err)
+	}
+	present := make(map[string]bool)
+	for _, entry := range entries {
+		if entry.kind == "file" {
+			present[entry.name] = true
+		}
+	}
+	for _, candidate := range sidecarNames {
+		candidate = strings.ReplaceAll(candidate, "{name}", name)
+		if !present[candidate] {
+			continue
+		}
+		sidecar := path.Join(dir, candidate)
+		content, err := f.fetchSmall(sidecar)
+		if err != nil {
+			return fmt.Errorf("failed to fetch %s: %v", sidecar, err)
+		}
+		want, ok := sidecarSum(content, name)
+		if !ok {
+			continue
+		}
+		algorithm := sidecarAlgorithms[len(want)]
+		got, err := fileChecksum(local, algorithm)
+		if err != nil {
+			return fmt.Errorf("failed to checksum %s: %v", local, err)
+		}
+		if got != want {
+			return fmt.Errorf("%s checksum mismatch for %s: %s lists %s, the download's is %s (kept as %s)", algorithm, remote, candidate, want, got, local)
+		}
+		f.out().Info("Verified %s against %s (%s)", local, candidate, algorithm)
+		return nil
+	}
+	if required {
+		f.out().Warn("no checksum file for %s in %s; not verified", name, displayDir(dir))
+	} else {
+		f.out().Info("No checksum file for %s; not verified", name)
+	}
+	return nil
+}
+
+// fetchSmall retrieves a remote file of at most maxSidecarSize bytes into
+// memory.
+func (f *FTPConnection) fetchSmall(remote string) (string, error) {
+	if _, err := f.prepareData(); err != nil {
+		return "", err
+	}
+	var content []byte
+	err := f.transfer(fmt.Sprintf("RETR %s", remote), func(dataConn net.Conn) error {
+		var err error
+		content, err = io.ReadAll(io.LimitReader(dataConn, maxSidecarSize+1))
+		if err == nil && len(content) > maxSidecarSize {
+			err = fmt.Errorf("larger than %d bytes", maxSidecarSize)
+		}
+		return err
+	})
+	return string(content), err
+}
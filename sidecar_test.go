@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestSidecarSum(t *testing.T) {
+	sum := strings.Repeat("ab", 32)
+	tests := []struct {
+		content, name, want string
+	}{
+		{sum + "  other.iso\n" + strings.ToUpper(sum) + "  debian.iso\n", "debian.iso", sum},
+		{sum + " *debian.iso\n", "debian.iso", sum},
+		{sum + "  ./pub/debian.iso\n", "debian.iso", sum},
+		{"SHA256 (debian.iso) = " + sum + "\n", "debian.iso", sum},
+		{"# comment\n" + sum + "\n", "debian.iso", sum}, // a per-file sidecar
+		{sum + "  other.iso\n", "debian.iso", ""},
+		{"abcd  debian.iso\n", "debian.iso", ""}, // no algorithm has 4 digits
+	}
+	for _, tt := range tests {
+		got, ok := sidecarSum(tt.content, tt.name)
+		if got != tt.want || ok != (tt.want != "") {
+			t.Errorf("sidecarSum(%q, %q) = %q, %v, want %q", tt.content, tt.name, got, ok, tt.want)
+		}
+	}
+}
+
+func TestGetVerifySidecar(t *testing.T) {
+	iso := "pretend this is an ISO image\n"
+	sha := sha256.Sum256([]byte(iso))
+	md := md5.Sum([]byte(iso))
+	tests := []struct {
+		name    string
+		listing string            // MLSD of pub
+		files   map[string]string // the sidecars served
+		fails   bool
+		output  string
+	}{
+		{"SHA256SUMS", "type=file; debian.iso\r\ntype=file; SHA256SUMS\r\n",
+			map[string]string{"SHA256SUMS": hex.EncodeToString(sha[:]) + "  debian.iso\n"}, false, "Verified"},
+		{"per-file md5", "type=file; debian.iso\r\ntype=file; debian.iso.md5\r\n",
+			map[string]string{"debian.iso.md5": hex.EncodeToString(md[:]) + "\n"}, false, "(MD5)"},
+		{"mismatch", "type=file; debian.iso\r\ntype=file; debian.iso.sha256\r\n",
+			map[string]string{"debian.iso.sha256": strings.Repeat("0", 64) + "  debian.iso\n"}, true, ""},
+		{"none", "type=file; debian.iso\r\n", nil, false, "no checksum file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newFakeSession().withFeatures("MLSD")
+			s.files["RETR pub/debian.iso"] = iso
+			s.files["MLSD pub"] = tt.listing
+			for name, content := range tt.files {
+				s.files["RETR pub/"+name] = content
+			}
+			f, out := newFakeConnection(s)
+			t.Chdir(t.TempDir())
+			err := handleGet(f, []string{"--verify-sidecar", "pub/debian.iso"})
+			if (err != nil) != tt.fails {
+				t.Fatalf("get --verify-sidecar = %v, want failure %v\n%s", err, tt.fails, out)
+			}
+			if tt.fails && !strings.Contains(err.Error(), "checksum mismatch") {
+				t.Errorf("error %v doesn't name a mismatch", err)
+			}
+			if !strings.Contains(out.String(), tt.output) {
+				t.Errorf("output lacks %q:\n%s", tt.output, out)
+			}
+		})
+	}
+}
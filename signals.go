@@ -0,0 +1,76 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// SIGTERM and SIGHUP, as systemd and a closed terminal send them, end the
+// session cleanly rather than mid-write. Transfers in progress stop as abort
+// --all stops them, so a download's .part file is synced and its resume
+// checkpoint written. The queue's unfinished jobs are saved, the transfer
+// log and event stream get their last records, QUIT is sent, and the client
+// exits with 128 plus the signal's number: 143 for SIGTERM, 129 for SIGHUP.
+// A sync agent restarted afterwards resumes from the checkpoints.
+
+// stopSignals are the signals that end a session this way.
+var stopSignals = []os.Signal{syscall.SIGTERM, syscall.SIGHUP}
+
+// watchStopSignals starts stopping the session's transfers as soon as a stop
+// signal arrives, and then closes f.terminating for the REPL to end the
+// session once the command running has returned. The returned func stops
+// watching.
+func (f *FTPConnection) watchStopSignals() func() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, stopSignals...)
+	done := make(chan struct{})
+	f.terminating = make(chan struct{})
+	go func() {
+		select {
+		case sig := <-signals:
+			f.stopSignal = sig
+			f.stopAll()
+			close(f.terminating)
+		case <-done:
+		}
+	}()
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
+
+// terminated reports whether a stop signal has arrived.
+func (f *FTPConnection) terminated() bool {
+	select {
+	case <-f.terminating:
+		return true
+	default:
+		return false
+	}
+}
+
+// endOnSignal ends the session after a stop signal, once the command or
+// background job it interrupted has stopped.
+func (f *FTPConnection) endOnSignal() {
+	endPrompt()
+	f.out().Info("Received %v, shutting down", f.stopSignal)
+	if f.inBackground() {
+		f.out().Info("Waiting for the background %s to stop...", f.background.command)
+	}
+	f.control.Lock()
+	f.settle()
+	if err := f.saveUnfinished(); err != nil {
+		f.out().Error(err)
+	}
+	f.shutdown(true)
+}
+
+// signalStatus is the exit status for a session ended by sig.
+func signalStatus(sig os.Signal) int {
+	if s, ok := sig.(syscall.Signal); ok {
+		return 128 + int(s)
+	}
+	return exitFailed
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeSignal is an os.Signal that isn't a syscall.Signal.
+type fakeSignal struct{}
+
+func (fakeSignal) String() string { return "fake" }
+func (fakeSignal) Signal()        {}
+
+func TestSignalStatus(t *testing.T) {
+	tests := []struct {
+		sig  os.Signal
+		want int
+	}{
+		{syscall.SIGTERM, 143},
+		{syscall.SIGHUP, 129},
+		{fakeSignal{}, exitFailed},
+	}
+	for _, tt := range tests {
+		if got := signalStatus(tt.sig); got != tt.want {
+			t.Errorf("signalStatus(%v) = %d, want %d", tt.sig, got, tt.want)
+		}
+	}
+}
+
+// SIGTERM stops a background download at once, keeping its .part file,
+// and ends the session with QUIT and status 143.
+func TestStopSignal(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no SIGTERM to send on windows")
+	}
+	f, out := slowMock(t)
+	stop := f.watchStopSignals()
+	defer stop()
+	f.control.Lock()
+	if err := f.runLocked("get big.bin &"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the download to start", growing("big.bin.part"))
+
+	self, _ := os.FindProcess(os.Getpid())
+	if err := self.Signal(syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-f.terminating:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the signal wasn't noticed")
+	}
+	start := time.Now()
+	f.endOnSignal()
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("shutting down took %v", elapsed)
+	}
+
+	for _, want := range []string{"Received terminated, shutting down", "partial data kept in big.bin.part", "221 Goodbye"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output lacks %q:\n%s", want, out)
+		}
+	}
+	if _, err := os.Stat("big.bin.part"); err != nil {
+		t.Errorf("the cut-off download lost its .part file: %v", err)
+	}
+	if checkpoints, _ := filepath.Glob(filepath.Join(stateDirOverride, stateDir, "resume", "*.json")); len(checkpoints) != 1 {
+		t.Errorf("resume checkpoints %v, want one", checkpoints)
+	}
+	if status := f.exitStatus(); status != 143 {
+		t.Errorf("exit status %d, want 143", status)
+	}
+}
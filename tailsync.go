@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+// tailsync follows a growing remote log, like tail -f over FTP: every
+// interval it asks for the remote SIZE and fetches only the bytes appended
+// since the last poll, with REST, appending them to the local copy. Each
+// fetch starts a little before the new bytes and checks that this overlap
+// matches the end of the local file, so a log that was rotated or rewritten
+// in place is noticed rather than spliced onto the old one. A rotated log is
+// then followed from its start, appended after what was already collected.
+
+// tailsyncOverlap is how much already-collected data each fetch re-reads to
+// check that the remote log is still the one being followed.
+const tailsyncOverlap = 4096
+
+// errLogReplaced reports that the remote log no longer continues the local
+// copy.
+var errLogReplaced = errors.New("remote log was rotated or rewritten")
+
+type tailsync struct {
+	f      *FTPConnection
+	remote string
+	file   *os.File // the local log, opened for appending
+	offset int64    // bytes of the current remote log already collected
+}
+
+// tailRemote runs tailsync of remote into local.
+func (f *FTPConnection) tailRemote(remote, local string, interval time.Duration, count int) error {
+	if !f.restStream() {
+		return fmt.Errorf("tailsync needs REST STREAM, which the server doesn't support")
+	}
+	if f.serverType == "A" {
+		return fmt.Errorf("tailsync needs binary transfers - ASCII changes the offsets; use 'set type binary'")
+	}
+	file, err := os.OpenFile(local, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", local, err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	// an existing local log is taken to be the start of the remote one; the
+	// first fetch's overlap check says if it isn't
+	t := &tailsync{f: f, remote: remote, file: file, offset: info.Size()}
+	f.out().Info("Following %s into %s every %v, from %d bytes; Ctrl-C stops", remote, local, interval, t.offset)
+	return f.poll(interval, count, "following "+remote, func() error {
+		n, err := t.sync()
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			f.out().Info("%s +%d bytes (%d collected)", remote, n, t.offset)
+		}
+		return nil
+	})
+}
+
+// sync appends what the remote log has gained since the last call and
+// returns how many bytes that was.
+func (t *tailsync) sync() (int64, error) {
+	// without SIZE the size comes from a listing, which mustn't be a
+	// cached one
+	t.f.listings = nil
+	size, err := t.f.remoteSize(t.remote)
+	if err != nil {
+		return 0, err
+	}
+	if size < t.offset {
+		t.restart(fmt.Sprintf("shrank from %d to %d bytes", t.offset, size))
+	}
+	if size == t.offset {
+		return 0, nil
+	}
+	n, err := t.fetch()
+	if errors.Is(err, errLogReplaced) {
+		t.restart("no longer ends with the data already collected")
+		n, err = t.fetch()
+	}
+	return n, err
+}
+
+// restart follows the remote log from its start after it was replaced.
+func (t *tailsync) restart(why string) {
+	t.f.out().Warn("%s %s; %v, following it from the start", t.remote, why, errLogReplaced)
+	t.offset = 0
+}
+
+// fetch appends the remote log from offset on, after checking the overlap.
+func (t *tailsync) fetch() (int64, error) {
+	overlap := min(int64(tailsyncOverlap), t.offset)
+	want := make([]byte, overlap)
+	if overlap > 0 {
+		end, err := t.file.Seek(0, io.SeekEnd)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := t.file.ReadAt(want, end-overlap); err != nil {
+			return 0, fmt.Errorf("failed to read the end of %s: %v", t.file.Name(), err)
+		}
+	}
+
+	if _, err := t.f.prepareData(); err != nil {
+		return 0, err
+	}
+	if err := t.f.restartAt(t.offset - overlap); err != nil {
+		return 0, err
+	}
+	var n int64
+	err := t.f.transfer("RETR "+t.remote, func(dataConn net.Conn) error {
+		got := make([]byte, overlap)
+		if _, err := io.ReadFull(dataConn, got); err != nil || !bytes.Equal(got, want) {
+			return errLogReplaced
+		}
+		var err error
+		n, err = io.Copy(t.file, dataConn)
+		if err != nil {
+			return fmt.Errorf("failed to append to %s: %v", t.file.Name(), err)
+		}
+		return nil
+	})
+	t.offset += n
+	if err == nil {
+		err = t.file.Sync()
+	}
+	return n, err
+}
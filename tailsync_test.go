@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// sync appends only what the remote log gained, and notices a log that was
+// rotated or rewritten in place.
+func TestTailsync(t *testing.T) {
+	s := newFakeSession().withFeatures("SIZE", "REST STREAM")
+	s.replies["REST"] = "350 Restarting"
+	f, out := newFakeConnection(s)
+	local := filepath.Join(t.TempDir(), "app.log")
+	file, err := os.OpenFile(local, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	tail := &tailsync{f: f, remote: "app.log", file: file}
+	long := "NEW1\nnew2\nnew3\n" + strings.Repeat("x", 5000) + "\n"
+
+	steps := []struct {
+		remote  string // the remote log at this poll
+		added   int64
+		local   string // the local copy after it
+		rotated bool
+	}{
+		{"line1\n", 6, "line1\n", false},
+		{"line1\nline2\n", 6, "line1\nline2\n", false},
+		{"line1\nline2\n", 0, "line1\nline2\n", false},
+		{"new1\n", 5, "line1\nline2\nnew1\n", true},                    // shrank
+		{"NEW1\nnew2\n", 10, "line1\nline2\nnew1\nNEW1\nnew2\n", true}, // rewritten
+		{"NEW1\nnew2\nnew3\n", 5, "line1\nline2\nnew1\nNEW1\nnew2\nnew3\n", false},
+		{long, 5001, "line1\nline2\nnew1\n" + long, false},
+		{long + "last\n", 5, "line1\nline2\nnew1\n" + long + "last\n", false},
+	}
+	for i, step := range steps {
+		out.Reset()
+		s.replies["SIZE app.log"] = fmt.Sprintf("213 %d", len(step.remote))
+		s.files["RETR app.log"] = step.remote
+		n, err := tail.sync()
+		if err != nil {
+			t.Fatalf("poll %d: %v\n%s", i, err, out)
+		}
+		if n != step.added {
+			t.Errorf("poll %d appended %d bytes, want %d", i, n, step.added)
+		}
+		if got, _ := os.ReadFile(local); string(got) != step.local {
+			t.Errorf("after poll %d the local log holds %q, want %q", i, got, step.local)
+		}
+		if rotated := strings.Contains(out.String(), "following it from the start"); rotated != step.rotated {
+			t.Errorf("poll %d warned of a rotation: %v, want %v\n%s", i, rotated, step.rotated, out)
+		}
+	}
+	if !slices.Contains(s.sentCommands(), fmt.Sprintf("REST %d", len(long)-tailsyncOverlap)) {
+		t.Errorf("no fetch re-read only the overlap: sent %q", s.sentCommands())
+	}
+}
+
+func TestTailsyncNeedsRestStream(t *testing.T) {
+	s := newFakeSession()
+	s.replies["REST"] = "502 REST not implemented"
+	f, _ := newFakeConnection(s)
+	if err := f.tailRemote("app.log", filepath.Join(t.TempDir(), "app.log"), 0, 1); err == nil || !strings.Contains(err.Error(), "REST STREAM") {
+		t.Errorf("tailsync without REST STREAM = %v", err)
+	}
+
+	f, _ = newFakeConnection(newFakeSession().withFeatures("REST STREAM"))
+	f.serverType = "A"
+	if err := f.tailRemote("app.log", filepath.Join(t.TempDir(), "app.log"), 0, 1); err == nil || !strings.Contains(err.Error(), "binary") {
+		t.Errorf("tailsync in ASCII mode = %v", err)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Script files, -F list files, and profile init commands may use Go template
+// substitutions, so a daily drop's name needn't come from a wrapper script:
+//
+//	{{date "2006-01-02"}}        today's date, in Go's reference-time layout
+//	{{date "20060102" "1d"}}     the date a day ago (any age, e.g. 6h or 7d)
+//	{{env "BUILD_ID"}}           an environment variable, which must be set
+//
+// Text without {{ is used as it is.
+
+var templateFuncs = template.FuncMap{
+	"date": templateDate,
+	"env":  templateEnv,
+}
+
+// expandTemplate expands the substitutions in text. name is where text came
+// from, for errors.
+func expandTemplate(name, text string) (string, error) {
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+	t, err := template.New(name).Option("missingkey=error").Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, nil); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// templateDate formats now, less an optional age, with layout.
+func templateDate(layout string, age ...string) (string, error) {
+	now := time.Now()
+	if len(age) > 1 {
+		return "", fmt.Errorf("date takes a layout and at most one age")
+	}
+	if len(age) == 1 {
+		d, err := parseAge(age[0])
+		if err != nil {
+			return "", err
+		}
+		now = now.Add(-d)
+	}
+	return now.Format(layout), nil
+}
+
+// templateEnv returns the environment variable name. An unset variable is an
+// error rather than "", which would quietly name the wrong file.
+func templateEnv(name string) (string, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+	return value, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestExpandTemplate(t *testing.T) {
+	t.Setenv("GOFTP_TEST_BUILD", "1234")
+	today := time.Now().Format("20060102")
+	yesterday := time.Now().Add(-24 * time.Hour).Format("2006-01-02")
+	tests := []struct {
+		text, want string
+	}{
+		{"plain/path.txt", "plain/path.txt"},
+		{`drop-{{date "20060102"}}.csv`, "drop-" + today + ".csv"},
+		{`{{date "2006-01-02" "1d"}}`, yesterday},
+		{`builds/{{env "GOFTP_TEST_BUILD"}}/app.zip`, "builds/1234/app.zip"},
+		{"{braces} stay", "{braces} stay"},
+	}
+	for _, tt := range tests {
+		got, err := expandTemplate("test", tt.text)
+		if err != nil || got != tt.want {
+			t.Errorf("expandTemplate(%q) = %q, %v, want %q", tt.text, got, err, tt.want)
+		}
+	}
+
+	for _, bad := range []string{
+		`{{env "GOFTP_TEST_UNSET_VARIABLE"}}`,
+		`{{date "2006" "1d" "2d"}}`,
+		`{{date "2006" "soon"}}`,
+		`{{unknown}}`,
+		`{{date`,
+	} {
+		if got, err := expandTemplate("test", bad); err == nil {
+			t.Errorf("expandTemplate(%q) = %q, want an error", bad, got)
+		}
+	}
+}
+
+// -F list files expand templates in each path.
+func TestReadPathListTemplates(t *testing.T) {
+	t.Setenv("GOFTP_TEST_BUILD", "1234")
+	list := filepath.Join(t.TempDir(), "list.txt")
+	text := "# nightly drop\n\nbuilds/{{env \"GOFTP_TEST_BUILD\"}}/app.zip\nstatic.txt\n"
+	if err := os.WriteFile(list, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	paths, err := readPathList(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"builds/1234/app.zip", "static.txt"}; !slices.Equal(paths, want) {
+		t.Errorf("readPathList = %q, want %q", paths, want)
+	}
+}
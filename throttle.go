@@ -0,0 +1,210 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// bandwidthSchedule is a transfer rate limit that may vary by time of day,
+// e.g. "09:00-18:00=500k,off" for 500 KB/s during business hours and no limit
+// otherwise.
+type bandwidthSchedule struct {
+	spec    string
+	windows []bandwidthWindow
+	rate    int64 // bytes per second outside every window; 0 is unlimited
+}
+
+// pacer is the clock a rate limit books traffic against. The session's
+// pacer is shared by every data connection of the session and its sibling
+// connections (parallel mirror workers, the queue), so bwlimit caps their
+// total rather than each one. Bookings are made a chunk at a time in the
+// order the chunks arrive, so connections competing for the budget take
+// turns and each gets a fair share.
+type pacer struct {
+	mu   sync.Mutex
+	next time.Time // when the bytes booked so far are paid for
+}
+
+// rateLimit is a schedule and the clock it paces.
+type rateLimit struct {
+	schedule *bandwidthSchedule
+	pacer    *pacer
+}
+
+// newRateLimit returns a limit with a clock of its own, for a single
+// command's --bwlimit. It applies within the session's bwlimit, not instead
+// of it.
+func newRateLimit(spec string) (*rateLimit, error) {
+	schedule, err := parseBandwidthSchedule(spec)
+	if err != nil {
+		return nil, err
+	}
+	return &rateLimit{schedule: schedule, pacer: &pacer{}}, nil
+}
+
+// bandwidthWindow limits transfers between two times of day. A window whose
+// end is before its start runs past midnight.
+type bandwidthWindow struct {
+	start, end time.Duration // since midnight
+	rate       int64
+}
+
+// parseBandwidthSchedule parses comma-separated "[HH:MM-HH:MM=]rate" entries.
+// The first window containing the current time applies; an entry without a
+// window is the rate at all other times. Rates are bytes per second with an
+// optional k, m, or g suffix, or "off" for no limit.
+func parseBandwidthSchedule(spec string) (*bandwidthSchedule, error) {
+	s := &bandwidthSchedule{spec: spec}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		window, rateText, found := strings.Cut(entry, "=")
+		if !found {
+			rateText = window
+		}
+		rate, err := parseRate(rateText)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			s.rate = rate
+			continue
+		}
+
+		from, to, ok := strings.Cut(window, "-")
+		start, err1 := parseClock(from)
+		end, err2 := parseClock(to)
+		if !ok || err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("invalid window %q - expected HH:MM-HH:MM", window)
+		}
+		s.windows = append(s.windows, bandwidthWindow{start: start, end: end, rate: rate})
+	}
+	return s, nil
+}
+
+func parseRate(value string) (int64, error) {
+	text := strings.ToLower(strings.TrimSpace(value))
+	if text == "off" || text == "unlimited" || text == "0" {
+		return 0, nil
+	}
+	n, err := parseByteSize(text)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid rate %q - expected bytes/s such as 500k or 2m, or off", value)
+	}
+	return n, nil
+}
+
+func parseClock(text string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(text))
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// rateAt returns the limit in force at t, in bytes per second.
+func (s *bandwidthSchedule) rateAt(t time.Time) int64 {
+	clock := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	for _, w := range s.windows {
+		inside := clock >= w.start && clock < w.end
+		if w.end <= w.start {
+			inside = clock >= w.start || clock < w.end
+		}
+		if inside {
+			return w.rate
+		}
+	}
+	return s.rate
+}
+
+// bwlimitOption documents --bwlimit for help.
+var bwlimitOption = commandOption{"--bwlimit RATE", "limit this command's transfers to this rate, e.g. 200k, within the session's bwlimit"}
+
+// addRateFlag registers --bwlimit on fs, setting *limit to a command's own
+// rate limit.
+func addRateFlag(fs *flag.FlagSet, limit **rateLimit) {
+	fs.Func("bwlimit", bwlimitOption.description, func(value string) error {
+		l, err := newRateLimit(value)
+		if err != nil {
+			return err
+		}
+		*limit = l
+		return nil
+	})
+}
+
+// book reserves n bytes at rate and returns how long until they are paid for.
+func (p *pacer) book(n int, rate int64, now time.Time) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.next.Before(now) {
+		p.next = now
+	}
+	p.next = p.next.Add(time.Duration(int64(n) * int64(time.Second) / rate))
+	return p.next.Sub(now)
+}
+
+// throttle blocks long enough that n more bytes keep every limit's total
+// within its current rate. Rates are looked up on every call, so a long
+// transfer speeds up or slows down as it crosses a window boundary.
+func throttle(limits []rateLimit, n int) {
+	now := time.Now()
+	var delay time.Duration
+	for _, l := range limits {
+		if rate := l.schedule.rateAt(now); rate > 0 {
+			delay = max(delay, l.pacer.book(n, rate, now))
+		}
+	}
+	time.Sleep(delay)
+}
+
+// throttledConn applies rate limits to a data connection.
+type throttledConn struct {
+	net.Conn
+	limits []rateLimit
+}
+
+func (c throttledConn) CloseWrite() error {
+	if hc, ok := c.Conn.(halfCloser); ok {
+		return hc.CloseWrite()
+	}
+	return nil
+}
+
+func (c throttledConn) CloseRead() error {
+	if hc, ok := c.Conn.(halfCloser); ok {
+		return hc.CloseRead()
+	}
+	return nil
+}
+
+// maxThrottleChunk keeps single reads and writes small, so the limiter paces
+// traffic smoothly rather than in large bursts.
+const maxThrottleChunk = 16 << 10
+
+func (c throttledConn) Read(p []byte) (int, error) {
+	if len(p) > maxThrottleChunk {
+		p = p[:maxThrottleChunk]
+	}
+	n, err := c.Conn.Read(p)
+	throttle(c.limits, n)
+	return n, err
+}
+
+func (c throttledConn) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), maxThrottleChunk)]
+		throttle(c.limits, len(chunk))
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBandwidthSchedule(t *testing.T) {
+	s, err := parseBandwidthSchedule("09:00-18:00=500k, 22:00-06:00=2m, off")
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := time.Date(2026, 10, 15, 0, 0, 0, 0, time.Local)
+	tests := []struct {
+		clock string
+		want  int64
+	}{
+		{"08:59", 0},
+		{"09:00", 500 << 10},
+		{"17:59", 500 << 10},
+		{"18:00", 0},
+		{"23:30", 2 << 20},
+		{"03:00", 2 << 20},
+		{"06:00", 0},
+	}
+	for _, tt := range tests {
+		clock, _ := parseClock(tt.clock)
+		if got := s.rateAt(day.Add(clock)); got != tt.want {
+			t.Errorf("rate at %s = %d, want %d", tt.clock, got, tt.want)
+		}
+	}
+
+	for _, bad := range []string{"fast", "09:00=1m", "9-17=1m", "-5k"} {
+		if _, err := parseBandwidthSchedule(bad); err == nil {
+			t.Errorf("parseBandwidthSchedule(%q) succeeded", bad)
+		}
+	}
+}
+
+// Connections sharing a pacer share its rate: bookings from two of them are
+// paid for one after the other, not side by side.
+func TestPacerShared(t *testing.T) {
+	var p pacer
+	now := time.Now()
+	const rate = 1000 // bytes per second
+	if d := p.book(500, rate, now); d != 500*time.Millisecond {
+		t.Errorf("first booking waits %v, want 500ms", d)
+	}
+	if d := p.book(500, rate, now); d != time.Second {
+		t.Errorf("second connection's booking waits %v, want 1s", d)
+	}
+	// time spent idle isn't saved up
+	later := now.Add(time.Minute)
+	if d := p.book(100, rate, later); d != 100*time.Millisecond {
+		t.Errorf("booking after an idle minute waits %v, want 100ms", d)
+	}
+}
+
+// A command's --bwlimit applies within the session's limit: the slower of
+// the two sets the pace.
+func TestThrottleCombinesLimits(t *testing.T) {
+	session, err := newRateLimit("1m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	command, err := newRateLimit("10k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	throttle([]rateLimit{*session, *command}, 1024)
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("1 KB at 10 KB/s took %v, want about 100ms", elapsed)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// formatTime renders t, a moment such as an MDTM reply, in local time in a
+// time-format style:
+//
+//	default   2024-01-02 15:04
+//	iso       2024-01-02T15:04:05-05:00
+//	relative  3h ago
+//	locale    the date order of $LC_ALL, $LC_TIME, or $LANG, e.g. 02.01.2024 15:04
+func formatTime(t time.Time, style string) string {
+	t = t.Local()
+	switch style {
+	case "iso":
+		return t.Format(time.RFC3339)
+	case "relative":
+		return relativeTime(time.Since(t))
+	case "locale":
+		return t.Format(localeLayout())
+	}
+	return t.Format("2006-01-02 15:04")
+}
+
+// serverClock reads a LIST timestamp, which is the server's wall clock with
+// no zone, as local time: the best guess, and the one that shows the digits
+// the server sent.
+func serverClock(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.Local)
+}
+
+// relativeTime renders an age in its largest whole unit, e.g. "5m ago", or
+// "in 5m" for a time in the future.
+func relativeTime(age time.Duration) string {
+	future := age < 0
+	if future {
+		age = -age
+	}
+	var text string
+	switch day := 24 * time.Hour; {
+	case age < time.Minute:
+		return "just now"
+	case age < time.Hour:
+		text = fmt.Sprintf("%dm", age/time.Minute)
+	case age < 2*day:
+		text = fmt.Sprintf("%dh", age/time.Hour)
+	case age < 60*day:
+		text = fmt.Sprintf("%dd", age/day)
+	case age < 365*day:
+		text = fmt.Sprintf("%dmo", age/(30*day))
+	default:
+		text = fmt.Sprintf("%dy", age/(365*day))
+	}
+	if future {
+		return "in " + text
+	}
+	return text + " ago"
+}
+
+// localeLayout returns a time layout in the date order of the user's locale.
+// The standard library has no locale data, so this covers the common orders
+// by language and region; C, POSIX, and unknown locales get the default.
+func localeLayout() string {
+	locale := ""
+	for _, env := range []string{"LC_ALL", "LC_TIME", "LANG"} {
+		if locale = os.Getenv(env); locale != "" {
+			break
+		}
+	}
+	locale, _, _ = strings.Cut(locale, ".")
+	language, region, _ := strings.Cut(locale, "_")
+	switch {
+	case region == "US" || region == "PH":
+		return "01/02/2006 3:04 PM"
+	case language == "ja" || language == "zh" || language == "ko" || language == "hu":
+		return "2006/01/02 15:04"
+	case language == "de" || language == "ru" || language == "pl" || language == "cs" ||
+		language == "fi" || language == "nb" || language == "da" || language == "tr" || language == "uk":
+		return "02.01.2006 15:04"
+	case language == "en" || language == "fr" || language == "es" || language == "it" ||
+		language == "pt" || language == "nl" || language == "el":
+		return "02/01/2006 15:04"
+	}
+	return "2006-01-02 15:04"
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// abortGrace is how long the server gets to answer ABOR once a reply has
+// timed out, and abortDrain how long to wait for more replies after that.
+const (
+	abortGrace = 5 * time.Second
+	abortDrain = 500 * time.Millisecond
+)
+
+// isTimeout reports whether err is a network deadline expiring.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// recoverControl is called when the reply to verb didn't arrive within the
+// reply-timeout. It sends ABOR and reads replies until the server falls quiet,
+// taking any late reply to verb on the way, so the control connection is back
+// in step. If the server doesn't answer, the connection is dropped and the
+// session marked idle, so the next command reconnects as it would after an
+// idle disconnect. Either way the returned error says what happened; it wraps
+// cause when the connection is gone.
+func (f *FTPConnection) recoverControl(verb string, cause error) error {
+	timeout := f.settings.replyTimeout
+	f.session.setReplyTimeout(abortGrace)
+	defer f.session.setReplyTimeout(timeout)
+
+	resp, err := f.session.sendCommand("ABOR")
+	if err == nil {
+		// a late reply to verb comes first, so ABOR's answer is the last
+		f.session.setReplyTimeout(abortDrain)
+		for {
+			next, drainErr := f.session.readResponse()
+			if drainErr != nil {
+				if !isTimeout(drainErr) {
+					err = drainErr
+				}
+				break
+			}
+			resp = next
+		}
+	}
+	if err == nil {
+		if f.activeTransfer != nil {
+			f.activeTransfer.done("")
+			f.activeTransfer = nil
+		}
+		return fmt.Errorf("no reply to %s within %v - sent ABOR and the server answered %q; the command may or may not have taken effect", verb, timeout, strings.TrimSpace(resp))
+	}
+
+	// reconnect returns to workDir, if it is known
+	f.closeDataListener()
+	f.session.Close()
+	f.idle = true
+	return fmt.Errorf("no reply to %s within %v, nor to ABOR - disconnected; the next command reconnects: %w", verb, timeout, cause)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// transferSummary describes n bytes moved in elapsed, e.g. "3000000 bytes in
+// 2.1s, 1.4 MB/s".
+func transferSummary(n int64, elapsed time.Duration) string {
+	return fmt.Sprintf("%d bytes in %s, %s", n, formatElapsed(elapsed), formatRate(n, elapsed))
+}
+
+func formatElapsed(d time.Duration) string {
+	if d < time.Millisecond {
+		return d.Round(time.Microsecond).String()
+	}
+	if d < time.Second {
+		return d.Round(time.Millisecond).String()
+	}
+	return d.Round(100 * time.Millisecond).String()
+}
+
+// formatRate gives the throughput of n bytes in elapsed in the binary units
+// bwlimit takes.
+func formatRate(n int64, elapsed time.Duration) string {
+	if elapsed <= 0 {
+		return "- B/s"
+	}
+	rate := float64(n) / elapsed.Seconds()
+	for _, unit := range []string{"B/s", "KB/s", "MB/s"} {
+		if rate < 1024 {
+			return fmt.Sprintf("%.1f %s", rate, unit)
+		}
+		rate /= 1024
+	}
+	return fmt.Sprintf("%.1f GB/s", rate)
+}
+
+// trafficConn adds the bytes moved over a data connection to the session's
+// running total, which `time` reads before and after a command.
+type trafficConn struct {
+	net.Conn
+	total *atomic.Int64
+}
+
+func (c trafficConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.total.Add(int64(n))
+	return n, err
+}
+
+func (c trafficConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.total.Add(int64(n))
+	return n, err
+}
+
+func (c trafficConn) CloseWrite() error {
+	if hc, ok := c.Conn.(halfCloser); ok {
+		return hc.CloseWrite()
+	}
+	return nil
+}
+
+func (c trafficConn) CloseRead() error {
+	if hc, ok := c.Conn.(halfCloser); ok {
+		return hc.CloseRead()
+	}
+	return nil
+}
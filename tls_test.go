@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// ftpsServer is just enough of an explicit FTPS server for one login and
+// one download: it upgrades the control connection on AUTH TLS and serves
+// RETR over a TLS data connection once PROT P is in effect.
+type ftpsServer struct {
+	cert     tls.Certificate
+	authResp string // the reply to AUTH TLS
+	content  string // what RETR sends
+
+	mu   sync.Mutex
+	sent []string // the commands received, in order
+}
+
+// start serves one control connection and returns the address to dial.
+func (s *ftpsServer) start(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		s.serve(conn)
+	}()
+	return ln.Addr().String()
+}
+
+func (s *ftpsServer) serve(conn net.Conn) {
+	defer func() { conn.Close() }()
+	config := &tls.Config{Certificates: []tls.Certificate{s.cert}}
+	reader := bufio.NewReader(conn)
+	reply := func(line string) { io.WriteString(conn, line+"\r\n") }
+	var dataLn net.Listener
+	protP := false
+	reply("220 FTPS test server")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.TrimRight(line, "\r\n")
+		s.mu.Lock()
+		s.sent = append(s.sent, cmd)
+		s.mu.Unlock()
+		verb, _, _ := strings.Cut(cmd, " ")
+		switch verb {
+		case "AUTH":
+			reply(s.authResp)
+			if strings.HasPrefix(s.authResp, "234") {
+				tc := tls.Server(conn, config)
+				if tc.Handshake() != nil {
+					return
+				}
+				conn, reader = tc, bufio.NewReader(tc)
+			}
+		case "USER":
+			reply("331 Password required")
+		case "PASS":
+			reply("230 Logged in")
+		case "PBSZ":
+			reply("200 PBSZ=0")
+		case "PROT":
+			protP = cmd == "PROT P"
+			reply("200 Protection level set")
+		case "TYPE":
+			reply("200 Type set")
+		case "PASV":
+			if dataLn, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+				reply("425 Can't open data connection")
+				continue
+			}
+			io.WriteString(conn, passiveReply("227", dataLn.Addr().(*net.TCPAddr)))
+		case "RETR":
+			reply("150 Opening data connection")
+			data, err := dataLn.Accept()
+			dataLn.Close()
+			if err != nil {
+				reply("425 Can't open data connection")
+				continue
+			}
+			if protP {
+				data = tls.Server(data, config)
+			}
+			io.WriteString(data, s.content)
+			data.Close()
+			reply("226 Transfer complete")
+		case "QUIT":
+			reply("221 Goodbye")
+			return
+		default:
+			reply("502 Not implemented")
+		}
+	}
+}
+
+func (s *ftpsServer) commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.sent...)
+}
+
+// Login upgrades the control connection before USER, protects the data
+// connections after PASS, and downloads over TLS.
+func TestExplicitFTPS(t *testing.T) {
+	useTempDirs(t)
+	server := &ftpsServer{cert: selfSignedCert(t), authResp: "234 Proceed with negotiation", content: "secret data\n"}
+	f, err := NewFTPConnection(server.start(t), "user", "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.stdout = io.Discard
+	f.settings.tls, f.settings.tlsInsecure = true, true
+	if _, err := f.readResponse(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.login(); err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	if f.controlTLS() == nil || !f.protP {
+		t.Fatalf("after login the control connection has TLS %v and PROT P %v", f.controlTLS() != nil, f.protP)
+	}
+
+	local := filepath.Join(t.TempDir(), "data.txt")
+	if _, err := f.downloadFile("data.txt", local, 12); err != nil {
+		t.Fatalf("download over a TLS data connection: %v", err)
+	}
+	if got, _ := os.ReadFile(local); string(got) != "secret data\n" {
+		t.Errorf("downloaded %q", got)
+	}
+
+	sent := server.commands()
+	order := []string{"AUTH TLS", "USER user", "PASS pass", "PBSZ 0", "PROT P", "RETR data.txt"}
+	last := -1
+	for _, cmd := range order {
+		i := slices.Index(sent, cmd)
+		if i <= last {
+			t.Fatalf("sent %q, want %q in that order", sent, order)
+		}
+		last = i
+	}
+}
+
+// A refused AUTH TLS fails the login before the password can go out in
+// the clear.
+func TestExplicitFTPSRefused(t *testing.T) {
+	useTempDirs(t)
+	server := &ftpsServer{cert: selfSignedCert(t), authResp: "502 AUTH not supported"}
+	f, err := NewFTPConnection(server.start(t), "user", "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.stdout = io.Discard
+	f.settings.tls = true
+	if _, err := f.readResponse(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.login(); err == nil || !strings.Contains(err.Error(), "refused AUTH TLS") {
+		t.Errorf("login = %v, want a refused AUTH TLS", err)
+	}
+	if sent := server.commands(); slices.ContainsFunc(sent, func(cmd string) bool { return strings.HasPrefix(cmd, "PASS") }) {
+		t.Errorf("the password was sent without TLS: %q", sent)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// transferCommands are raw FTP commands sent on the control connection
+// around each file transfer, for servers that expect a ritual such as
+// SITE UMASK 022 before an upload. They come from the precmd and postcmd
+// settings, which get, put, and mget's --precmd and --postcmd override. In
+// each command {remote} stands for the file's remote path and {name} for its
+// base name.
+type transferCommands struct {
+	pre  []string // sent before the data connection is set up
+	post []string // sent once the transfer has succeeded
+}
+
+// parseCommandList splits a precmd or postcmd setting, whose commands are
+// separated by semicolons.
+func parseCommandList(value string) []string {
+	var commands []string
+	for _, command := range strings.Split(value, ";") {
+		if command = strings.TrimSpace(command); command != "" {
+			commands = append(commands, command)
+		}
+	}
+	return commands
+}
+
+func formatCommandList(commands []string) string {
+	if len(commands) == 0 {
+		return "off"
+	}
+	return strings.Join(commands, "; ")
+}
+
+// transferCommandOptions document --precmd and --postcmd for help.
+var transferCommandOptions = []commandOption{
+	{"--precmd CMD", "send this FTP command before each transfer, e.g. \"SITE UMASK 022\" (repeatable)"},
+	{"--postcmd CMD", "send this FTP command after each successful transfer (repeatable)"},
+}
+
+// addTransferCommandFlags registers --precmd and --postcmd on fs. Each may be
+// repeated; the first use replaces the setting's commands for the command.
+func addTransferCommandFlags(fs *flag.FlagSet, commands **transferCommands, settings sessionSettings) {
+	var pre, post bool
+	own := func() *transferCommands {
+		if *commands == nil {
+			c := settings.transferCommands
+			*commands = &c
+		}
+		return *commands
+	}
+	fs.Func("precmd", transferCommandOptions[0].description, func(value string) error {
+		c := own()
+		if !pre {
+			c.pre, pre = nil, true
+		}
+		c.pre = append(c.pre, value)
+		return nil
+	})
+	fs.Func("postcmd", transferCommandOptions[1].description, func(value string) error {
+		c := own()
+		if !post {
+			c.post, post = nil, true
+		}
+		c.post = append(c.post, value)
+		return nil
+	})
+}
+
+// transferCommands returns the commands for the running command's
+// transfers: its own flags' if it has any, otherwise the settings'.
+func (f *FTPConnection) transferCommands() transferCommands {
+	if f.jobCommands != nil {
+		return *f.jobCommands
+	}
+	return f.settings.transferCommands
+}
+
+// sendTransferCommands sends commands for the transfer of remote, failing
+// on the first one the server refuses.
+func (f *FTPConnection) sendTransferCommands(commands []string, remote string) error {
+	expand := strings.NewReplacer("{remote}", remote, "{name}", path.Base(remote))
+	for _, command := range commands {
+		command = expand.Replace(command)
+		resp, err := f.sendCommand(command)
+		if err != nil {
+			return err
+		}
+		if f.quitSent {
+			// the server may have closed the connection without a reply
+			return fmt.Errorf("%s ended the session", command)
+		}
+		if !strings.HasPrefix(resp, "2") && !strings.HasPrefix(resp, "3") {
+			return fmt.Errorf("%s failed: %s", command, strings.TrimSpace(resp))
+		}
+		f.out().Reply(resp)
+	}
+	return nil
+}
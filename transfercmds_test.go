@@ -0,0 +1,96 @@
+package main
+
+import (
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSplitQuoted(t *testing.T) {
+	tests := []struct {
+		input string
+		want  []string
+	}{
+		{"put a.txt b.txt", []string{"put", "a.txt", "b.txt"}},
+		{`put --precmd "SITE UMASK 022" a.txt`, []string{"put", "--precmd", "SITE UMASK 022", "a.txt"}},
+		{`get "name with spaces.txt"`, []string{"get", "name with spaces.txt"}},
+		{`set precmd "SITE A; SITE B"`, []string{"set", "precmd", "SITE A; SITE B"}},
+		{`a ""`, []string{"a", ""}},
+	}
+	for _, tt := range tests {
+		if got := splitQuoted(tt.input); !slices.Equal(got, tt.want) {
+			t.Errorf("splitQuoted(%q) = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
+
+// sentAround returns the SITE and STOR commands s has seen, in order.
+func sentAround(s *fakeSession) []string {
+	var sent []string
+	for _, cmd := range s.sentCommands() {
+		if strings.HasPrefix(cmd, "SITE ") || strings.HasPrefix(cmd, "STOR ") {
+			sent = append(sent, cmd)
+		}
+	}
+	return sent
+}
+
+func TestTransferCommands(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings []string // set lines
+		line     string
+		site     string // the reply to SITE
+		want     []string
+		fails    bool
+	}{
+		{
+			name:     "settings",
+			settings: []string{`set precmd "SITE UMASK 022"`, `set postcmd "SITE CHMOD 640 {remote}; SITE TOUCH {name}"`},
+			line:     "put a.txt in/a.txt",
+			want:     []string{"SITE UMASK 022", "STOR in/a.txt", "SITE CHMOD 640 in/a.txt", "SITE TOUCH a.txt"},
+		},
+		{
+			name:     "flags override settings",
+			settings: []string{`set precmd "SITE UMASK 022"`},
+			line:     `put --precmd "SITE UMASK 002" --precmd "SITE IDLE 60" a.txt`,
+			want:     []string{"SITE UMASK 002", "SITE IDLE 60", "STOR a.txt"},
+		},
+		{
+			name:     "refused precmd stops the transfer",
+			settings: []string{`set precmd "SITE UMASK 022"`},
+			line:     "put a.txt",
+			site:     "500 SITE not understood",
+			want:     []string{"SITE UMASK 022"},
+			fails:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTempDirs(t)
+			t.Chdir(t.TempDir())
+			if err := os.WriteFile("a.txt", []byte("data"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			s := newFakeSession()
+			s.replies["SITE"] = "200 OK"
+			if tt.site != "" {
+				s.replies["SITE"] = tt.site
+			}
+			f, out := newFakeConnection(s)
+			for _, line := range tt.settings {
+				if err := f.execute(line); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := f.execute(tt.line)
+			if (err != nil) != tt.fails {
+				t.Fatalf("%s returned %v\n%s", tt.line, err, out)
+			}
+			if got := sentAround(s); !slices.Equal(got, tt.want) {
+				t.Errorf("sent %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
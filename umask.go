@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The umask and default-chmod settings give every upload the same
+// permissions, whichever command made it: put, mput, mirror -R, the queue,
+// or a pipeline. umask is sent with SITE UMASK once per login, before the
+// first STOR, so the server creates files with it; default-chmod is applied
+// with SITE CHMOD after each STOR, for servers without SITE UMASK. A server
+// that refuses either gets a warning rather than a failed upload, since the
+// file itself arrived.
+
+// applyUmask sends the umask setting ahead of an upload if this login hasn't
+// had it yet.
+func (f *FTPConnection) applyUmask() {
+	mask := f.settings.umask
+	if mask == "" || f.umaskSent == mask {
+		return
+	}
+	// one attempt per login, so a server without SITE UMASK warns once
+	f.umaskSent = mask
+	if err := f.siteUmask(mask); err != nil {
+		f.out().Warn("%v", err)
+	}
+}
+
+// siteUmask sends SITE UMASK mask.
+func (f *FTPConnection) siteUmask(mask string) error {
+	resp, err := f.sendCommand("SITE UMASK " + mask)
+	if err != nil {
+		return err
+	}
+	if !isSuccessResponse(resp) {
+		return fmt.Errorf("SITE UMASK %s failed: %s", mask, strings.TrimSpace(resp))
+	}
+	return nil
+}
+
+// applyDefaultChmod sets remote, just uploaded, to the default-chmod mode.
+func (f *FTPConnection) applyDefaultChmod(remote string) {
+	mode := f.settings.defaultChmod
+	if mode == "" {
+		return
+	}
+	resp, err := f.sendCommand(fmt.Sprintf("SITE CHMOD %s %s", mode, remote))
+	if err == nil && !isSuccessResponse(resp) {
+		err = fmt.Errorf("SITE CHMOD %s %s failed: %s", mode, remote, strings.TrimSpace(resp))
+	}
+	if err != nil {
+		f.out().Warn("%v", err)
+	}
+}
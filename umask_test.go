@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestUmaskAndDefaultChmod(t *testing.T) {
+	useTempDirs(t)
+	t.Chdir(t.TempDir())
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if err := os.WriteFile(name, []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := newFakeSession()
+	s.replies["SITE"] = "200 OK"
+	f, out := newFakeConnection(s)
+	for _, line := range []string{"set umask 027", "set default-chmod 640", "put a.txt", "put b.txt"} {
+		if err := f.execute(line); err != nil {
+			t.Fatalf("%s: %v\n%s", line, err, out)
+		}
+	}
+	// the umask goes once per login, the chmod after every upload
+	want := []string{"SITE UMASK 027", "STOR a.txt", "SITE CHMOD 640 a.txt", "STOR b.txt", "SITE CHMOD 640 b.txt"}
+	if got := sentAround(s); !slices.Equal(got, want) {
+		t.Errorf("sent %q, want %q", got, want)
+	}
+}
+
+// A server that refuses SITE UMASK or SITE CHMOD gets a warning, once for
+// the umask, and the uploads still succeed.
+func TestUmaskRefused(t *testing.T) {
+	useTempDirs(t)
+	t.Chdir(t.TempDir())
+	if err := os.WriteFile("a.txt", []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := newFakeSession()
+	s.replies["SITE"] = "500 Unknown SITE command"
+	f, out := newFakeConnection(s)
+	f.settings.umask = "022"
+	f.settings.defaultChmod = "644"
+	for _, line := range []string{"put a.txt", "put a.txt"} {
+		if err := f.execute(line); err != nil {
+			t.Fatalf("%s: %v\n%s", line, err, out)
+		}
+	}
+	if n := strings.Count(out.String(), "SITE UMASK 022 failed"); n != 1 {
+		t.Errorf("warned %d times about SITE UMASK, want once:\n%s", n, out)
+	}
+	if n := strings.Count(out.String(), "SITE CHMOD 644 a.txt failed"); n != 2 {
+		t.Errorf("warned %d times about SITE CHMOD, want after each upload:\n%s", n, out)
+	}
+}
+
+func TestHandleUmask(t *testing.T) {
+	s := newFakeSession()
+	s.replies["SITE"] = "500 Unknown SITE command"
+	f, _ := newFakeConnection(s)
+	if err := handleUmask(f, []string{"022"}); err == nil {
+		t.Error("umask succeeded on a server that refuses SITE UMASK")
+	}
+	if f.settings.umask != "" {
+		t.Errorf("a refused umask was kept: %q", f.settings.umask)
+	}
+	if err := handleUmask(f, []string{"999"}); err == nil {
+		t.Error("umask 999 was accepted")
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// urlOptions holds the curl-style flags honored in one-shot URL mode.
+type urlOptions struct {
+	userPass   string
+	upload     string
+	output     string
+	createDirs bool
+	record     string
+	relaxPasv  bool
+}
+
+// runURLMode performs a single download, listing, or upload against an
+// ftp:// URL and exits, mirroring how curl treats FTP URLs: paths are
+// relative to the login directory, a trailing slash lists the directory,
+// and downloads go to stdout unless -o is given.
+func runURLMode(rawURL string, opts urlOptions) error {
+	u, err := parseFTPURL(rawURL)
+	if err != nil {
+		return err
+	}
+	conn, err := dialURL(u, opts)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	remotePath := strings.TrimPrefix(u.Path, "/")
+	if opts.upload != "" {
+		err = uploadURL(conn, remotePath, opts)
+	} else {
+		err = downloadURL(conn, remotePath, opts)
+	}
+	if err != nil {
+		return err
+	}
+
+	conn.sendCommand("QUIT")
+	return nil
+}
+
+func parseFTPURL(rawURL string) (*url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL %q: %v", rawURL, err)
+	}
+	if u.Scheme != "ftp" {
+		return nil, fmt.Errorf("unsupported URL scheme %q - only ftp:// is supported", u.Scheme)
+	}
+	return u, nil
+}
+
+// urlLogin returns the server address and credentials for u: the URL's
+// own, unless -u gave others.
+func urlLogin(u *url.URL, opts urlOptions) (addr, user, pass string) {
+	port := u.Port()
+	if port == "" {
+		port = "21"
+	}
+	addr = net.JoinHostPort(strings.ToLower(u.Hostname()), port)
+	user, pass = "anonymous", ""
+	if u.User != nil {
+		user = u.User.Username()
+		pass, _ = u.User.Password()
+	}
+	if opts.userPass != "" {
+		user, pass, _ = strings.Cut(opts.userPass, ":")
+	}
+	return addr, user, pass
+}
+
+// dialURL connects and logs in to the server named by u.
+func dialURL(u *url.URL, opts urlOptions) (*FTPConnection, error) {
+	addr, user, pass := urlLogin(u, opts)
+	addSecret(pass)
+
+	conn, err := NewFTPConnection(addr, user, pass)
+	if err != nil {
+		return nil, err
+	}
+	conn.relaxPasv = opts.relaxPasv
+
+	if opts.record != "" {
+		if conn.recorder, err = newSessionRecorder(opts.record); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	if _, err := conn.readResponse(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error reading welcome message: %v", err)
+	}
+	if _, err := conn.login(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &conn, nil
+}
+
+func uploadURL(conn *FTPConnection, remotePath string, opts urlOptions) error {
+	file, err := os.Open(opts.upload)
+	if err != nil {
+		return fmt.Errorf("failed to open local file %s: %v", opts.upload, err)
+	}
+	defer file.Close()
+
+	if remotePath == "" || strings.HasSuffix(remotePath, "/") {
+		remotePath += filepath.Base(opts.upload)
+	}
+
+	if opts.createDirs {
+		if dir := path.Dir(remotePath); dir != "." {
+			if err := conn.makeRemoteDirs(dir); err != nil {
+				return err
+			}
+		}
+	}
+
+	if _, err := conn.prepareData(); err != nil {
+		return err
+	}
+	return conn.transfer(fmt.Sprintf("STOR %s", remotePath), func(dataConn net.Conn) error {
+		if _, err := io.Copy(dataConn, file); err != nil {
+			return fmt.Errorf("failed to upload file: %v", err)
+		}
+		return nil
+	})
+}
+
+func downloadURL(conn *FTPConnection, remotePath string, opts urlOptions) error {
+	var out io.Writer = os.Stdout
+	if opts.output != "" {
+		file, err := os.Create(opts.output)
+		if err != nil {
+			return fmt.Errorf("failed to create file %s: %v", opts.output, err)
+		}
+		defer file.Close()
+		out = file
+	}
+
+	cmd := fmt.Sprintf("RETR %s", remotePath)
+	if remotePath == "" || strings.HasSuffix(remotePath, "/") {
+		cmd = strings.TrimSpace(fmt.Sprintf("LIST %s", remotePath))
+	}
+
+	if _, err := conn.prepareData(); err != nil {
+		return err
+	}
+	return conn.transfer(cmd, func(dataConn net.Conn) error {
+		if _, err := io.Copy(out, dataConn); err != nil {
+			return fmt.Errorf("failed to write file: %v", err)
+		}
+		return nil
+	})
+}
+
+// urlJob is one file of a batch fetch.
+type urlJob struct {
+	raw   string
+	url   *url.URL
+	local string
+}
+
+// runURLBatch fetches every URL into dir, like a minimal wget for FTP. URLs
+// on the same server and login share one connection and take turns on it,
+// however the URLs spell the host and port, while different servers are
+// fetched from in parallel. Every URL is tried even after one fails; the
+// error says how many did.
+func runURLBatch(rawURLs []string, dir string, opts urlOptions) error {
+	groups := make(map[string][]urlJob)
+	var hosts []string
+	claimed := make(map[string]bool)
+	for _, raw := range rawURLs {
+		u, err := parseFTPURL(raw)
+		if err != nil {
+			return err
+		}
+		remotePath := strings.TrimPrefix(u.Path, "/")
+		if remotePath == "" || strings.HasSuffix(remotePath, "/") {
+			return fmt.Errorf("%s is a directory - only files can be fetched in a batch", raw)
+		}
+		addr, user, pass := urlLogin(u, opts)
+		key := user + ":" + pass + "@" + addr
+		if groups[key] == nil {
+			hosts = append(hosts, key)
+		}
+		local := batchLocalName(filepath.Join(dir, path.Base(remotePath)), claimed)
+		groups[key] = append(groups[key], urlJob{raw: raw, url: u, local: local})
+	}
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+
+	var failed atomic.Int64
+	var wg sync.WaitGroup
+	for _, key := range hosts {
+		wg.Add(1)
+		go func(jobs []urlJob) {
+			defer wg.Done()
+			failed.Add(int64(fetchURLs(jobs, opts)))
+		}(groups[key])
+	}
+	wg.Wait()
+	if n := failed.Load(); n > 0 {
+		return fmt.Errorf("%d of %d URLs failed", n, len(rawURLs))
+	}
+	return nil
+}
+
+// fetchURLs downloads jobs, which all name one server and login, over a
+// single connection and returns how many failed. A dropped connection is
+// reopened and the file it was fetching tried again.
+func fetchURLs(jobs []urlJob, opts urlOptions) int {
+	conn, err := dialURL(jobs[0].url, opts)
+	if err != nil {
+		for _, job := range jobs {
+			log.Printf("%s: %v", job.raw, err)
+		}
+		return len(jobs)
+	}
+	defer conn.Close()
+
+	failed := 0
+	for i, job := range jobs {
+		opts.output = job.local
+		start := time.Now()
+		remotePath := strings.TrimPrefix(job.url.Path, "/")
+		err := downloadURL(conn, remotePath, opts)
+		if err != nil {
+			if lost, rerr := conn.recoverLost(); rerr != nil {
+				os.Remove(job.local)
+				for _, job := range jobs[i:] {
+					log.Printf("%s: %v", job.raw, rerr)
+				}
+				return failed + len(jobs) - i
+			} else if lost {
+				start = time.Now()
+				err = downloadURL(conn, remotePath, opts)
+			}
+		}
+		if err != nil {
+			log.Printf("%s: %v", job.raw, err)
+			os.Remove(job.local)
+			failed++
+			continue
+		}
+		var n int64
+		if info, err := os.Stat(job.local); err == nil {
+			n = info.Size()
+		}
+		fmt.Println(redact(fmt.Sprintf("%s -> %s (%s)", job.raw, job.local, transferSummary(n, time.Since(start)))))
+	}
+	conn.sendCommand("QUIT")
+	return failed
+}
+
+// batchLocalName returns name, or name.1, name.2, ... if an earlier URL in
+// the batch already saves to name.
+func batchLocalName(name string, claimed map[string]bool) string {
+	candidate := name
+	for i := 1; claimed[candidate]; i++ {
+		candidate = fmt.Sprintf("%s.%d", name, i)
+	}
+	claimed[candidate] = true
+	return candidate
+}
+
+// readURLList reads URLs one per line from name, or standard input for "-",
+// skipping blank lines and # comments.
+func readURLList(name string) ([]string, error) {
+	in := os.Stdin
+	if name != "-" {
+		file, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		in = file
+	}
+	var urls []string
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			urls = append(urls, line)
+		}
+	}
+	return urls, scanner.Err()
+}
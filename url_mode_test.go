@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+func TestURLLogin(t *testing.T) {
+	tests := []struct {
+		raw, userPass    string
+		addr, user, pass string
+	}{
+		{"ftp://Files.Example.com/pub/a.iso", "", "files.example.com:21", "anonymous", ""},
+		{"ftp://bob:pw@files.example.com:2121/a.iso", "", "files.example.com:2121", "bob", "pw"},
+		{"ftp://bob:pw@files.example.com/a.iso", "alice:secret", "files.example.com:21", "alice", "secret"},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr, user, pass := urlLogin(u, urlOptions{userPass: tt.userPass})
+		if addr != tt.addr || user != tt.user || pass != tt.pass {
+			t.Errorf("urlLogin(%s) = %s, %s, %s, want %s, %s, %s", tt.raw, addr, user, pass, tt.addr, tt.user, tt.pass)
+		}
+	}
+}
+
+// countingProxy forwards connections to target and counts them.
+func countingProxy(t *testing.T, target string) (string, *atomic.Int32) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	var accepted atomic.Int32
+	go func() {
+		for {
+			client, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			server, err := net.Dial("tcp", target)
+			if err != nil {
+				client.Close()
+				continue
+			}
+			go func() { io.Copy(server, client); server.Close() }()
+			go func() { io.Copy(client, server); client.Close() }()
+		}
+	}()
+	return ln.Addr().String(), &accepted
+}
+
+// URLs on one server share a connection however they spell its host, and
+// its name is resolved once.
+func TestURLBatchSharesConnection(t *testing.T) {
+	useTempDirs(t)
+	served := t.TempDir()
+	os.MkdirAll(filepath.Join(served, "sub"), 0755)
+	os.WriteFile(filepath.Join(served, "a.txt"), []byte("top a\n"), 0644)
+	os.WriteFile(filepath.Join(served, "sub", "a.txt"), []byte("sub a\n"), 0644)
+	os.WriteFile(filepath.Join(served, "b.txt"), []byte("b\n"), 0644)
+	mock, err := startMockServer(served)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy, accepted := countingProxy(t, mock)
+	_, port, _ := net.SplitHostPort(proxy)
+
+	dir := t.TempDir()
+	err = runURLBatch([]string{
+		"ftp://localhost:" + port + "/a.txt",
+		"ftp://LOCALHOST:" + port + "/sub/a.txt",
+		"ftp://localhost:" + port + "/b.txt",
+	}, dir, urlOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"a.txt": "top a\n", "a.txt.1": "sub a\n", "b.txt": "b\n"} {
+		if got, err := os.ReadFile(filepath.Join(dir, name)); err != nil || string(got) != want {
+			t.Errorf("%s holds %q, %v, want %q", name, got, err, want)
+		}
+	}
+	if n := accepted.Load(); n != 1 {
+		t.Errorf("the batch opened %d control connections, want 1", n)
+	}
+	resolved.Lock()
+	_, cached := resolved.byHost["localhost"]
+	resolved.Unlock()
+	if !cached {
+		t.Error("localhost's addresses weren't cached")
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// version is the release, set at build time with
+// -ldflags "-X main.version=v1.2.3". A plain go build leaves it "dev", and
+// clientVersion falls back to the module version go install records.
+var version = "dev"
+
+// clientVersion is the version the client reports: in version, CLNT, the
+// default anonymous password, and the --machine hello.
+func clientVersion() string {
+	if version != "dev" {
+		return version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	return version
+}
+
+// clientName is the client as CLNT names it, e.g. "goftp v1.2.3".
+func clientName() string {
+	return "goftp " + clientVersion()
+}
+
+// buildDetails describes how the binary was built, as version prints it.
+func buildDetails() [][2]string {
+	details := [][2]string{
+		{"Version", clientVersion()},
+		{"Go", runtime.Version()},
+		{"Platform", runtime.GOOS + "/" + runtime.GOARCH},
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return details
+	}
+	settings := make(map[string]string)
+	for _, s := range info.Settings {
+		settings[s.Key] = s.Value
+	}
+	if rev := settings["vcs.revision"]; rev != "" {
+		if settings["vcs.modified"] == "true" {
+			rev += " (modified)"
+		}
+		details = append(details, [2]string{"Commit", rev})
+	}
+	if at := settings["vcs.time"]; at != "" {
+		details = append(details, [2]string{"Commit time", at})
+	}
+	return details
+}
+
+// printVersion writes the version and build details for `goftp version`.
+func printVersion() {
+	for _, d := range buildDetails() {
+		fmt.Printf("%-12s %s\n", d[0]+":", d[1])
+	}
+}
+
+// identifyClient tells a server that advertises CLNT which client this is.
+// Servers only log it, so a refusal is ignored.
+func (f *FTPConnection) identifyClient() {
+	if f.advertises("CLNT") {
+		f.sendCommand("CLNT " + clientName())
+	}
+}
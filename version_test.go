@@ -0,0 +1,45 @@
+package main
+
+import (
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestClientVersion(t *testing.T) {
+	saved := version
+	t.Cleanup(func() { version = saved })
+	version = "v1.2.3"
+	if got := clientName(); got != "goftp v1.2.3" {
+		t.Errorf("clientName = %q, want the -ldflags version", got)
+	}
+	if got := defaultSettings().anonPassword; got != "goftp-v1.2.3@" {
+		t.Errorf("the default anonymous password is %q", got)
+	}
+	details := buildDetails()
+	if details[0] != [2]string{"Version", "v1.2.3"} || !slices.Contains(details, [2]string{"Platform", runtime.GOOS + "/" + runtime.GOARCH}) {
+		t.Errorf("buildDetails = %q", details)
+	}
+
+	f, out := newFakeConnection(newFakeSession())
+	if err := handleVersion(f, nil); err != nil || !strings.Contains(out.String(), "Version: v1.2.3") {
+		t.Errorf("version = %v:\n%s", err, out)
+	}
+}
+
+// CLNT goes only to servers that advertise it.
+func TestIdentifyClient(t *testing.T) {
+	for _, advertised := range []bool{false, true} {
+		s := newFakeSession()
+		if advertised {
+			s.withFeatures("CLNT")
+		}
+		f, _ := newFakeConnection(s)
+		f.identifyClient()
+		sent := slices.ContainsFunc(s.sentCommands(), func(cmd string) bool { return strings.HasPrefix(cmd, "CLNT goftp ") })
+		if sent != advertised {
+			t.Errorf("with CLNT advertised %v, CLNT was sent: %v (%q)", advertised, sent, s.sentCommands())
+		}
+	}
+}
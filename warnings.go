@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Exit statuses of a scripted session, one whose commands come from a pipe
+// or file rather than a terminal. Flag errors already exit with 2.
+const (
+	exitFailed   = 1 // a command failed
+	exitWarnings = 3 // every command succeeded, but some warned
+)
+
+// commandLog collects the warnings a session's commands print, such as a
+// transfer whose data connection didn't close gracefully, and counts the
+// commands that failed, so that a script can tell from the exit status that
+// something needs a look. Sibling connections share their session's log.
+type commandLog struct {
+	mu       sync.Mutex
+	command  string // the command line running, which warnings are charged to
+	warnings []commandWarning
+	failures int
+}
+
+type commandWarning struct {
+	command string
+	message string
+}
+
+// begin charges later warnings to the command line command.
+func (l *commandLog) begin(command string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.command = command
+}
+
+// warn records a warning and returns the command it is charged to.
+func (l *commandLog) warn(message string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.warnings = append(l.warnings, commandWarning{l.command, message})
+	return l.command
+}
+
+func (l *commandLog) fail() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.failures++
+}
+
+// exitStatus returns the exit status the session ends with.
+func (l *commandLog) exitStatus() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch {
+	case l.failures > 0:
+		return exitFailed
+	case len(l.warnings) > 0:
+		return exitWarnings
+	}
+	return 0
+}
+
+// summarize repeats the session's warnings, each with its command, at the
+// end of a script whose output may have scrolled them away.
+func (l *commandLog) summarize(out Renderer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.warnings) == 0 {
+		return
+	}
+	out.Info("Completed with warnings:")
+	for _, w := range l.warnings {
+		out.Line(fmt.Sprintf("  %s: %s", redact(w.command), w.message))
+	}
+}
+
+// exitStatus returns the status a scripted session exits with, after
+// repeating its warnings. An interactive session exits with 0, and one ended
+// by a stop signal with that signal's status.
+func (f *FTPConnection) exitStatus() int {
+	if f.terminated() {
+		return signalStatus(f.stopSignal)
+	}
+	if stdinIsTerminal() {
+		return 0
+	}
+	f.commands.summarize(f.out())
+	return f.commands.exitStatus()
+}
+
+// warningRenderer records every warning it shows in the session's log and
+// event stream.
+type warningRenderer struct {
+	Renderer
+	log    *commandLog
+	events *eventStream
+}
+
+func (r warningRenderer) Warn(format string, args ...any) {
+	message := fmt.Sprintf(format, args...)
+	r.events.warning(r.log.warn(message), message)
+	r.Renderer.Warn("%s", message)
+}